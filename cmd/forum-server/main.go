@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	loads "github.com/go-openapi/loads"
+	flags "github.com/jessevdk/go-flags"
+
+	"github.com/couatl/forum-db-api/restapi"
+	"github.com/couatl/forum-db-api/restapi/operations"
+)
+
+// The main of go-swagger is generated with --exclude-main: besides serving the API the binary
+// has subcommands, they share the option groups of the server.
+
+func main() {
+
+	swaggerSpec, err := loads.Analyzed(restapi.SwaggerJSON, "")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	api := operations.NewForumAPI(swaggerSpec)
+	server := restapi.NewServer(api)
+	defer server.Shutdown()
+
+	parser := flags.NewParser(server, flags.Default)
+	parser.ShortDescription = "forum"
+	parser.LongDescription = swaggerSpec.Spec().Info.Description
+
+	server.ConfigureFlags()
+	for _, optsGroup := range api.CommandLineOptionsGroups {
+		_, err := parser.AddGroup(optsGroup.ShortDescription, optsGroup.LongDescription, optsGroup.Options)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Without a subcommand the server is started
+	parser.SubcommandsOptional = true
+	if _, err := parser.AddCommand("import", "load an NDJSON dump",
+		"Loads users, forums, threads, posts and votes of an NDJSON dump into the database, keeping ids of threads and posts.",
+		&restapi.ImportCommand{}); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := parser.AddCommand("export", "write a forum as a dump",
+		"Writes the users, threads, posts and votes of a forum from a single snapshot, in the format the import command loads.",
+		&restapi.ExportCommand{}); err != nil {
+		log.Fatalln(err)
+	}
+
+	if _, err := parser.Parse(); err != nil {
+		code := 1
+		if fe, ok := err.(*flags.Error); ok {
+			if fe.Type == flags.ErrHelp {
+				code = 0
+			}
+		}
+		os.Exit(code)
+	}
+	if parser.Active != nil {
+		return
+	}
+
+	server.ConfigureAPI()
+
+	if err := server.Serve(); err != nil {
+		log.Fatalln(err)
+	}
+
+}
@@ -0,0 +1,56 @@
+-- +migrate Up
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS message_tsv TSVECTOR;
+ALTER TABLE threads ADD COLUMN IF NOT EXISTS search_tsv TSVECTOR;
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION update_posts_tsv() RETURNS TRIGGER AS
+$update_posts_tsv$
+  BEGIN
+    NEW.message_tsv = to_tsvector('russian', NEW.message);
+    RETURN NEW;
+  END;
+$update_posts_tsv$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION update_threads_tsv() RETURNS TRIGGER AS
+$update_threads_tsv$
+  BEGIN
+    NEW.search_tsv = setweight(to_tsvector('russian', NEW.title), 'A') ||
+                     setweight(to_tsvector('russian', NEW.message), 'B');
+    RETURN NEW;
+  END;
+$update_threads_tsv$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate Up
+DROP TRIGGER IF EXISTS posts_tsv_tgr ON posts;
+CREATE TRIGGER posts_tsv_tgr BEFORE INSERT OR UPDATE OF message ON posts
+FOR EACH ROW EXECUTE PROCEDURE update_posts_tsv();
+
+DROP TRIGGER IF EXISTS threads_tsv_tgr ON threads;
+CREATE TRIGGER threads_tsv_tgr BEFORE INSERT OR UPDATE OF title, message ON threads
+FOR EACH ROW EXECUTE PROCEDURE update_threads_tsv();
+
+-- +migrate Up
+UPDATE posts SET message_tsv = to_tsvector('russian', message);
+UPDATE threads SET search_tsv = setweight(to_tsvector('russian', title), 'A') ||
+                                setweight(to_tsvector('russian', message), 'B');
+
+-- +migrate Up
+CREATE INDEX IF NOT EXISTS posts_message_tsv_index
+  ON posts USING GIN (message_tsv);
+CREATE INDEX IF NOT EXISTS threads_search_tsv_index
+  ON threads USING GIN (search_tsv);
+
+-- +migrate Down
+DROP INDEX IF EXISTS threads_search_tsv_index;
+DROP INDEX IF EXISTS posts_message_tsv_index;
+DROP TRIGGER IF EXISTS threads_tsv_tgr ON threads;
+DROP TRIGGER IF EXISTS posts_tsv_tgr ON posts;
+DROP FUNCTION IF EXISTS update_threads_tsv();
+DROP FUNCTION IF EXISTS update_posts_tsv();
+ALTER TABLE threads DROP COLUMN IF EXISTS search_tsv;
+ALTER TABLE posts DROP COLUMN IF EXISTS message_tsv;
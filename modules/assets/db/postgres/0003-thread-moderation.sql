@@ -0,0 +1,13 @@
+-- +migrate Up
+ALTER TABLE threads ADD COLUMN IF NOT EXISTS locked BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE threads ADD COLUMN IF NOT EXISTS pinned BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE threads ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS threads_forum_pinned_created_index
+  ON threads (forum_id, pinned, created)
+  WHERE deleted_at IS NULL;
+
+-- +migrate Down
+DROP INDEX IF EXISTS threads_forum_pinned_created_index;
+ALTER TABLE threads DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE threads DROP COLUMN IF EXISTS pinned;
+ALTER TABLE threads DROP COLUMN IF EXISTS locked;
@@ -0,0 +1,20 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT;
+
+-- +migrate Up
+-- Tokens are stored as sha256 hashes, expires_at is NULL for API tokens
+CREATE TABLE IF NOT EXISTS tokens (
+  id         SERIAL PRIMARY KEY,
+  token_hash TEXT NOT NULL,
+  user_id    INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  created    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  expires_at TIMESTAMP WITH TIME ZONE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS tokens_hash_index
+  ON tokens (token_hash);
+CREATE INDEX IF NOT EXISTS tokens_user_index
+  ON tokens (user_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS tokens;
+ALTER TABLE users DROP COLUMN IF EXISTS password_hash;
@@ -0,0 +1,12 @@
+-- +migrate Up
+-- Forum owners (forums.author) and site administrators are not stored here,
+-- users without a row are members of the forum
+CREATE TABLE IF NOT EXISTS forum_roles (
+  forum_id INT  NOT NULL REFERENCES forums (id) ON DELETE CASCADE,
+  user_id  INT  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  role     TEXT NOT NULL CHECK (role IN ('moderator', 'banned')),
+  PRIMARY KEY (forum_id, user_id)
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS forum_roles;
@@ -0,0 +1,34 @@
+-- +migrate Up
+-- forum_id is NULL for site-wide bans, lifted and expired bans are kept for the record
+CREATE TABLE IF NOT EXISTS bans (
+  id         SERIAL PRIMARY KEY,
+  user_id    INT  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  forum_id   INT  REFERENCES forums (id) ON DELETE CASCADE,
+  reason     TEXT NOT NULL DEFAULT '',
+  moderator  TEXT NOT NULL,
+  created    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  expires_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS bans_user_index
+  ON bans (user_id);
+CREATE INDEX IF NOT EXISTS bans_forum_index
+  ON bans (forum_id);
+
+-- +migrate Up
+-- Bans used to be the banned role of forum_roles
+INSERT INTO bans (user_id, forum_id, moderator)
+  SELECT forum_roles.user_id, forum_roles.forum_id, COALESCE(forums.author, '')
+  FROM forum_roles JOIN forums ON forums.id = forum_roles.forum_id
+  WHERE forum_roles.role = 'banned';
+DELETE FROM forum_roles WHERE role = 'banned';
+ALTER TABLE forum_roles DROP CONSTRAINT IF EXISTS forum_roles_role_check;
+ALTER TABLE forum_roles ADD CONSTRAINT forum_roles_role_check CHECK (role = 'moderator');
+
+-- +migrate Down
+ALTER TABLE forum_roles DROP CONSTRAINT IF EXISTS forum_roles_role_check;
+ALTER TABLE forum_roles ADD CONSTRAINT forum_roles_role_check CHECK (role IN ('moderator', 'banned'));
+INSERT INTO forum_roles (forum_id, user_id, role)
+  SELECT DISTINCT forum_id, user_id, 'banned' FROM bans
+  WHERE forum_id IS NOT NULL AND expires_at IS NULL
+  ON CONFLICT DO NOTHING;
+DROP TABLE IF EXISTS bans;
@@ -0,0 +1,30 @@
+-- +migrate Up
+-- Notifications only point to the changed row, server instances load it themselves
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION notify_thread_event() RETURNS TRIGGER AS
+$notify_thread_event$
+  BEGIN
+    IF TG_TABLE_NAME = 'posts' THEN
+      PERFORM pg_notify('thread_events', json_build_object('type', 'post', 'thread', NEW.thread, 'id', NEW.id)::text);
+    ELSE
+      PERFORM pg_notify('thread_events', json_build_object('type', 'vote', 'thread', NEW.thread)::text);
+    END IF;
+    RETURN NULL;
+  END;
+$notify_thread_event$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate Up
+DROP TRIGGER IF EXISTS posts_notify_tgr ON posts;
+CREATE TRIGGER posts_notify_tgr AFTER INSERT ON posts
+FOR EACH ROW EXECUTE PROCEDURE notify_thread_event();
+
+DROP TRIGGER IF EXISTS votes_notify_tgr ON votes;
+CREATE TRIGGER votes_notify_tgr AFTER INSERT OR UPDATE OF voice ON votes
+FOR EACH ROW EXECUTE PROCEDURE notify_thread_event();
+
+-- +migrate Down
+DROP TRIGGER IF EXISTS votes_notify_tgr ON votes;
+DROP TRIGGER IF EXISTS posts_notify_tgr ON posts;
+DROP FUNCTION IF EXISTS notify_thread_event();
@@ -0,0 +1,36 @@
+-- +migrate Up
+-- Notifications also name the forum and the user, so instances load only rows somebody is subscribed to
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION notify_thread_event() RETURNS TRIGGER AS
+$notify_thread_event$
+  BEGIN
+    IF TG_TABLE_NAME = 'threads' THEN
+      PERFORM pg_notify('thread_events', json_build_object('type', 'thread', 'forum', NEW.forum,
+        'thread', NEW.id, 'user', NEW.author)::text);
+    ELSIF TG_TABLE_NAME = 'posts' THEN
+      PERFORM pg_notify('thread_events', json_build_object('type', CASE TG_OP WHEN 'INSERT' THEN 'post' ELSE 'post_edit' END,
+        'forum', NEW.forum, 'thread', NEW.thread, 'id', NEW.id, 'user', NEW.author)::text);
+    ELSE
+      PERFORM pg_notify('thread_events', json_build_object('type', 'vote',
+        'forum', (SELECT forum FROM threads WHERE id = NEW.thread), 'thread', NEW.thread, 'user', NEW.author)::text);
+    END IF;
+    RETURN NULL;
+  END;
+$notify_thread_event$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate Up
+DROP TRIGGER IF EXISTS threads_notify_tgr ON threads;
+CREATE TRIGGER threads_notify_tgr AFTER INSERT ON threads
+FOR EACH ROW EXECUTE PROCEDURE notify_thread_event();
+
+-- Deleting a post also changes its message, only edits are announced
+DROP TRIGGER IF EXISTS posts_edit_notify_tgr ON posts;
+CREATE TRIGGER posts_edit_notify_tgr AFTER UPDATE OF message ON posts
+FOR EACH ROW WHEN (NEW.is_edited AND NOT NEW.is_deleted AND NEW.message IS DISTINCT FROM OLD.message)
+EXECUTE PROCEDURE notify_thread_event();
+
+-- +migrate Down
+DROP TRIGGER IF EXISTS posts_edit_notify_tgr ON posts;
+DROP TRIGGER IF EXISTS threads_notify_tgr ON threads;
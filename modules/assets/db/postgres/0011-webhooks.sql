@@ -0,0 +1,34 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS webhooks (
+  id         SERIAL PRIMARY KEY,
+  forum_id   INT  NOT NULL REFERENCES forums (id) ON DELETE CASCADE,
+  url        TEXT NOT NULL,
+  secret     TEXT NOT NULL,
+  creator    TEXT NOT NULL,
+  created    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhooks_forum_index
+  ON webhooks (forum_id);
+
+-- The outbox: deliveries are written in the transaction of the event and leased by workers through next_attempt
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id              SERIAL PRIMARY KEY,
+  webhook_id      INT  NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+  payload         TEXT NOT NULL,
+  status          TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+  attempts        INT  NOT NULL DEFAULT 0,
+  response_status INT  NOT NULL DEFAULT 0,
+  error           TEXT NOT NULL DEFAULT '',
+  created         TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  next_attempt    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  delivered       TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_index
+  ON webhook_deliveries (webhook_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_index
+  ON webhook_deliveries (next_attempt, id)
+  WHERE status = 'pending';
+
+-- +migrate Down
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
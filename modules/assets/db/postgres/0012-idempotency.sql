@@ -0,0 +1,16 @@
+-- +migrate Up
+-- Responses of creating requests made with Idempotency-Key, owner is '' for anonymous clients
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  owner           TEXT NOT NULL,
+  idempotency_key TEXT NOT NULL,
+  operation       TEXT NOT NULL,
+  fingerprint     TEXT NOT NULL,
+  status          INT  NOT NULL,
+  response        TEXT NOT NULL,
+  created         TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  expires         TIMESTAMP WITH TIME ZONE NOT NULL,
+  PRIMARY KEY (owner, idempotency_key)
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS idempotency_keys;
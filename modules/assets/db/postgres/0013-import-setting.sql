@@ -0,0 +1,39 @@
+-- +migrate Up
+-- An import sets forum.import in its transaction instead of disabling the triggers: it sets paths of posts
+-- itself and its records aren't announced, while other sessions keep writing
+DROP TRIGGER IF EXISTS parent_path_tgr ON posts;
+CREATE TRIGGER parent_path_tgr BEFORE INSERT ON posts
+FOR EACH ROW WHEN (current_setting('forum.import', true) IS DISTINCT FROM 'on')
+EXECUTE PROCEDURE update_parent_path();
+
+DROP TRIGGER IF EXISTS posts_notify_tgr ON posts;
+CREATE TRIGGER posts_notify_tgr AFTER INSERT ON posts
+FOR EACH ROW WHEN (current_setting('forum.import', true) IS DISTINCT FROM 'on')
+EXECUTE PROCEDURE notify_thread_event();
+
+DROP TRIGGER IF EXISTS votes_notify_tgr ON votes;
+CREATE TRIGGER votes_notify_tgr AFTER INSERT OR UPDATE OF voice ON votes
+FOR EACH ROW WHEN (current_setting('forum.import', true) IS DISTINCT FROM 'on')
+EXECUTE PROCEDURE notify_thread_event();
+
+DROP TRIGGER IF EXISTS threads_notify_tgr ON threads;
+CREATE TRIGGER threads_notify_tgr AFTER INSERT ON threads
+FOR EACH ROW WHEN (current_setting('forum.import', true) IS DISTINCT FROM 'on')
+EXECUTE PROCEDURE notify_thread_event();
+
+-- +migrate Down
+DROP TRIGGER IF EXISTS threads_notify_tgr ON threads;
+CREATE TRIGGER threads_notify_tgr AFTER INSERT ON threads
+FOR EACH ROW EXECUTE PROCEDURE notify_thread_event();
+
+DROP TRIGGER IF EXISTS votes_notify_tgr ON votes;
+CREATE TRIGGER votes_notify_tgr AFTER INSERT OR UPDATE OF voice ON votes
+FOR EACH ROW EXECUTE PROCEDURE notify_thread_event();
+
+DROP TRIGGER IF EXISTS posts_notify_tgr ON posts;
+CREATE TRIGGER posts_notify_tgr AFTER INSERT ON posts
+FOR EACH ROW EXECUTE PROCEDURE notify_thread_event();
+
+DROP TRIGGER IF EXISTS parent_path_tgr ON posts;
+CREATE TRIGGER parent_path_tgr BEFORE INSERT ON posts
+FOR EACH ROW EXECUTE PROCEDURE update_parent_path();
@@ -0,0 +1,125 @@
+-- +migrate Up
+DROP TRIGGER IF EXISTS parent_path_tgr;
+
+-- +migrate Up
+DROP TABLE IF EXISTS forum_users;
+DROP TABLE IF EXISTS votes;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS threads;
+DROP TABLE IF EXISTS forums;
+DROP TABLE IF EXISTS users;
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS users (
+  id       INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  about    TEXT,
+  email    TEXT NOT NULL,
+  fullname VARCHAR(64) NOT NULL,
+  nickname TEXT UNIQUE NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_nickname_index
+  ON users (lower(nickname));
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_index
+  ON users (lower(email));
+CREATE INDEX IF NOT EXISTS users_nickname_id_index
+  ON users (id, lower(nickname));
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS forums (
+  id      INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  slug    TEXT NOT NULL,
+  author  TEXT,
+  title   VARCHAR(255) NOT NULL,
+  posts   INT  DEFAULT 0,
+  threads INTEGER DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS forums_low_slug_index
+  ON forums (lower(slug));
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS threads (
+  id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  forum     TEXT,
+  forum_id  INT,
+  author_id INT,
+  author    TEXT,
+  created   TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  message   TEXT NOT NULL,
+  slug      TEXT,
+  title     VARCHAR(255) NOT NULL,
+  votes     INTEGER DEFAULT 0 NOT NULL
+);
+CREATE INDEX IF NOT EXISTS threads_slug_index
+  ON threads (lower(slug));
+CREATE INDEX IF NOT EXISTS threads_forum_id_index
+  ON threads (forum_id);
+CREATE INDEX IF NOT EXISTS threads_forum_created_index
+  ON threads (forum_id, created);
+CREATE INDEX IF NOT EXISTS threads_created_index
+  ON threads (created);
+
+-- +migrate Up
+-- path is a materialized list of zero-padded ids separated by dots:
+-- text comparison of such paths matches comparison of INT[] paths in PostgreSQL.
+CREATE TABLE IF NOT EXISTS posts (
+  id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  forum     TEXT,
+  thread    INT,
+  author    TEXT,
+  created   TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  is_edited BOOLEAN NOT NULL DEFAULT FALSE,
+  message   TEXT NOT NULL,
+  parent    INT DEFAULT 0,
+  path      TEXT,
+  root_id   INT
+);
+CREATE INDEX IF NOT EXISTS posts_thread_index
+  ON posts (thread);
+CREATE INDEX IF NOT EXISTS posts_thread_path_index
+  ON posts (thread, path);
+CREATE INDEX IF NOT EXISTS posts_thread_id_index
+  ON posts (thread, id);
+CREATE INDEX IF NOT EXISTS post_thread_id_parent_root_index
+  ON posts (thread, root_id)
+  WHERE parent = 0;
+
+-- +migrate StatementBegin
+CREATE TRIGGER parent_path_tgr AFTER INSERT ON posts
+FOR EACH ROW
+BEGIN
+  UPDATE posts SET
+    path = CASE
+      WHEN NEW.parent = 0 THEN printf('%010d', NEW.id)
+      ELSE (SELECT parent.path FROM posts parent WHERE parent.id = NEW.parent) || '.' || printf('%010d', NEW.id)
+    END,
+    root_id = CASE
+      WHEN NEW.parent = 0 THEN NEW.id
+      ELSE (SELECT parent.root_id FROM posts parent WHERE parent.id = NEW.parent)
+    END
+  WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS votes (
+  id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  author    TEXT REFERENCES users (nickname),
+  thread    INT,
+  voice     INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX votes_user_thread_index
+  ON votes (lower(author), thread);
+CREATE INDEX votes_thread_index
+  ON votes (thread);
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS forum_users (
+  author_id  INT,
+  forum_id   INT
+);
+CREATE INDEX forum_users_forum_index
+  ON forum_users (forum_id);
+CREATE INDEX forum_users_author_index
+  ON forum_users (author_id);
+CREATE UNIQUE INDEX forum_users_author_forum_index
+  ON forum_users (author_id, forum_id);
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE posts ADD COLUMN is_deleted BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +migrate Down
+ALTER TABLE posts DROP COLUMN is_deleted;
@@ -0,0 +1,13 @@
+-- +migrate Up
+ALTER TABLE threads ADD COLUMN locked BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE threads ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE threads ADD COLUMN deleted_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS threads_forum_pinned_created_index
+  ON threads (forum_id, pinned, created)
+  WHERE deleted_at IS NULL;
+
+-- +migrate Down
+DROP INDEX IF EXISTS threads_forum_pinned_created_index;
+ALTER TABLE threads DROP COLUMN deleted_at;
+ALTER TABLE threads DROP COLUMN pinned;
+ALTER TABLE threads DROP COLUMN locked;
@@ -0,0 +1,28 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS post_revisions (
+  id      INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  post_id INT NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+  number  INT NOT NULL,
+  message TEXT NOT NULL,
+  editor  TEXT NOT NULL,
+  created TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+CREATE UNIQUE INDEX IF NOT EXISTS post_revisions_post_number_index
+  ON post_revisions (post_id, number);
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS thread_revisions (
+  id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  thread_id INT NOT NULL REFERENCES threads (id) ON DELETE CASCADE,
+  number    INT NOT NULL,
+  title     VARCHAR(255) NOT NULL,
+  message   TEXT NOT NULL,
+  editor    TEXT NOT NULL,
+  created   TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+CREATE UNIQUE INDEX IF NOT EXISTS thread_revisions_thread_number_index
+  ON thread_revisions (thread_id, number);
+
+-- +migrate Down
+DROP TABLE IF EXISTS thread_revisions;
+DROP TABLE IF EXISTS post_revisions;
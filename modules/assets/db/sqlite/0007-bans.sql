@@ -0,0 +1,31 @@
+-- +migrate Up
+-- forum_id is NULL for site-wide bans, lifted and expired bans are kept for the record
+CREATE TABLE IF NOT EXISTS bans (
+  id         INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  user_id    INT  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  forum_id   INT  REFERENCES forums (id) ON DELETE CASCADE,
+  reason     TEXT NOT NULL DEFAULT '',
+  moderator  TEXT NOT NULL,
+  created    TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  expires_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS bans_user_index
+  ON bans (user_id);
+CREATE INDEX IF NOT EXISTS bans_forum_index
+  ON bans (forum_id);
+
+-- +migrate Up
+-- Bans used to be the banned role of forum_roles, SQLite can't alter its CHECK constraint
+INSERT INTO bans (user_id, forum_id, moderator)
+  SELECT forum_roles.user_id, forum_roles.forum_id, COALESCE(forums.author, '')
+  FROM forum_roles JOIN forums ON forums.id = forum_roles.forum_id
+  WHERE forum_roles.role = 'banned';
+DELETE FROM forum_roles WHERE role = 'banned';
+
+-- +migrate Down
+-- The CHECK constraint of forum_roles still allows the banned role
+INSERT INTO forum_roles (forum_id, user_id, role)
+  SELECT DISTINCT forum_id, user_id, 'banned' FROM bans
+  WHERE forum_id IS NOT NULL AND expires_at IS NULL
+  ON CONFLICT DO NOTHING;
+DROP TABLE IF EXISTS bans;
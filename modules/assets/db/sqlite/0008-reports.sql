@@ -0,0 +1,23 @@
+-- +migrate Up
+-- post is 0 for reports on a thread, action and moderator are filled when the report is closed
+CREATE TABLE IF NOT EXISTS reports (
+  id          INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  forum_id    INT  NOT NULL REFERENCES forums (id) ON DELETE CASCADE,
+  thread      INT  NOT NULL REFERENCES threads (id) ON DELETE CASCADE,
+  post        INT  NOT NULL DEFAULT 0,
+  reporter_id INT  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  reason      TEXT NOT NULL DEFAULT '',
+  status      TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved', 'dismissed')),
+  action      TEXT NOT NULL DEFAULT '',
+  moderator   TEXT NOT NULL DEFAULT '',
+  created     TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  closed      TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS reports_forum_status_index
+  ON reports (forum_id, status, id);
+CREATE UNIQUE INDEX IF NOT EXISTS reports_open_index
+  ON reports (reporter_id, thread, post)
+  WHERE status = 'open';
+
+-- +migrate Down
+DROP TABLE IF EXISTS reports;
@@ -0,0 +1,34 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS webhooks (
+  id         INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  forum_id   INT  NOT NULL REFERENCES forums (id) ON DELETE CASCADE,
+  url        TEXT NOT NULL,
+  secret     TEXT NOT NULL,
+  creator    TEXT NOT NULL,
+  created    TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+CREATE INDEX IF NOT EXISTS webhooks_forum_index
+  ON webhooks (forum_id);
+
+-- The outbox: deliveries are written in the transaction of the event and leased by workers through next_attempt
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id              INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  webhook_id      INT  NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+  payload         TEXT NOT NULL,
+  status          TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+  attempts        INT  NOT NULL DEFAULT 0,
+  response_status INT  NOT NULL DEFAULT 0,
+  error           TEXT NOT NULL DEFAULT '',
+  created         TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  next_attempt    TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  delivered       TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_index
+  ON webhook_deliveries (webhook_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_index
+  ON webhook_deliveries (next_attempt, id)
+  WHERE status = 'pending';
+
+-- +migrate Down
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SessionTTL limits the lifetime of tokens issued by UserLogin, tokens from UserTokenCreate never expire.
+var SessionTTL = 24 * time.Hour
+
+// BearerToken extracts the token from the value of Authorization header.
+func BearerToken(header string) string {
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	return ""
+}
+
+// optionalPrincipal authenticates the token of a request to a public operation,
+// anonymous requests and requests with bad tokens are made on behalf of nobody.
+func optionalPrincipal(authenticate func(token string) (*models.Principal, error), request *http.Request) *models.Principal {
+	token := BearerToken(request.Header.Get("Authorization"))
+	if token == "" {
+		return nil
+	}
+	principal, err := authenticate(token)
+	if err != nil {
+		return nil
+	}
+	return principal
+}
+
+// isPrincipal tells whether the request is made on behalf of nickname.
+func isPrincipal(principal *models.Principal, nickname string) bool {
+	return principal != nil && strings.EqualFold(principal.Nickname, nickname)
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// dummyHash is compared against when there is no user or password, so unknown nicknames take as long as wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+func checkPassword(hash, password string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// newToken generates a random token, only its hash is stored.
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+)
+
+// isActiveBan tells whether ban is in force at the moment.
+func isActiveBan(ban *models.Ban, now time.Time) bool {
+	return ban != nil && (ban.Expires == nil || time.Time(*ban.Expires).After(now))
+}
+
+// bannedError explains to the banned user why the request is rejected.
+func bannedError(ban *models.Ban) *Error {
+	message := fmt.Sprintf("User %s is banned site-wide", ban.Nickname)
+	if ban.Forum != "" {
+		message = fmt.Sprintf("User %s is banned in forum %s", ban.Nickname, ban.Forum)
+	}
+	if ban.Expires != nil {
+		message += " until " + ban.Expires.String()
+	}
+	if ban.Reason != "" {
+		message += ": " + ban.Reason
+	}
+	return Forbidden("%s", message)
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+)
+
+// CursorSecret signs pagination cursors. When it is empty a random one is generated on first use,
+// so cursors don't survive a restart.
+var CursorSecret []byte
+
+var cursorSecretOnce sync.Once
+
+// cursor is the position of the last item of a page: its sort key and id as the tie-breaker.
+// Scope ties the cursor to the listing and the order it was issued for.
+type cursor struct {
+	Scope  string `json:"s"`
+	Pinned bool   `json:"p,omitempty"`
+	Key    string `json:"k,omitempty"`
+	Kind   string `json:"t,omitempty"`
+	ID     int64  `json:"i,omitempty"`
+}
+
+// cursorScope joins operation with the parameters that define the order of its listing.
+func cursorScope(operation string, parts ...interface{}) string {
+	scope := operation
+	for _, part := range parts {
+		scope += "/" + fmt.Sprint(part)
+	}
+	return scope
+}
+
+func cursorSecret() []byte {
+	cursorSecretOnce.Do(func() {
+		if len(CursorSecret) == 0 {
+			CursorSecret = make([]byte, 32)
+			if _, err := rand.Read(CursorSecret); err != nil {
+				panic(err)
+			}
+		}
+	})
+	return CursorSecret
+}
+
+func cursorSignature(payload []byte) []byte {
+	mac := hmac.New(sha256.New, cursorSecret())
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// encode gives the opaque form of the cursor: base64url of JSON and of its HMAC-SHA256 joined by a dot.
+func (c cursor) encode() string {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(cursorSignature(payload))
+}
+
+// decodeCursor checks the signature and the scope of value, an omitted value gives nil.
+func decodeCursor(value *string, scope string) (*cursor, *Error) {
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(*value, ".")
+	if len(parts) != 2 {
+		return nil, Validation("Malformed cursor")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, Validation("Malformed cursor")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, cursorSignature(payload)) {
+		return nil, Validation("Invalid cursor signature")
+	}
+
+	result := cursor{}
+	if err := json.Unmarshal(payload, &result); err != nil {
+		return nil, Validation("Malformed cursor")
+	}
+	if result.Scope != scope {
+		return nil, Validation("Cursor was issued for another listing")
+	}
+	return &result, nil
+}
+
+// cursorTime keeps the full precision of a timestamp, so rows created within a millisecond are told apart.
+func cursorTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// created is the timestamp stored in Key by cursorTime.
+func (c *cursor) created() time.Time {
+	created, _ := time.Parse(time.RFC3339Nano, c.Key)
+	return created
+}
+
+func threadCursor(scope string, thread *models.Thread) cursor {
+	return cursor{Scope: scope, Pinned: thread.Pinned, Key: cursorTime(time.Time(*thread.Created)), ID: int64(thread.ID)}
+}
+
+// afterThread tells whether thread goes after the cursor: pinned threads first, then by created and id.
+func (c *cursor) afterThread(thread *models.Thread, desc bool) bool {
+	if thread.Pinned != c.Pinned {
+		return c.Pinned
+	}
+	created, key := time.Time(*thread.Created), c.created()
+	if !created.Equal(key) {
+		return created.After(key) != desc
+	}
+	return (int64(thread.ID) > c.ID) != desc
+}
+
+func searchCursor(scope string, result *models.SearchResult) cursor {
+	return cursor{Scope: scope, Kind: result.Type, Key: cursorTime(searchResultCreated(result)), ID: searchResultID(result)}
+}
+
+// afterSearchResult tells whether a search result goes after the cursor:
+// results are ordered by created, posts go before threads created at the same moment, then by id.
+func (c *cursor) afterSearchResult(created time.Time, kind string, id int64, desc bool) bool {
+	key := c.created()
+	if !created.Equal(key) {
+		return created.After(key) != desc
+	}
+	if kind != c.Kind {
+		return kind == searchResultThread
+	}
+	return (id > c.ID) != desc
+}
+
+// pageSize counts the items limit applies to: posts, or root posts for parent_tree.
+func pageSize(posts models.Posts, sort string) int {
+	if sort != "parent_tree" {
+		return len(posts)
+	}
+	roots := 0
+	for _, post := range posts {
+		if post.Parent == 0 {
+			roots++
+		}
+	}
+	return roots
+}
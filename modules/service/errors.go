@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/go-openapi/runtime"
+	"github.com/lib/pq"
+)
+
+// ErrorKind tells the client what went wrong without exposing the cause.
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindNotFound
+	KindConflict
+	KindValidation
+	KindUnavailable
+	KindTimeout
+	KindUnauthorized
+	KindForbidden
+	KindUnsupported
+)
+
+var errorStatuses = map[ErrorKind]int{
+	KindInternal:     http.StatusInternalServerError,
+	KindNotFound:     http.StatusNotFound,
+	KindConflict:     http.StatusConflict,
+	KindValidation:   http.StatusBadRequest,
+	KindUnavailable:  http.StatusServiceUnavailable,
+	KindTimeout:      http.StatusGatewayTimeout,
+	KindUnauthorized: http.StatusUnauthorized,
+	KindForbidden:    http.StatusForbidden,
+	KindUnsupported:  http.StatusNotImplemented,
+}
+
+// Error is returned by ForumHandler methods instead of operation specific error responses.
+// It is a middleware.Responder itself, so every error is written as the swagger Error model.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Cause   error
+}
+
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return e.Message + ": " + e.Cause.Error()
+	}
+	return e.Message
+}
+
+// StatusCode is the HTTP status the error is reported with.
+func (e *Error) StatusCode() int {
+	return errorStatuses[e.Kind]
+}
+
+// Code implements errors.Error of go-openapi, so security handlers report the status as well.
+func (e *Error) Code() int32 {
+	return int32(e.StatusCode())
+}
+
+// WriteResponse implements middleware.Responder.
+func (e *Error) WriteResponse(rw http.ResponseWriter, producer runtime.Producer) {
+	if e.Cause != nil {
+		entry := requestLogger(rw).WithError(e.Cause).WithField("status", e.StatusCode())
+		if e.Kind == KindInternal {
+			entry.Error(e.Message)
+		} else {
+			entry.Warn(e.Message)
+		}
+	}
+	rw.WriteHeader(e.StatusCode())
+	if err := producer.Produce(rw, &models.Error{Message: e.Message}); err != nil {
+		panic(err)
+	}
+}
+
+func NotFound(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func Conflict(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func Validation(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindValidation, Message: fmt.Sprintf(format, args...)}
+}
+
+func Unauthorized(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindUnauthorized, Message: fmt.Sprintf(format, args...)}
+}
+
+func Forbidden(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+// Unsupported is returned by backends that can't do an operation at all.
+func Unsupported(format string, args ...interface{}) *Error {
+	return &Error{Kind: KindUnsupported, Message: fmt.Sprintf(format, args...)}
+}
+
+func Unavailable(cause error) *Error {
+	return &Error{Kind: KindUnavailable, Message: "Database is unavailable, try again later", Cause: cause}
+}
+
+func Timeout(cause error) *Error {
+	return &Error{Kind: KindTimeout, Message: "Database query timed out", Cause: cause}
+}
+
+func Internal(cause error) *Error {
+	return &Error{Kind: KindInternal, Message: "An error occured!", Cause: cause}
+}
+
+// dbError wraps an unexpected database error: connection problems are reported as transient.
+// Any error after ctx is done is caused by the deadline or by the client, who went away.
+func dbError(ctx context.Context, err error) *Error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return Timeout(err)
+	case context.Canceled:
+		return Unavailable(err)
+	}
+	if err == context.DeadlineExceeded {
+		return Timeout(err)
+	}
+	if err == driver.ErrBadConn || err == sql.ErrConnDone {
+		return Unavailable(err)
+	}
+	if _, ok := err.(net.Error); ok {
+		return Unavailable(err)
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		if pqErr.Code.Name() == "query_canceled" {
+			return Timeout(err)
+		}
+		// Class 08 - Connection Exception, 53 - Insufficient Resources, 57 - Operator Intervention
+		switch pqErr.Code.Class() {
+		case "08", "53", "57":
+			return Unavailable(err)
+		case "23":
+			return &Error{Kind: KindConflict, Message: pqErr.Message, Cause: err}
+		}
+	}
+	// SQLite driver reports constraint and locking problems only in the error text
+	if strings.Contains(err.Error(), "database is locked") {
+		return Unavailable(err)
+	}
+	if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return &Error{Kind: KindConflict, Message: "Already exists!", Cause: err}
+	}
+	return Internal(err)
+}
+
+// notFoundOr reports sql.ErrNoRows as NotFound and anything else as a database error.
+func notFoundOr(ctx context.Context, err error, format string, args ...interface{}) *Error {
+	if err == sql.ErrNoRows {
+		return NotFound(format, args...)
+	}
+	return dbError(ctx, err)
+}
+
+// isForeignKeyViolation recognizes foreign key errors of both PostgreSQL and SQLite drivers.
+func isForeignKeyViolation(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code.Name() == "foreign_key_violation"
+	}
+	return err != nil && strings.Contains(err.Error(), "FOREIGN KEY constraint failed")
+}
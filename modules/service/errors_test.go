@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/go-openapi/runtime"
+	"github.com/lib/pq"
+)
+
+func TestDBError(t *testing.T) {
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := []struct {
+		name   string
+		ctx    context.Context
+		err    error
+		status int
+	}{
+		{"deadline of the operation", expired, errors.New("pq: canceling statement due to user request"), http.StatusGatewayTimeout},
+		{"client went away", cancelled, errors.New("sql: transaction has already been committed or rolled back"), http.StatusServiceUnavailable},
+		{"deadline error", context.Background(), context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"bad connection", context.Background(), driver.ErrBadConn, http.StatusServiceUnavailable},
+		{"closed connection", context.Background(), sql.ErrConnDone, http.StatusServiceUnavailable},
+		{"network", context.Background(), &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+		{"statement timeout", context.Background(), &pq.Error{Code: "57014"}, http.StatusGatewayTimeout},
+		{"connection failure", context.Background(), &pq.Error{Code: "08006"}, http.StatusServiceUnavailable},
+		{"too many connections", context.Background(), &pq.Error{Code: "53300"}, http.StatusServiceUnavailable},
+		{"admin shutdown", context.Background(), &pq.Error{Code: "57P01"}, http.StatusServiceUnavailable},
+		{"unique violation", context.Background(), &pq.Error{Code: "23505", Message: "duplicate key"}, http.StatusConflict},
+		{"syntax error", context.Background(), &pq.Error{Code: "42601"}, http.StatusInternalServerError},
+		{"sqlite locked", context.Background(), errors.New("database is locked"), http.StatusServiceUnavailable},
+		{"sqlite unique", context.Background(), errors.New("UNIQUE constraint failed: users.nickname"), http.StatusConflict},
+		{"anything else", context.Background(), errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		if err := dbError(tc.ctx, tc.err); err.StatusCode() != tc.status || err.Cause != tc.err {
+			t.Errorf("%s: expected %d caused by %v, got %d caused by %v", tc.name, tc.status, tc.err, err.StatusCode(), err.Cause)
+		}
+	}
+}
+
+func TestNotFoundOr(t *testing.T) {
+	err := notFoundOr(context.Background(), sql.ErrNoRows, "Can't find user %s", "j.sparrow")
+	if err.StatusCode() != http.StatusNotFound || err.Message != "Can't find user j.sparrow" {
+		t.Errorf("expected 404 for a missing row, got %d: %s", err.StatusCode(), err.Message)
+	}
+	if err := notFoundOr(context.Background(), driver.ErrBadConn, "Can't find user %s", "j.sparrow"); err.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for an outage, got %d: %s", err.StatusCode(), err.Message)
+	}
+}
+
+func TestErrorWriteResponse(t *testing.T) {
+	cases := []struct {
+		err     *Error
+		status  int
+		message string
+	}{
+		{NotFound("Can't find forum %s", "pirates"), http.StatusNotFound, "Can't find forum pirates"},
+		{Conflict("Forum %s exists", "pirates"), http.StatusConflict, "Forum pirates exists"},
+		{Validation("Bad request"), http.StatusBadRequest, "Bad request"},
+		{Unauthorized("Log in"), http.StatusUnauthorized, "Log in"},
+		{Forbidden("Keep out"), http.StatusForbidden, "Keep out"},
+		{Unsupported("Not here"), http.StatusNotImplemented, "Not here"},
+		// Causes are logged, never sent to the client
+		{Unavailable(errors.New("dial tcp: connection refused")), http.StatusServiceUnavailable, "Database is unavailable, try again later"},
+		{Timeout(errors.New("pq: canceling statement")), http.StatusGatewayTimeout, "Database query timed out"},
+		{Internal(errors.New("pq: syntax error")), http.StatusInternalServerError, "An error occured!"},
+	}
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		tc.err.WriteResponse(recorder, runtime.JSONProducer())
+
+		body := models.Error{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatalf("expected the Error model, got %q: %v", recorder.Body.String(), err)
+		}
+		if recorder.Code != tc.status || body.Message != tc.message || tc.err.Code() != int32(tc.status) {
+			t.Errorf("expected %d %q, got %d %q", tc.status, tc.message, recorder.Code, body.Message)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/go-openapi/runtime"
+)
+
+// Event types.
+const (
+	EventThread   = "thread"
+	EventPost     = "post"
+	EventPostEdit = "post_edit"
+	EventVote     = "vote"
+)
+
+// StreamKeepAlive is the interval of comments sent to idle streams, so proxies don't close them.
+var StreamKeepAlive = 15 * time.Second
+
+// streamBuffer is the number of events a subscriber may lag behind before it is dropped.
+const streamBuffer = 64
+
+// Topics events are published to: every event goes to its forum, its thread and the user who made it.
+func forumTopic(slug string) string {
+	return "forum:" + strings.ToLower(slug)
+}
+
+func threadTopic(id int32) string {
+	return "thread:" + strconv.FormatInt(int64(id), 10)
+}
+
+func userTopic(nickname string) string {
+	return "user:" + strings.ToLower(nickname)
+}
+
+// parseTopic normalizes a topic given by a client.
+func parseTopic(topic string) (string, *Error) {
+	parts := strings.SplitN(topic, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", Validation("Malformed topic %q, expected forum:<slug>, thread:<id> or user:<nickname>", topic)
+	}
+	switch parts[0] {
+	case "forum":
+		return forumTopic(parts[1]), nil
+	case "user":
+		return userTopic(parts[1]), nil
+	case "thread":
+		id, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil {
+			return "", Validation("Malformed thread id in topic %q", topic)
+		}
+		return threadTopic(int32(id)), nil
+	default:
+		return "", Validation("Unknown topic %q, expected forum:<slug>, thread:<id> or user:<nickname>", topic)
+	}
+}
+
+func eventThreadID(event *models.ForumEvent) int32 {
+	if event.Post != nil {
+		return event.Post.Thread
+	}
+	if event.Thread != nil {
+		return event.Thread.ID
+	}
+	return 0
+}
+
+func eventTopics(event *models.ForumEvent) []string {
+	return []string{forumTopic(event.Forum), threadTopic(eventThreadID(event)), userTopic(event.User)}
+}
+
+func threadEvent(thread *models.Thread) *models.ForumEvent {
+	return &models.ForumEvent{Type: EventThread, Forum: thread.Forum, User: thread.Author, Thread: thread}
+}
+
+func postEvents(posts models.Posts) []*models.ForumEvent {
+	events := []*models.ForumEvent{}
+	for _, post := range posts {
+		events = append(events, &models.ForumEvent{Type: EventPost, Forum: post.Forum, User: post.Author, Post: post})
+	}
+	return events
+}
+
+func postEditEvent(post *models.Post) *models.ForumEvent {
+	return &models.ForumEvent{Type: EventPostEdit, Forum: post.Forum, User: post.Author, Post: post}
+}
+
+// voteEvent carries thread with its rating after the vote of voter.
+func voteEvent(thread *models.Thread, voter string) *models.ForumEvent {
+	return &models.ForumEvent{Type: EventVote, Forum: thread.Forum, User: voter, Thread: thread}
+}
+
+// subscription receives events of its topics until it is closed by the hub.
+type subscription struct {
+	events chan *models.ForumEvent
+	topics map[string]bool
+	closed bool
+}
+
+// eventHub delivers events to the subscribers of this server instance.
+type eventHub struct {
+	mu     sync.Mutex
+	topics map[string]map[*subscription]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{topics: map[string]map[*subscription]bool{}}
+}
+
+func (hub *eventHub) subscribe(topics ...string) *subscription {
+	sub := &subscription{events: make(chan *models.ForumEvent, streamBuffer), topics: map[string]bool{}}
+	hub.listen(sub, -1, topics...)
+	return sub
+}
+
+// listen adds topics to sub unless it would have more than limit of them, negative limit means no limit.
+func (hub *eventHub) listen(sub *subscription, limit int, topics ...string) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	added := map[string]bool{}
+	for _, topic := range topics {
+		if !sub.topics[topic] {
+			added[topic] = true
+		}
+	}
+	if limit >= 0 && len(sub.topics)+len(added) > limit {
+		return false
+	}
+	if sub.closed {
+		return true
+	}
+	for topic := range added {
+		sub.topics[topic] = true
+		if hub.topics[topic] == nil {
+			hub.topics[topic] = map[*subscription]bool{}
+		}
+		hub.topics[topic][sub] = true
+	}
+	return true
+}
+
+// ignore removes topics from sub.
+func (hub *eventHub) ignore(sub *subscription, topics ...string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for _, topic := range topics {
+		hub.removeTopic(sub, topic)
+	}
+}
+
+func (hub *eventHub) removeTopic(sub *subscription, topic string) {
+	delete(sub.topics, topic)
+	delete(hub.topics[topic], sub)
+	if len(hub.topics[topic]) == 0 {
+		delete(hub.topics, topic)
+	}
+}
+
+// topicsOf lists the topics of sub in order.
+func (hub *eventHub) topicsOf(sub *subscription) []string {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	topics := []string{}
+	for topic := range sub.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// unsubscribe closes the events of sub, it may be called more than once.
+func (hub *eventHub) unsubscribe(sub *subscription) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.close(sub)
+}
+
+func (hub *eventHub) close(sub *subscription) {
+	if sub.closed {
+		return
+	}
+	for topic := range sub.topics {
+		hub.removeTopic(sub, topic)
+	}
+	sub.closed = true
+	close(sub.events)
+}
+
+// watched tells whether somebody listens to any of topics.
+func (hub *eventHub) watched(topics ...string) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for _, topic := range topics {
+		if len(hub.topics[topic]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// publish never blocks: a subscriber that can't keep up is dropped, its client reconnects.
+// An event is delivered once even when a subscriber listens to several of its topics.
+func (hub *eventHub) publish(events ...*models.ForumEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for _, event := range events {
+		delivered := map[*subscription]bool{}
+		for _, topic := range eventTopics(event) {
+			for sub := range hub.topics[topic] {
+				if delivered[sub] {
+					continue
+				}
+				delivered[sub] = true
+				select {
+				case sub.events <- event:
+				default:
+					hub.close(sub)
+				}
+			}
+		}
+	}
+}
+
+// streamEvent is the form of event in the stream of a thread, nil for events the stream doesn't carry.
+func streamEvent(event *models.ForumEvent) *models.ThreadEvent {
+	switch event.Type {
+	case EventPost:
+		return &models.ThreadEvent{Type: EventPost, Thread: event.Post.Thread, Post: event.Post}
+	case EventVote:
+		return &models.ThreadEvent{Type: EventVote, Thread: event.Thread.ID, Votes: event.Thread.Votes}
+	default:
+		return nil
+	}
+}
+
+// connKey keeps the connection of a request in its context.
+type connKey struct{}
+
+// ConnContext is the ConnContext of the API server, streaming responses find their connection by it.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// keepStreaming lifts the write timeout of the server from the connection of request, otherwise
+// a stream is cut off once --write-timeout passes. The server sets it again for the next request.
+func keepStreaming(request *http.Request) {
+	if request == nil {
+		return
+	}
+	if conn, ok := request.Context().Value(connKey{}).(net.Conn); ok {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// eventStream writes events of a thread as Server-Sent Events until the client goes away.
+type eventStream struct {
+	request *http.Request
+	hub     *eventHub
+	sub     *subscription
+}
+
+func (stream *eventStream) WriteResponse(rw http.ResponseWriter, producer runtime.Producer) {
+	defer stream.hub.unsubscribe(stream.sub)
+	keepStreaming(stream.request)
+
+	rw.Header().Set(runtime.HeaderContentType, "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+
+	flusher, _ := rw.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	var done <-chan struct{}
+	if stream.request != nil {
+		done = stream.request.Context().Done()
+	}
+	keepAlive := time.NewTicker(StreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-stream.sub.events:
+			if !ok {
+				return
+			}
+			if event := streamEvent(event); event != nil {
+				if err := writeEvent(rw, event); err != nil {
+					return
+				}
+				flush()
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flush()
+		}
+	}
+}
+
+func writeEvent(rw http.ResponseWriter, event *models.ThreadEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	message := "event: " + event.Type + "\n"
+	if event.Post != nil {
+		message += "id: " + strconv.FormatInt(event.Post.ID, 10) + "\n"
+	}
+	_, err = fmt.Fprintf(rw, "%sdata: %s\n\n", message, data)
+	return err
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/runtime"
+)
+
+func TestStreamOutlivesWriteTimeout(t *testing.T) {
+	keepAlive := StreamKeepAlive
+	StreamKeepAlive = 20 * time.Millisecond
+	defer func() { StreamKeepAlive = keepAlive }()
+
+	hub := newEventHub()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		stream := &eventStream{request: r, hub: hub, sub: hub.subscribe(threadTopic(1))}
+		stream.WriteResponse(rw, runtime.JSONProducer())
+	}))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Config.ConnContext = ConnContext
+	server.Start()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := server.Client().Do(request.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	// Keep-alive comments keep coming long after the write timeout of the server
+	started := time.Now()
+	lines := bufio.NewScanner(response.Body)
+	for time.Since(started) < 5*server.Config.WriteTimeout {
+		if !lines.Scan() {
+			t.Fatalf("stream is cut off after %v: %v", time.Since(started), lines.Err())
+		}
+	}
+}
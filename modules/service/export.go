@@ -0,0 +1,121 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/go-openapi/runtime"
+)
+
+// Formats of exports.
+const (
+	DumpNDJSON = "ndjson"
+	DumpJSON   = "json"
+)
+
+// dumpMimes are content types of exports by format.
+var dumpMimes = map[string]string{
+	DumpNDJSON: "application/x-ndjson",
+	DumpJSON:   runtime.JSONMime,
+}
+
+// dumpWriter encodes records of an export, a line each in NDJSON or as elements of a JSON array.
+type dumpWriter struct {
+	w       *bufio.Writer
+	array   bool
+	records int64
+	// counts go to the end record
+	counts models.ImportResult
+}
+
+func newDumpWriter(w io.Writer, format string) *dumpWriter {
+	return &dumpWriter{w: bufio.NewWriterSize(w, 64*1024), array: format == DumpJSON}
+}
+
+func (dump *dumpWriter) write(record *dumpRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	separator := "\n"
+	if dump.array {
+		separator = ",\n"
+		if dump.records == 0 {
+			separator = "[\n"
+		}
+	}
+	if dump.records > 0 || dump.array {
+		if _, err := dump.w.WriteString(separator); err != nil {
+			return err
+		}
+	}
+	dump.records++
+	switch record.Type {
+	case DumpUser:
+		dump.counts.Users++
+	case DumpForum:
+		dump.counts.Forums++
+	case DumpThread:
+		dump.counts.Threads++
+	case DumpPost:
+		dump.counts.Posts++
+	case DumpVote:
+		dump.counts.Votes++
+	}
+	_, err = dump.w.Write(body)
+	return err
+}
+
+// close writes the end record, ends the array and flushes the rest.
+func (dump *dumpWriter) close() error {
+	counts := dump.counts
+	if err := dump.write(&dumpRecord{Type: DumpEnd, Counts: &counts}); err != nil {
+		return err
+	}
+	end := "\n"
+	if dump.array {
+		end = "\n]\n"
+	}
+	if _, err := dump.w.WriteString(end); err != nil {
+		return err
+	}
+	return dump.w.Flush()
+}
+
+// exportForum writes the records of a forum to dump.
+type exportForum func(dump *dumpWriter) *Error
+
+// writeDump runs export into w in the given format.
+func writeDump(w io.Writer, format string, export exportForum) *Error {
+	dump := newDumpWriter(w, format)
+	if err := export(dump); err != nil {
+		return err
+	}
+	if err := dump.close(); err != nil {
+		return Internal(err)
+	}
+	return nil
+}
+
+// dumpStream is the response of forumExport: the forum is checked before, its records are read
+// while they are written. A failure after the status is sent cuts the export short, a JSON
+// array is left unclosed then.
+type dumpStream struct {
+	request *http.Request
+	slug    string
+	format  string
+	export  exportForum
+}
+
+func (stream *dumpStream) WriteResponse(rw http.ResponseWriter, producer runtime.Producer) {
+	keepStreaming(stream.request)
+	rw.Header().Set(runtime.HeaderContentType, dumpMimes[stream.format])
+	rw.Header().Set("Content-Disposition", `attachment; filename="`+stream.slug+`.`+stream.format+`"`)
+	rw.WriteHeader(http.StatusOK)
+	if err := writeDump(rw, stream.format, stream.export); err != nil {
+		requestLogger(rw).WithError(err).WithField("forum", stream.slug).Error("Export is cut short")
+	}
+}
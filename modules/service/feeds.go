@@ -0,0 +1,350 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couatl/forum-db-api/restapi/operations"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/swag"
+)
+
+// Feed formats.
+const (
+	FeedAtom = "atom"
+	FeedRSS  = "rss"
+)
+
+var feedContentTypes = map[string]string{
+	FeedAtom: "application/atom+xml; charset=utf-8",
+	FeedRSS:  "application/rss+xml; charset=utf-8",
+}
+
+// feedSource is the part of ForumHandler feeds are built on, so they list exactly what the JSON API does.
+type feedSource interface {
+	ForumGetOne(params operations.ForumGetOneParams) middleware.Responder
+	ForumGetThreads(params operations.ForumGetThreadsParams) middleware.Responder
+	ThreadGetOne(params operations.ThreadGetOneParams) middleware.Responder
+	ThreadGetPosts(params operations.ThreadGetPostsParams) middleware.Responder
+}
+
+// forumFeed lists the latest threads of a forum.
+func forumFeed(source feedSource, request *http.Request, slug string, limit *int32, format string) middleware.Responder {
+	one := source.ForumGetOne(operations.ForumGetOneParams{HTTPRequest: request, Slug: slug})
+	found, ok := one.(*operations.ForumGetOneOK)
+	if !ok {
+		return one
+	}
+	list := source.ForumGetThreads(operations.ForumGetThreadsParams{
+		HTTPRequest: request, Slug: slug, Limit: feedLimitOr(limit), Desc: swag.Bool(true),
+	})
+	threads, ok := list.(*operations.ForumGetThreadsOK)
+	if !ok {
+		return list
+	}
+
+	base := feedBase(request, "/forum/")
+	forum := found.Payload
+	result := &feedResponse{request: request, format: format, feed: feed{
+		ID:    base + "/forum/" + forum.Slug + "/threads",
+		Title: forum.Title,
+		Link:  base + "/forum/" + forum.Slug + "/details",
+		Self:  feedOrigin(request) + request.URL.RequestURI(),
+	}}
+	for _, thread := range threads.Payload {
+		link := base + "/thread/" + strconv.FormatInt(int64(thread.ID), 10) + "/details"
+		result.feed.add(feedEntry{
+			ID: link, Link: link, Title: thread.Title, Author: thread.Author,
+			Content: thread.Message, Created: feedTime(thread.Created),
+		})
+	}
+	return result
+}
+
+// threadFeed lists the latest posts of a thread in the flat order, deleted posts are left out.
+func threadFeed(source feedSource, request *http.Request, slugOrID string, limit *int32, format string) middleware.Responder {
+	one := source.ThreadGetOne(operations.ThreadGetOneParams{HTTPRequest: request, SlugOrID: slugOrID})
+	found, ok := one.(*operations.ThreadGetOneOK)
+	if !ok {
+		return one
+	}
+	list := source.ThreadGetPosts(operations.ThreadGetPostsParams{
+		HTTPRequest: request, SlugOrID: slugOrID, Limit: feedLimitOr(limit), Sort: swag.String("flat"), Desc: swag.Bool(true),
+	})
+	posts, ok := list.(*operations.ThreadGetPostsOK)
+	if !ok {
+		return list
+	}
+
+	base := feedBase(request, "/thread/")
+	thread := found.Payload
+	id := strconv.FormatInt(int64(thread.ID), 10)
+	result := &feedResponse{request: request, format: format, feed: feed{
+		ID:    base + "/thread/" + id + "/posts",
+		Title: thread.Title,
+		Link:  base + "/thread/" + id + "/details",
+		Self:  feedOrigin(request) + request.URL.RequestURI(),
+	}}
+	for _, post := range posts.Payload {
+		if post.IsDeleted {
+			continue
+		}
+		link := base + "/post/" + strconv.FormatInt(post.ID, 10) + "/details"
+		result.feed.add(feedEntry{
+			ID: link, Link: link, Title: "Re: " + thread.Title, Author: post.Author,
+			Content: post.Message, Created: feedTime(post.Created),
+		})
+	}
+	return result
+}
+
+func feedOrigin(request *http.Request) string {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + request.Host
+}
+
+// feedBase is the absolute URL of the API the request was made to, marker is the first segment of the route.
+func feedBase(request *http.Request, marker string) string {
+	path := request.URL.Path
+	if i := strings.Index(path, marker); i >= 0 {
+		path = path[:i]
+	} else {
+		path = ""
+	}
+	return feedOrigin(request) + path
+}
+
+func feedTime(value *strfmt.DateTime) time.Time {
+	if value == nil {
+		return time.Time{}
+	}
+	return time.Time(*value).UTC()
+}
+
+type feed struct {
+	ID      string
+	Title   string
+	Link    string
+	Self    string
+	Updated time.Time
+	Entries []feedEntry
+}
+
+type feedEntry struct {
+	ID      string
+	Link    string
+	Title   string
+	Author  string
+	Content string
+	Created time.Time
+}
+
+// add appends entry, the feed is as recent as its latest entry.
+func (f *feed) add(entry feedEntry) {
+	f.Entries = append(f.Entries, entry)
+	if entry.Created.After(f.Updated) {
+		f.Updated = entry.Created
+	}
+}
+
+// feedResponse renders a feed and answers conditional requests with 304 by its ETag and Last-Modified.
+type feedResponse struct {
+	request *http.Request
+	format  string
+	feed    feed
+}
+
+func (response *feedResponse) WriteResponse(rw http.ResponseWriter, producer runtime.Producer) {
+	body, err := response.render()
+	if err != nil {
+		Internal(err).WriteResponse(rw, producer)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	rw.Header().Set("ETag", etag)
+	if !response.feed.Updated.IsZero() {
+		rw.Header().Set("Last-Modified", response.feed.Updated.Format(http.TimeFormat))
+	}
+	if response.notModified(etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rw.Header().Set(runtime.HeaderContentType, feedContentTypes[response.format])
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// notModified follows RFC 7232: If-None-Match takes precedence over If-Modified-Since.
+func (response *feedResponse) notModified(etag string) bool {
+	if response.request == nil {
+		return false
+	}
+	if match := response.request.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(response.request.Header.Get("If-Modified-Since"))
+	if err != nil || response.feed.Updated.IsZero() {
+		return false
+	}
+	return !response.feed.Updated.Truncate(time.Second).After(since)
+}
+
+func (response *feedResponse) render() ([]byte, error) {
+	var document interface{}
+	if response.format == FeedRSS {
+		document = rssDocument(response.feed)
+	} else {
+		document = atomDocument(response.feed)
+	}
+	buffer := bytes.NewBufferString(xml.Header)
+	if err := xml.NewEncoder(buffer).Encode(document); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Atom, RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Author    atomPerson `xml:"author"`
+	Link      atomLink   `xml:"link"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func atomDocument(f feed) atomFeed {
+	document := atomFeed{
+		ID:      f.ID,
+		Title:   f.Title,
+		Updated: f.Updated.Format(time.RFC3339Nano),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: f.Self},
+			{Rel: "alternate", Type: "application/json", Href: f.Link},
+		},
+		Entries: []atomEntry{},
+	}
+	for _, entry := range f.Entries {
+		created := entry.Created.Format(time.RFC3339Nano)
+		document.Entries = append(document.Entries, atomEntry{
+			ID:        entry.ID,
+			Title:     entry.Title,
+			Updated:   created,
+			Published: created,
+			Author:    atomPerson{Name: entry.Author},
+			Link:      atomLink{Rel: "alternate", Type: "application/json", Href: entry.Link},
+			Content:   atomText{Type: "text", Body: entry.Content},
+		})
+	}
+	return document
+}
+
+// RSS 2.0, authors are given by Dublin Core since RSS expects an email there.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	Creator     string  `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func rssDocument(f feed) rssFeed {
+	document := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:       f.Title,
+		Link:        f.Link,
+		Description: f.Title,
+		Items:       []rssItem{},
+	}}
+	if !f.Updated.IsZero() {
+		document.Channel.LastBuildDate = f.Updated.Format(time.RFC1123Z)
+	}
+	for _, entry := range f.Entries {
+		document.Channel.Items = append(document.Channel.Items, rssItem{
+			Title:       entry.Title,
+			Link:        entry.Link,
+			Description: entry.Content,
+			Creator:     entry.Author,
+			GUID:        rssGUID{IsPermaLink: true, Value: entry.ID},
+			PubDate:     entry.Created.Format(time.RFC1123Z),
+		})
+	}
+	return document
+}
+
+// feedLimit is the number of entries of a feed unless its request says otherwise.
+const feedLimit = 30
+
+func feedLimitOr(limit *int32) *int32 {
+	if limit == nil {
+		return swag.Int32(feedLimit)
+	}
+	return limit
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStatementTimeout runs against the database from FORUM_TEST_POSTGRES, see TestForumPgSQL.
+func TestStatementTimeout(t *testing.T) {
+	dataSourceName := os.Getenv("FORUM_TEST_POSTGRES")
+	if dataSourceName == "" {
+		t.Skip("FORUM_TEST_POSTGRES is not set")
+	}
+	generic := NewForumGeneric("postgres", dataSourceName)
+	defer generic.db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	tx, err := generic.begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// The server stops the transaction at the deadline of the operation
+	var setting string
+	if err := tx.GetContext(ctx, &setting, `SELECT current_setting('statement_timeout')`); err != nil {
+		t.Fatal(err)
+	}
+	timeout, err := time.ParseDuration(strings.Replace(setting, "min", "m", 1))
+	if err != nil || timeout <= 0 || timeout > 2*time.Second {
+		t.Errorf("expected statement_timeout up to 2s, got %q", setting)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelShort()
+	tx, err = generic.begin(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	started := time.Now()
+	_, err = tx.ExecContext(short, `SELECT pg_sleep(5)`)
+	if err == nil || dbError(short, err).StatusCode() != http.StatusGatewayTimeout || time.Since(started) > time.Second {
+		t.Errorf("expected the query to time out with 504 in 200ms, got %v after %v", err, time.Since(started))
+	}
+}
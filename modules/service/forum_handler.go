@@ -1,31 +1,92 @@
 package service
 
 import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/couatl/forum-db-api/models"
 	"github.com/couatl/forum-db-api/restapi/operations"
 	"github.com/go-openapi/runtime/middleware"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ForumHandler:			Handles database queries.
 type ForumHandler interface {
-	Clear(params operations.ClearParams) middleware.Responder
+	Clear(params operations.ClearParams, principal *models.Principal) middleware.Responder
 	Status(params operations.StatusParams) middleware.Responder
 
+	ForumBanDelete(params operations.ForumBanDeleteParams, principal *models.Principal) middleware.Responder
+	ForumBanSet(params operations.ForumBanSetParams, principal *models.Principal) middleware.Responder
 	ForumCreate(params operations.ForumCreateParams) middleware.Responder
+	ForumExport(params operations.ForumExportParams, principal *models.Principal) middleware.Responder
+	ForumGetBans(params operations.ForumGetBansParams) middleware.Responder
 	ForumGetOne(params operations.ForumGetOneParams) middleware.Responder
+	ForumGetReports(params operations.ForumGetReportsParams, principal *models.Principal) middleware.Responder
 	ForumGetThreads(params operations.ForumGetThreadsParams) middleware.Responder
+	ForumGetThreadsAtom(params operations.ForumGetThreadsAtomParams) middleware.Responder
+	ForumGetThreadsRss(params operations.ForumGetThreadsRssParams) middleware.Responder
+	ForumGetRoles(params operations.ForumGetRolesParams) middleware.Responder
 	ForumGetUsers(params operations.ForumGetUsersParams) middleware.Responder
+	ForumRoleSet(params operations.ForumRoleSetParams, principal *models.Principal) middleware.Responder
+	ForumSearch(params operations.ForumSearchParams) middleware.Responder
+	ForumGetWebhooks(params operations.ForumGetWebhooksParams, principal *models.Principal) middleware.Responder
+	ForumWebhookCreate(params operations.ForumWebhookCreateParams, principal *models.Principal) middleware.Responder
 
+	PostDelete(params operations.PostDeleteParams, principal *models.Principal) middleware.Responder
 	PostGetOne(params operations.PostGetOneParams) middleware.Responder
-	PostUpdate(params operations.PostUpdateParams) middleware.Responder
-	PostsCreate(params operations.PostsCreateParams) middleware.Responder
+	PostHistory(params operations.PostHistoryParams) middleware.Responder
+	PostHistoryDiff(params operations.PostHistoryDiffParams) middleware.Responder
+	PostReport(params operations.PostReportParams, principal *models.Principal) middleware.Responder
+	PostUpdate(params operations.PostUpdateParams, principal *models.Principal) middleware.Responder
+	PostsCreate(params operations.PostsCreateParams, principal *models.Principal) middleware.Responder
 
-	ThreadCreate(params operations.ThreadCreateParams) middleware.Responder
+	ThreadCreate(params operations.ThreadCreateParams, principal *models.Principal) middleware.Responder
+	ThreadDelete(params operations.ThreadDeleteParams, principal *models.Principal) middleware.Responder
 	ThreadGetOne(params operations.ThreadGetOneParams) middleware.Responder
 	ThreadGetPosts(params operations.ThreadGetPostsParams) middleware.Responder
-	ThreadUpdate(params operations.ThreadUpdateParams) middleware.Responder
-	ThreadVote(params operations.ThreadVoteParams) middleware.Responder
+	ThreadGetPostsAtom(params operations.ThreadGetPostsAtomParams) middleware.Responder
+	ThreadHistory(params operations.ThreadHistoryParams) middleware.Responder
+	ThreadHistoryDiff(params operations.ThreadHistoryDiffParams) middleware.Responder
+	ThreadLock(params operations.ThreadLockParams, principal *models.Principal) middleware.Responder
+	ThreadPin(params operations.ThreadPinParams, principal *models.Principal) middleware.Responder
+	ThreadReport(params operations.ThreadReportParams, principal *models.Principal) middleware.Responder
+	ThreadStream(params operations.ThreadStreamParams) middleware.Responder
+	ThreadUnlock(params operations.ThreadUnlockParams, principal *models.Principal) middleware.Responder
+	ThreadUnpin(params operations.ThreadUnpinParams, principal *models.Principal) middleware.Responder
+	ThreadUpdate(params operations.ThreadUpdateParams, principal *models.Principal) middleware.Responder
+	ThreadVote(params operations.ThreadVoteParams, principal *models.Principal) middleware.Responder
 
+	UserBan(params operations.UserBanParams, principal *models.Principal) middleware.Responder
 	UserCreate(params operations.UserCreateParams) middleware.Responder
 	UserGetOne(params operations.UserGetOneParams) middleware.Responder
-	UserUpdate(params operations.UserUpdateParams) middleware.Responder
+	UserLogin(params operations.UserLoginParams) middleware.Responder
+	UserLogout(params operations.UserLogoutParams, principal *models.Principal) middleware.Responder
+	UserTokenCreate(params operations.UserTokenCreateParams, principal *models.Principal) middleware.Responder
+	UserUnban(params operations.UserUnbanParams, principal *models.Principal) middleware.Responder
+	UserUpdate(params operations.UserUpdateParams, principal *models.Principal) middleware.Responder
+
+	ReportDismiss(params operations.ReportDismissParams, principal *models.Principal) middleware.Responder
+	ReportResolve(params operations.ReportResolveParams, principal *models.Principal) middleware.Responder
+
+	Search(params operations.SearchParams) middleware.Responder
+
+	WebhookDelete(params operations.WebhookDeleteParams, principal *models.Principal) middleware.Responder
+	WebhookDeliveries(params operations.WebhookDeliveriesParams, principal *models.Principal) middleware.Responder
+
+	// Authenticate resolves the principal of a bearer token.
+	Authenticate(token string) (*models.Principal, error)
+	// BootstrapAdmins creates the accounts of Admins with password, or resets their password to it.
+	BootstrapAdmins(ctx context.Context, password string) *Error
+	// Gateway serves the WebSocket feed of forum, thread and user events.
+	Gateway() http.Handler
+	// Collector reports the state of the storage to Prometheus.
+	Collector() prometheus.Collector
+	// Ready checks the storage for /readyz, checks are named by what they look at.
+	Ready(ctx context.Context) map[string]HealthCheck
+	// Import loads an NDJSON dump of another board, it is served by ImportHandler and the import command.
+	// With placeholderEmails new users without emails get them at PlaceholderEmailDomain.
+	Import(ctx context.Context, dump io.Reader, placeholderEmails bool) (*models.ImportResult, *Error)
+	// Export writes a forum with emails of its users for the export command, format is DumpNDJSON or DumpJSON.
+	Export(ctx context.Context, slug, format string, dump io.Writer) *Error
 }
@@ -0,0 +1,2186 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/couatl/forum-db-api/restapi/operations"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/go-openapi/strfmt"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type memoryForum struct {
+	models.Forum
+	users map[string]bool
+	roles map[string]string
+}
+
+type memoryPost struct {
+	models.Post
+	path []int64
+}
+
+type memoryDelivery struct {
+	models.WebhookDelivery
+	payload []byte
+}
+
+// idempotencyScope is the key of a remembered response, see idempotency.
+type idempotencyScope struct {
+	owner string
+	key   string
+}
+
+type memoryIdempotency struct {
+	operation   string
+	fingerprint string
+	response    *storedResponse
+	expires     time.Time
+}
+
+type memoryToken struct {
+	nickname string
+	expires  *strfmt.DateTime
+}
+
+// ForumMemory keeps the whole forum in process memory.
+// Nicknames, emails and slugs are indexed in lower case, like the lower(...) indexes of PostgreSQL schema.
+type ForumMemory struct {
+	mu sync.RWMutex
+
+	users     map[string]*models.User
+	emails    map[string]string
+	passwords map[string]string
+	tokens    map[string]memoryToken
+
+	idempotency map[idempotencyScope]memoryIdempotency
+
+	forums  map[string]*memoryForum
+	bans    []*models.Ban
+	reports []*models.Report
+
+	// webhooks are indexed by id - 1, removed ones are nil
+	webhooks   []*models.Webhook
+	deliveries []*memoryDelivery
+
+	threads        []*models.Thread
+	threadSlugs    map[string]*models.Thread
+	deletedThreads map[int32]bool
+	votes          map[int32]map[string]int32
+
+	posts       []*memoryPost
+	threadPosts map[int32][]*memoryPost
+
+	postRevisions   map[int64]models.Revisions
+	threadRevisions map[int32]models.Revisions
+
+	events *eventHub
+	worker *webhookWorker
+}
+
+func NewForumMemory(dataSourceName string) ForumHandler {
+	dbManager := &ForumMemory{events: newEventHub()}
+	dbManager.reset()
+	dbManager.worker = startWebhooks(dbManager, DefaultLogger)
+	return dbManager
+}
+
+func (dbManager *ForumMemory) reset() {
+	dbManager.users = map[string]*models.User{}
+	dbManager.emails = map[string]string{}
+	dbManager.passwords = map[string]string{}
+	dbManager.tokens = map[string]memoryToken{}
+	dbManager.idempotency = map[idempotencyScope]memoryIdempotency{}
+	dbManager.forums = map[string]*memoryForum{}
+	dbManager.bans = nil
+	dbManager.reports = nil
+	dbManager.webhooks = nil
+	dbManager.deliveries = nil
+	dbManager.threads = nil
+	dbManager.threadSlugs = map[string]*models.Thread{}
+	dbManager.deletedThreads = map[int32]bool{}
+	dbManager.votes = map[int32]map[string]int32{}
+	dbManager.posts = nil
+	dbManager.threadPosts = map[int32][]*memoryPost{}
+	dbManager.postRevisions = map[int64]models.Revisions{}
+	dbManager.threadRevisions = map[int32]models.Revisions{}
+}
+
+func (dbManager *ForumMemory) thread(slugOrID string) *models.Thread {
+	slug, id := SlugID(slugOrID)
+	if thread, ok := dbManager.threadSlugs[strings.ToLower(slug)]; ok {
+		return thread
+	}
+	if id > 0 && id <= int64(len(dbManager.threads)) && !dbManager.deletedThreads[int32(id)] {
+		return dbManager.threads[id-1]
+	}
+	return nil
+}
+
+// post finds a post by id, posts of deleted threads are gone with them.
+func (dbManager *ForumMemory) post(id int64) *memoryPost {
+	if id > 0 && id <= int64(len(dbManager.posts)) && !dbManager.deletedThreads[dbManager.posts[id-1].Thread] {
+		return dbManager.posts[id-1]
+	}
+	return nil
+}
+
+// forumRole resolves the role of principal in the forum with the given slug.
+func (dbManager *ForumMemory) forumRole(principal *models.Principal, slug string) string {
+	forum := dbManager.forums[strings.ToLower(slug)]
+	banned := dbManager.activeBan(principal.Nickname, forum.Slug) != nil || dbManager.activeBan(principal.Nickname, "") != nil
+	return resolveRole(principal, forum.User, forum.roles[strings.ToLower(principal.Nickname)], banned)
+}
+
+// activeBan finds the ban of the user in force in the forum, forum is empty for site-wide bans.
+func (dbManager *ForumMemory) activeBan(nickname string, forum string) *models.Ban {
+	now := time.Now()
+	for idx := len(dbManager.bans) - 1; idx >= 0; idx-- {
+		ban := dbManager.bans[idx]
+		if strings.EqualFold(ban.Nickname, nickname) && strings.EqualFold(ban.Forum, forum) && isActiveBan(ban, now) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// checkBan returns Forbidden when principal is banned in the forum with the given slug or site-wide.
+func (dbManager *ForumMemory) checkBan(principal *models.Principal, forum string) *Error {
+	if isAdmin(principal) {
+		return nil
+	}
+	if ban := dbManager.activeBan(principal.Nickname, ""); ban != nil {
+		return bannedError(ban)
+	}
+	if ban := dbManager.activeBan(principal.Nickname, forum); ban != nil {
+		return bannedError(ban)
+	}
+	return nil
+}
+
+// setBan replaces the active ban of the user, the previous one is lifted but kept.
+func (dbManager *ForumMemory) setBan(nickname string, forum string, ban *models.Ban, moderator string) *models.Ban {
+	now := strfmt.DateTime(time.Now().UTC())
+	if previous := dbManager.activeBan(nickname, forum); previous != nil {
+		previous.Expires = &now
+	}
+
+	result := &models.Ban{Nickname: nickname, Forum: forum, Reason: ban.Reason, Moderator: moderator, Created: &now}
+	if ban.Expires != nil {
+		expires := strfmt.DateTime(time.Time(*ban.Expires).UTC())
+		result.Expires = &expires
+	}
+	dbManager.bans = append(dbManager.bans, result)
+	return copyBan(result)
+}
+
+// liftBan ends the active ban of the user in the forum and returns it, nil if there is none.
+func (dbManager *ForumMemory) liftBan(nickname string, forum string) *models.Ban {
+	ban := dbManager.activeBan(nickname, forum)
+	if ban == nil {
+		return nil
+	}
+	now := strfmt.DateTime(time.Now().UTC())
+	ban.Expires = &now
+	return copyBan(ban)
+}
+
+func copyUser(user *models.User) *models.User {
+	result := *user
+	return &result
+}
+
+func copyForum(forum *memoryForum) *models.Forum {
+	result := forum.Forum
+	return &result
+}
+
+func copyThread(thread *models.Thread) *models.Thread {
+	result := *thread
+	return &result
+}
+
+func copyPost(post *memoryPost) *models.Post {
+	result := post.Post
+	return &result
+}
+
+func copyBan(ban *models.Ban) *models.Ban {
+	result := *ban
+	return &result
+}
+
+func copyReport(report *models.Report) *models.Report {
+	result := *report
+	return &result
+}
+
+func copyWebhook(webhook *models.Webhook) *models.Webhook {
+	result := *webhook
+	result.Secret = ""
+	return &result
+}
+
+func copyDelivery(delivery *memoryDelivery) *models.WebhookDelivery {
+	result := delivery.WebhookDelivery
+	return &result
+}
+
+func copyRevisions(revisions models.Revisions) models.Revisions {
+	result := models.Revisions{}
+	for _, revision := range revisions {
+		copied := *revision
+		result = append(result, &copied)
+	}
+	return result
+}
+
+// comparePath orders posts the same way as PostgreSQL compares INT[] paths.
+func comparePath(a, b []int64) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Clear ...
+func (dbManager *ForumMemory) Clear(params operations.ClearParams, principal *models.Principal) middleware.Responder {
+	if err := authorizeClear(principal); err != nil {
+		return err
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	// Accounts of administrators are kept with their tokens
+	users, passwords, tokens := dbManager.users, dbManager.passwords, dbManager.tokens
+	dbManager.reset()
+	for _, nickname := range adminNicknames() {
+		user, ok := users[nickname]
+		if !ok {
+			continue
+		}
+		dbManager.users[nickname] = user
+		dbManager.emails[strings.ToLower(user.Email.String())] = nickname
+		if hash, ok := passwords[nickname]; ok {
+			dbManager.passwords[nickname] = hash
+		}
+	}
+	for hash, token := range tokens {
+		if _, ok := dbManager.users[token.nickname]; ok {
+			dbManager.tokens[hash] = token
+		}
+	}
+	return operations.NewClearOK()
+}
+
+// Status ...
+func (dbManager *ForumMemory) Status(params operations.StatusParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	return operations.NewStatusOK().WithPayload(&models.Status{
+		Forum:  int32(len(dbManager.forums)),
+		Thread: int32(len(dbManager.threads)),
+		Post:   int64(len(dbManager.posts)),
+		User:   int32(len(dbManager.users)),
+	})
+}
+
+// ForumCreate ...
+func (dbManager *ForumMemory) ForumCreate(params operations.ForumCreateParams) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "forumCreate", nil, params.Forum)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if replayed := dbManager.replay(key); replayed != nil {
+		return replayed
+	}
+
+	user, ok := dbManager.users[strings.ToLower(params.Forum.User)]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Forum.User)
+	}
+
+	if forum, ok := dbManager.forums[strings.ToLower(params.Forum.Slug)]; ok {
+		return operations.NewForumCreateConflict().WithPayload(copyForum(forum))
+	}
+
+	forum := &memoryForum{
+		Forum: models.Forum{
+			Slug:  params.Forum.Slug,
+			Title: params.Forum.Title,
+			User:  user.Nickname,
+		},
+		users: map[string]bool{},
+		roles: map[string]string{},
+	}
+	dbManager.forums[strings.ToLower(forum.Slug)] = forum
+
+	result := copyForum(forum)
+	if err := dbManager.remember(key, http.StatusCreated, result); err != nil {
+		return err
+	}
+	return operations.NewForumCreateCreated().WithPayload(result)
+}
+
+// ForumGetOne ...
+func (dbManager *ForumMemory) ForumGetOne(params operations.ForumGetOneParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+
+	return operations.NewForumGetOneOK().WithPayload(copyForum(forum))
+}
+
+// ForumGetThreads ...
+func (dbManager *ForumMemory) ForumGetThreads(params operations.ForumGetThreadsParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("forumGetThreads", strings.ToLower(params.Slug), desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+
+	threads := models.Threads{}
+	for _, thread := range dbManager.threads {
+		if thread.Forum != forum.Slug || dbManager.deletedThreads[thread.ID] {
+			continue
+		}
+		if after != nil {
+			if !after.afterThread(thread, desc) {
+				continue
+			}
+		} else if params.Since != nil {
+			created, since := time.Time(*thread.Created), time.Time(*params.Since)
+			if desc && created.After(since) || !desc && created.Before(since) {
+				continue
+			}
+		}
+		threads = append(threads, copyThread(thread))
+	}
+
+	sort.SliceStable(threads, func(i, j int) bool {
+		if threads[i].Pinned != threads[j].Pinned {
+			return threads[i].Pinned
+		}
+		a, b := time.Time(*threads[i].Created), time.Time(*threads[j].Created)
+		if !a.Equal(b) {
+			return a.After(b) == desc
+		}
+		return (threads[i].ID < threads[j].ID) != desc
+	})
+	if params.Limit != nil && int(*params.Limit) < len(threads) {
+		threads = threads[:*params.Limit]
+	}
+
+	response := operations.NewForumGetThreadsOK().WithPayload(threads)
+	if params.Limit != nil && len(threads) == int(*params.Limit) {
+		response.WithXNextCursor(threadCursor(scope, threads[len(threads)-1]).encode())
+	}
+	return response
+}
+
+// ForumGetThreadsAtom ...
+func (dbManager *ForumMemory) ForumGetThreadsAtom(params operations.ForumGetThreadsAtomParams) middleware.Responder {
+	return forumFeed(dbManager, params.HTTPRequest, params.Slug, params.Limit, FeedAtom)
+}
+
+// ForumGetThreadsRss ...
+func (dbManager *ForumMemory) ForumGetThreadsRss(params operations.ForumGetThreadsRssParams) middleware.Responder {
+	return forumFeed(dbManager, params.HTTPRequest, params.Slug, params.Limit, FeedRSS)
+}
+
+// ForumGetUsers ...
+func (dbManager *ForumMemory) ForumGetUsers(params operations.ForumGetUsersParams) middleware.Responder {
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("forumGetUsers", strings.ToLower(params.Slug), desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+	if after != nil {
+		params.Since = &after.Key
+	}
+
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+
+	excludeBanned := params.ExcludeBanned != nil && *params.ExcludeBanned
+	nicknames := []string{}
+	for nickname := range forum.users {
+		if params.Since != nil {
+			since := strings.ToLower(*params.Since)
+			if desc && nickname >= since || !desc && nickname <= since {
+				continue
+			}
+		}
+		if excludeBanned && (dbManager.activeBan(nickname, forum.Slug) != nil || dbManager.activeBan(nickname, "") != nil) {
+			continue
+		}
+		nicknames = append(nicknames, nickname)
+	}
+
+	if desc {
+		sort.Sort(sort.Reverse(sort.StringSlice(nicknames)))
+	} else {
+		sort.Strings(nicknames)
+	}
+	if params.Limit != nil && int(*params.Limit) < len(nicknames) {
+		nicknames = nicknames[:*params.Limit]
+	}
+
+	users := models.Users{}
+	for _, nickname := range nicknames {
+		users = append(users, copyUser(dbManager.users[nickname]))
+	}
+
+	response := operations.NewForumGetUsersOK().WithPayload(users)
+	if params.Limit != nil && len(users) == int(*params.Limit) {
+		response.WithXNextCursor(cursor{Scope: scope, Key: users[len(users)-1].Nickname}.encode())
+	}
+	return response
+}
+
+// ForumGetRoles ...
+func (dbManager *ForumMemory) ForumGetRoles(params operations.ForumGetRolesParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+
+	nicknames := []string{}
+	for nickname := range forum.roles {
+		nicknames = append(nicknames, nickname)
+	}
+	sort.Strings(nicknames)
+
+	roles := models.ForumRoles{}
+	for _, nickname := range nicknames {
+		roles = append(roles, &models.ForumRole{Nickname: dbManager.users[nickname].Nickname, Role: forum.roles[nickname]})
+	}
+
+	return operations.NewForumGetRolesOK().WithPayload(roles)
+}
+
+// ForumRoleSet ...
+func (dbManager *ForumMemory) ForumRoleSet(params operations.ForumRoleSetParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+	nickname := strings.ToLower(params.Nickname)
+	user, ok := dbManager.users[nickname]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	role := dbManager.forumRole(principal, forum.Slug)
+	current := dbManager.forumRole(&models.Principal{Nickname: user.Nickname}, forum.Slug)
+	if !canAssign(role, current, params.Role.Role) {
+		return Forbidden("%s can't change role of %s from %s to %s in forum %s",
+			principal.Nickname, user.Nickname, current, params.Role.Role, forum.Slug)
+	}
+
+	if params.Role.Role == RoleMember {
+		delete(forum.roles, nickname)
+	} else {
+		forum.roles[nickname] = params.Role.Role
+	}
+
+	return operations.NewForumRoleSetOK().WithPayload(&models.ForumRole{Nickname: user.Nickname, Role: params.Role.Role})
+}
+
+// ForumGetBans ...
+func (dbManager *ForumMemory) ForumGetBans(params operations.ForumGetBansParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+
+	now := time.Now()
+	bans := models.Bans{}
+	for _, ban := range dbManager.bans {
+		if strings.EqualFold(ban.Forum, forum.Slug) && isActiveBan(ban, now) {
+			bans = append(bans, copyBan(ban))
+		}
+	}
+	sort.SliceStable(bans, func(i, j int) bool {
+		return strings.ToLower(bans[i].Nickname) < strings.ToLower(bans[j].Nickname)
+	})
+
+	return operations.NewForumGetBansOK().WithPayload(bans)
+}
+
+// ForumBanSet ...
+func (dbManager *ForumMemory) ForumBanSet(params operations.ForumBanSetParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+	user, ok := dbManager.users[strings.ToLower(params.Nickname)]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	role := dbManager.forumRole(principal, forum.Slug)
+	current := dbManager.forumRole(&models.Principal{Nickname: user.Nickname}, forum.Slug)
+	if !canAssign(role, current, RoleBanned) {
+		return Forbidden("%s can't ban %s in forum %s", principal.Nickname, user.Nickname, forum.Slug)
+	}
+
+	ban := dbManager.setBan(user.Nickname, forum.Slug, params.Ban, principal.Nickname)
+	return operations.NewForumBanSetOK().WithPayload(ban)
+}
+
+// ForumBanDelete ...
+func (dbManager *ForumMemory) ForumBanDelete(params operations.ForumBanDeleteParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+	if !can(dbManager.forumRole(principal, forum.Slug), permModerate) {
+		return Forbidden("Only moderators of forum %s can lift bans", forum.Slug)
+	}
+	user, ok := dbManager.users[strings.ToLower(params.Nickname)]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	ban := dbManager.liftBan(user.Nickname, forum.Slug)
+	if ban == nil {
+		return NotFound("User %s is not banned in forum %s", user.Nickname, forum.Slug)
+	}
+	return operations.NewForumBanDeleteOK().WithPayload(ban)
+}
+
+// PostGetOne ...
+func (dbManager *ForumMemory) PostGetOne(params operations.PostGetOneParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	post := dbManager.post(params.ID)
+	if post == nil {
+		return NotFound("Can't find post with id %d", params.ID)
+	}
+
+	postFull := models.PostFull{Post: copyPost(post)}
+	for _, item := range params.Related {
+		switch item {
+		case "user":
+			if !post.IsDeleted {
+				postFull.Author = copyUser(dbManager.users[strings.ToLower(post.Author)])
+			}
+		case "forum":
+			postFull.Forum = copyForum(dbManager.forums[strings.ToLower(post.Forum)])
+		case "thread":
+			postFull.Thread = copyThread(dbManager.threads[post.Thread-1])
+		}
+	}
+
+	return operations.NewPostGetOneOK().WithPayload(&postFull)
+}
+
+// PostUpdate ...
+func (dbManager *ForumMemory) PostUpdate(params operations.PostUpdateParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	post := dbManager.post(params.ID)
+	if post == nil {
+		return NotFound("Can't find post with id %d", params.ID)
+	}
+	if post.IsDeleted {
+		return Conflict("Post %d is deleted", params.ID)
+	}
+	if !canEdit(dbManager.forumRole(principal, post.Forum), principal, post.Author) {
+		return Forbidden("Post %d can't be edited by %s", params.ID, principal.Nickname)
+	}
+
+	if params.Post.Message != "" && params.Post.Message != post.Message {
+		revisions := dbManager.postRevisions[post.ID]
+		if len(revisions) == 0 {
+			revisions = append(revisions, postOriginal(&post.Post))
+		}
+		created := strfmt.DateTime(time.Now().UTC())
+		dbManager.postRevisions[post.ID] = append(revisions, &models.Revision{
+			Number: int32(len(revisions) + 1), Message: params.Post.Message, Editor: principal.Nickname, Created: &created})
+
+		post.Message = params.Post.Message
+		post.IsEdited = true
+		dbManager.publish(postEditEvent(copyPost(post)))
+	}
+
+	return operations.NewPostUpdateOK().WithPayload(copyPost(post))
+}
+
+// PostHistory ...
+func (dbManager *ForumMemory) PostHistory(params operations.PostHistoryParams) middleware.Responder {
+	principal := optionalPrincipal(dbManager.Authenticate, params.HTTPRequest)
+
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	revisions := dbManager.postHistory(principal, params.ID)
+	if revisions == nil {
+		return NotFound("Can't find post with id %d", params.ID)
+	}
+
+	return operations.NewPostHistoryOK().WithPayload(revisions)
+}
+
+// PostHistoryDiff ...
+func (dbManager *ForumMemory) PostHistoryDiff(params operations.PostHistoryDiffParams) middleware.Responder {
+	principal := optionalPrincipal(dbManager.Authenticate, params.HTTPRequest)
+
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	revisions := dbManager.postHistory(principal, params.ID)
+	if revisions == nil {
+		return NotFound("Can't find post with id %d", params.ID)
+	}
+
+	diff, err := diffRevisions(revisions, params.From, params.To, false)
+	if err != nil {
+		return err
+	}
+	return operations.NewPostHistoryDiffOK().WithPayload(diff)
+}
+
+// postHistory returns copies of every version of the post, nil when there is no such post.
+// Only moderators of the forum see versions of a deleted post, others get the tombstone.
+func (dbManager *ForumMemory) postHistory(principal *models.Principal, id int64) models.Revisions {
+	post := dbManager.post(id)
+	if post == nil {
+		return nil
+	}
+	if post.IsDeleted && (principal == nil || !can(dbManager.forumRole(principal, post.Forum), permModerate)) {
+		return models.Revisions{postOriginal(&post.Post)}
+	}
+	revisions := dbManager.postRevisions[id]
+	if len(revisions) == 0 {
+		return models.Revisions{postOriginal(&post.Post)}
+	}
+	return copyRevisions(revisions)
+}
+
+// PostDelete ...
+func (dbManager *ForumMemory) PostDelete(params operations.PostDeleteParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	post := dbManager.post(params.ID)
+	if post == nil {
+		return NotFound("Can't find post with id %d", params.ID)
+	}
+
+	if !post.IsDeleted {
+		if !canEdit(dbManager.forumRole(principal, post.Forum), principal, post.Author) {
+			return Forbidden("Post %d can't be deleted by %s", params.ID, principal.Nickname)
+		}
+
+		dbManager.deletePost(post)
+	}
+
+	return operations.NewPostDeleteOK().WithPayload(copyPost(post))
+}
+
+// deletePost replaces post with a tombstone, the original of a post which was never edited
+// is kept in its history for moderators.
+func (dbManager *ForumMemory) deletePost(post *memoryPost) {
+	if post.IsDeleted {
+		return
+	}
+	if len(dbManager.postRevisions[post.ID]) == 0 {
+		dbManager.postRevisions[post.ID] = models.Revisions{postOriginal(&post.Post)}
+	}
+	post.IsDeleted = true
+	post.Message = postTombstone
+	post.Author = ""
+	dbManager.forums[strings.ToLower(post.Forum)].Posts--
+}
+
+// PostsCreate ...
+func (dbManager *ForumMemory) PostsCreate(params operations.PostsCreateParams, principal *models.Principal) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "postsCreate", principal, params.SlugOrID, params.Posts)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if replayed := dbManager.replay(key); replayed != nil {
+		return replayed
+	}
+
+	thread := dbManager.thread(params.SlugOrID)
+	if thread == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+	if thread.Locked {
+		return Conflict("Thread %s is locked", params.SlugOrID)
+	}
+	if err := dbManager.checkBan(principal, thread.Forum); err != nil {
+		return err
+	}
+
+	if len(params.Posts) == 0 {
+		return operations.NewPostsCreateCreated().WithPayload(params.Posts)
+	}
+
+	author, ok := dbManager.users[strings.ToLower(principal.Nickname)]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", principal.Nickname)
+	}
+
+	// Validate the whole batch first: PostgreSQL rolls back the transaction on the first failure.
+	for _, item := range params.Posts {
+		if item.Parent != 0 {
+			parent := dbManager.post(item.Parent)
+			if parent == nil || parent.Thread != thread.ID {
+				return Conflict("Parent post %d is not in thread %d", item.Parent, thread.ID)
+			}
+		}
+	}
+
+	forum := dbManager.forums[strings.ToLower(thread.Forum)]
+	created := strfmt.DateTime(time.Now())
+	posts := models.Posts{}
+	for _, item := range params.Posts {
+		post := &memoryPost{Post: models.Post{
+			ID:      int64(len(dbManager.posts) + 1),
+			Author:  author.Nickname,
+			Created: &created,
+			Forum:   thread.Forum,
+			Message: item.Message,
+			Parent:  item.Parent,
+			Thread:  thread.ID,
+		}}
+		if post.Parent == 0 {
+			post.path = []int64{post.ID}
+		} else {
+			parent := dbManager.post(post.Parent)
+			post.path = append(append([]int64{}, parent.path...), post.ID)
+		}
+
+		dbManager.posts = append(dbManager.posts, post)
+		dbManager.threadPosts[thread.ID] = append(dbManager.threadPosts[thread.ID], post)
+		forum.users[strings.ToLower(post.Author)] = true
+		posts = append(posts, copyPost(post))
+	}
+	forum.Posts += int64(len(posts))
+	dbManager.publish(postEvents(posts)...)
+
+	if err := dbManager.remember(key, http.StatusCreated, posts); err != nil {
+		return err
+	}
+	return operations.NewPostsCreateCreated().WithPayload(posts)
+}
+
+// ThreadCreate ...
+func (dbManager *ForumMemory) ThreadCreate(params operations.ThreadCreateParams, principal *models.Principal) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "threadCreate", principal, params.Slug, params.Thread)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if replayed := dbManager.replay(key); replayed != nil {
+		return replayed
+	}
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+	user, ok := dbManager.users[strings.ToLower(principal.Nickname)]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", principal.Nickname)
+	}
+	if err := dbManager.checkBan(principal, forum.Slug); err != nil {
+		return err
+	}
+
+	if params.Thread.Slug != "" {
+		if thread, ok := dbManager.threadSlugs[strings.ToLower(params.Thread.Slug)]; ok {
+			return operations.NewThreadCreateConflict().WithPayload(copyThread(thread))
+		}
+	}
+
+	created := strfmt.DateTime(time.Now())
+	if params.Thread.Created != nil {
+		created = *params.Thread.Created
+	}
+	thread := &models.Thread{
+		ID:      int32(len(dbManager.threads) + 1),
+		Author:  user.Nickname,
+		Created: &created,
+		Forum:   forum.Slug,
+		Message: params.Thread.Message,
+		Slug:    params.Thread.Slug,
+		Title:   params.Thread.Title,
+	}
+
+	dbManager.threads = append(dbManager.threads, thread)
+	if thread.Slug != "" {
+		dbManager.threadSlugs[strings.ToLower(thread.Slug)] = thread
+	}
+	forum.Threads++
+	forum.users[strings.ToLower(user.Nickname)] = true
+	dbManager.publish(threadEvent(copyThread(thread)))
+
+	result := copyThread(thread)
+	if err := dbManager.remember(key, http.StatusCreated, result); err != nil {
+		return err
+	}
+	return operations.NewThreadCreateCreated().WithPayload(result)
+}
+
+// ThreadGetOne ...
+func (dbManager *ForumMemory) ThreadGetOne(params operations.ThreadGetOneParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	thread := dbManager.thread(params.SlugOrID)
+	if thread == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+
+	return operations.NewThreadGetOneOK().WithPayload(copyThread(thread))
+}
+
+// ThreadGetPosts ...
+func (dbManager *ForumMemory) ThreadGetPosts(params operations.ThreadGetPostsParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	thread := dbManager.thread(params.SlugOrID)
+	if thread == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+
+	desc := params.Desc != nil && *params.Desc
+	limit := -1
+	if params.Limit != nil {
+		limit = int(*params.Limit)
+	}
+	sortType := "flat"
+	if params.Sort != nil {
+		sortType = *params.Sort
+	}
+
+	// Posts are positioned by the id of the last one: their paths never change
+	scope := cursorScope("threadGetPosts", thread.ID, sortType, desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+	if after != nil {
+		params.Since = &after.ID
+	}
+
+	var since *memoryPost
+	if params.Since != nil {
+		if since = dbManager.post(*params.Since); since == nil {
+			return operations.NewThreadGetPostsOK().WithPayload(models.Posts{})
+		}
+	}
+
+	selected := []*memoryPost{}
+	switch sortType {
+	case "flat":
+		for _, post := range dbManager.threadPosts[thread.ID] {
+			if since != nil && (desc && post.ID >= since.ID || !desc && post.ID <= since.ID) {
+				continue
+			}
+			selected = append(selected, post)
+		}
+		sort.Slice(selected, func(i, j int) bool {
+			return (selected[i].ID < selected[j].ID) != desc
+		})
+		if limit >= 0 && limit < len(selected) {
+			selected = selected[:limit]
+		}
+	case "tree":
+		for _, post := range dbManager.threadPosts[thread.ID] {
+			if since != nil {
+				cmp := comparePath(post.path, since.path)
+				if desc && cmp >= 0 || !desc && cmp <= 0 {
+					continue
+				}
+			}
+			selected = append(selected, post)
+		}
+		sort.Slice(selected, func(i, j int) bool {
+			return (comparePath(selected[i].path, selected[j].path) < 0) != desc
+		})
+		if limit >= 0 && limit < len(selected) {
+			selected = selected[:limit]
+		}
+	case "parent_tree":
+		roots := []int64{}
+		for _, post := range dbManager.threadPosts[thread.ID] {
+			if post.Parent != 0 {
+				continue
+			}
+			if since != nil && (desc && post.ID >= since.path[0] || !desc && post.ID <= since.path[0]) {
+				continue
+			}
+			roots = append(roots, post.ID)
+		}
+		sort.Slice(roots, func(i, j int) bool {
+			return (roots[i] < roots[j]) != desc
+		})
+		if limit >= 0 && limit < len(roots) {
+			roots = roots[:limit]
+		}
+
+		selectedRoots := map[int64]bool{}
+		for _, root := range roots {
+			selectedRoots[root] = true
+		}
+		for _, post := range dbManager.threadPosts[thread.ID] {
+			if selectedRoots[post.path[0]] {
+				selected = append(selected, post)
+			}
+		}
+		sort.Slice(selected, func(i, j int) bool {
+			return (comparePath(selected[i].path, selected[j].path) < 0) != desc
+		})
+	default:
+		return Validation("Unknown sort type %s", sortType)
+	}
+
+	posts := models.Posts{}
+	for _, post := range selected {
+		posts = append(posts, copyPost(post))
+	}
+
+	response := operations.NewThreadGetPostsOK().WithPayload(posts)
+	if limit >= 0 && pageSize(posts, sortType) == limit {
+		response.WithXNextCursor(cursor{Scope: scope, ID: posts[len(posts)-1].ID}.encode())
+	}
+	return response
+}
+
+// ThreadGetPostsAtom ...
+func (dbManager *ForumMemory) ThreadGetPostsAtom(params operations.ThreadGetPostsAtomParams) middleware.Responder {
+	return threadFeed(dbManager, params.HTTPRequest, params.SlugOrID, params.Limit, FeedAtom)
+}
+
+// ThreadUpdate ...
+func (dbManager *ForumMemory) ThreadUpdate(params operations.ThreadUpdateParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	thread := dbManager.thread(params.SlugOrID)
+	if thread == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+
+	role := dbManager.forumRole(principal, thread.Forum)
+	if !canEdit(role, principal, thread.Author) {
+		return Forbidden("Thread %s can't be edited by %s", params.SlugOrID, principal.Nickname)
+	}
+	if (params.Thread.Locked != nil || params.Thread.Pinned != nil) && !can(role, permModerate) {
+		return Forbidden("Only moderators of forum %s can lock and pin threads", thread.Forum)
+	}
+
+	title, message := thread.Title, thread.Message
+	if params.Thread.Title != "" {
+		title = params.Thread.Title
+	}
+	if params.Thread.Message != "" {
+		message = params.Thread.Message
+	}
+	if title != thread.Title || message != thread.Message {
+		revisions := dbManager.threadRevisions[thread.ID]
+		if len(revisions) == 0 {
+			revisions = append(revisions, threadOriginal(thread))
+		}
+		created := strfmt.DateTime(time.Now().UTC())
+		dbManager.threadRevisions[thread.ID] = append(revisions, &models.Revision{
+			Number: int32(len(revisions) + 1), Title: title, Message: message, Editor: principal.Nickname, Created: &created})
+	}
+
+	thread.Title, thread.Message = title, message
+	if params.Thread.Locked != nil {
+		thread.Locked = *params.Thread.Locked
+	}
+	if params.Thread.Pinned != nil {
+		thread.Pinned = *params.Thread.Pinned
+	}
+
+	return operations.NewThreadUpdateOK().WithPayload(copyThread(thread))
+}
+
+// ThreadHistory ...
+func (dbManager *ForumMemory) ThreadHistory(params operations.ThreadHistoryParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	revisions := dbManager.threadHistory(params.SlugOrID)
+	if revisions == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+
+	return operations.NewThreadHistoryOK().WithPayload(revisions)
+}
+
+// ThreadHistoryDiff ...
+func (dbManager *ForumMemory) ThreadHistoryDiff(params operations.ThreadHistoryDiffParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	revisions := dbManager.threadHistory(params.SlugOrID)
+	if revisions == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+
+	diff, err := diffRevisions(revisions, params.From, params.To, true)
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadHistoryDiffOK().WithPayload(diff)
+}
+
+// threadHistory returns copies of every version of a live thread, nil when there is no such thread.
+func (dbManager *ForumMemory) threadHistory(slugOrID string) models.Revisions {
+	thread := dbManager.thread(slugOrID)
+	if thread == nil {
+		return nil
+	}
+	revisions := dbManager.threadRevisions[thread.ID]
+	if len(revisions) == 0 {
+		return models.Revisions{threadOriginal(thread)}
+	}
+	return copyRevisions(revisions)
+}
+
+// ThreadDelete ...
+func (dbManager *ForumMemory) ThreadDelete(params operations.ThreadDeleteParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	thread := dbManager.thread(params.SlugOrID)
+	if thread == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+	if !canEdit(dbManager.forumRole(principal, thread.Forum), principal, thread.Author) {
+		return Forbidden("Thread %s can't be deleted by %s", params.SlugOrID, principal.Nickname)
+	}
+
+	dbManager.deletedThreads[thread.ID] = true
+	if thread.Slug != "" {
+		delete(dbManager.threadSlugs, strings.ToLower(thread.Slug))
+	}
+	forum := dbManager.forums[strings.ToLower(thread.Forum)]
+	forum.Threads--
+	// Posts of the thread stop counting, tombstones are not counted already
+	for _, post := range dbManager.threadPosts[thread.ID] {
+		if !post.IsDeleted {
+			forum.Posts--
+		}
+	}
+
+	return operations.NewThreadDeleteOK().WithPayload(copyThread(thread))
+}
+
+// ThreadLock ...
+func (dbManager *ForumMemory) ThreadLock(params operations.ThreadLockParams, principal *models.Principal) middleware.Responder {
+	thread, err := dbManager.setThreadFlag(params.SlugOrID, principal, func(thread *models.Thread) { thread.Locked = true })
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadLockOK().WithPayload(thread)
+}
+
+// ThreadUnlock ...
+func (dbManager *ForumMemory) ThreadUnlock(params operations.ThreadUnlockParams, principal *models.Principal) middleware.Responder {
+	thread, err := dbManager.setThreadFlag(params.SlugOrID, principal, func(thread *models.Thread) { thread.Locked = false })
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadUnlockOK().WithPayload(thread)
+}
+
+// ThreadPin ...
+func (dbManager *ForumMemory) ThreadPin(params operations.ThreadPinParams, principal *models.Principal) middleware.Responder {
+	thread, err := dbManager.setThreadFlag(params.SlugOrID, principal, func(thread *models.Thread) { thread.Pinned = true })
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadPinOK().WithPayload(thread)
+}
+
+// ThreadUnpin ...
+func (dbManager *ForumMemory) ThreadUnpin(params operations.ThreadUnpinParams, principal *models.Principal) middleware.Responder {
+	thread, err := dbManager.setThreadFlag(params.SlugOrID, principal, func(thread *models.Thread) { thread.Pinned = false })
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadUnpinOK().WithPayload(thread)
+}
+
+// setThreadFlag applies set to a live thread on behalf of a moderator and returns its copy.
+func (dbManager *ForumMemory) setThreadFlag(slugOrID string, principal *models.Principal, set func(thread *models.Thread)) (*models.Thread, *Error) {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	thread := dbManager.thread(slugOrID)
+	if thread == nil {
+		return nil, NotFound("Can't find thread %s", slugOrID)
+	}
+	if !can(dbManager.forumRole(principal, thread.Forum), permModerate) {
+		return nil, Forbidden("Only moderators of forum %s can lock and pin threads", thread.Forum)
+	}
+	set(thread)
+	return copyThread(thread), nil
+}
+
+// PostReport ...
+func (dbManager *ForumMemory) PostReport(params operations.PostReportParams, principal *models.Principal) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "postReport", principal, params.ID, params.Report)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if replayed := dbManager.replay(key); replayed != nil {
+		return replayed
+	}
+
+	post := dbManager.post(params.ID)
+	if post == nil {
+		return NotFound("Can't find post with id %d", params.ID)
+	}
+
+	report, err := dbManager.createReport(principal, post.Forum, post.Thread, post.ID, params.Report.Reason)
+	if err != nil {
+		return err
+	}
+	if err := dbManager.remember(key, http.StatusCreated, report); err != nil {
+		return err
+	}
+	return operations.NewPostReportCreated().WithPayload(report)
+}
+
+// ThreadReport ...
+func (dbManager *ForumMemory) ThreadReport(params operations.ThreadReportParams, principal *models.Principal) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "threadReport", principal, params.SlugOrID, params.Report)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if replayed := dbManager.replay(key); replayed != nil {
+		return replayed
+	}
+
+	thread := dbManager.thread(params.SlugOrID)
+	if thread == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+
+	report, err := dbManager.createReport(principal, thread.Forum, thread.ID, 0, params.Report.Reason)
+	if err != nil {
+		return err
+	}
+	if err := dbManager.remember(key, http.StatusCreated, report); err != nil {
+		return err
+	}
+	return operations.NewThreadReportCreated().WithPayload(report)
+}
+
+// createReport files a report of principal, post is 0 for reports on the thread itself.
+func (dbManager *ForumMemory) createReport(principal *models.Principal, forum string, thread int32, post int64, reason string) (*models.Report, *Error) {
+	if err := dbManager.checkBan(principal, forum); err != nil {
+		return nil, err
+	}
+	user, ok := dbManager.users[strings.ToLower(principal.Nickname)]
+	if !ok {
+		return nil, NotFound("Can't find user with nickname %s", principal.Nickname)
+	}
+
+	for _, report := range dbManager.reports {
+		if report.Reporter == user.Nickname && report.Thread == thread && report.Post == post && report.Status == ReportOpen {
+			return nil, Conflict("%s has already filed report %d", user.Nickname, report.ID)
+		}
+	}
+
+	now := strfmt.DateTime(time.Now().UTC())
+	report := &models.Report{
+		ID:       int64(len(dbManager.reports) + 1),
+		Forum:    forum,
+		Thread:   thread,
+		Post:     post,
+		Reporter: user.Nickname,
+		Reason:   reason,
+		Status:   ReportOpen,
+		Created:  &now,
+	}
+	dbManager.reports = append(dbManager.reports, report)
+	return copyReport(report), nil
+}
+
+// ForumGetReports ...
+func (dbManager *ForumMemory) ForumGetReports(params operations.ForumGetReportsParams, principal *models.Principal) middleware.Responder {
+	status := ReportOpen
+	if params.Status != nil {
+		status = *params.Status
+	}
+	scope := cursorScope("forumGetReports", strings.ToLower(params.Slug), status)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+	if after != nil {
+		params.Since = &after.ID
+	}
+
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+	if !can(dbManager.forumRole(principal, forum.Slug), permModerate) {
+		return Forbidden("Only moderators of forum %s can see its reports", forum.Slug)
+	}
+
+	reports := models.Reports{}
+	for _, report := range dbManager.reports {
+		if params.Limit != nil && len(reports) >= int(*params.Limit) {
+			break
+		}
+		if report.Forum != forum.Slug || report.Status != status || params.Since != nil && report.ID <= *params.Since {
+			continue
+		}
+		reports = append(reports, copyReport(report))
+	}
+
+	response := operations.NewForumGetReportsOK().WithPayload(reports)
+	if params.Limit != nil && len(reports) == int(*params.Limit) {
+		response.WithXNextCursor(cursor{Scope: scope, ID: reports[len(reports)-1].ID}.encode())
+	}
+	return response
+}
+
+// ReportResolve ...
+func (dbManager *ForumMemory) ReportResolve(params operations.ReportResolveParams, principal *models.Principal) middleware.Responder {
+	report, err := dbManager.closeReport(principal, params.ID, ReportResolved, resolutionAction(params.Resolution))
+	if err != nil {
+		return err
+	}
+	return operations.NewReportResolveOK().WithPayload(report)
+}
+
+// ReportDismiss ...
+func (dbManager *ForumMemory) ReportDismiss(params operations.ReportDismissParams, principal *models.Principal) middleware.Responder {
+	report, err := dbManager.closeReport(principal, params.ID, ReportDismissed, "")
+	if err != nil {
+		return err
+	}
+	return operations.NewReportDismissOK().WithPayload(report)
+}
+
+// closeReport applies action and closes the report with status on behalf of a moderator.
+func (dbManager *ForumMemory) closeReport(principal *models.Principal, id int64, status string, action string) (*models.Report, *Error) {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if id <= 0 || id > int64(len(dbManager.reports)) {
+		return nil, NotFound("Can't find report with id %d", id)
+	}
+	report := dbManager.reports[id-1]
+	if !can(dbManager.forumRole(principal, report.Forum), permModerate) {
+		return nil, Forbidden("Only moderators of forum %s can close its reports", report.Forum)
+	}
+	if err := checkReportAction(report, action); err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case ActionDeletePost:
+		// Posts of deleted threads are gone already
+		if post := dbManager.post(report.Post); post != nil {
+			dbManager.deletePost(post)
+		}
+	case ActionLockThread:
+		dbManager.threads[report.Thread-1].Locked = true
+	}
+
+	now := strfmt.DateTime(time.Now().UTC())
+	report.Status, report.Action, report.Moderator, report.Closed = status, action, principal.Nickname, &now
+	return copyReport(report), nil
+}
+
+// ThreadVote ...
+func (dbManager *ForumMemory) ThreadVote(params operations.ThreadVoteParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	thread := dbManager.thread(params.SlugOrID)
+	if thread == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+	if thread.Locked {
+		return Conflict("Thread %s is locked", params.SlugOrID)
+	}
+	if err := dbManager.checkBan(principal, thread.Forum); err != nil {
+		return err
+	}
+
+	nickname := strings.ToLower(principal.Nickname)
+	if _, ok := dbManager.users[nickname]; !ok {
+		return NotFound("Can't find user with nickname %s", principal.Nickname)
+	}
+
+	votes, ok := dbManager.votes[thread.ID]
+	if !ok {
+		votes = map[string]int32{}
+		dbManager.votes[thread.ID] = votes
+	}
+	votes[nickname] = params.Vote.Voice
+
+	thread.Votes = 0
+	for _, voice := range votes {
+		thread.Votes += voice
+	}
+	dbManager.publish(voteEvent(copyThread(thread), principal.Nickname))
+
+	return operations.NewThreadVoteOK().WithPayload(copyThread(thread))
+}
+
+// ThreadStream ...
+func (dbManager *ForumMemory) ThreadStream(params operations.ThreadStreamParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	thread := dbManager.thread(params.SlugOrID)
+	if thread == nil {
+		return NotFound("Can't find thread %s", params.SlugOrID)
+	}
+
+	sub := dbManager.events.subscribe(threadTopic(thread.ID))
+	return &eventStream{request: params.HTTPRequest, hub: dbManager.events, sub: sub}
+}
+
+// replay gives the remembered response of a retried request, the caller holds the write lock.
+func (dbManager *ForumMemory) replay(key *idempotency) middleware.Responder {
+	if key == nil {
+		return nil
+	}
+	stored, ok := dbManager.idempotency[idempotencyScope{owner: key.Owner, key: key.Key}]
+	if !ok || !stored.expires.After(time.Now()) {
+		return nil
+	}
+	if err := key.check(stored.operation, stored.fingerprint); err != nil {
+		return err
+	}
+	return stored.response
+}
+
+// remember stores the response of a request made with key and forgets expired keys of its owner.
+func (dbManager *ForumMemory) remember(key *idempotency, status int, payload interface{}) *Error {
+	if key == nil {
+		return nil
+	}
+	response, err := newStoredResponse(status, payload)
+	if err != nil {
+		return Internal(err)
+	}
+	now := time.Now()
+	for scope, stored := range dbManager.idempotency {
+		if scope.owner == key.Owner && !stored.expires.After(now) {
+			delete(dbManager.idempotency, scope)
+		}
+	}
+	dbManager.idempotency[idempotencyScope{owner: key.Owner, key: key.Key}] = memoryIdempotency{
+		operation:   key.Operation,
+		fingerprint: key.Fingerprint,
+		response:    response,
+		expires:     now.Add(IdempotencyTTL),
+	}
+	return nil
+}
+
+// Gateway ...
+func (dbManager *ForumMemory) Gateway() http.Handler {
+	return gateway{hub: dbManager.events}
+}
+
+// Collector ... there is no database to report
+func (dbManager *ForumMemory) Collector() prometheus.Collector {
+	return dbCollector{}
+}
+
+// Ready ... there is no database to check
+func (dbManager *ForumMemory) Ready(ctx context.Context) map[string]HealthCheck {
+	return map[string]HealthCheck{}
+}
+
+// Import ... posts and threads are kept by their ids in order, imported ids can't be preserved
+func (dbManager *ForumMemory) Import(ctx context.Context, dump io.Reader, placeholderEmails bool) (*models.ImportResult, *Error) {
+	return nil, Unsupported("In-memory storage can't import dumps, use PostgreSQL or SQLite")
+}
+
+// ForumExport ...
+func (dbManager *ForumMemory) ForumExport(params operations.ForumExportParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+	role := dbManager.forumRole(principal, forum.Slug)
+	if !can(role, permExport) {
+		return Forbidden("Only the owner of forum %s can export it", forum.Slug)
+	}
+
+	slug, private := forum.Slug, role == RoleAdmin
+	return &dumpStream{request: params.HTTPRequest, slug: slug, format: *params.Format, export: func(dump *dumpWriter) *Error {
+		return dbManager.exportForum(slug, private, dump)
+	}}
+}
+
+// Export ...
+func (dbManager *ForumMemory) Export(ctx context.Context, slug, format string, dump io.Writer) *Error {
+	return writeDump(dump, format, func(records *dumpWriter) *Error {
+		return dbManager.exportForum(slug, true, records)
+	})
+}
+
+// exportForum copies the records of a forum under the lock and writes them after it, in the order
+// of ForumPgSQL.exportForum.
+func (dbManager *ForumMemory) exportForum(slug string, private bool, dump *dumpWriter) *Error {
+	records, err := dbManager.forumRecords(slug, private)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := dump.write(record); err != nil {
+			return Internal(err)
+		}
+	}
+	return nil
+}
+
+func (dbManager *ForumMemory) forumRecords(slug string, private bool) ([]*dumpRecord, *Error) {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(slug)]
+	if !ok {
+		return nil, NotFound("Can't find forum with slug %s", slug)
+	}
+
+	threads := []*models.Thread{}
+	participants := map[string]bool{strings.ToLower(forum.User): true}
+	for nickname := range forum.users {
+		participants[nickname] = true
+	}
+	for _, thread := range dbManager.threads {
+		if thread.Forum != forum.Slug || dbManager.deletedThreads[thread.ID] {
+			continue
+		}
+		threads = append(threads, thread)
+		for nickname := range dbManager.votes[thread.ID] {
+			participants[nickname] = true
+		}
+	}
+	nicknames := []string{}
+	for nickname := range participants {
+		nicknames = append(nicknames, nickname)
+	}
+	sort.Strings(nicknames)
+
+	records := []*dumpRecord{}
+	for _, nickname := range nicknames {
+		user := dbManager.users[nickname]
+		record := &dumpRecord{Type: DumpUser, Nickname: user.Nickname, Fullname: user.Fullname, About: user.About}
+		if private {
+			record.Email = string(user.Email)
+		}
+		records = append(records, record)
+	}
+	records = append(records, &dumpRecord{Type: DumpForum, Slug: forum.Slug, Title: forum.Title, User: forum.User})
+	for _, thread := range threads {
+		records = append(records, &dumpRecord{Type: DumpThread, ID: int64(thread.ID), Forum: thread.Forum, Author: thread.Author,
+			Created: thread.Created, Message: thread.Message, Slug: thread.Slug, Title: thread.Title})
+	}
+	for _, thread := range threads {
+		posts := append([]*memoryPost{}, dbManager.threadPosts[thread.ID]...)
+		sort.Slice(posts, func(i, j int) bool { return comparePath(posts[i].path, posts[j].path) < 0 })
+		for _, post := range posts {
+			records = append(records, &dumpRecord{Type: DumpPost, ID: post.ID, Thread: post.Thread, Author: post.Author,
+				Created: post.Created, Message: post.Message, Parent: post.Parent, Edited: post.IsEdited, Deleted: post.IsDeleted})
+		}
+	}
+	for _, thread := range threads {
+		voters := []string{}
+		for nickname := range dbManager.votes[thread.ID] {
+			voters = append(voters, nickname)
+		}
+		sort.Strings(voters)
+		for _, nickname := range voters {
+			records = append(records, &dumpRecord{Type: DumpVote, Thread: thread.ID, Nickname: dbManager.users[nickname].Nickname,
+				Voice: dbManager.votes[thread.ID][nickname]})
+		}
+	}
+	return records, nil
+}
+
+// UserCreate ...
+func (dbManager *ForumMemory) UserCreate(params operations.UserCreateParams) middleware.Responder {
+	// Keys are kept for a day, the password stays out of their fingerprints
+	profile := *params.Profile
+	profile.Password = ""
+	key, keyErr := newIdempotency(params.IdempotencyKey, "userCreate", nil, params.Nickname, &profile)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	passwordHash := ""
+	if params.Profile.Password != "" {
+		hash, err := hashPassword(string(params.Profile.Password))
+		if err != nil {
+			return Internal(err)
+		}
+		passwordHash = hash
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if replayed := dbManager.replay(key); replayed != nil {
+		return replayed
+	}
+
+	nickname := strings.ToLower(params.Nickname)
+	email := strings.ToLower(params.Profile.Email.String())
+
+	users := models.Users{}
+	if user, ok := dbManager.users[nickname]; ok {
+		users = append(users, copyUser(user))
+	}
+	if owner, ok := dbManager.emails[email]; ok && owner != nickname {
+		users = append(users, copyUser(dbManager.users[owner]))
+	}
+	if len(users) != 0 {
+		return operations.NewUserCreateConflict().WithPayload(users)
+	}
+
+	user := &models.User{
+		Nickname: params.Nickname,
+		Fullname: params.Profile.Fullname,
+		About:    params.Profile.About,
+		Email:    params.Profile.Email,
+	}
+	dbManager.users[nickname] = user
+	dbManager.emails[email] = nickname
+	if passwordHash != "" {
+		dbManager.passwords[nickname] = passwordHash
+	}
+
+	result := copyUser(user)
+	if err := dbManager.remember(key, http.StatusCreated, result); err != nil {
+		return err
+	}
+	return operations.NewUserCreateCreated().WithPayload(result)
+}
+
+// UserBan ...
+func (dbManager *ForumMemory) UserBan(params operations.UserBanParams, principal *models.Principal) middleware.Responder {
+	if !can(resolveRole(principal, "", "", false), permBanGlobal) {
+		return Forbidden("Only administrators can ban users site-wide")
+	}
+	if isAdmin(&models.Principal{Nickname: params.Nickname}) {
+		return Forbidden("Administrator %s can't be banned", params.Nickname)
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	user, ok := dbManager.users[strings.ToLower(params.Nickname)]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	ban := dbManager.setBan(user.Nickname, "", params.Ban, principal.Nickname)
+	return operations.NewUserBanOK().WithPayload(ban)
+}
+
+// UserUnban ...
+func (dbManager *ForumMemory) UserUnban(params operations.UserUnbanParams, principal *models.Principal) middleware.Responder {
+	if !can(resolveRole(principal, "", "", false), permBanGlobal) {
+		return Forbidden("Only administrators can lift site-wide bans")
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	user, ok := dbManager.users[strings.ToLower(params.Nickname)]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	ban := dbManager.liftBan(user.Nickname, "")
+	if ban == nil {
+		return NotFound("User %s is not banned site-wide", user.Nickname)
+	}
+	return operations.NewUserUnbanOK().WithPayload(ban)
+}
+
+// UserGetOne ...
+func (dbManager *ForumMemory) UserGetOne(params operations.UserGetOneParams) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	user, ok := dbManager.users[strings.ToLower(params.Nickname)]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	return operations.NewUserGetOneOK().WithPayload(copyUser(user))
+}
+
+// UserUpdate ...
+func (dbManager *ForumMemory) UserUpdate(params operations.UserUpdateParams, principal *models.Principal) middleware.Responder {
+	if !isPrincipal(principal, params.Nickname) {
+		return Forbidden("Profile of %s can be updated only by its owner", params.Nickname)
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	nickname := strings.ToLower(params.Nickname)
+	user, ok := dbManager.users[nickname]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	if params.Profile == nil {
+		return operations.NewUserUpdateOK().WithPayload(copyUser(user))
+	}
+
+	email := strings.ToLower(params.Profile.Email.String())
+	if email != "" {
+		if owner, ok := dbManager.emails[email]; ok && owner != nickname {
+			return Conflict("Email %s is already used by another user", params.Profile.Email)
+		}
+	}
+
+	if params.Profile.Fullname != "" {
+		user.Fullname = params.Profile.Fullname
+	}
+	if email != "" {
+		delete(dbManager.emails, strings.ToLower(user.Email.String()))
+		dbManager.emails[email] = nickname
+		user.Email = params.Profile.Email
+	}
+	if params.Profile.About != "" {
+		user.About = params.Profile.About
+	}
+
+	return operations.NewUserUpdateOK().WithPayload(copyUser(user))
+}
+
+// UserLogin ...
+func (dbManager *ForumMemory) UserLogin(params operations.UserLoginParams) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	nickname := strings.ToLower(params.Nickname)
+	user, ok := dbManager.users[nickname]
+	if !checkPassword(dbManager.passwords[nickname], string(params.Credentials.Password)) || !ok {
+		return Unauthorized("Wrong nickname or password")
+	}
+
+	expires := strfmt.DateTime(time.Now().UTC().Add(SessionTTL))
+	token, err := dbManager.issueToken(nickname, &expires)
+	if err != nil {
+		return Internal(err)
+	}
+	return operations.NewUserLoginOK().WithPayload(&models.Token{Token: token, Nickname: user.Nickname, Expires: &expires})
+}
+
+// UserLogout ...
+func (dbManager *ForumMemory) UserLogout(params operations.UserLogoutParams, principal *models.Principal) middleware.Responder {
+	if !isPrincipal(principal, params.Nickname) {
+		return Forbidden("Only %s can log out", params.Nickname)
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	delete(dbManager.tokens, tokenHash(BearerToken(params.HTTPRequest.Header.Get("Authorization"))))
+	return operations.NewUserLogoutOK()
+}
+
+// UserTokenCreate ...
+func (dbManager *ForumMemory) UserTokenCreate(params operations.UserTokenCreateParams, principal *models.Principal) middleware.Responder {
+	if !isPrincipal(principal, params.Nickname) {
+		return Forbidden("Tokens of %s can be issued only to its owner", params.Nickname)
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	nickname := strings.ToLower(params.Nickname)
+	user, ok := dbManager.users[nickname]
+	if !ok {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	token, err := dbManager.issueToken(nickname, nil)
+	if err != nil {
+		return Internal(err)
+	}
+	return operations.NewUserTokenCreateCreated().WithPayload(&models.Token{Token: token, Nickname: user.Nickname})
+}
+
+// Authenticate ...
+func (dbManager *ForumMemory) Authenticate(token string) (*models.Principal, error) {
+	if token == "" {
+		return nil, Unauthorized("Authorization token is required")
+	}
+
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	stored, ok := dbManager.tokens[tokenHash(token)]
+	if !ok || stored.expires != nil && !time.Time(*stored.expires).After(time.Now()) {
+		return nil, Unauthorized("Token is invalid or expired")
+	}
+	return &models.Principal{Nickname: dbManager.users[stored.nickname].Nickname}, nil
+}
+
+// BootstrapAdmins ...
+func (dbManager *ForumMemory) BootstrapAdmins(ctx context.Context, password string) *Error {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	for _, admin := range Admins {
+		nickname := strings.ToLower(admin)
+		if _, ok := dbManager.users[nickname]; ok && checkPassword(dbManager.passwords[nickname], password) {
+			continue
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			return Internal(err)
+		}
+
+		if _, ok := dbManager.users[nickname]; !ok {
+			email := adminEmail(nickname)
+			dbManager.users[nickname] = &models.User{Nickname: admin, Fullname: admin, Email: strfmt.Email(email)}
+			dbManager.emails[email] = nickname
+		}
+		dbManager.passwords[nickname] = hash
+		// Whoever registered the nickname before it became an administrator loses the sessions
+		for key, token := range dbManager.tokens {
+			if token.nickname == nickname {
+				delete(dbManager.tokens, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (dbManager *ForumMemory) issueToken(nickname string, expires *strfmt.DateTime) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	dbManager.tokens[tokenHash(token)] = memoryToken{nickname: nickname, expires: expires}
+	return token, nil
+}
+
+// ForumSearch ...
+func (dbManager *ForumMemory) ForumSearch(params operations.ForumSearchParams) middleware.Responder {
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("forumSearch", strings.ToLower(params.Slug), params.Q, desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+
+	results := dbManager.search(forum, params.Q, params.Limit, params.Since, after, desc)
+	response := operations.NewForumSearchOK().WithPayload(results)
+	if params.Limit != nil && len(results) == int(*params.Limit) {
+		response.WithXNextCursor(searchCursor(scope, results[len(results)-1]).encode())
+	}
+	return response
+}
+
+// Search ...
+func (dbManager *ForumMemory) Search(params operations.SearchParams) middleware.Responder {
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("search", params.Q, desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	results := dbManager.search(nil, params.Q, params.Limit, params.Since, after, desc)
+	response := operations.NewSearchOK().WithPayload(results)
+	if params.Limit != nil && len(results) == int(*params.Limit) {
+		response.WithXNextCursor(searchCursor(scope, results[len(results)-1]).encode())
+	}
+	return response
+}
+
+// searchRank counts occurrences of the query words in text, it is zero unless every word is found.
+func searchRank(text string, words []string) float32 {
+	text = strings.ToLower(text)
+	rank := 0
+	for _, word := range words {
+		count := strings.Count(text, word)
+		if count == 0 {
+			return 0
+		}
+		rank += count
+	}
+	return float32(rank)
+}
+
+func searchSnippet(text string) string {
+	if runes := []rune(text); len(runes) > 200 {
+		return string(runes[:200])
+	}
+	return text
+}
+
+func (dbManager *ForumMemory) search(forum *memoryForum, q string, limit *int32, since *strfmt.DateTime, after *cursor, isDesc bool) models.SearchResults {
+	words := strings.Fields(strings.ToLower(q))
+	skip := func(created *strfmt.DateTime, kind string, id int64) bool {
+		if after != nil {
+			return !after.afterSearchResult(time.Time(*created), kind, id, isDesc)
+		}
+		if since == nil {
+			return false
+		}
+		if isDesc {
+			return time.Time(*created).After(time.Time(*since))
+		}
+		return time.Time(*created).Before(time.Time(*since))
+	}
+
+	posts := models.SearchResults{}
+	for _, post := range dbManager.posts {
+		if post.IsDeleted || dbManager.deletedThreads[post.Thread] || forum != nil && post.Forum != forum.Slug || skip(post.Created, searchResultPost, post.ID) {
+			continue
+		}
+		if rank := searchRank(post.Message, words); rank > 0 {
+			posts = append(posts, &models.SearchResult{
+				Type: searchResultPost, Rank: rank, Snippet: searchSnippet(post.Message), Post: copyPost(post)})
+		}
+	}
+	threads := models.SearchResults{}
+	for _, thread := range dbManager.threads {
+		if dbManager.deletedThreads[thread.ID] || forum != nil && thread.Forum != forum.Slug || skip(thread.Created, searchResultThread, int64(thread.ID)) {
+			continue
+		}
+		if rank := searchRank(thread.Title+" "+thread.Message, words); rank > 0 {
+			threads = append(threads, &models.SearchResult{
+				Type: searchResultThread, Rank: rank, Snippet: searchSnippet(thread.Title + ": " + thread.Message), Thread: copyThread(thread)})
+		}
+	}
+
+	for _, results := range []models.SearchResults{posts, threads} {
+		results := results
+		sort.SliceStable(results, func(i, j int) bool {
+			a, b := searchResultCreated(results[i]), searchResultCreated(results[j])
+			if !a.Equal(b) {
+				return a.After(b) == isDesc
+			}
+			return (searchResultID(results[i]) < searchResultID(results[j])) != isDesc
+		})
+	}
+
+	maxResults := -1
+	if limit != nil {
+		maxResults = int(*limit)
+	}
+	return mergeSearchResults(posts, threads, isDesc, maxResults)
+}
+
+// publish queues webhook deliveries of events and sends them to subscribers, the caller holds the write lock.
+func (dbManager *ForumMemory) publish(events ...*models.ForumEvent) {
+	now := strfmt.DateTime(time.Now().UTC())
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			panic(err)
+		}
+		for _, webhook := range dbManager.webhooks {
+			if webhook == nil || !strings.EqualFold(webhook.Forum, event.Forum) {
+				continue
+			}
+			dbManager.deliveries = append(dbManager.deliveries, &memoryDelivery{
+				WebhookDelivery: models.WebhookDelivery{
+					ID:          int64(len(dbManager.deliveries) + 1),
+					Webhook:     webhook.ID,
+					Event:       event,
+					Status:      DeliveryPending,
+					Created:     &now,
+					NextAttempt: &now,
+				},
+				payload: payload,
+			})
+		}
+	}
+	dbManager.events.publish(events...)
+	dbManager.worker.notify()
+}
+
+// ForumWebhookCreate ...
+func (dbManager *ForumMemory) ForumWebhookCreate(params operations.ForumWebhookCreateParams, principal *models.Principal) middleware.Responder {
+	if err := checkWebhookURL(params.Webhook.URL); err != nil {
+		return err
+	}
+	key, keyErr := newIdempotency(params.IdempotencyKey, "forumWebhookCreate", principal, params.Slug, params.Webhook)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if replayed := dbManager.replay(key); replayed != nil {
+		return replayed
+	}
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+	if !can(dbManager.forumRole(principal, forum.Slug), permWebhooks) {
+		return Forbidden("Only the owner of forum %s can manage its webhooks", forum.Slug)
+	}
+
+	secret, err := newToken()
+	if err != nil {
+		return Internal(err)
+	}
+	now := strfmt.DateTime(time.Now().UTC())
+	webhook := &models.Webhook{
+		ID:      int64(len(dbManager.webhooks) + 1),
+		Forum:   forum.Slug,
+		URL:     params.Webhook.URL,
+		Secret:  secret,
+		Creator: principal.Nickname,
+		Created: &now,
+	}
+	dbManager.webhooks = append(dbManager.webhooks, webhook)
+
+	// The secret is shown once, retries get the webhook without it
+	result, redacted := *webhook, *webhook
+	redacted.Secret = ""
+	if err := dbManager.remember(key, http.StatusCreated, &redacted); err != nil {
+		return err
+	}
+	return operations.NewForumWebhookCreateCreated().WithPayload(&result)
+}
+
+// ForumGetWebhooks ...
+func (dbManager *ForumMemory) ForumGetWebhooks(params operations.ForumGetWebhooksParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	forum, ok := dbManager.forums[strings.ToLower(params.Slug)]
+	if !ok {
+		return NotFound("Can't find forum with slug %s", params.Slug)
+	}
+	if !can(dbManager.forumRole(principal, forum.Slug), permWebhooks) {
+		return Forbidden("Only the owner of forum %s can manage its webhooks", forum.Slug)
+	}
+
+	webhooks := models.Webhooks{}
+	for _, webhook := range dbManager.webhooks {
+		if webhook != nil && webhook.Forum == forum.Slug {
+			webhooks = append(webhooks, copyWebhook(webhook))
+		}
+	}
+	return operations.NewForumGetWebhooksOK().WithPayload(webhooks)
+}
+
+// webhook finds the webhook with id, when principal may manage it.
+func (dbManager *ForumMemory) webhook(principal *models.Principal, id int64) (*models.Webhook, *Error) {
+	if id <= 0 || id > int64(len(dbManager.webhooks)) || dbManager.webhooks[id-1] == nil {
+		return nil, NotFound("Can't find webhook with id %d", id)
+	}
+	webhook := dbManager.webhooks[id-1]
+	if !can(dbManager.forumRole(principal, webhook.Forum), permWebhooks) {
+		return nil, Forbidden("Only the owner of forum %s can manage its webhooks", webhook.Forum)
+	}
+	return webhook, nil
+}
+
+// WebhookDelete ... deliveries of a removed webhook are never leased again
+func (dbManager *ForumMemory) WebhookDelete(params operations.WebhookDeleteParams, principal *models.Principal) middleware.Responder {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	webhook, err := dbManager.webhook(principal, params.ID)
+	if err != nil {
+		return err
+	}
+	dbManager.webhooks[webhook.ID-1] = nil
+	return operations.NewWebhookDeleteOK().WithPayload(copyWebhook(webhook))
+}
+
+// WebhookDeliveries ...
+func (dbManager *ForumMemory) WebhookDeliveries(params operations.WebhookDeliveriesParams, principal *models.Principal) middleware.Responder {
+	scope := cursorScope("webhookDeliveries", params.ID)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+	if after != nil {
+		params.Since = &after.ID
+	}
+
+	dbManager.mu.RLock()
+	defer dbManager.mu.RUnlock()
+
+	if _, err := dbManager.webhook(principal, params.ID); err != nil {
+		return err
+	}
+
+	deliveries := models.WebhookDeliveries{}
+	for _, delivery := range dbManager.deliveries {
+		if params.Limit != nil && len(deliveries) >= int(*params.Limit) {
+			break
+		}
+		if delivery.Webhook != params.ID || params.Since != nil && delivery.ID <= *params.Since {
+			continue
+		}
+		deliveries = append(deliveries, copyDelivery(delivery))
+	}
+
+	response := operations.NewWebhookDeliveriesOK().WithPayload(deliveries)
+	if params.Limit != nil && len(deliveries) == int(*params.Limit) {
+		response.WithXNextCursor(cursor{Scope: scope, ID: deliveries[len(deliveries)-1].ID}.encode())
+	}
+	return response
+}
+
+// leaseDeliveries ...
+func (dbManager *ForumMemory) leaseDeliveries(now time.Time, limit int) ([]webhookJob, error) {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	due := []*memoryDelivery{}
+	for _, delivery := range dbManager.deliveries {
+		if delivery.Status == DeliveryPending && dbManager.webhooks[delivery.Webhook-1] != nil &&
+			!time.Time(*delivery.NextAttempt).After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return time.Time(*due[i].NextAttempt).Before(time.Time(*due[j].NextAttempt))
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	jobs := []webhookJob{}
+	lease := strfmt.DateTime(now.Add(webhookLease()))
+	for _, delivery := range due {
+		webhook := dbManager.webhooks[delivery.Webhook-1]
+		delivery.Attempts++
+		delivery.NextAttempt = &lease
+		jobs = append(jobs, webhookJob{ID: delivery.ID, URL: webhook.URL, Secret: webhook.Secret, Payload: delivery.payload, Attempts: delivery.Attempts})
+	}
+	return jobs, nil
+}
+
+// completeDelivery ...
+func (dbManager *ForumMemory) completeDelivery(job webhookJob, result webhookResult) error {
+	dbManager.mu.Lock()
+	defer dbManager.mu.Unlock()
+
+	if job.ID > int64(len(dbManager.deliveries)) {
+		// The storage was cleared during the attempt
+		return nil
+	}
+	delivery := dbManager.deliveries[job.ID-1]
+	nextAttempt := strfmt.DateTime(result.NextAttempt)
+	delivery.Status, delivery.ResponseStatus, delivery.Error, delivery.NextAttempt = result.Status, result.Response, result.Error, &nextAttempt
+	if result.Delivered != nil {
+		delivered := strfmt.DateTime(*result.Delivered)
+		delivery.Delivered = &delivered
+	}
+	return nil
+}
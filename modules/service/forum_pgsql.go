@@ -1,21 +1,26 @@
 package service
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/couatl/forum-db-api/models"
 	"github.com/couatl/forum-db-api/restapi/operations"
 	"github.com/go-openapi/runtime/middleware"
+	"github.com/go-openapi/strfmt"
+	"github.com/jmoiron/sqlx"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-const (
-	ERR_NOT_FOUND      = "Can't find!"
-	ERR_ALREADY_EXISTS = "Already exists!"
-	ERR                = "An error occured!"
-)
+// postTombstone replaces the message of a deleted post
+const postTombstone = "[deleted]"
 
 type ID struct {
 	ID int64 `db:"id"`
@@ -26,143 +31,295 @@ type userID struct {
 	Nickname string `db:"nickname"`
 }
 
+type userCredentials struct {
+	ID           int64          `db:"id"`
+	Nickname     string         `db:"nickname"`
+	PasswordHash sql.NullString `db:"password_hash"`
+}
+
 type forumID struct {
 	ID   int64  `db:"id"`
 	Slug string `db:"slug"`
 }
 
+type forumRoleRow struct {
+	Owner  string         `db:"owner"`
+	Role   sql.NullString `db:"role"`
+	Banned bool           `db:"banned"`
+}
+
+type banRow struct {
+	ID int64 `db:"id"`
+	models.Ban
+}
+
+type deliveryRow struct {
+	models.WebhookDelivery
+	Payload string `db:"payload"`
+}
+
+type leasedDelivery struct {
+	ID       int64  `db:"id"`
+	Webhook  int64  `db:"webhook_id"`
+	Payload  string `db:"payload"`
+	Attempts int32  `db:"attempts"`
+}
+
+type postSearchRow struct {
+	models.Post
+	Rank    float32 `db:"rank"`
+	Snippet string  `db:"snippet"`
+}
+
+type threadSearchRow struct {
+	models.Thread
+	Rank    float32 `db:"rank"`
+	Snippet string  `db:"snippet"`
+}
+
 type ForumPgSQL struct {
 	ForumGeneric
 }
 
 func NewForumPgSQL(dataSourceName string) ForumHandler {
-	return ForumPgSQL{ForumGeneric: NewForumGeneric("postgres", dataSourceName)}
+	dbManager := ForumPgSQL{ForumGeneric: NewForumGeneric("postgres", dataSourceName)}
+	dbManager.listen(dataSourceName)
+	dbManager.webhooks = startWebhooks(dbManager, dbManager.logger)
+	return dbManager
 }
 
 //Clear ... OK
-func (dbManager ForumPgSQL) Clear(params operations.ClearParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+func (dbManager ForumPgSQL) Clear(params operations.ClearParams, principal *models.Principal) middleware.Responder {
+	if err := authorizeClear(principal); err != nil {
+		return err
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "clear")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
 	defer tx.Rollback()
 
-	_, err := tx.Exec(`TRUNCATE TABLE forums, threads, users, posts CASCADE`)
-	check(err)
-	check(tx.Commit())
+	if _, err := tx.ExecContext(ctx, `TRUNCATE TABLE forums, threads, posts, idempotency_keys CASCADE`); err != nil {
+		return dbError(ctx, err)
+	}
+	// Accounts of administrators are kept with their tokens, everything else of users goes by cascade
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE lower(nickname) <> ALL($1)`, pq.Array(adminNicknames())); err != nil {
+		return dbError(ctx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
 
 	return operations.NewClearOK()
 }
 
 //ForumCreate ... OK OK
 func (dbManager ForumPgSQL) ForumCreate(params operations.ForumCreateParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+	key, keyErr := newIdempotency(params.IdempotencyKey, "forumCreate", nil, params.Forum)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumCreate")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if replayed := dbManager.replay(ctx, tx, key); replayed != nil {
+		return replayed
+	}
 
 	user := models.User{}
 	forum := models.Forum{}
-	err := tx.Get(&user, `SELECT nickname FROM users WHERE lower(nickname) = lower($1)`, params.Forum.User)
-
+	err = tx.GetContext(ctx, &user, `SELECT nickname FROM users WHERE lower(nickname) = lower($1)`, params.Forum.User)
 	if err != nil {
-		tx.Rollback()
-		return operations.NewForumCreateNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", params.Forum.User)
 	}
 
-	errAlreadyExists := tx.Get(&forum, `SELECT posts, slug, threads, title, author as user
+	errAlreadyExists := tx.GetContext(ctx, &forum, `SELECT posts, slug, threads, title, author as user
 		FROM forums WHERE lower(slug) = lower($1)`, params.Forum.Slug)
 
 	if errAlreadyExists == nil {
-		tx.Rollback()
 		return operations.NewForumCreateConflict().WithPayload(&forum)
 	}
+	if errAlreadyExists != sql.ErrNoRows {
+		return dbError(ctx, errAlreadyExists)
+	}
 
-	tx.Get(&forum, `INSERT INTO forums (slug, author, title)
+	err = tx.GetContext(ctx, &forum, `INSERT INTO forums (slug, author, title)
 		VALUES ($1, $2, $3) RETURNING slug, title, posts, threads, author as user`,
 		params.Forum.Slug, user.Nickname, params.Forum.Title)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := dbManager.remember(ctx, tx, key, http.StatusCreated, &forum); err != nil {
+		return err
+	}
 
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
 	return operations.NewForumCreateCreated().WithPayload(&forum)
 }
 
 //ForumGetOne ... OK OK
 func (dbManager ForumPgSQL) ForumGetOne(params operations.ForumGetOneParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumGetOne")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
 
 	forum := models.Forum{}
-	err := tx.Get(&forum, `SELECT slug, title, author as user, threads, posts
+	err = tx.GetContext(ctx, &forum, `SELECT slug, title, author as user, threads, posts
 		FROM forums
 		WHERE lower(slug) = lower($1)`, params.Slug)
-
 	if err != nil {
-		tx.Rollback()
-		return operations.NewForumGetOneNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
 	}
 
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
 	return operations.NewForumGetOneOK().WithPayload(&forum)
 }
 
 //ForumGetThreads ... OK
 func (dbManager ForumPgSQL) ForumGetThreads(params operations.ForumGetThreadsParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("forumGetThreads", strings.ToLower(params.Slug), desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumGetThreads")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
 
 	forum := forumID{}
 	threads := models.Threads{}
 
-	err := tx.Get(&forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
 	if err != nil {
-		tx.Rollback()
-		return operations.NewForumGetThreadsNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
 	}
 
-	query := `SELECT id, forum, author, created, message, slug, title, votes FROM threads WHERE threads.forum_id = $1 `
+	query := `SELECT id, forum, author, created, message, slug, title, votes, locked, pinned FROM threads
+	WHERE threads.forum_id = $1 AND threads.deleted_at IS NULL`
 
-	desc := params.Desc != nil && *params.Desc
-	if params.Since != nil {
-		if desc {
-			query += ` AND threads.created <= $2`
-		} else {
-			query += ` AND threads.created >= $2`
-		}
+	args := []interface{}{forum.ID}
+	cmp := ">"
+	if desc {
+		cmp = "<"
+	}
+	if after != nil {
+		args = append(args, after.Pinned, dbManager.timeParam(after.created()), after.ID)
+		query += ` AND (threads.pinned < $2 OR threads.pinned = $2 AND (threads.created ` + cmp + ` $3
+			OR threads.created = $3 AND threads.id ` + cmp + ` $4))`
+	} else if params.Since != nil {
+		args = append(args, *params.Since)
+		query += ` AND threads.created ` + cmp + `= $2`
 	}
-	query += ` ORDER BY threads.created`
+	// Pinned threads go first regardless of the direction, id tells apart threads created at once
+	query += ` ORDER BY threads.pinned DESC, threads.created`
 	if desc {
-		query += ` DESC`
+		query += ` DESC, threads.id DESC`
+	} else {
+		query += `, threads.id`
 	}
 	if params.Limit != nil {
 		query += ` LIMIT ` + strconv.FormatInt(int64(*params.Limit), 10)
 	}
 
-	if params.Since != nil {
-		tx.Select(&threads, query, forum.ID, *params.Since)
-	} else {
-		tx.Select(&threads, query, forum.ID)
+	if err := tx.SelectContext(ctx, &threads, query, args...); err != nil {
+		return dbError(ctx, err)
 	}
 
-	tx.Commit()
-	return operations.NewForumGetThreadsOK().WithPayload(threads)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	response := operations.NewForumGetThreadsOK().WithPayload(threads)
+	if params.Limit != nil && len(threads) == int(*params.Limit) {
+		response.WithXNextCursor(threadCursor(scope, threads[len(threads)-1]).encode())
+	}
+	return response
+}
+
+// ForumGetThreadsAtom ...
+func (dbManager ForumPgSQL) ForumGetThreadsAtom(params operations.ForumGetThreadsAtomParams) middleware.Responder {
+	return forumFeed(dbManager, params.HTTPRequest, params.Slug, params.Limit, FeedAtom)
+}
+
+// ForumGetThreadsRss ...
+func (dbManager ForumPgSQL) ForumGetThreadsRss(params operations.ForumGetThreadsRssParams) middleware.Responder {
+	return forumFeed(dbManager, params.HTTPRequest, params.Slug, params.Limit, FeedRSS)
 }
 
 //ForumGetUsers ...
 func (dbManager ForumPgSQL) ForumGetUsers(params operations.ForumGetUsersParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("forumGetUsers", strings.ToLower(params.Slug), desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+	if after != nil {
+		params.Since = &after.Key
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumGetUsers")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
 
 	forum := forumID{}
 	users := models.Users{}
 
-	err := tx.Get(&forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
 	if err != nil {
-		tx.Rollback()
-		return operations.NewForumGetUsersNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
 	}
 
 	query := `SELECT about, email, fullname, nickname FROM users
 	WHERE users.id IN (SELECT author_id FROM forum_users WHERE forum_id = $1)`
 
-	desc := params.Desc != nil && *params.Desc
+	args := []interface{}{forum.ID}
 	if params.Since != nil {
+		args = append(args, *params.Since)
 		if desc {
 			query += ` AND lower(users.nickname) < lower($2)`
 		} else {
 			query += ` AND lower(users.nickname) > lower($2)`
 		}
 	}
+	if params.ExcludeBanned != nil && *params.ExcludeBanned {
+		args = append(args, strfmt.DateTime(time.Now().UTC()))
+		query += ` AND NOT EXISTS (SELECT 1 FROM bans WHERE bans.user_id = users.id
+			AND (bans.forum_id = $1 OR bans.forum_id IS NULL)
+			AND (bans.expires_at IS NULL OR bans.expires_at > $` + strconv.Itoa(len(args)) + `))`
+	}
 	query += ` ORDER BY lower(users.nickname)`
 	if desc {
 		query += ` DESC`
@@ -171,606 +328,2317 @@ func (dbManager ForumPgSQL) ForumGetUsers(params operations.ForumGetUsersParams)
 		query += ` LIMIT ` + strconv.FormatInt(int64(*params.Limit), 10)
 	}
 
-	if params.Since != nil {
-		errUnexpected := tx.Select(&users, query, forum.ID, *params.Since)
-		if errUnexpected != nil {
-			log.Println(errUnexpected)
-			tx.Rollback()
-			return operations.NewForumGetUsersNotFound().WithPayload(&models.Error{Message: ERR})
-		}
-	} else {
-		errUnexpected := tx.Select(&users, query, forum.ID)
-		if errUnexpected != nil {
-			log.Println(errUnexpected)
-			tx.Rollback()
-			return operations.NewForumGetUsersNotFound().WithPayload(&models.Error{Message: ERR})
-		}
+	if err := tx.SelectContext(ctx, &users, query, args...); err != nil {
+		return dbError(ctx, err)
 	}
 
-	tx.Commit()
-	return operations.NewForumGetUsersOK().WithPayload(users)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	response := operations.NewForumGetUsersOK().WithPayload(users)
+	if params.Limit != nil && len(users) == int(*params.Limit) {
+		response.WithXNextCursor(cursor{Scope: scope, Key: users[len(users)-1].Nickname}.encode())
+	}
+	return response
 }
 
-// PostGetOne ... OK
-func (dbManager ForumPgSQL) PostGetOne(params operations.PostGetOneParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+// ForumGetRoles ...
+func (dbManager ForumPgSQL) ForumGetRoles(params operations.ForumGetRolesParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumGetRoles")
+	defer cancel()
 
-	post := models.Post{}
-	postFull := models.PostFull{}
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
 
-	err := tx.Get(&post, `SELECT id, forum, thread, author, created, is_edited as isEdited,
-		message, parent FROM posts WHERE id = $1`, params.ID)
+	forum := forumID{}
+	roles := models.ForumRoles{}
 
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
 	if err != nil {
-		tx.Rollback()
-		return operations.NewPostGetOneNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
 	}
 
-	postFull.Post = &post
+	err = tx.SelectContext(ctx, &roles, `SELECT users.nickname, forum_roles.role FROM forum_roles
+		JOIN users ON users.id = forum_roles.user_id
+		WHERE forum_roles.forum_id = $1
+		ORDER BY lower(users.nickname)`, forum.ID)
+	if err != nil {
+		return dbError(ctx, err)
+	}
 
-	for _, item := range params.Related {
-		if item == "user" {
-			user := models.User{}
-			errUnexpected := tx.Get(&user, `SELECT about, email, fullname, nickname
-				FROM users WHERE lower(nickname) = lower($1)`, post.Author)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewForumGetRolesOK().WithPayload(roles)
+}
 
-			if errUnexpected != nil {
-				log.Println(errUnexpected)
-				tx.Rollback()
-			}
-			postFull.Author = &user
-			continue
-		}
-		if item == "forum" {
-			forum := models.Forum{}
-			errUnexpected2 := tx.Get(&forum, `SELECT posts, threads, slug, title, author as user
-				FROM forums WHERE lower(slug) = lower($1)`, post.Forum)
+// ForumRoleSet ... member role is the absence of a row in forum_roles
+func (dbManager ForumPgSQL) ForumRoleSet(params operations.ForumRoleSetParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumRoleSet")
+	defer cancel()
 
-			if errUnexpected2 != nil {
-				log.Println(errUnexpected2)
-				tx.Rollback()
-			}
-			postFull.Forum = &forum
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
 
-			continue
-		}
-		if item == "thread" {
-			thread := models.Thread{}
-			errUnexpected3 := tx.Get(&thread, `SELECT forum, author, created, message, title, slug, id, votes FROM threads WHERE id = $1`, post.Thread)
+	forum := forumID{}
+	user := userID{}
 
-			if errUnexpected3 != nil {
-				log.Println(errUnexpected3)
-				tx.Rollback()
-			}
-			postFull.Thread = &thread
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+	err = tx.GetContext(ctx, &user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, params.Nickname)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", params.Nickname)
+	}
 
-			continue
-		}
+	role, err := dbManager.forumRole(ctx, tx, principal, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	current, err := dbManager.forumRole(ctx, tx, &models.Principal{Nickname: user.Nickname}, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !canAssign(role, current, params.Role.Role) {
+		return Forbidden("%s can't change role of %s from %s to %s in forum %s",
+			principal.Nickname, user.Nickname, current, params.Role.Role, forum.Slug)
 	}
 
-	tx.Commit()
-	return operations.NewPostGetOneOK().WithPayload(&postFull)
+	if params.Role.Role == RoleMember {
+		_, err = tx.ExecContext(ctx, `DELETE FROM forum_roles WHERE forum_id = $1 AND user_id = $2`, forum.ID, user.ID)
+	} else {
+		_, err = tx.ExecContext(ctx, `INSERT INTO forum_roles (forum_id, user_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (forum_id, user_id) DO UPDATE SET role = excluded.role`, forum.ID, user.ID, params.Role.Role)
+	}
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewForumRoleSetOK().WithPayload(&models.ForumRole{Nickname: user.Nickname, Role: params.Role.Role})
 }
 
-// PostUpdate OK
-func (dbManager ForumPgSQL) PostUpdate(params operations.PostUpdateParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+// forumRole resolves the role of principal in the forum with the given slug.
+func (dbManager ForumPgSQL) forumRole(ctx context.Context, tx *tracedTx, principal *models.Principal, forum string) (string, error) {
+	row := forumRoleRow{}
+	err := tx.GetContext(ctx, &row, `SELECT COALESCE(forums.author, '') AS owner, forum_roles.role,
+			EXISTS (SELECT 1 FROM bans WHERE bans.user_id = users.id
+				AND (bans.forum_id = forums.id OR bans.forum_id IS NULL)
+				AND (bans.expires_at IS NULL OR bans.expires_at > $3)) AS banned
+		FROM forums
+		LEFT JOIN users ON lower(users.nickname) = lower($2)
+		LEFT JOIN forum_roles ON forum_roles.forum_id = forums.id AND forum_roles.user_id = users.id
+		WHERE lower(forums.slug) = lower($1)`, forum, principal.Nickname, strfmt.DateTime(time.Now().UTC()))
+	if err != nil {
+		return "", err
+	}
+	return resolveRole(principal, row.Owner, row.Role.String, row.Banned), nil
+}
 
-	post := models.Post{}
+// selectBans joins bans with nicknames and slugs, forum is empty for site-wide bans.
+const selectBans = `SELECT bans.id, users.nickname, COALESCE(forums.slug, '') AS forum, bans.reason, bans.moderator,
+		bans.created, bans.expires_at AS expires
+	FROM bans
+	JOIN users ON users.id = bans.user_id
+	LEFT JOIN forums ON forums.id = bans.forum_id`
+
+// checkBan returns Forbidden when principal is banned in the forum with the given slug or site-wide.
+func (dbManager ForumPgSQL) checkBan(ctx context.Context, tx *tracedTx, principal *models.Principal, forum string) *Error {
+	if isAdmin(principal) {
+		return nil
+	}
 
-	err := tx.Get(&post, "SELECT id, forum, thread, created, author, is_edited as isEdited, message, parent FROM posts WHERE id = $1", params.ID)
+	ban := banRow{}
+	err := tx.GetContext(ctx, &ban, selectBans+`
+		WHERE lower(users.nickname) = lower($1) AND (bans.forum_id IS NULL OR lower(forums.slug) = lower($2))
+			AND (bans.expires_at IS NULL OR bans.expires_at > $3)
+		ORDER BY bans.forum_id IS NOT NULL, bans.id LIMIT 1`, principal.Nickname, forum, strfmt.DateTime(time.Now().UTC()))
+	if err == sql.ErrNoRows {
+		return nil
+	}
 	if err != nil {
-		tx.Rollback()
-		return operations.NewPostUpdateNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		return dbError(ctx, err)
 	}
+	return bannedError(&ban.Ban)
+}
 
-	if params.Post.Message != "" && params.Post.Message != post.Message {
-		err := tx.Get(&post, `UPDATE posts SET is_edited = true, message = $1
-			WHERE id = $2
-			RETURNING id, forum, thread, created, author, is_edited as isEdited, message, parent `, params.Post.Message, params.ID)
-		if err != nil {
-			tx.Rollback()
-			return operations.NewPostUpdateNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-		}
+// activeBan finds the ban of the user in force in the forum, forumID is nil for site-wide bans.
+func (dbManager ForumPgSQL) activeBan(ctx context.Context, tx *tracedTx, userID int64, forumID *int64) (*banRow, error) {
+	ban := banRow{}
+	query := selectBans + ` WHERE bans.user_id = $1 AND (bans.expires_at IS NULL OR bans.expires_at > $2)`
+	args := []interface{}{userID, strfmt.DateTime(time.Now().UTC())}
+	if forumID == nil {
+		query += ` AND bans.forum_id IS NULL`
+	} else {
+		query += ` AND bans.forum_id = $3`
+		args = append(args, *forumID)
 	}
-
-	tx.Commit()
-	return operations.NewPostUpdateOK().WithPayload(&post)
+	if err := tx.GetContext(ctx, &ban, query+` ORDER BY bans.id DESC LIMIT 1`, args...); err != nil {
+		return nil, err
+	}
+	return &ban, nil
 }
 
-// PostsCreate OK OK
-func (dbManager ForumPgSQL) PostsCreate(params operations.PostsCreateParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+// setBan replaces the active ban of the user, the previous one is lifted but kept.
+func (dbManager ForumPgSQL) setBan(ctx context.Context, tx *tracedTx, user userID, forum *forumID, ban *models.Ban, moderator string) (*models.Ban, error) {
+	now := strfmt.DateTime(time.Now().UTC())
+	var forumID *int64
+	result := models.Ban{Nickname: user.Nickname, Reason: ban.Reason, Moderator: moderator, Created: &now}
+	if forum != nil {
+		forumID, result.Forum = &forum.ID, forum.Slug
+	}
+	if ban.Expires != nil {
+		expires := strfmt.DateTime(time.Time(*ban.Expires).UTC())
+		result.Expires = &expires
+	}
 
-	thread := models.Thread{}
-	posts := []*models.Post{}
-	users := []userID{}
-	user := userID{}
+	if err := dbManager.liftBans(ctx, tx, user.ID, forumID, now); err != nil {
+		return nil, err
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO bans (user_id, forum_id, reason, moderator, created, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`, user.ID, forumID, result.Reason, moderator, now, result.Expires)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
 
-	forumID := ID{}
-	postID := ID{}
+// liftBans ends active bans of the user in the forum at now, forumID is nil for site-wide bans.
+func (dbManager ForumPgSQL) liftBans(ctx context.Context, tx *tracedTx, userID int64, forumID *int64, now strfmt.DateTime) error {
+	query := `UPDATE bans SET expires_at = $2 WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > $2)`
+	args := []interface{}{userID, now}
+	if forumID == nil {
+		query += ` AND forum_id IS NULL`
+	} else {
+		query += ` AND forum_id = $3`
+		args = append(args, *forumID)
+	}
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
 
-	slug, id := SlugID(params.SlugOrID)
+// ForumGetBans ...
+func (dbManager ForumPgSQL) ForumGetBans(params operations.ForumGetBansParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumGetBans")
+	defer cancel()
 
-	err := tx.Get(&thread, `SELECT id, slug, forum FROM threads WHERE lower(slug) = lower($1) OR id = $2`, slug, id)
+	tx, err := dbManager.begin(ctx)
 	if err != nil {
-		tx.Rollback()
-		return operations.NewPostsCreateNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		return dbError(ctx, err)
 	}
+	defer tx.Rollback()
 
-	if len(params.Posts) == 0 {
-		tx.Commit()
-		return operations.NewPostsCreateCreated().WithPayload(params.Posts)
-	}
+	forum := forumID{}
+	rows := []banRow{}
 
-	checkParent := "SELECT id FROM posts WHERE thread = $1 AND id = $2"
-	checkUser := "SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)"
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
 
-	insertPosts := `INSERT INTO posts (forum, thread, author, message, parent) VALUES
-	($1, $2, $3, $4, $5) RETURNING author, created, forum, id, is_edited as isEdited, message, thread, parent;`
+	err = tx.SelectContext(ctx, &rows, selectBans+`
+		WHERE bans.forum_id = $1 AND (bans.expires_at IS NULL OR bans.expires_at > $2)
+		ORDER BY lower(users.nickname)`, forum.ID, strfmt.DateTime(time.Now().UTC()))
+	if err != nil {
+		return dbError(ctx, err)
+	}
 
-	stmtParent, errNotFound := tx.Preparex(checkParent)
-	stmtUser, errUserNotFound := tx.Preparex(checkUser)
-	stmtInsertPosts, errAlreadyExists := tx.Preparex(insertPosts)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
 
-	tx.Get(&forumID, "UPDATE forums SET posts = posts + $1 WHERE slug = $2 RETURNING id", len(params.Posts), thread.Forum)
+	bans := models.Bans{}
+	for idx := range rows {
+		bans = append(bans, &rows[idx].Ban)
+	}
+	return operations.NewForumGetBansOK().WithPayload(bans)
+}
 
-	for _, item := range params.Posts {
-		post := models.Post{}
+// ForumBanSet ...
+func (dbManager ForumPgSQL) ForumBanSet(params operations.ForumBanSetParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumBanSet")
+	defer cancel()
 
-		errUserNotFound = stmtUser.Get(&user, item.Author)
-		if errUserNotFound != nil {
-			tx.Rollback()
-			return operations.NewPostsCreateNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-		}
-		users = append(users, user)
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
 
-		if item.Parent != 0 {
-			errNotFound = stmtParent.Get(&postID, thread.ID, item.Parent)
-			if errNotFound != nil {
-				tx.Rollback()
-				return operations.NewPostsCreateConflict().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-			}
-		}
+	forum := forumID{}
+	user := userID{}
 
-		errAlreadyExists = stmtInsertPosts.Get(&post, thread.Forum, thread.ID, user.Nickname, item.Message, item.Parent)
-		if errAlreadyExists != nil {
-			tx.Rollback()
-			return operations.NewPostsCreateConflict().WithPayload(&models.Error{Message: ERR_ALREADY_EXISTS})
-		}
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+	err = tx.GetContext(ctx, &user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, params.Nickname)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", params.Nickname)
+	}
 
-		posts = append(posts, &post)
+	role, err := dbManager.forumRole(ctx, tx, principal, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	current, err := dbManager.forumRole(ctx, tx, &models.Principal{Nickname: user.Nickname}, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !canAssign(role, current, RoleBanned) {
+		return Forbidden("%s can't ban %s in forum %s", principal.Nickname, user.Nickname, forum.Slug)
 	}
 
-	insertForumUsers := "INSERT INTO forum_users (author_id, forum_id) VALUES"
-	for idx, _ := range params.Posts {
-		if idx > 0 {
-			insertForumUsers += ","
-		}
-		insertForumUsers += " (" + strconv.FormatInt(users[idx].ID, 10) + ", " + strconv.FormatInt(forumID.ID, 10) + ") "
+	ban, err := dbManager.setBan(ctx, tx, user, &forum, params.Ban, principal.Nickname)
+	if err != nil {
+		return dbError(ctx, err)
 	}
-	insertForumUsers += " ON CONFLICT(author_id, forum_id) DO NOTHING;"
-	tx.MustExec(insertForumUsers)
 
-	tx.Commit()
-	return operations.NewPostsCreateCreated().WithPayload(models.Posts(posts))
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewForumBanSetOK().WithPayload(ban)
 }
 
-// Status ... OK
-func (dbManager ForumPgSQL) Status(params operations.StatusParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+// ForumBanDelete ...
+func (dbManager ForumPgSQL) ForumBanDelete(params operations.ForumBanDeleteParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumBanDelete")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
 	defer tx.Rollback()
 
-	status := models.Status{}
+	forum := forumID{}
+	user := userID{}
+
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !can(role, permModerate) {
+		return Forbidden("Only moderators of forum %s can lift bans", forum.Slug)
+	}
 
-	err := tx.Get(&status, `SELECT (SELECT COUNT(forums.*) FROM forums) as forum,
-	(SELECT COUNT(threads.*) FROM threads) as thread,
-	(SELECT COUNT(posts.*) FROM posts) as post,
-	(SELECT COUNT(users.*) FROM users) as user`)
+	err = tx.GetContext(ctx, &user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, params.Nickname)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", params.Nickname)
+	}
+	ban, err := dbManager.activeBan(ctx, tx, user.ID, &forum.ID)
+	if err != nil {
+		return notFoundOr(ctx, err, "User %s is not banned in forum %s", user.Nickname, forum.Slug)
+	}
 
-	check(err)
-	check(tx.Commit())
+	now := strfmt.DateTime(time.Now().UTC())
+	if err := dbManager.liftBans(ctx, tx, user.ID, &forum.ID, now); err != nil {
+		return dbError(ctx, err)
+	}
+	ban.Expires = &now
 
-	return operations.NewStatusOK().WithPayload(&status)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewForumBanDeleteOK().WithPayload(&ban.Ban)
 }
 
-// ThreadCreate ... OK OK
-func (dbManager ForumPgSQL) ThreadCreate(params operations.ThreadCreateParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+// UserBan ...
+func (dbManager ForumPgSQL) UserBan(params operations.UserBanParams, principal *models.Principal) middleware.Responder {
+	if !can(resolveRole(principal, "", "", false), permBanGlobal) {
+		return Forbidden("Only administrators can ban users site-wide")
+	}
+	if isAdmin(&models.Principal{Nickname: params.Nickname}) {
+		return Forbidden("Administrator %s can't be banned", params.Nickname)
+	}
 
-	thread := models.Thread{}
-	forum := forumID{}
-	user := userID{}
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "userBan")
+	defer cancel()
 
-	errNotFound := tx.Get(&forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
-	errNotFound2 := tx.Get(&user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, params.Thread.Author)
-	if errNotFound != nil || errNotFound2 != nil {
-		tx.Rollback()
-		return operations.NewThreadCreateNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
 	}
+	defer tx.Rollback()
 
-	if params.Thread.Slug != "" {
-		errAlreadyExists := tx.Get(&thread, `SELECT forum, author, created, message, title, slug, id, votes FROM threads WHERE lower(slug) = lower($1)`, params.Thread.Slug)
-		if errAlreadyExists == nil {
-			tx.Rollback()
-			return operations.NewThreadCreateConflict().WithPayload(&thread)
-		}
+	user := userID{}
+	err = tx.GetContext(ctx, &user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, params.Nickname)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", params.Nickname)
 	}
 
-	err := tx.Get(&thread, `INSERT INTO threads (forum, author, created, message, title, slug, forum_id, author_id)
-	VALUES ($1, $2, COALESCE($3, now()), $4, $5, $6, $7, $8) RETURNING forum, author, created, message, title, slug, id, votes`,
-		forum.Slug, user.Nickname, params.Thread.Created, params.Thread.Message, params.Thread.Title, params.Thread.Slug, forum.ID, user.ID)
+	ban, err := dbManager.setBan(ctx, tx, user, nil, params.Ban, principal.Nickname)
 	if err != nil {
-		log.Println(err)
-		tx.Rollback()
-		return operations.NewThreadCreateNotFound().WithPayload(&models.Error{Message: ERR})
+		return dbError(ctx, err)
 	}
 
-	tx.MustExec("UPDATE forums SET threads = threads + 1 WHERE id = $1", forum.ID)
-	tx.MustExec("INSERT INTO forum_users (author_id, forum_id) VALUES ($1, $2) ON CONFLICT(forum_id, author_id) DO NOTHING", user.ID, forum.ID)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewUserBanOK().WithPayload(ban)
+}
 
-	tx.Commit()
-	return operations.NewThreadCreateCreated().WithPayload(&thread)
-}
-
-// ThreadGetOne ... OK
-func (dbManager ForumPgSQL) ThreadGetOne(params operations.ThreadGetOneParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+// UserUnban ...
+func (dbManager ForumPgSQL) UserUnban(params operations.UserUnbanParams, principal *models.Principal) middleware.Responder {
+	if !can(resolveRole(principal, "", "", false), permBanGlobal) {
+		return Forbidden("Only administrators can lift site-wide bans")
+	}
 
-	thread := models.Thread{}
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "userUnban")
+	defer cancel()
 
-	slug, id := SlugID(params.SlugOrID)
-	querySlugID := `SELECT forum, author, created, message, title, slug, id, votes FROM threads WHERE `
-	if id == -1 {
-		querySlugID += ` lower(slug) = lower($1)`
-		errNotFound := tx.Get(&thread, querySlugID, slug)
-		if errNotFound != nil {
-			tx.Rollback()
-			return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-		}
-	} else {
-		querySlugID += ` id = $1`
-		errNotFound := tx.Get(&thread, querySlugID, id)
-		if errNotFound != nil {
-			tx.Rollback()
-			return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-		}
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
 	}
+	defer tx.Rollback()
 
-	tx.Commit()
-	return operations.NewThreadGetOneOK().WithPayload(&thread)
-}
-
-// ThreadGetPosts ... !OPTIMIZ
-func (dbManager ForumPgSQL) ThreadGetPosts(params operations.ThreadGetPostsParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+	user := userID{}
+	err = tx.GetContext(ctx, &user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, params.Nickname)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", params.Nickname)
+	}
+	ban, err := dbManager.activeBan(ctx, tx, user.ID, nil)
+	if err != nil {
+		return notFoundOr(ctx, err, "User %s is not banned site-wide", user.Nickname)
+	}
 
-	threadID := ID{}
-	posts := models.Posts{}
+	now := strfmt.DateTime(time.Now().UTC())
+	if err := dbManager.liftBans(ctx, tx, user.ID, nil, now); err != nil {
+		return dbError(ctx, err)
+	}
+	ban.Expires = &now
 
-	slug, id := SlugID(params.SlugOrID)
-	querySlugID := `SELECT id FROM threads WHERE `
-	if id == -1 {
-		querySlugID += ` lower(slug) = lower($1)`
-		errNotFound := tx.Get(&threadID, querySlugID, slug)
-		if errNotFound != nil {
-			tx.Rollback()
-			return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-		}
-	} else {
-		querySlugID += ` id = $1`
-		errNotFound := tx.Get(&threadID, querySlugID, id)
-		if errNotFound != nil {
-			tx.Rollback()
-			return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-		}
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
 	}
+	return operations.NewUserUnbanOK().WithPayload(&ban.Ban)
+}
 
-	query := `SELECT posts.id, forum, thread, author, created, is_edited as isEdited, message, parent FROM posts`
+// PostGetOne ... OK
+func (dbManager ForumPgSQL) PostGetOne(params operations.PostGetOneParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "postGetOne")
+	defer cancel()
 
-	desc := params.Desc != nil && *params.Desc
-	limit := strconv.FormatInt(int64(*params.Limit), 10)
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
 
-	if *params.Sort == "flat" {
-		query += ` WHERE thread = $1`
-		if params.Since != nil {
-			if desc {
-				query += ` AND id < $2`
-			} else {
-				query += ` AND id > $2`
-			}
-		}
+	post := models.Post{}
+	postFull := models.PostFull{}
 
-		if desc {
-			query += ` ORDER BY id DESC`
-		} else {
-			query += ` ORDER BY id`
-		}
+	err = tx.GetContext(ctx, &post, selectPost, params.ID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find post with id %d", params.ID)
+	}
 
-		if params.Limit != nil {
-			query += ` LIMIT ` + limit
-		}
+	postFull.Post = &post
 
-		if params.Since != nil {
-			err := tx.Select(&posts, query, threadID.ID, params.Since)
-			if err != nil {
-				log.Println(err)
-				tx.Rollback()
-				return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR})
-			}
-		} else {
-			err := tx.Select(&posts, query, threadID.ID)
+	for _, item := range params.Related {
+		if item == "user" && !post.IsDeleted {
+			user := models.User{}
+			err := tx.GetContext(ctx, &user, `SELECT about, email, fullname, nickname
+				FROM users WHERE lower(nickname) = lower($1)`, post.Author)
 			if err != nil {
-				log.Println(err)
-				tx.Rollback()
-				return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR})
+				return dbError(ctx, err)
 			}
+			postFull.Author = &user
+			continue
 		}
-	}
-	if *params.Sort == "tree" {
-		query += ` WHERE thread = $1`
-		if params.Since != nil {
-			if desc {
-				query += ` AND path < (SELECT path FROM posts WHERE id = $2)`
-			} else {
-				query += ` AND path > (SELECT path FROM posts WHERE id = $2)`
+		if item == "forum" {
+			forum := models.Forum{}
+			err := tx.GetContext(ctx, &forum, `SELECT posts, threads, slug, title, author as user
+				FROM forums WHERE lower(slug) = lower($1)`, post.Forum)
+			if err != nil {
+				return dbError(ctx, err)
 			}
-		}
-
-		if desc {
-			query += ` ORDER BY path DESC`
-		} else {
-			query += ` ORDER BY path`
-		}
+			postFull.Forum = &forum
 
-		if params.Limit != nil {
-			query += ` LIMIT ` + limit
+			continue
 		}
-
-		if params.Since != nil {
-			err := tx.Select(&posts, query, threadID.ID, params.Since)
-			if err != nil {
-				log.Println(err)
-				tx.Rollback()
-				return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR})
-			}
-		} else {
-			err := tx.Select(&posts, query, threadID.ID)
+		if item == "thread" {
+			thread := models.Thread{}
+			err := tx.GetContext(ctx, &thread, `SELECT forum, author, created, message, title, slug, id, votes, locked, pinned FROM threads WHERE id = $1`, post.Thread)
 			if err != nil {
-				log.Println(err)
-				tx.Rollback()
-				return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR})
-			}
-		}
-	}
-	if *params.Sort == "parent_tree" {
-		if params.Since != nil {
-			if desc {
-				if params.Limit != nil {
-					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1
-						AND root_id < (SELECT root_id FROM posts WHERE id = ` +
-						strconv.FormatInt(*params.Since, 10) + `)` + ` ORDER BY id DESC LIMIT ` + limit +
-						`) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path DESC`
-				} else {
-					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1
-						AND root_id < (SELECT root_id FROM posts WHERE id = ` +
-						strconv.FormatInt(*params.Since, 10) + `)` + ` ORDER BY id DESC` +
-						`) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path DESC`
-				}
-			} else {
-				if params.Limit != nil {
-					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1
-						AND root_id > (SELECT root_id FROM posts WHERE id = ` +
-						strconv.FormatInt(*params.Since, 10) + `)` + ` ORDER BY id LIMIT ` + limit +
-						`) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path`
-				} else {
-					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1
-						AND root_id > (SELECT root_id FROM posts WHERE id = ` +
-						strconv.FormatInt(*params.Since, 10) + `)` + ` ORDER BY id` +
-						`) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path`
-				}
+				return dbError(ctx, err)
 			}
-		} else {
-			if desc {
-				if params.Limit != nil {
-					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1` +
-						` ORDER BY id DESC LIMIT ` + limit + `) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path DESC`
-				} else {
-					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1` +
-						` ORDER BY id DESC) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path DESC`
-				}
-			} else {
-				if params.Limit != nil {
-					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1` +
-						` ORDER BY id LIMIT ` + limit + `) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path`
-				} else {
-					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1` +
-						` ORDER BY id) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path`
-				}
-			}
-		}
+			postFull.Thread = &thread
 
-		err := tx.Select(&posts, query, threadID.ID)
-		if err != nil {
-			log.Println(err)
-			tx.Rollback()
-			return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR})
+			continue
 		}
 	}
 
-	tx.Commit()
-	return operations.NewThreadGetPostsOK().WithPayload(posts)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewPostGetOneOK().WithPayload(&postFull)
 }
 
-// ThreadUpdate ... OK
-func (dbManager ForumPgSQL) ThreadUpdate(params operations.ThreadUpdateParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
-
-	threadID := ID{}
-	thread := models.Thread{}
+// PostUpdate OK
+func (dbManager ForumPgSQL) PostUpdate(params operations.PostUpdateParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "postUpdate")
+	defer cancel()
 
-	slug, id := SlugID(params.SlugOrID)
-	err := tx.Get(&threadID, `SELECT id FROM threads WHERE lower(slug) = lower($1) OR id = $2`, slug, id)
+	tx, err := dbManager.begin(ctx)
 	if err != nil {
-		tx.Rollback()
-		return operations.NewThreadUpdateNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		return dbError(ctx, err)
 	}
+	defer tx.Rollback()
 
-	query := `UPDATE threads SET id = id `
-	if params.Thread.Message != "" {
-		query += `, message = '` + params.Thread.Message + `' `
+	post := models.Post{}
+
+	err = tx.GetContext(ctx, &post, selectPost, params.ID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find post with id %d", params.ID)
 	}
-	if params.Thread.Title != "" {
-		query += `, title = '` + params.Thread.Title + `' `
+	if post.IsDeleted {
+		return Conflict("Post %d is deleted", params.ID)
 	}
-	query += ` WHERE id = $1 RETURNING forum, author, created, message, title, slug, id, votes`
+	role, err := dbManager.forumRole(ctx, tx, principal, post.Forum)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !canEdit(role, principal, post.Author) {
+		return Forbidden("Post %d can't be edited by %s", params.ID, principal.Nickname)
+	}
+
+	edited := params.Post.Message != "" && params.Post.Message != post.Message
+	if edited {
+		if err := dbManager.addPostRevision(ctx, tx, &post, params.Post.Message, principal.Nickname); err != nil {
+			return dbError(ctx, err)
+		}
 
-	errNotFound := tx.Get(&thread, query, threadID.ID)
-	if errNotFound != nil {
-		tx.Rollback()
-		return operations.NewUserUpdateConflict().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		err := tx.GetContext(ctx, &post, `UPDATE posts SET is_edited = true, message = $1
+			WHERE id = $2
+			RETURNING id, forum, thread, created, author, is_edited as isedited, is_deleted as isdeleted, message, parent `, params.Post.Message, params.ID)
+		if err != nil {
+			return notFoundOr(ctx, err, "Can't find post with id %d", params.ID)
+		}
+		if err := dbManager.enqueueWebhooks(ctx, tx, postEditEvent(&post)); err != nil {
+			return dbError(ctx, err)
+		}
 	}
 
-	tx.Commit()
-	return operations.NewThreadUpdateOK().WithPayload(&thread)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	if edited {
+		dbManager.publish(postEditEvent(&post))
+	}
+	return operations.NewPostUpdateOK().WithPayload(&post)
 }
 
-// ThreadVote ... OK
-func (dbManager ForumPgSQL) ThreadVote(params operations.ThreadVoteParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
-
-	thread := models.Thread{}
-	threadID := ID{}
-	voteID := ID{}
+// PostDelete ... replaces the post with a tombstone, path and root_id are kept for tree sorts
+func (dbManager ForumPgSQL) PostDelete(params operations.PostDeleteParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "postDelete")
+	defer cancel()
 
-	slug, id := SlugID(params.SlugOrID)
-	querySlugID := `SELECT id FROM threads WHERE `
-	if id == -1 {
-		querySlugID += ` lower(slug) = lower($1)`
-		errNotFound := tx.Get(&threadID, querySlugID, slug)
-		if errNotFound != nil {
-			tx.Rollback()
-			return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-		}
-	} else {
-		querySlugID += ` id = $1`
-		errNotFound := tx.Get(&threadID, querySlugID, id)
-		if errNotFound != nil {
-			tx.Rollback()
-			return operations.NewThreadGetPostsNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-		}
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
 	}
-	// err := tx.Get(&threadID, `SELECT id FROM threads WHERE lower(slug) = lower($1) OR id = $2`, slug, id)
-	// if err != nil {
-	// 	//log.Println(err)
-	// 	tx.Rollback()
-	// 	return operations.NewThreadVoteNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
-	// }
+	defer tx.Rollback()
 
-	errExist := tx.Get(&voteID, `SELECT id FROM votes WHERE lower(author) = lower($1) AND thread = $2`, params.Vote.Nickname, threadID.ID)
-	if errExist != nil {
-		_, errAlreadyExists := tx.Exec(`INSERT INTO votes (voice, author, thread) VALUES ($1, $2, $3)`,
-			params.Vote.Voice, params.Vote.Nickname, threadID.ID)
+	post := models.Post{}
 
-		tx.Get(&thread, `UPDATE threads SET votes = votes + $1 WHERE id = $2 RETURNING forum, author, created, message, title, slug, id, votes`, params.Vote.Voice, threadID.ID)
+	err = tx.GetContext(ctx, &post, selectPost, params.ID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find post with id %d", params.ID)
+	}
 
-		if errAlreadyExists != nil {
-			tx.Rollback()
-			return operations.NewThreadVoteNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+	// A tombstone has no author left, deleting it again just returns it
+	if !post.IsDeleted {
+		role, err := dbManager.forumRole(ctx, tx, principal, post.Forum)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+		if !canEdit(role, principal, post.Author) {
+			return Forbidden("Post %d can't be deleted by %s", params.ID, principal.Nickname)
 		}
-	} else {
-		_, errNotFound := tx.Exec(`UPDATE votes SET voice = $1 WHERE lower(author) = lower($2) AND thread = $3`,
-			params.Vote.Voice, params.Vote.Nickname, threadID.ID)
-
-		tx.Get(&thread, `UPDATE threads SET votes = (SELECT SUM(voice) FROM votes WHERE thread = $1)
-									WHERE id = $1 RETURNING forum, author, created, message, title, slug, id, votes`, threadID.ID)
 
-		if errNotFound != nil {
-			tx.Rollback()
-			return operations.NewThreadVoteNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+		if err := dbManager.deletePost(ctx, tx, &post); err != nil {
+			return notFoundOr(ctx, err, "Can't find post with id %d", params.ID)
 		}
 	}
 
-	tx.Commit()
-	return operations.NewThreadVoteOK().WithPayload(&thread)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewPostDeleteOK().WithPayload(&post)
 }
 
-//UserCreate ... OK OK
-func (dbManager ForumPgSQL) UserCreate(params operations.UserCreateParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+// selectPost finds a post by id, posts of deleted threads are gone with them.
+const selectPost = `SELECT id, forum, thread, created, author, is_edited as isedited, is_deleted as isdeleted, message, parent
+	FROM posts WHERE id = $1 AND thread IN (SELECT id FROM threads WHERE deleted_at IS NULL)`
+
+// deletePost replaces post with a tombstone and reloads it, the original of a post which was never edited
+// is kept in its history for moderators.
+// Only the request that actually deletes the post decrements forums.posts.
+func (dbManager ForumPgSQL) deletePost(ctx context.Context, tx *tracedTx, post *models.Post) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO post_revisions (post_id, number, message, editor, created)
+		SELECT id, 1, message, author, created FROM posts WHERE id = $1 AND NOT is_deleted
+		ON CONFLICT (post_id, number) DO NOTHING`, post.ID)
+	if err != nil {
+		return err
+	}
+	err = tx.GetContext(ctx, post, `UPDATE posts SET is_deleted = true, message = $1, author = ''
+		WHERE id = $2 AND NOT is_deleted AND thread IN (SELECT id FROM threads WHERE deleted_at IS NULL)
+		RETURNING id, forum, thread, created, author, is_edited as isedited, is_deleted as isdeleted, message, parent`, postTombstone, post.ID)
+	if err == sql.ErrNoRows {
+		return tx.GetContext(ctx, post, selectPost, post.ID)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE forums SET posts = posts - 1 WHERE slug = $1`, post.Forum)
+	return err
+}
 
-	user := models.User{}
-	users := models.Users{}
+// PostHistory ...
+func (dbManager ForumPgSQL) PostHistory(params operations.PostHistoryParams) middleware.Responder {
+	principal := optionalPrincipal(dbManager.Authenticate, params.HTTPRequest)
 
-	tx.Select(&users, "SELECT nickname, fullname, about, email FROM users WHERE lower(users.nickname) = lower($1) OR lower(users.email) = lower($2)", params.Nickname, params.Profile.Email)
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "postHistory")
+	defer cancel()
 
-	if len(users) != 0 {
-		tx.Rollback()
-		return operations.NewUserCreateConflict().WithPayload(users)
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
 	}
+	defer tx.Rollback()
 
-	tx.Get(&user, "INSERT INTO users (nickname, fullname, about, email) VALUES ($1, $2, $3, $4) RETURNING nickname, fullname, about, email",
-		params.Nickname, params.Profile.Fullname, params.Profile.About, params.Profile.Email)
+	revisions, err := dbManager.postHistory(ctx, tx, principal, params.ID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find post with id %d", params.ID)
+	}
 
-	tx.Commit()
-	return operations.NewUserCreateCreated().WithPayload(&user)
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewPostHistoryOK().WithPayload(revisions)
 }
 
-//UserGetOne ... OK
-func (dbManager ForumPgSQL) UserGetOne(params operations.UserGetOneParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
-	defer tx.Rollback()
+// PostHistoryDiff ...
+func (dbManager ForumPgSQL) PostHistoryDiff(params operations.PostHistoryDiffParams) middleware.Responder {
+	principal := optionalPrincipal(dbManager.Authenticate, params.HTTPRequest)
 
-	users := []models.User{}
-	check(tx.Select(&users, "SELECT nickname, fullname, about, email FROM users WHERE lower(users.nickname) = lower($1)", params.Nickname))
-	check(tx.Commit())
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "postHistoryDiff")
+	defer cancel()
 
-	if len(users) == 0 {
-		return operations.NewUserGetOneNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
 	}
+	defer tx.Rollback()
 
-	return operations.NewUserGetOneOK().WithPayload(&users[0])
-}
+	revisions, err := dbManager.postHistory(ctx, tx, principal, params.ID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find post with id %d", params.ID)
+	}
 
-//UserUpdate ... OK OK
-func (dbManager ForumPgSQL) UserUpdate(params operations.UserUpdateParams) middleware.Responder {
-	tx := dbManager.db.MustBegin()
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
 
-	user := models.User{}
-	users := models.Users{}
+	diff, diffErr := diffRevisions(revisions, params.From, params.To, false)
+	if diffErr != nil {
+		return diffErr
+	}
+	return operations.NewPostHistoryDiffOK().WithPayload(diff)
+}
 
-	check(tx.Select(&users, `SELECT nickname FROM users
-		WHERE lower(users.nickname) = lower($1) OR lower(users.email) = COALESCE(lower($2), email)`, params.Nickname, params.Profile.Email))
-	if len(users) == 0 {
-		tx.Rollback()
-		return operations.NewUserUpdateNotFound().WithPayload(&models.Error{Message: ERR_NOT_FOUND})
+// postHistory returns every version of the post, sql.ErrNoRows when there is no such post.
+// Only moderators of the forum see versions of a deleted post, others get the tombstone.
+func (dbManager ForumPgSQL) postHistory(ctx context.Context, tx *tracedTx, principal *models.Principal, postID int64) (models.Revisions, error) {
+	post := models.Post{}
+	err := tx.GetContext(ctx, &post, `SELECT id, forum, author, created, is_deleted as isdeleted, message FROM posts
+		WHERE id = $1 AND thread IN (SELECT id FROM threads WHERE deleted_at IS NULL)`, postID)
+	if err != nil {
+		return nil, err
 	}
-	if len(users) > 1 {
-		tx.Rollback()
-		return operations.NewUserUpdateConflict().WithPayload(&models.Error{Message: ERR_ALREADY_EXISTS})
+	if post.IsDeleted {
+		role := RoleMember
+		if principal != nil {
+			if role, err = dbManager.forumRole(ctx, tx, principal, post.Forum); err != nil {
+				return nil, err
+			}
+		}
+		if !can(role, permModerate) {
+			return models.Revisions{postOriginal(&post)}, nil
+		}
 	}
 
-	if params.Profile == nil {
-		tx.Rollback()
-		return operations.NewUserUpdateOK().WithPayload(users[0])
+	revisions := models.Revisions{}
+	err = tx.SelectContext(ctx, &revisions, `SELECT number, message, editor, created FROM post_revisions
+		WHERE post_id = $1 ORDER BY number`, postID)
+	if err != nil {
+		return nil, err
 	}
+	if len(revisions) == 0 {
+		revisions = append(revisions, postOriginal(&post))
+	}
+	return revisions, nil
+}
 
-	query := `UPDATE users SET nickname = nickname`
-	if params.Profile.Fullname != "" {
-		query += `, fullname = '` + params.Profile.Fullname + `'`
+// addPostRevision records the version of post written by editor.
+// The original version is recorded along with the first edit.
+func (dbManager ForumPgSQL) addPostRevision(ctx context.Context, tx *tracedTx, post *models.Post, message, editor string) error {
+	count := 0
+	if err := tx.GetContext(ctx, &count, `SELECT COUNT(*) FROM post_revisions WHERE post_id = $1`, post.ID); err != nil {
+		return err
 	}
-	if params.Profile.Email != "" {
-		query += `, email = '` + params.Profile.Email.String() + `'`
+	insert := `INSERT INTO post_revisions (post_id, number, message, editor, created) VALUES ($1, $2, $3, $4, $5)`
+	if count == 0 {
+		original := postOriginal(post)
+		if _, err := tx.ExecContext(ctx, insert, post.ID, original.Number, original.Message, original.Editor, original.Created); err != nil {
+			return err
+		}
+		count = 1
 	}
-	if params.Profile.About != "" {
-		query += `, about = '` + params.Profile.About + `'`
+	_, err := tx.ExecContext(ctx, insert, post.ID, count+1, message, editor, strfmt.DateTime(time.Now().UTC()))
+	return err
+}
+
+// PostsCreate OK OK
+func (dbManager ForumPgSQL) PostsCreate(params operations.PostsCreateParams, principal *models.Principal) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "postsCreate", principal, params.SlugOrID, params.Posts)
+	if keyErr != nil {
+		return keyErr
 	}
-	query += ` WHERE lower(nickname) = lower($1) RETURNING about, email, fullname, nickname`
 
-	tx.Get(&user, query, params.Nickname)
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "postsCreate")
+	defer cancel()
 
-	tx.Commit()
-	return operations.NewUserUpdateOK().WithPayload(&user)
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if replayed := dbManager.replay(ctx, tx, key); replayed != nil {
+		return replayed
+	}
+
+	thread := models.Thread{}
+	posts := []*models.Post{}
+	users := []userID{}
+	user := userID{}
+
+	forumID := ID{}
+	postID := ID{}
+
+	slug, id := SlugID(params.SlugOrID)
+
+	err = tx.GetContext(ctx, &thread, `SELECT id, slug, forum, locked FROM threads
+		WHERE (lower(slug) = lower($1) OR id = $2) AND deleted_at IS NULL`, slug, id)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+	if thread.Locked {
+		return Conflict("Thread %s is locked", params.SlugOrID)
+	}
+	if err := dbManager.checkBan(ctx, tx, principal, thread.Forum); err != nil {
+		return err
+	}
+
+	if len(params.Posts) == 0 {
+		if err := tx.Commit(); err != nil {
+			return dbError(ctx, err)
+		}
+		return operations.NewPostsCreateCreated().WithPayload(params.Posts)
+	}
+
+	checkParent := "SELECT id FROM posts WHERE thread = $1 AND id = $2"
+	checkUser := "SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)"
+
+	insertPosts := `INSERT INTO posts (forum, thread, author, message, parent) VALUES
+	($1, $2, $3, $4, $5) RETURNING author, created, forum, id, is_edited as isedited, is_deleted as isdeleted, message, thread, parent;`
+
+	stmtParent, err := tx.PreparexContext(ctx, checkParent)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	stmtUser, err := tx.PreparexContext(ctx, checkUser)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	stmtInsertPosts, err := tx.PreparexContext(ctx, insertPosts)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	err = tx.GetContext(ctx, &forumID, "UPDATE forums SET posts = posts + $1 WHERE slug = $2 RETURNING id", len(params.Posts), thread.Forum)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	err = stmtUser.GetContext(ctx, &user, principal.Nickname)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", principal.Nickname)
+	}
+
+	for _, item := range params.Posts {
+		post := models.Post{}
+		users = append(users, user)
+
+		if item.Parent != 0 {
+			err = stmtParent.GetContext(ctx, &postID, thread.ID, item.Parent)
+			if err == sql.ErrNoRows {
+				return Conflict("Parent post %d is not in thread %d", item.Parent, thread.ID)
+			}
+			if err != nil {
+				return dbError(ctx, err)
+			}
+		}
+
+		err = stmtInsertPosts.GetContext(ctx, &post, thread.Forum, thread.ID, user.Nickname, item.Message, item.Parent)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+
+		posts = append(posts, &post)
+	}
+
+	insertForumUsers := "INSERT INTO forum_users (author_id, forum_id) VALUES"
+	for idx, _ := range params.Posts {
+		if idx > 0 {
+			insertForumUsers += ","
+		}
+		insertForumUsers += " (" + strconv.FormatInt(users[idx].ID, 10) + ", " + strconv.FormatInt(forumID.ID, 10) + ") "
+	}
+	insertForumUsers += " ON CONFLICT(author_id, forum_id) DO NOTHING;"
+	if _, err := tx.ExecContext(ctx, insertForumUsers); err != nil {
+		return dbError(ctx, err)
+	}
+	events := postEvents(posts)
+	if err := dbManager.enqueueWebhooks(ctx, tx, events...); err != nil {
+		return dbError(ctx, err)
+	}
+	if err := dbManager.remember(ctx, tx, key, http.StatusCreated, posts); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	dbManager.publish(events...)
+	return operations.NewPostsCreateCreated().WithPayload(models.Posts(posts))
+}
+
+// Status ... OK
+func (dbManager ForumPgSQL) Status(params operations.StatusParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "status")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	status := models.Status{}
+
+	err = tx.GetContext(ctx, &status, `SELECT (SELECT COUNT(*) FROM forums) as forum,
+	(SELECT COUNT(*) FROM threads) as thread,
+	(SELECT COUNT(*) FROM posts) as post,
+	(SELECT COUNT(*) FROM users) as user`)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewStatusOK().WithPayload(&status)
+}
+
+// ThreadCreate ... OK OK
+func (dbManager ForumPgSQL) ThreadCreate(params operations.ThreadCreateParams, principal *models.Principal) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "threadCreate", principal, params.Slug, params.Thread)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadCreate")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if replayed := dbManager.replay(ctx, tx, key); replayed != nil {
+		return replayed
+	}
+
+	thread := models.Thread{}
+	forum := forumID{}
+	user := userID{}
+
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+	err = tx.GetContext(ctx, &user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, principal.Nickname)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", principal.Nickname)
+	}
+	if err := dbManager.checkBan(ctx, tx, principal, forum.Slug); err != nil {
+		return err
+	}
+
+	if params.Thread.Slug != "" {
+		errAlreadyExists := tx.GetContext(ctx, &thread, `SELECT forum, author, created, message, title, slug, id, votes, locked, pinned FROM threads
+			WHERE lower(slug) = lower($1) AND deleted_at IS NULL`, params.Thread.Slug)
+		if errAlreadyExists == nil {
+			return operations.NewThreadCreateConflict().WithPayload(&thread)
+		}
+		if errAlreadyExists != sql.ErrNoRows {
+			return dbError(ctx, errAlreadyExists)
+		}
+	}
+
+	// SQLite keeps RFC 3339 timestamps, CURRENT_TIMESTAMP has another format there
+	created := params.Thread.Created
+	if created == nil && dbManager.dialect != "postgres" {
+		now := strfmt.DateTime(time.Now().UTC())
+		created = &now
+	}
+	err = tx.GetContext(ctx, &thread, `INSERT INTO threads (forum, author, created, message, title, slug, forum_id, author_id)
+	VALUES ($1, $2, COALESCE($3, CURRENT_TIMESTAMP), $4, $5, $6, $7, $8) RETURNING forum, author, created, message, title, slug, id, votes, locked, pinned`,
+		forum.Slug, user.Nickname, created, params.Thread.Message, params.Thread.Title, params.Thread.Slug, forum.ID, user.ID)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE forums SET threads = threads + 1 WHERE id = $1", forum.ID); err != nil {
+		return dbError(ctx, err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO forum_users (author_id, forum_id) VALUES ($1, $2) ON CONFLICT(forum_id, author_id) DO NOTHING", user.ID, forum.ID); err != nil {
+		return dbError(ctx, err)
+	}
+	event := threadEvent(&thread)
+	if err := dbManager.enqueueWebhooks(ctx, tx, event); err != nil {
+		return dbError(ctx, err)
+	}
+	if err := dbManager.remember(ctx, tx, key, http.StatusCreated, &thread); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	dbManager.publish(event)
+	return operations.NewThreadCreateCreated().WithPayload(&thread)
+}
+
+// ThreadGetOne ... OK
+func (dbManager ForumPgSQL) ThreadGetOne(params operations.ThreadGetOneParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadGetOne")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	thread := models.Thread{}
+
+	slug, id := SlugID(params.SlugOrID)
+	querySlugID := `SELECT forum, author, created, message, title, slug, id, votes, locked, pinned FROM threads WHERE `
+	if id == -1 {
+		querySlugID += ` lower(slug) = lower($1) AND deleted_at IS NULL`
+		err = tx.GetContext(ctx, &thread, querySlugID, slug)
+	} else {
+		querySlugID += ` id = $1 AND deleted_at IS NULL`
+		err = tx.GetContext(ctx, &thread, querySlugID, id)
+	}
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewThreadGetOneOK().WithPayload(&thread)
+}
+
+// ThreadGetPosts ... !OPTIMIZ
+func (dbManager ForumPgSQL) ThreadGetPosts(params operations.ThreadGetPostsParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadGetPosts")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	threadID := ID{}
+	posts := models.Posts{}
+
+	slug, id := SlugID(params.SlugOrID)
+	querySlugID := `SELECT id FROM threads WHERE `
+	if id == -1 {
+		querySlugID += ` lower(slug) = lower($1) AND deleted_at IS NULL`
+		err = tx.GetContext(ctx, &threadID, querySlugID, slug)
+	} else {
+		querySlugID += ` id = $1 AND deleted_at IS NULL`
+		err = tx.GetContext(ctx, &threadID, querySlugID, id)
+	}
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+
+	// Posts are positioned by the id of the last one: their paths never change
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("threadGetPosts", threadID.ID, *params.Sort, desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+	if after != nil {
+		params.Since = &after.ID
+	}
+
+	query := `SELECT posts.id, forum, thread, author, created, is_edited as isedited, is_deleted as isdeleted, message, parent FROM posts`
+
+	limit := strconv.FormatInt(int64(*params.Limit), 10)
+
+	switch *params.Sort {
+	case "flat":
+		query += ` WHERE thread = $1`
+		if params.Since != nil {
+			if desc {
+				query += ` AND id < $2`
+			} else {
+				query += ` AND id > $2`
+			}
+		}
+
+		if desc {
+			query += ` ORDER BY id DESC`
+		} else {
+			query += ` ORDER BY id`
+		}
+
+		if params.Limit != nil {
+			query += ` LIMIT ` + limit
+		}
+
+		if params.Since != nil {
+			err = tx.SelectContext(ctx, &posts, query, threadID.ID, params.Since)
+		} else {
+			err = tx.SelectContext(ctx, &posts, query, threadID.ID)
+		}
+	case "tree":
+		query += ` WHERE thread = $1`
+		if params.Since != nil {
+			if desc {
+				query += ` AND path < (SELECT path FROM posts WHERE id = $2)`
+			} else {
+				query += ` AND path > (SELECT path FROM posts WHERE id = $2)`
+			}
+		}
+
+		if desc {
+			query += ` ORDER BY path DESC`
+		} else {
+			query += ` ORDER BY path`
+		}
+
+		if params.Limit != nil {
+			query += ` LIMIT ` + limit
+		}
+
+		if params.Since != nil {
+			err = tx.SelectContext(ctx, &posts, query, threadID.ID, params.Since)
+		} else {
+			err = tx.SelectContext(ctx, &posts, query, threadID.ID)
+		}
+	case "parent_tree":
+		if params.Since != nil {
+			if desc {
+				if params.Limit != nil {
+					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1
+						AND root_id < (SELECT root_id FROM posts WHERE id = ` +
+						strconv.FormatInt(*params.Since, 10) + `)` + ` ORDER BY id DESC LIMIT ` + limit +
+						`) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path DESC`
+				} else {
+					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1
+						AND root_id < (SELECT root_id FROM posts WHERE id = ` +
+						strconv.FormatInt(*params.Since, 10) + `)` + ` ORDER BY id DESC` +
+						`) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path DESC`
+				}
+			} else {
+				if params.Limit != nil {
+					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1
+						AND root_id > (SELECT root_id FROM posts WHERE id = ` +
+						strconv.FormatInt(*params.Since, 10) + `)` + ` ORDER BY id LIMIT ` + limit +
+						`) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path`
+				} else {
+					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1
+						AND root_id > (SELECT root_id FROM posts WHERE id = ` +
+						strconv.FormatInt(*params.Since, 10) + `)` + ` ORDER BY id` +
+						`) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path`
+				}
+			}
+		} else {
+			if desc {
+				if params.Limit != nil {
+					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1` +
+						` ORDER BY id DESC LIMIT ` + limit + `) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path DESC`
+				} else {
+					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1` +
+						` ORDER BY id DESC) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path DESC`
+				}
+			} else {
+				if params.Limit != nil {
+					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1` +
+						` ORDER BY id LIMIT ` + limit + `) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path`
+				} else {
+					query += ` JOIN (SELECT id FROM posts WHERE posts.parent = 0 AND posts.thread = $1` +
+						` ORDER BY id) selectedParents ON (root_id = selectedParents.id AND thread = $1) ORDER BY path`
+				}
+			}
+		}
+
+		err = tx.SelectContext(ctx, &posts, query, threadID.ID)
+	default:
+		return Validation("Unknown sort type %s", *params.Sort)
+	}
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	response := operations.NewThreadGetPostsOK().WithPayload(posts)
+	if params.Limit != nil && pageSize(posts, *params.Sort) == int(*params.Limit) {
+		response.WithXNextCursor(cursor{Scope: scope, ID: posts[len(posts)-1].ID}.encode())
+	}
+	return response
+}
+
+// ThreadGetPostsAtom ...
+func (dbManager ForumPgSQL) ThreadGetPostsAtom(params operations.ThreadGetPostsAtomParams) middleware.Responder {
+	return threadFeed(dbManager, params.HTTPRequest, params.SlugOrID, params.Limit, FeedAtom)
+}
+
+// ThreadUpdate ... OK
+func (dbManager ForumPgSQL) ThreadUpdate(params operations.ThreadUpdateParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadUpdate")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	previous := models.Thread{}
+	thread := models.Thread{}
+
+	slug, id := SlugID(params.SlugOrID)
+	err = tx.GetContext(ctx, &previous, `SELECT id, forum, author, created, title, message FROM threads
+		WHERE (lower(slug) = lower($1) OR id = $2) AND deleted_at IS NULL`, slug, id)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, previous.Forum)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !canEdit(role, principal, previous.Author) {
+		return Forbidden("Thread %s can't be edited by %s", params.SlugOrID, principal.Nickname)
+	}
+	if (params.Thread.Locked != nil || params.Thread.Pinned != nil) && !can(role, permModerate) {
+		return Forbidden("Only moderators of forum %s can lock and pin threads", previous.Forum)
+	}
+
+	title, message := previous.Title, previous.Message
+	if params.Thread.Title != "" {
+		title = params.Thread.Title
+	}
+	if params.Thread.Message != "" {
+		message = params.Thread.Message
+	}
+	if title != previous.Title || message != previous.Message {
+		if err := dbManager.addThreadRevision(ctx, tx, &previous, title, message, principal.Nickname); err != nil {
+			return dbError(ctx, err)
+		}
+	}
+
+	query := `UPDATE threads SET message = $2, title = $3`
+	args := []interface{}{previous.ID, message, title}
+	if params.Thread.Locked != nil {
+		args = append(args, *params.Thread.Locked)
+		query += `, locked = $` + strconv.Itoa(len(args))
+	}
+	if params.Thread.Pinned != nil {
+		args = append(args, *params.Thread.Pinned)
+		query += `, pinned = $` + strconv.Itoa(len(args))
+	}
+	query += ` WHERE id = $1 RETURNING forum, author, created, message, title, slug, id, votes, locked, pinned`
+
+	err = tx.GetContext(ctx, &thread, query, args...)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewThreadUpdateOK().WithPayload(&thread)
+}
+
+// ThreadDelete ... hides the thread, its posts stay in the database
+func (dbManager ForumPgSQL) ThreadDelete(params operations.ThreadDeleteParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadDelete")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	thread := models.Thread{}
+
+	slug, id := SlugID(params.SlugOrID)
+	err = tx.GetContext(ctx, &thread, `SELECT id, forum, author FROM threads
+		WHERE (lower(slug) = lower($1) OR id = $2) AND deleted_at IS NULL`, slug, id)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, thread.Forum)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !canEdit(role, principal, thread.Author) {
+		return Forbidden("Thread %s can't be deleted by %s", params.SlugOrID, principal.Nickname)
+	}
+
+	err = tx.GetContext(ctx, &thread, `UPDATE threads SET deleted_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING forum, author, created, message, title, slug, id, votes, locked, pinned`, thread.ID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+
+	// Posts of the thread stop counting, tombstones are not counted already
+	if _, err := tx.ExecContext(ctx, `UPDATE forums SET threads = threads - 1,
+		posts = posts - (SELECT count(*) FROM posts WHERE thread = $2 AND NOT is_deleted) WHERE slug = $1`, thread.Forum, thread.ID); err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewThreadDeleteOK().WithPayload(&thread)
+}
+
+// ThreadHistory ...
+func (dbManager ForumPgSQL) ThreadHistory(params operations.ThreadHistoryParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadHistory")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	revisions, err := dbManager.threadHistory(ctx, tx, params.SlugOrID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewThreadHistoryOK().WithPayload(revisions)
+}
+
+// ThreadHistoryDiff ...
+func (dbManager ForumPgSQL) ThreadHistoryDiff(params operations.ThreadHistoryDiffParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadHistoryDiff")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	revisions, err := dbManager.threadHistory(ctx, tx, params.SlugOrID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+
+	diff, diffErr := diffRevisions(revisions, params.From, params.To, true)
+	if diffErr != nil {
+		return diffErr
+	}
+	return operations.NewThreadHistoryDiffOK().WithPayload(diff)
+}
+
+// threadHistory returns every version of a live thread, sql.ErrNoRows when there is no such thread.
+func (dbManager ForumPgSQL) threadHistory(ctx context.Context, tx *tracedTx, slugOrID string) (models.Revisions, error) {
+	thread := models.Thread{}
+	slug, id := SlugID(slugOrID)
+	err := tx.GetContext(ctx, &thread, `SELECT id, author, created, title, message FROM threads
+		WHERE (lower(slug) = lower($1) OR id = $2) AND deleted_at IS NULL`, slug, id)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := models.Revisions{}
+	err = tx.SelectContext(ctx, &revisions, `SELECT number, title, message, editor, created FROM thread_revisions
+		WHERE thread_id = $1 ORDER BY number`, thread.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		revisions = append(revisions, threadOriginal(&thread))
+	}
+	return revisions, nil
+}
+
+// addThreadRevision records the title and message of thread written by editor.
+// The original version is recorded along with the first edit.
+func (dbManager ForumPgSQL) addThreadRevision(ctx context.Context, tx *tracedTx, thread *models.Thread, title, message, editor string) error {
+	count := 0
+	if err := tx.GetContext(ctx, &count, `SELECT COUNT(*) FROM thread_revisions WHERE thread_id = $1`, thread.ID); err != nil {
+		return err
+	}
+	insert := `INSERT INTO thread_revisions (thread_id, number, title, message, editor, created) VALUES ($1, $2, $3, $4, $5, $6)`
+	if count == 0 {
+		original := threadOriginal(thread)
+		if _, err := tx.ExecContext(ctx, insert, thread.ID, original.Number, original.Title, original.Message, original.Editor, original.Created); err != nil {
+			return err
+		}
+		count = 1
+	}
+	_, err := tx.ExecContext(ctx, insert, thread.ID, count+1, title, message, editor, strfmt.DateTime(time.Now().UTC()))
+	return err
+}
+
+// ThreadLock ...
+func (dbManager ForumPgSQL) ThreadLock(params operations.ThreadLockParams, principal *models.Principal) middleware.Responder {
+	thread, err := dbManager.setThreadFlag(params.HTTPRequest, principal, "threadLock", params.SlugOrID, "locked", true)
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadLockOK().WithPayload(thread)
+}
+
+// ThreadUnlock ...
+func (dbManager ForumPgSQL) ThreadUnlock(params operations.ThreadUnlockParams, principal *models.Principal) middleware.Responder {
+	thread, err := dbManager.setThreadFlag(params.HTTPRequest, principal, "threadUnlock", params.SlugOrID, "locked", false)
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadUnlockOK().WithPayload(thread)
+}
+
+// ThreadPin ...
+func (dbManager ForumPgSQL) ThreadPin(params operations.ThreadPinParams, principal *models.Principal) middleware.Responder {
+	thread, err := dbManager.setThreadFlag(params.HTTPRequest, principal, "threadPin", params.SlugOrID, "pinned", true)
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadPinOK().WithPayload(thread)
+}
+
+// ThreadUnpin ...
+func (dbManager ForumPgSQL) ThreadUnpin(params operations.ThreadUnpinParams, principal *models.Principal) middleware.Responder {
+	thread, err := dbManager.setThreadFlag(params.HTTPRequest, principal, "threadUnpin", params.SlugOrID, "pinned", false)
+	if err != nil {
+		return err
+	}
+	return operations.NewThreadUnpinOK().WithPayload(thread)
+}
+
+// setThreadFlag sets a boolean column of a live thread, column is one of the threads table columns.
+func (dbManager ForumPgSQL) setThreadFlag(request *http.Request, principal *models.Principal, operation string, slugOrID string, column string, value bool) (*models.Thread, *Error) {
+	ctx, cancel := dbManager.operationContext(request, operation)
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	thread := models.Thread{}
+
+	slug, id := SlugID(slugOrID)
+	err = tx.GetContext(ctx, &thread, `SELECT id, forum FROM threads
+		WHERE (lower(slug) = lower($1) OR id = $2) AND deleted_at IS NULL`, slug, id)
+	if err != nil {
+		return nil, notFoundOr(ctx, err, "Can't find thread %s", slugOrID)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, thread.Forum)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	if !can(role, permModerate) {
+		return nil, Forbidden("Only moderators of forum %s can lock and pin threads", thread.Forum)
+	}
+
+	err = tx.GetContext(ctx, &thread, `UPDATE threads SET `+column+` = $2 WHERE id = $1
+		RETURNING forum, author, created, message, title, slug, id, votes, locked, pinned`, thread.ID, value)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, dbError(ctx, err)
+	}
+	return &thread, nil
+}
+
+const selectReports = `SELECT reports.id, forums.slug AS forum, reports.thread, reports.post, users.nickname AS reporter,
+		reports.reason, reports.status, reports.action, reports.moderator, reports.created, reports.closed
+	FROM reports
+	JOIN forums ON forums.id = reports.forum_id
+	JOIN users ON users.id = reports.reporter_id`
+
+// PostReport ...
+func (dbManager ForumPgSQL) PostReport(params operations.PostReportParams, principal *models.Principal) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "postReport", principal, params.ID, params.Report)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "postReport")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if replayed := dbManager.replay(ctx, tx, key); replayed != nil {
+		return replayed
+	}
+
+	post := models.Post{}
+	err = tx.GetContext(ctx, &post, selectPost, params.ID)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find post with id %d", params.ID)
+	}
+
+	report, reportErr := dbManager.createReport(ctx, tx, principal, post.Forum, post.Thread, post.ID, params.Report.Reason)
+	if reportErr != nil {
+		return reportErr
+	}
+	if err := dbManager.remember(ctx, tx, key, http.StatusCreated, report); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewPostReportCreated().WithPayload(report)
+}
+
+// ThreadReport ...
+func (dbManager ForumPgSQL) ThreadReport(params operations.ThreadReportParams, principal *models.Principal) middleware.Responder {
+	key, keyErr := newIdempotency(params.IdempotencyKey, "threadReport", principal, params.SlugOrID, params.Report)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadReport")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if replayed := dbManager.replay(ctx, tx, key); replayed != nil {
+		return replayed
+	}
+
+	thread := models.Thread{}
+
+	slug, id := SlugID(params.SlugOrID)
+	err = tx.GetContext(ctx, &thread, `SELECT id, forum FROM threads
+		WHERE (lower(slug) = lower($1) OR id = $2) AND deleted_at IS NULL`, slug, id)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+
+	report, reportErr := dbManager.createReport(ctx, tx, principal, thread.Forum, thread.ID, 0, params.Report.Reason)
+	if reportErr != nil {
+		return reportErr
+	}
+	if err := dbManager.remember(ctx, tx, key, http.StatusCreated, report); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewThreadReportCreated().WithPayload(report)
+}
+
+// createReport files a report of principal, post is 0 for reports on the thread itself.
+func (dbManager ForumPgSQL) createReport(ctx context.Context, tx *tracedTx, principal *models.Principal, forum string, thread int32, post int64, reason string) (*models.Report, *Error) {
+	if err := dbManager.checkBan(ctx, tx, principal, forum); err != nil {
+		return nil, err
+	}
+
+	user := userID{}
+	err := tx.GetContext(ctx, &user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, principal.Nickname)
+	if err != nil {
+		return nil, notFoundOr(ctx, err, "Can't find user with nickname %s", principal.Nickname)
+	}
+
+	open := ID{}
+	err = tx.GetContext(ctx, &open, `SELECT id FROM reports WHERE reporter_id = $1 AND thread = $2 AND post = $3 AND status = $4`,
+		user.ID, thread, post, ReportOpen)
+	if err == nil {
+		return nil, Conflict("%s has already filed report %d", user.Nickname, open.ID)
+	}
+	if err != sql.ErrNoRows {
+		return nil, dbError(ctx, err)
+	}
+
+	now := strfmt.DateTime(time.Now().UTC())
+	report := models.Report{Forum: forum, Thread: thread, Post: post, Reporter: user.Nickname, Reason: reason, Status: ReportOpen, Created: &now}
+	inserted := ID{}
+	err = tx.GetContext(ctx, &inserted, `INSERT INTO reports (forum_id, thread, post, reporter_id, reason, created)
+		SELECT id, $2, $3, $4, $5, $6 FROM forums WHERE lower(slug) = lower($1) RETURNING id`,
+		forum, thread, post, user.ID, reason, now)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	report.ID = inserted.ID
+	return &report, nil
+}
+
+// ForumGetReports ...
+func (dbManager ForumPgSQL) ForumGetReports(params operations.ForumGetReportsParams, principal *models.Principal) middleware.Responder {
+	status := ReportOpen
+	if params.Status != nil {
+		status = *params.Status
+	}
+	scope := cursorScope("forumGetReports", strings.ToLower(params.Slug), status)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+	if after != nil {
+		params.Since = &after.ID
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumGetReports")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	forum := forumID{}
+	reports := models.Reports{}
+
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !can(role, permModerate) {
+		return Forbidden("Only moderators of forum %s can see its reports", forum.Slug)
+	}
+
+	query := selectReports + ` WHERE reports.forum_id = $1 AND reports.status = $2`
+	args := []interface{}{forum.ID, status}
+	if params.Since != nil {
+		args = append(args, *params.Since)
+		query += ` AND reports.id > $3`
+	}
+	query += ` ORDER BY reports.id`
+	if params.Limit != nil {
+		query += ` LIMIT ` + strconv.FormatInt(int64(*params.Limit), 10)
+	}
+
+	if err := tx.SelectContext(ctx, &reports, query, args...); err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	response := operations.NewForumGetReportsOK().WithPayload(reports)
+	if params.Limit != nil && len(reports) == int(*params.Limit) {
+		response.WithXNextCursor(cursor{Scope: scope, ID: reports[len(reports)-1].ID}.encode())
+	}
+	return response
+}
+
+// ReportResolve ...
+func (dbManager ForumPgSQL) ReportResolve(params operations.ReportResolveParams, principal *models.Principal) middleware.Responder {
+	report, err := dbManager.closeReport(params.HTTPRequest, principal, "reportResolve", params.ID, ReportResolved, resolutionAction(params.Resolution))
+	if err != nil {
+		return err
+	}
+	return operations.NewReportResolveOK().WithPayload(report)
+}
+
+// ReportDismiss ...
+func (dbManager ForumPgSQL) ReportDismiss(params operations.ReportDismissParams, principal *models.Principal) middleware.Responder {
+	report, err := dbManager.closeReport(params.HTTPRequest, principal, "reportDismiss", params.ID, ReportDismissed, "")
+	if err != nil {
+		return err
+	}
+	return operations.NewReportDismissOK().WithPayload(report)
+}
+
+// closeReport applies action and closes the report with status on behalf of a moderator.
+func (dbManager ForumPgSQL) closeReport(request *http.Request, principal *models.Principal, operation string, id int64, status string, action string) (*models.Report, *Error) {
+	ctx, cancel := dbManager.operationContext(request, operation)
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	report := models.Report{}
+
+	err = tx.GetContext(ctx, &report, selectReports+` WHERE reports.id = $1`, id)
+	if err != nil {
+		return nil, notFoundOr(ctx, err, "Can't find report with id %d", id)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, report.Forum)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	if !can(role, permModerate) {
+		return nil, Forbidden("Only moderators of forum %s can close its reports", report.Forum)
+	}
+	if err := checkReportAction(&report, action); err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case ActionDeletePost:
+		// Posts of deleted threads are gone already
+		post := models.Post{ID: report.Post}
+		if err := dbManager.deletePost(ctx, tx, &post); err != nil && err != sql.ErrNoRows {
+			return nil, dbError(ctx, err)
+		}
+	case ActionLockThread:
+		if _, err := tx.ExecContext(ctx, `UPDATE threads SET locked = true WHERE id = $1`, report.Thread); err != nil {
+			return nil, dbError(ctx, err)
+		}
+	}
+
+	now := strfmt.DateTime(time.Now().UTC())
+	report.Status, report.Action, report.Moderator, report.Closed = status, action, principal.Nickname, &now
+	_, err = tx.ExecContext(ctx, `UPDATE reports SET status = $2, action = $3, moderator = $4, closed = $5 WHERE id = $1`,
+		report.ID, report.Status, report.Action, report.Moderator, now)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, dbError(ctx, err)
+	}
+	return &report, nil
+}
+
+// ThreadStream ... subscribes before returning, so no event committed after the response is missed
+func (dbManager ForumPgSQL) ThreadStream(params operations.ThreadStreamParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadStream")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	thread := ID{}
+
+	slug, id := SlugID(params.SlugOrID)
+	err = tx.GetContext(ctx, &thread, `SELECT id FROM threads
+		WHERE (lower(slug) = lower($1) OR id = $2) AND deleted_at IS NULL`, slug, id)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	sub := dbManager.events.subscribe(threadTopic(int32(thread.ID)))
+	return &eventStream{request: params.HTTPRequest, hub: dbManager.events, sub: sub}
+}
+
+// threadEventsChannel is the channel the triggers from db/postgres/0009-thread-events.sql
+// and 0010-activity.sql notify.
+const threadEventsChannel = "thread_events"
+
+// eventNotification is the payload of a NOTIFY, it only points to the changed row
+// because a payload is limited to 8000 bytes.
+type eventNotification struct {
+	Type   string `json:"type"`
+	Forum  string `json:"forum"`
+	Thread int32  `json:"thread"`
+	ID     int64  `json:"id"`
+	User   string `json:"user"`
+}
+
+const selectThread = `SELECT forum, author, created, message, title, slug, id, votes, locked, pinned FROM threads WHERE id = $1`
+
+// listen relays notifications of every server instance to the streams of this one.
+// Events sent while the connection is being restored are lost, clients catch up with ThreadGetPosts.
+func (dbManager ForumPgSQL) listen(dataSourceName string) {
+	logger := dbManager.logger.WithField("component", "thread events")
+	listener := pq.NewListener(dataSourceName, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.WithError(err).Warn("Listener connection problem")
+		}
+	})
+	if err := listener.Listen(threadEventsChannel); err != nil {
+		logger.WithError(err).Fatal("Can't listen to " + threadEventsChannel)
+	}
+
+	go func() {
+		for {
+			select {
+			case notification := <-listener.Notify:
+				if notification != nil {
+					dbManager.relay(notification.Extra)
+				}
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
+}
+
+// relay loads the row a notification points to and publishes it, when any of its topics is watched here.
+func (dbManager ForumPgSQL) relay(payload string) {
+	notification := eventNotification{}
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		dbManager.logger.WithError(err).WithField("component", "thread events").Error("Malformed notification")
+		return
+	}
+	if !dbManager.events.watched(forumTopic(notification.Forum), threadTopic(notification.Thread), userTopic(notification.User)) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbManager.timeouts.Default)
+	defer cancel()
+
+	event := &models.ForumEvent{Type: notification.Type, Forum: notification.Forum, User: notification.User}
+	var err error
+	switch notification.Type {
+	case EventPost, EventPostEdit:
+		event.Post = &models.Post{}
+		err = dbManager.db.GetContext(ctx, event.Post, selectPost, notification.ID)
+	case EventThread, EventVote:
+		event.Thread = &models.Thread{}
+		err = dbManager.db.GetContext(ctx, event.Thread, selectThread, notification.Thread)
+	default:
+		return
+	}
+	if err != nil {
+		dbManager.logger.WithError(err).WithField("component", "thread events").Error("Can't load the event")
+		return
+	}
+	dbManager.events.publish(event)
+}
+
+// ThreadVote ... OK
+func (dbManager ForumPgSQL) ThreadVote(params operations.ThreadVoteParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "threadVote")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	thread := models.Thread{}
+	voteID := ID{}
+
+	slug, id := SlugID(params.SlugOrID)
+	querySlugID := `SELECT id, forum, locked FROM threads WHERE `
+	if id == -1 {
+		querySlugID += ` lower(slug) = lower($1) AND deleted_at IS NULL`
+		err = tx.GetContext(ctx, &thread, querySlugID, slug)
+	} else {
+		querySlugID += ` id = $1 AND deleted_at IS NULL`
+		err = tx.GetContext(ctx, &thread, querySlugID, id)
+	}
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find thread %s", params.SlugOrID)
+	}
+	if thread.Locked {
+		return Conflict("Thread %s is locked", params.SlugOrID)
+	}
+	if err := dbManager.checkBan(ctx, tx, principal, thread.Forum); err != nil {
+		return err
+	}
+	params.Vote.Nickname = principal.Nickname
+
+	errExist := tx.GetContext(ctx, &voteID, `SELECT id FROM votes WHERE lower(author) = lower($1) AND thread = $2`, params.Vote.Nickname, thread.ID)
+	if errExist == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, `INSERT INTO votes (voice, author, thread) VALUES ($1, $2, $3)`,
+			params.Vote.Voice, params.Vote.Nickname, thread.ID)
+		if isForeignKeyViolation(err) {
+			return NotFound("Can't find user with nickname %s", params.Vote.Nickname)
+		}
+		if err != nil {
+			return dbError(ctx, err)
+		}
+
+		err = tx.GetContext(ctx, &thread, `UPDATE threads SET votes = votes + $1 WHERE id = $2 RETURNING forum, author, created, message, title, slug, id, votes, locked, pinned`, params.Vote.Voice, thread.ID)
+	} else if errExist == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE votes SET voice = $1 WHERE lower(author) = lower($2) AND thread = $3`,
+			params.Vote.Voice, params.Vote.Nickname, thread.ID)
+		if err != nil {
+			return dbError(ctx, err)
+		}
+
+		err = tx.GetContext(ctx, &thread, `UPDATE threads SET votes = (SELECT SUM(voice) FROM votes WHERE thread = $1)
+									WHERE id = $1 RETURNING forum, author, created, message, title, slug, id, votes, locked, pinned`, thread.ID)
+	} else {
+		err = errExist
+	}
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	event := voteEvent(&thread, principal.Nickname)
+	if err := dbManager.enqueueWebhooks(ctx, tx, event); err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	dbManager.publish(event)
+	return operations.NewThreadVoteOK().WithPayload(&thread)
+}
+
+//UserCreate ... OK OK
+func (dbManager ForumPgSQL) UserCreate(params operations.UserCreateParams) middleware.Responder {
+	// Keys are kept for a day, the password stays out of their fingerprints
+	profile := *params.Profile
+	profile.Password = ""
+	key, keyErr := newIdempotency(params.IdempotencyKey, "userCreate", nil, params.Nickname, &profile)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	// Users without password can't log in, but still can be referenced by posts and threads
+	var passwordHash *string
+	if params.Profile.Password != "" {
+		hash, err := hashPassword(string(params.Profile.Password))
+		if err != nil {
+			return Internal(err)
+		}
+		passwordHash = &hash
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "userCreate")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if replayed := dbManager.replay(ctx, tx, key); replayed != nil {
+		return replayed
+	}
+
+	user := models.User{}
+	users := models.Users{}
+
+	err = tx.SelectContext(ctx, &users, "SELECT nickname, fullname, about, email FROM users WHERE lower(users.nickname) = lower($1) OR lower(users.email) = lower($2)", params.Nickname, params.Profile.Email)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if len(users) != 0 {
+		return operations.NewUserCreateConflict().WithPayload(users)
+	}
+
+	err = tx.GetContext(ctx, &user, "INSERT INTO users (nickname, fullname, about, email, password_hash) VALUES ($1, $2, $3, $4, $5) RETURNING nickname, fullname, about, email",
+		params.Nickname, params.Profile.Fullname, params.Profile.About, params.Profile.Email, passwordHash)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := dbManager.remember(ctx, tx, key, http.StatusCreated, &user); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewUserCreateCreated().WithPayload(&user)
+}
+
+//UserGetOne ... OK
+func (dbManager ForumPgSQL) UserGetOne(params operations.UserGetOneParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "userGetOne")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	users := []models.User{}
+	if err := tx.SelectContext(ctx, &users, "SELECT nickname, fullname, about, email FROM users WHERE lower(users.nickname) = lower($1)", params.Nickname); err != nil {
+		return dbError(ctx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+
+	if len(users) == 0 {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+
+	return operations.NewUserGetOneOK().WithPayload(&users[0])
+}
+
+//UserUpdate ... OK OK
+func (dbManager ForumPgSQL) UserUpdate(params operations.UserUpdateParams, principal *models.Principal) middleware.Responder {
+	if !isPrincipal(principal, params.Nickname) {
+		return Forbidden("Profile of %s can be updated only by its owner", params.Nickname)
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "userUpdate")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	user := models.User{}
+	users := models.Users{}
+
+	err = tx.SelectContext(ctx, &users, `SELECT nickname FROM users
+		WHERE lower(users.nickname) = lower($1) OR lower(users.email) = COALESCE(lower($2), email)`, params.Nickname, params.Profile.Email)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if len(users) == 0 {
+		return NotFound("Can't find user with nickname %s", params.Nickname)
+	}
+	if len(users) > 1 {
+		return Conflict("Email %s is already used by another user", params.Profile.Email)
+	}
+
+	if params.Profile == nil {
+		return operations.NewUserUpdateOK().WithPayload(users[0])
+	}
+
+	query := `UPDATE users SET nickname = nickname`
+	args := []interface{}{params.Nickname}
+	if params.Profile.Fullname != "" {
+		args = append(args, params.Profile.Fullname)
+		query += `, fullname = $` + strconv.Itoa(len(args))
+	}
+	if params.Profile.Email != "" {
+		args = append(args, params.Profile.Email.String())
+		query += `, email = $` + strconv.Itoa(len(args))
+	}
+	if params.Profile.About != "" {
+		args = append(args, params.Profile.About)
+		query += `, about = $` + strconv.Itoa(len(args))
+	}
+	query += ` WHERE lower(nickname) = lower($1) RETURNING about, email, fullname, nickname`
+
+	if err := tx.GetContext(ctx, &user, query, args...); err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewUserUpdateOK().WithPayload(&user)
+}
+
+// UserLogin ... issues a session token
+func (dbManager ForumPgSQL) UserLogin(params operations.UserLoginParams) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "userLogin")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	user := userCredentials{}
+	err = tx.GetContext(ctx, &user, `SELECT id, nickname, password_hash FROM users WHERE lower(nickname) = lower($1)`, params.Nickname)
+	if err != nil && err != sql.ErrNoRows {
+		return dbError(ctx, err)
+	}
+	// Unknown nicknames are checked against a dummy hash too
+	if !checkPassword(user.PasswordHash.String, string(params.Credentials.Password)) {
+		return Unauthorized("Wrong nickname or password")
+	}
+
+	expires := strfmt.DateTime(time.Now().UTC().Add(SessionTTL))
+	token, err := dbManager.issueToken(ctx, tx, user.ID, &expires)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewUserLoginOK().WithPayload(&models.Token{Token: token, Nickname: user.Nickname, Expires: &expires})
+}
+
+// UserLogout ... revokes the token of the request
+func (dbManager ForumPgSQL) UserLogout(params operations.UserLogoutParams, principal *models.Principal) middleware.Responder {
+	if !isPrincipal(principal, params.Nickname) {
+		return Forbidden("Only %s can log out", params.Nickname)
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "userLogout")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	token := BearerToken(params.HTTPRequest.Header.Get("Authorization"))
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE token_hash = $1`, tokenHash(token)); err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewUserLogoutOK()
+}
+
+// UserTokenCreate ... issues a token without expiration
+func (dbManager ForumPgSQL) UserTokenCreate(params operations.UserTokenCreateParams, principal *models.Principal) middleware.Responder {
+	if !isPrincipal(principal, params.Nickname) {
+		return Forbidden("Tokens of %s can be issued only to its owner", params.Nickname)
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "userTokenCreate")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	user := userID{}
+	err = tx.GetContext(ctx, &user, `SELECT nickname, id FROM users WHERE lower(nickname) = lower($1)`, params.Nickname)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find user with nickname %s", params.Nickname)
+	}
+
+	token, err := dbManager.issueToken(ctx, tx, user.ID, nil)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewUserTokenCreateCreated().WithPayload(&models.Token{Token: token, Nickname: user.Nickname})
+}
+
+// Authenticate finds the owner of a token, it is the security handler of the API.
+func (dbManager ForumPgSQL) Authenticate(token string) (*models.Principal, error) {
+	if token == "" {
+		return nil, Unauthorized("Authorization token is required")
+	}
+
+	ctx, cancel := dbManager.operationContext(nil, "authenticate")
+	defer cancel()
+
+	principal := models.Principal{}
+	err := dbManager.db.GetContext(ctx, &principal, `SELECT users.nickname FROM tokens JOIN users ON users.id = tokens.user_id
+		WHERE tokens.token_hash = $1 AND (tokens.expires_at IS NULL OR tokens.expires_at > $2)`,
+		tokenHash(token), strfmt.DateTime(time.Now().UTC()))
+	if err == sql.ErrNoRows {
+		return nil, Unauthorized("Token is invalid or expired")
+	}
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	return &principal, nil
+}
+
+// BootstrapAdmins creates the accounts of Admins or resets their passwords, a reset revokes the tokens.
+func (dbManager ForumPgSQL) BootstrapAdmins(ctx context.Context, password string) *Error {
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	for _, nickname := range Admins {
+		user := userCredentials{}
+		err := tx.GetContext(ctx, &user, `SELECT id, nickname, password_hash FROM users WHERE lower(nickname) = lower($1)`, nickname)
+		if err != nil && err != sql.ErrNoRows {
+			return dbError(ctx, err)
+		}
+		if err == nil && checkPassword(user.PasswordHash.String, password) {
+			continue
+		}
+		hash, hashErr := hashPassword(password)
+		if hashErr != nil {
+			return Internal(hashErr)
+		}
+
+		if err == sql.ErrNoRows {
+			_, err = tx.ExecContext(ctx, `INSERT INTO users (nickname, fullname, about, email, password_hash) VALUES ($1, $1, '', $2, $3)`,
+				nickname, adminEmail(nickname), hash)
+		} else if _, err = tx.ExecContext(ctx, `UPDATE users SET password_hash = $2 WHERE id = $1`, user.ID, hash); err == nil {
+			// Whoever registered the nickname before it became an administrator loses the sessions
+			_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1`, user.ID)
+		}
+		if err != nil {
+			return dbError(ctx, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return nil
+}
+
+// issueToken stores the hash of a new token of the user, expires is nil for tokens without expiration.
+func (dbManager ForumPgSQL) issueToken(ctx context.Context, tx *tracedTx, userID int64, expires *strfmt.DateTime) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO tokens (token_hash, user_id, created, expires_at) VALUES ($1, $2, $3, $4)`,
+		tokenHash(token), userID, strfmt.DateTime(time.Now().UTC()), expires)
+	return token, err
+}
+
+// ForumSearch ...
+func (dbManager ForumPgSQL) ForumSearch(params operations.ForumSearchParams) middleware.Responder {
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("forumSearch", strings.ToLower(params.Slug), params.Q, desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumSearch")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	forum := forumID{}
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+
+	results, err := dbManager.search(ctx, tx, &forum, params.Q, params.Limit, params.Since, after, desc)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	response := operations.NewForumSearchOK().WithPayload(results)
+	if params.Limit != nil && len(results) == int(*params.Limit) {
+		response.WithXNextCursor(searchCursor(scope, results[len(results)-1]).encode())
+	}
+	return response
+}
+
+// Search ...
+func (dbManager ForumPgSQL) Search(params operations.SearchParams) middleware.Responder {
+	desc := params.Desc != nil && *params.Desc
+	scope := cursorScope("search", params.Q, desc)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "search")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	results, err := dbManager.search(ctx, tx, nil, params.Q, params.Limit, params.Since, after, desc)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	response := operations.NewSearchOK().WithPayload(results)
+	if params.Limit != nil && len(results) == int(*params.Limit) {
+		response.WithXNextCursor(searchCursor(scope, results[len(results)-1]).encode())
+	}
+	return response
+}
+
+// search looks for posts and threads using the tsvector columns from 0001-search.sql.
+// SQLite has no text search configurations, there the query is matched as a substring.
+// A cursor replaces since.
+func (dbManager ForumPgSQL) search(ctx context.Context, tx *tracedTx, forum *forumID, q string,
+	limit *int32, since *strfmt.DateTime, after *cursor, isDesc bool) (models.SearchResults, error) {
+
+	postMatch := `posts.message_tsv @@ plainto_tsquery('russian', $1)`
+	postRank := `ts_rank(posts.message_tsv, plainto_tsquery('russian', $1))`
+	postSnippet := `ts_headline('russian', posts.message, plainto_tsquery('russian', $1))`
+	threadMatch := `threads.search_tsv @@ plainto_tsquery('russian', $1)`
+	threadRank := `ts_rank(threads.search_tsv, plainto_tsquery('russian', $1))`
+	threadSnippet := `ts_headline('russian', threads.title || ': ' || threads.message, plainto_tsquery('russian', $1))`
+	if dbManager.dialect == "sqlite3" {
+		postMatch = `instr(lower(posts.message), lower($1)) > 0`
+		postRank = `1.0`
+		postSnippet = `substr(posts.message, 1, 200)`
+		threadMatch = `instr(lower(threads.title || ' ' || threads.message), lower($1)) > 0`
+		threadRank = `1.0`
+		threadSnippet = `substr(threads.title || ': ' || threads.message, 1, 200)`
+	}
+
+	postsQuery := `SELECT posts.id, posts.forum, posts.thread, posts.author, posts.created, posts.is_edited as isedited, posts.is_deleted as isdeleted,
+		posts.message, posts.parent, ` + postRank + ` AS rank, ` + postSnippet + ` AS snippet
+		FROM posts WHERE NOT posts.is_deleted
+		AND posts.thread NOT IN (SELECT id FROM threads WHERE deleted_at IS NOT NULL) AND ` + postMatch
+	threadsQuery := `SELECT threads.id, threads.forum, threads.author, threads.created, threads.message, threads.slug,
+		threads.title, threads.votes, threads.locked, threads.pinned, ` + threadRank + ` AS rank, ` + threadSnippet + ` AS snippet
+		FROM threads WHERE threads.deleted_at IS NULL AND ` + threadMatch
+
+	args := []interface{}{q}
+	if forum != nil {
+		args = append(args, forum.Slug)
+		postsQuery += ` AND posts.forum = $` + strconv.Itoa(len(args))
+		threadsQuery += ` AND threads.forum = $` + strconv.Itoa(len(args))
+	}
+
+	cmp := ">"
+	if isDesc {
+		cmp = "<"
+	}
+	if since != nil && after == nil {
+		args = append(args, *since)
+		postsQuery += ` AND posts.created ` + cmp + `= $` + strconv.Itoa(len(args))
+		threadsQuery += ` AND threads.created ` + cmp + `= $` + strconv.Itoa(len(args))
+	}
+	postArgs, threadArgs := args, args
+	if after != nil {
+		key, created, id := dbManager.timeParam(after.created()), `$`+strconv.Itoa(len(args)+1), `$`+strconv.Itoa(len(args)+2)
+		// Posts go before threads created at the same moment
+		if after.Kind == searchResultPost {
+			postsQuery += ` AND (posts.created ` + cmp + ` ` + created + ` OR posts.created = ` + created + ` AND posts.id ` + cmp + ` ` + id + `)`
+			postArgs = append(args[:len(args):len(args)], key, after.ID)
+			threadsQuery += ` AND threads.created ` + cmp + `= ` + created
+			threadArgs = append(args[:len(args):len(args)], key)
+		} else {
+			postsQuery += ` AND posts.created ` + cmp + ` ` + created
+			postArgs = append(args[:len(args):len(args)], key)
+			threadsQuery += ` AND (threads.created ` + cmp + ` ` + created + ` OR threads.created = ` + created + ` AND threads.id ` + cmp + ` ` + id + `)`
+			threadArgs = append(args[:len(args):len(args)], key, after.ID)
+		}
+	}
+
+	if isDesc {
+		postsQuery += ` ORDER BY posts.created DESC, posts.id DESC`
+		threadsQuery += ` ORDER BY threads.created DESC, threads.id DESC`
+	} else {
+		postsQuery += ` ORDER BY posts.created, posts.id`
+		threadsQuery += ` ORDER BY threads.created, threads.id`
+	}
+
+	maxResults := -1
+	if limit != nil {
+		maxResults = int(*limit)
+		postsQuery += ` LIMIT ` + strconv.Itoa(maxResults)
+		threadsQuery += ` LIMIT ` + strconv.Itoa(maxResults)
+	}
+
+	postRows := []postSearchRow{}
+	if err := tx.SelectContext(ctx, &postRows, postsQuery, postArgs...); err != nil {
+		return nil, err
+	}
+	threadRows := []threadSearchRow{}
+	if err := tx.SelectContext(ctx, &threadRows, threadsQuery, threadArgs...); err != nil {
+		return nil, err
+	}
+
+	posts := models.SearchResults{}
+	for idx := range postRows {
+		row := &postRows[idx]
+		posts = append(posts, &models.SearchResult{Type: searchResultPost, Rank: row.Rank, Snippet: row.Snippet, Post: &row.Post})
+	}
+	threads := models.SearchResults{}
+	for idx := range threadRows {
+		row := &threadRows[idx]
+		threads = append(threads, &models.SearchResult{Type: searchResultThread, Rank: row.Rank, Snippet: row.Snippet, Thread: &row.Thread})
+	}
+
+	return mergeSearchResults(posts, threads, isDesc, maxResults), nil
 }
 
 func SlugID(slugOrID string) (string, int64) {
@@ -781,3 +2649,805 @@ func SlugID(slugOrID string) (string, int64) {
 	}
 	return slug, id
 }
+
+const selectWebhooks = `SELECT webhooks.id, forums.slug AS forum, webhooks.url, webhooks.secret, webhooks.creator, webhooks.created
+	FROM webhooks
+	JOIN forums ON forums.id = webhooks.forum_id`
+
+// ForumWebhookCreate ...
+func (dbManager ForumPgSQL) ForumWebhookCreate(params operations.ForumWebhookCreateParams, principal *models.Principal) middleware.Responder {
+	if err := checkWebhookURL(params.Webhook.URL); err != nil {
+		return err
+	}
+	key, keyErr := newIdempotency(params.IdempotencyKey, "forumWebhookCreate", principal, params.Slug, params.Webhook)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumWebhookCreate")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	if replayed := dbManager.replay(ctx, tx, key); replayed != nil {
+		return replayed
+	}
+
+	forum := forumID{}
+	webhook := models.Webhook{}
+
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !can(role, permWebhooks) {
+		return Forbidden("Only the owner of forum %s can manage its webhooks", forum.Slug)
+	}
+
+	secret, err := newToken()
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	err = tx.GetContext(ctx, &webhook, `INSERT INTO webhooks (forum_id, url, secret, creator) VALUES ($1, $2, $3, $4)
+		RETURNING id, url, secret, creator, created`, forum.ID, params.Webhook.URL, secret, principal.Nickname)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	webhook.Forum = forum.Slug
+	// The secret is shown once, retries get the webhook without it
+	redacted := webhook
+	redacted.Secret = ""
+	if err := dbManager.remember(ctx, tx, key, http.StatusCreated, &redacted); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewForumWebhookCreateCreated().WithPayload(&webhook)
+}
+
+// ForumGetWebhooks ... secrets are shown only once, by ForumWebhookCreate
+func (dbManager ForumPgSQL) ForumGetWebhooks(params operations.ForumGetWebhooksParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumGetWebhooks")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	forum := forumID{}
+	webhooks := models.Webhooks{}
+
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !can(role, permWebhooks) {
+		return Forbidden("Only the owner of forum %s can manage its webhooks", forum.Slug)
+	}
+
+	if err := tx.SelectContext(ctx, &webhooks, selectWebhooks+` WHERE webhooks.forum_id = $1 ORDER BY webhooks.id`, forum.ID); err != nil {
+		return dbError(ctx, err)
+	}
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewForumGetWebhooksOK().WithPayload(webhooks)
+}
+
+// webhook loads the webhook with id, when principal may manage it.
+func (dbManager ForumPgSQL) webhook(ctx context.Context, tx *tracedTx, principal *models.Principal, id int64) (*models.Webhook, *Error) {
+	webhook := models.Webhook{}
+	err := tx.GetContext(ctx, &webhook, selectWebhooks+` WHERE webhooks.id = $1`, id)
+	if err != nil {
+		return nil, notFoundOr(ctx, err, "Can't find webhook with id %d", id)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, webhook.Forum)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	if !can(role, permWebhooks) {
+		return nil, Forbidden("Only the owner of forum %s can manage its webhooks", webhook.Forum)
+	}
+	webhook.Secret = ""
+	return &webhook, nil
+}
+
+// WebhookDelete ...
+func (dbManager ForumPgSQL) WebhookDelete(params operations.WebhookDeleteParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "webhookDelete")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	webhook, webhookErr := dbManager.webhook(ctx, tx, principal, params.ID)
+	if webhookErr != nil {
+		return webhookErr
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, webhook.ID); err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	return operations.NewWebhookDeleteOK().WithPayload(webhook)
+}
+
+// WebhookDeliveries ...
+func (dbManager ForumPgSQL) WebhookDeliveries(params operations.WebhookDeliveriesParams, principal *models.Principal) middleware.Responder {
+	scope := cursorScope("webhookDeliveries", params.ID)
+	after, cursorErr := decodeCursor(params.Cursor, scope)
+	if cursorErr != nil {
+		return cursorErr
+	}
+	if after != nil {
+		params.Since = &after.ID
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "webhookDeliveries")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	rows := []deliveryRow{}
+
+	if _, err := dbManager.webhook(ctx, tx, principal, params.ID); err != nil {
+		return err
+	}
+
+	query := `SELECT id, webhook_id AS webhook, payload, status, attempts, response_status AS responsestatus, error,
+		created, next_attempt AS nextattempt, delivered
+	FROM webhook_deliveries WHERE webhook_id = $1`
+	args := []interface{}{params.ID}
+	if params.Since != nil {
+		args = append(args, *params.Since)
+		query += ` AND id > $2`
+	}
+	query += ` ORDER BY id`
+	if params.Limit != nil {
+		query += ` LIMIT ` + strconv.FormatInt(int64(*params.Limit), 10)
+	}
+	if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+		return dbError(ctx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+
+	deliveries := models.WebhookDeliveries{}
+	for _, row := range rows {
+		delivery := row.WebhookDelivery
+		delivery.Event = &models.ForumEvent{}
+		if err := json.Unmarshal([]byte(row.Payload), delivery.Event); err != nil {
+			return dbError(ctx, err)
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	response := operations.NewWebhookDeliveriesOK().WithPayload(deliveries)
+	if params.Limit != nil && len(deliveries) == int(*params.Limit) {
+		response.WithXNextCursor(cursor{Scope: scope, ID: deliveries[len(deliveries)-1].ID}.encode())
+	}
+	return response
+}
+
+// enqueueWebhooks writes deliveries of events to the outbox in the transaction of the change itself,
+// so that an event is delivered if and only if the change is committed. Events belong to a single forum.
+func (dbManager ForumPgSQL) enqueueWebhooks(ctx context.Context, tx *tracedTx, events ...*models.ForumEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	webhooks := []int64{}
+	err := tx.SelectContext(ctx, &webhooks, `SELECT webhooks.id FROM webhooks
+		JOIN forums ON forums.id = webhooks.forum_id
+		WHERE lower(forums.slug) = lower($1)`, events[0].Forum)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	now := dbManager.timeParam(time.Now())
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		for _, webhook := range webhooks {
+			_, err := tx.ExecContext(ctx, `INSERT INTO webhook_deliveries (webhook_id, payload, created, next_attempt) VALUES ($1, $2, $3, $3)`,
+				webhook, string(payload), now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storedIdempotency is the request and the response remembered for an Idempotency-Key.
+type storedIdempotency struct {
+	Operation   string `db:"operation"`
+	Fingerprint string `db:"fingerprint"`
+	Status      int    `db:"status"`
+	Response    string `db:"response"`
+}
+
+// replay gives the remembered response of a retried request, nil when the request is to be performed.
+func (dbManager ForumPgSQL) replay(ctx context.Context, tx *tracedTx, key *idempotency) middleware.Responder {
+	if key == nil {
+		return nil
+	}
+	stored := storedIdempotency{}
+	err := tx.GetContext(ctx, &stored, `SELECT operation, fingerprint, status, response FROM idempotency_keys
+		WHERE owner = $1 AND idempotency_key = $2 AND expires > $3`, key.Owner, key.Key, dbManager.timeParam(time.Now()))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if err := key.check(stored.Operation, stored.Fingerprint); err != nil {
+		return err
+	}
+	return &storedResponse{Status: stored.Status, Body: []byte(stored.Response)}
+}
+
+// remember stores the response of a request in the transaction that performed it. Of concurrent requests
+// with the same key the first to commit wins, the others are rolled back with Conflict.
+// Expired keys of the owner are removed on the way.
+func (dbManager ForumPgSQL) remember(ctx context.Context, tx *tracedTx, key *idempotency, status int, payload interface{}) *Error {
+	if key == nil {
+		return nil
+	}
+	response, err := newStoredResponse(status, payload)
+	if err != nil {
+		return Internal(err)
+	}
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE owner = $1 AND expires <= $2`, key.Owner, dbManager.timeParam(now)); err != nil {
+		return dbError(ctx, err)
+	}
+	result, err := tx.ExecContext(ctx, `INSERT INTO idempotency_keys (owner, idempotency_key, operation, fingerprint, status, response, created, expires)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (owner, idempotency_key) DO NOTHING`,
+		key.Owner, key.Key, key.Operation, key.Fingerprint, response.Status, string(response.Body),
+		dbManager.timeParam(now), dbManager.timeParam(now.Add(IdempotencyTTL)))
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return dbError(ctx, err)
+	} else if rows == 0 {
+		return key.conflict()
+	}
+	return nil
+}
+
+// leaseDeliveries ... the lease moves next_attempt forward, a worker of another instance checks it again
+// after taking the row lock, so a delivery is leased only once
+func (dbManager ForumPgSQL) leaseDeliveries(now time.Time, limit int) ([]webhookJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbManager.timeouts.Default)
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	leased := []leasedDelivery{}
+	err = tx.SelectContext(ctx, &leased, `UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt = $2
+		WHERE status = 'pending' AND next_attempt <= $1 AND id IN (
+			SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt <= $1
+			ORDER BY next_attempt, id LIMIT $3)
+		RETURNING id, webhook_id, payload, attempts`,
+		dbManager.timeParam(now), dbManager.timeParam(now.Add(webhookLease())), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []webhookJob{}
+	for _, delivery := range leased {
+		job := webhookJob{ID: delivery.ID, Payload: []byte(delivery.Payload), Attempts: delivery.Attempts}
+		err := tx.QueryRowxContext(ctx, `SELECT url, secret FROM webhooks WHERE id = $1`, delivery.Webhook).Scan(&job.URL, &job.Secret)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// completeDelivery ...
+func (dbManager ForumPgSQL) completeDelivery(job webhookJob, result webhookResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbManager.timeouts.Default)
+	defer cancel()
+
+	var delivered interface{}
+	if result.Delivered != nil {
+		delivered = dbManager.timeParam(*result.Delivered)
+	}
+	_, err := dbManager.db.ExecContext(ctx, `UPDATE webhook_deliveries
+		SET status = $2, response_status = $3, error = $4, next_attempt = $5, delivered = $6 WHERE id = $1`,
+		job.ID, result.Status, result.Response, result.Error, dbManager.timeParam(result.NextAttempt), delivered)
+	return err
+}
+
+// importColumns are the columns of the staging tables of an import, in the order records are written.
+var importColumns = map[string][]string{
+	"import_users":   {"nickname", "fullname", "email", "about"},
+	"import_forums":  {"slug", "title", "author"},
+	"import_threads": {"id", "forum", "author", "created", "message", "slug", "title"},
+	"import_posts":   {"id", "thread", "author", "created", "message", "parent", "is_edited", "is_deleted"},
+	"import_votes":   {"thread", "author", "voice"},
+}
+
+// importStaging creates the temporary tables a dump is staged in, they live until the end of the import.
+var importStaging = []string{
+	`CREATE TEMP TABLE import_users (nickname TEXT, fullname TEXT, email TEXT, about TEXT)`,
+	`CREATE TEMP TABLE import_forums (slug TEXT, title TEXT, author TEXT)`,
+	`CREATE TEMP TABLE import_threads (id INT, forum TEXT, author TEXT, created TIMESTAMPTZ, message TEXT, slug TEXT, title TEXT)`,
+	`CREATE TEMP TABLE import_posts (id INT, thread INT, author TEXT, created TIMESTAMPTZ, message TEXT, parent INT,
+		is_edited BOOLEAN, is_deleted BOOLEAN)`,
+	`CREATE TEMP TABLE import_votes (thread INT, author TEXT, voice INT)`,
+}
+
+// importStep moves a kind of staged records to the forum. Checks return a description of a staged
+// record referring to something that doesn't exist, conflicts of a record taking an existing id.
+type importStep struct {
+	conflicts []string
+	checks    []string
+	moves     []string
+}
+
+// importSteps gives the statements of an import, paths of posts are INT[] in PostgreSQL and
+// dot separated zero-padded ids in SQLite.
+func (dbManager ForumPgSQL) importSteps() []importStep {
+	rootPath, childPath := `ARRAY[p.id]`, `tree.path || p.id`
+	parentPath := `posts.path || p.id`
+	if dbManager.dialect != "postgres" {
+		rootPath, childPath = `printf('%010d', p.id)`, `tree.path || '.' || printf('%010d', p.id)`
+		parentPath = `posts.path || '.' || printf('%010d', p.id)`
+	}
+	return []importStep{{
+		// Users already here are matched by nickname, exports of forum owners have no emails
+		conflicts: []string{
+			`SELECT 'User ' || i.nickname || ' exists with another email' FROM import_users i
+			JOIN users ON lower(users.nickname) = lower(i.nickname)
+			WHERE i.email <> '' AND lower(users.email) <> lower(i.email) LIMIT 1`,
+			`SELECT 'User ' || MIN(nickname) || ' is in the dump twice' FROM import_users GROUP BY lower(nickname) HAVING COUNT(*) > 1 LIMIT 1`,
+		},
+		checks: []string{
+			`SELECT 'User ' || i.nickname || ' is new and needs an email' FROM import_users i
+			WHERE i.email = '' AND NOT EXISTS (SELECT 1 FROM users WHERE lower(users.nickname) = lower(i.nickname)) LIMIT 1`,
+		},
+		moves: []string{
+			`INSERT INTO users (nickname, fullname, email, about) SELECT nickname, fullname, email, about FROM import_users i
+			WHERE NOT EXISTS (SELECT 1 FROM users WHERE lower(users.nickname) = lower(i.nickname))`,
+		},
+	}, {
+		conflicts: []string{
+			`SELECT 'Forum ' || f.slug || ' already exists' FROM import_forums f
+			WHERE EXISTS (SELECT 1 FROM forums WHERE lower(forums.slug) = lower(f.slug)) LIMIT 1`,
+			`SELECT 'Forum ' || MIN(slug) || ' is in the dump twice' FROM import_forums GROUP BY lower(slug) HAVING COUNT(*) > 1 LIMIT 1`,
+		},
+		checks: []string{
+			`SELECT 'Forum ' || f.slug || ' is created by unknown user ' || f.author FROM import_forums f
+			WHERE NOT EXISTS (SELECT 1 FROM users WHERE lower(users.nickname) = lower(f.author)) LIMIT 1`,
+		},
+		moves: []string{
+			`INSERT INTO forums (slug, title, author) SELECT f.slug, f.title, users.nickname
+			FROM import_forums f JOIN users ON lower(users.nickname) = lower(f.author)`,
+		},
+	}, {
+		conflicts: []string{
+			`SELECT 'Thread ' || t.id || ' already exists' FROM import_threads t
+			WHERE EXISTS (SELECT 1 FROM threads WHERE threads.id = t.id) LIMIT 1`,
+			`SELECT 'Thread ' || id || ' is in the dump twice' FROM import_threads GROUP BY id HAVING COUNT(*) > 1 LIMIT 1`,
+		},
+		checks: []string{
+			`SELECT 'Thread ' || t.id || ' is in unknown forum ' || t.forum FROM import_threads t
+			WHERE NOT EXISTS (SELECT 1 FROM forums WHERE lower(forums.slug) = lower(t.forum)) LIMIT 1`,
+			`SELECT 'Thread ' || t.id || ' is created by unknown user ' || t.author FROM import_threads t
+			WHERE NOT EXISTS (SELECT 1 FROM users WHERE lower(users.nickname) = lower(t.author)) LIMIT 1`,
+			`SELECT 'Thread ' || t.id || ' has slug ' || t.slug || ' of another thread' FROM import_threads t
+			WHERE t.slug <> '' AND (
+				EXISTS (SELECT 1 FROM threads WHERE lower(threads.slug) = lower(t.slug) AND threads.deleted_at IS NULL) OR
+				EXISTS (SELECT 1 FROM import_threads other WHERE lower(other.slug) = lower(t.slug) AND other.id <> t.id)) LIMIT 1`,
+		},
+		moves: []string{
+			`INSERT INTO threads (id, forum, forum_id, author, author_id, created, message, slug, title)
+			SELECT t.id, forums.slug, forums.id, users.nickname, users.id, t.created, t.message, t.slug, t.title
+			FROM import_threads t
+			JOIN forums ON lower(forums.slug) = lower(t.forum)
+			JOIN users ON lower(users.nickname) = lower(t.author)`,
+			`UPDATE forums SET threads = threads + (SELECT COUNT(*) FROM import_threads t WHERE lower(t.forum) = lower(forums.slug))
+			WHERE lower(slug) IN (SELECT lower(forum) FROM import_threads)`,
+		},
+	}, {
+		// Posts replying to a post with their own id would make the tree below endless
+		conflicts: []string{
+			`SELECT 'Post ' || p.id || ' already exists' FROM import_posts p
+			WHERE EXISTS (SELECT 1 FROM posts WHERE posts.id = p.id) LIMIT 1`,
+			`SELECT 'Post ' || id || ' is in the dump twice' FROM import_posts GROUP BY id HAVING COUNT(*) > 1 LIMIT 1`,
+		},
+		checks: []string{
+			`SELECT 'Post ' || p.id || ' is in unknown thread ' || p.thread FROM import_posts p
+			WHERE NOT EXISTS (SELECT 1 FROM threads WHERE threads.id = p.thread) LIMIT 1`,
+			`SELECT 'Post ' || p.id || ' is written by unknown user ' || p.author FROM import_posts p
+			WHERE p.author <> '' AND NOT EXISTS (SELECT 1 FROM users WHERE lower(users.nickname) = lower(p.author)) LIMIT 1`,
+			`SELECT 'Post ' || p.id || ' replies to post ' || p.parent || ' missing in its thread' FROM import_posts p
+			WHERE p.parent <> 0
+			AND NOT EXISTS (SELECT 1 FROM import_posts parent WHERE parent.id = p.parent AND parent.thread = p.thread)
+			AND NOT EXISTS (SELECT 1 FROM posts parent WHERE parent.id = p.parent AND parent.thread = p.thread) LIMIT 1`,
+		},
+		moves: []string{
+			// Posts are inserted parents first, SQLite computes paths in its trigger from the parent row
+			`WITH RECURSIVE tree (id, thread, path, root_id, depth) AS (
+				SELECT p.id, p.thread,
+					CASE WHEN p.parent = 0 THEN ` + rootPath + ` ELSE ` + parentPath + ` END,
+					CASE WHEN p.parent = 0 THEN p.id ELSE posts.root_id END, 1
+				FROM import_posts p LEFT JOIN posts ON posts.id = p.parent AND posts.thread = p.thread
+				WHERE p.parent = 0 OR posts.id IS NOT NULL
+				UNION ALL
+				SELECT p.id, p.thread, ` + childPath + `, tree.root_id, tree.depth + 1
+				FROM tree JOIN import_posts p ON p.parent = tree.id AND p.thread = tree.thread
+			)
+			INSERT INTO posts (id, forum, thread, author, created, is_edited, is_deleted, message, parent, path, root_id)
+			SELECT p.id, threads.forum, p.thread, COALESCE(users.nickname, ''), p.created, p.is_edited, p.is_deleted, p.message,
+				p.parent, tree.path, tree.root_id
+			FROM tree
+			JOIN import_posts p ON p.id = tree.id
+			JOIN threads ON threads.id = p.thread
+			LEFT JOIN users ON lower(users.nickname) = lower(p.author)
+			ORDER BY tree.depth`,
+			`UPDATE forums SET posts = posts + (
+				SELECT COUNT(*) FROM import_posts p JOIN threads ON threads.id = p.thread
+				WHERE threads.forum_id = forums.id AND NOT p.is_deleted)
+			WHERE id IN (SELECT threads.forum_id FROM import_posts p JOIN threads ON threads.id = p.thread)`,
+		},
+	}, {
+		checks: []string{
+			`SELECT 'Vote of ' || v.author || ' is for unknown thread ' || v.thread FROM import_votes v
+			WHERE NOT EXISTS (SELECT 1 FROM threads WHERE threads.id = v.thread) LIMIT 1`,
+			`SELECT 'Vote for thread ' || v.thread || ' is of unknown user ' || v.author FROM import_votes v
+			WHERE NOT EXISTS (SELECT 1 FROM users WHERE lower(users.nickname) = lower(v.author)) LIMIT 1`,
+		},
+		moves: []string{
+			`INSERT INTO votes (author, thread, voice) SELECT users.nickname, v.thread, v.voice
+			FROM import_votes v JOIN users ON lower(users.nickname) = lower(v.author)`,
+			`UPDATE threads SET votes = (SELECT COALESCE(SUM(voice), 0) FROM votes WHERE votes.thread = threads.id)
+			WHERE id IN (SELECT thread FROM import_votes)`,
+		},
+	}, {
+		moves: []string{
+			`INSERT INTO forum_users (author_id, forum_id)
+			SELECT DISTINCT author_id, forum_id FROM (
+				SELECT threads.author_id, threads.forum_id FROM import_threads t JOIN threads ON threads.id = t.id
+				UNION
+				SELECT users.id, threads.forum_id FROM import_posts p
+				JOIN threads ON threads.id = p.thread
+				JOIN users ON lower(users.nickname) = lower(p.author)
+			) AS authors WHERE true
+			ON CONFLICT (author_id, forum_id) DO NOTHING`,
+		},
+	}}
+}
+
+// Import ... the dump is staged in temporary tables, with COPY on PostgreSQL, and moved to the forum
+// by a few statements, the whole import is a single transaction
+func (dbManager ForumPgSQL) Import(ctx context.Context, dump io.Reader, placeholderEmails bool) (*models.ImportResult, *Error) {
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return nil, dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	for _, statement := range importStaging {
+		if dbManager.dialect != "postgres" {
+			statement = strings.Replace(statement, "TIMESTAMPTZ", "TIMESTAMP", -1)
+		}
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return nil, dbError(ctx, err)
+		}
+	}
+
+	stage := &importStage{ctx: ctx, tx: tx.Tx, copy: dbManager.dialect == "postgres", stmts: map[string]*sqlx.Stmt{}}
+	defer stage.close()
+	now := time.Now()
+	result, err := readDump(dump, func(record *dumpRecord) error {
+		switch record.Type {
+		case DumpUser:
+			return stage.add("import_users", record.Nickname, record.Fullname, record.Email, record.About)
+		case DumpForum:
+			return stage.add("import_forums", record.Slug, record.Title, record.User)
+		case DumpThread:
+			return stage.add("import_threads", record.ID, record.Forum, record.Author,
+				dbManager.timeParam(record.created(now)), record.Message, record.Slug, record.Title)
+		case DumpPost:
+			return stage.add("import_posts", record.ID, record.Thread, record.Author,
+				dbManager.timeParam(record.created(now)), record.Message, record.Parent, record.Edited, record.Deleted)
+		default:
+			return stage.add("import_votes", record.Thread, record.Nickname, record.Voice)
+		}
+	})
+	if err != nil {
+		return nil, importError(ctx, err)
+	}
+	if err := stage.close(); err != nil {
+		return nil, dbError(ctx, err)
+	}
+
+	prepare := []string{
+		`CREATE INDEX import_posts_id_index ON import_posts (id)`,
+		`CREATE INDEX import_posts_parent_index ON import_posts (parent)`,
+	}
+	if placeholderEmails {
+		// Users already here are matched by nickname and keep their emails
+		prepare = append(prepare, `UPDATE import_users SET email = lower(nickname) || '@`+PlaceholderEmailDomain+`'
+			WHERE email = '' AND NOT EXISTS (SELECT 1 FROM users WHERE lower(users.nickname) = lower(import_users.nickname))`)
+	}
+	finish := []string{}
+	if dbManager.dialect == "postgres" {
+		// Triggers of paths and events skip rows of this transaction, see db/postgres/0013-import-setting.sql.
+		// Disabling them would lock the tables against writes of the forum for the whole import.
+		prepare = append(prepare, `ANALYZE import_posts`, `SET LOCAL forum.import = 'on'`)
+		// Imported ids are taken, the next threads and posts get ids after them
+		for _, table := range []string{"threads", "posts"} {
+			finish = append(finish, `SELECT setval(pg_get_serial_sequence('`+table+`', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM `+table)
+		}
+	}
+	for _, table := range []string{"import_users", "import_forums", "import_threads", "import_posts", "import_votes"} {
+		finish = append(finish, `DROP TABLE `+table)
+	}
+	for _, statement := range prepare {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return nil, dbError(ctx, err)
+		}
+	}
+
+	for _, step := range dbManager.importSteps() {
+		if problem, err := importProblem(ctx, tx, step.conflicts); err != nil || problem != "" {
+			return nil, importFailure(ctx, err, Conflict("%s", problem))
+		}
+		if problem, err := importProblem(ctx, tx, step.checks); err != nil || problem != "" {
+			return nil, importFailure(ctx, err, Validation("%s", problem))
+		}
+		for _, move := range step.moves {
+			if _, err := tx.ExecContext(ctx, move); err != nil {
+				return nil, dbError(ctx, err)
+			}
+		}
+	}
+
+	// Posts are reachable from a root only unless their parents make a cycle
+	var moved int64
+	if err := tx.GetContext(ctx, &moved, `SELECT COUNT(*) FROM posts WHERE id IN (SELECT id FROM import_posts)`); err != nil {
+		return nil, dbError(ctx, err)
+	}
+	if moved != result.Posts {
+		return nil, Validation("%d posts reply to each other in a cycle", result.Posts-moved)
+	}
+
+	for _, statement := range finish {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return nil, dbError(ctx, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, dbError(ctx, err)
+	}
+	return result, nil
+}
+
+// importProblem runs checks until one of them finds a problem.
+func importProblem(ctx context.Context, tx *tracedTx, checks []string) (string, error) {
+	for _, check := range checks {
+		var problem string
+		if err := tx.GetContext(ctx, &problem, check); err != sql.ErrNoRows {
+			return problem, err
+		}
+	}
+	return "", nil
+}
+
+// importFailure is problem unless the check itself failed.
+func importFailure(ctx context.Context, err error, problem *Error) *Error {
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	return problem
+}
+
+// importStage writes records to the staging tables of an import without a span per row. PostgreSQL
+// gets a COPY per run of records of a table, a single COPY can be in progress at a time.
+type importStage struct {
+	ctx   context.Context
+	tx    *sqlx.Tx
+	copy  bool
+	stmts map[string]*sqlx.Stmt
+}
+
+func (stage *importStage) add(table string, values ...interface{}) error {
+	stmt, ok := stage.stmts[table]
+	if !ok {
+		if stage.copy {
+			if err := stage.close(); err != nil {
+				return err
+			}
+		}
+		columns := importColumns[table]
+		query := pq.CopyIn(table, columns...)
+		if !stage.copy {
+			params := make([]string, len(columns))
+			for i := range columns {
+				params[i] = `$` + strconv.Itoa(i+1)
+			}
+			query = `INSERT INTO ` + table + ` (` + strings.Join(columns, ", ") + `) VALUES (` + strings.Join(params, ", ") + `)`
+		}
+		var err error
+		if stmt, err = stage.tx.PreparexContext(stage.ctx, query); err != nil {
+			return err
+		}
+		stage.stmts[table] = stmt
+	}
+	_, err := stmt.ExecContext(stage.ctx, values...)
+	return err
+}
+
+// close finishes the COPY in progress and closes the statements.
+func (stage *importStage) close() error {
+	var result error
+	for table, stmt := range stage.stmts {
+		if stage.copy {
+			if _, err := stmt.ExecContext(stage.ctx); err != nil && result == nil {
+				result = err
+			}
+		}
+		if err := stmt.Close(); err != nil && result == nil {
+			result = err
+		}
+		delete(stage.stmts, table)
+	}
+	return result
+}
+
+// ForumExport ... the forum and the role are checked before the response, records are read while it is written
+func (dbManager ForumPgSQL) ForumExport(params operations.ForumExportParams, principal *models.Principal) middleware.Responder {
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "forumExport")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	forum := forumID{}
+	err = tx.GetContext(ctx, &forum, `SELECT slug, id FROM forums WHERE lower(slug) = lower($1)`, params.Slug)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", params.Slug)
+	}
+	role, err := dbManager.forumRole(ctx, tx, principal, forum.Slug)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	if !can(role, permExport) {
+		return Forbidden("Only the owner of forum %s can export it", forum.Slug)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+	// The export outlives the operation timeout, it lasts while the client reads
+	request := params.HTTPRequest.Context()
+	return &dumpStream{request: params.HTTPRequest, slug: forum.Slug, format: *params.Format, export: func(dump *dumpWriter) *Error {
+		return dbManager.exportForum(request, forum.Slug, role == RoleAdmin, dump)
+	}}
+}
+
+// Export ... with emails of users
+func (dbManager ForumPgSQL) Export(ctx context.Context, slug, format string, dump io.Writer) *Error {
+	return writeDump(dump, format, func(records *dumpWriter) *Error {
+		return dbManager.exportForum(ctx, slug, true, records)
+	})
+}
+
+// exportForum writes a forum from a single snapshot: users taking part in it, the forum, its threads,
+// posts in path order and votes, so every record refers to records written before it.
+// Deleted threads are left out with their posts and votes.
+func (dbManager ForumPgSQL) exportForum(ctx context.Context, slug string, private bool, dump *dumpWriter) *Error {
+	tx, err := dbManager.beginSnapshot(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	forum := dumpRecord{Type: DumpForum}
+	err = tx.QueryRowxContext(ctx, `SELECT id, slug, title, COALESCE(author, '') FROM forums WHERE lower(slug) = lower($1)`, slug).
+		Scan(&id, &forum.Slug, &forum.Title, &forum.User)
+	if err != nil {
+		return notFoundOr(ctx, err, "Can't find forum with slug %s", slug)
+	}
+
+	email := `email`
+	if !private {
+		email = `'' AS email`
+	}
+	if err := exportRows(ctx, tx, dump, DumpUser, `SELECT nickname, fullname, `+email+`, COALESCE(about, '') AS about FROM users
+		WHERE id IN (SELECT author_id FROM forum_users WHERE forum_id = $1) OR lower(nickname) = lower($2)
+		OR lower(nickname) IN (SELECT lower(votes.author) FROM votes JOIN threads ON threads.id = votes.thread
+			WHERE threads.forum_id = $1 AND threads.deleted_at IS NULL)
+		ORDER BY lower(nickname)`, id, forum.User); err != nil {
+		return err
+	}
+	if err := dump.write(&forum); err != nil {
+		return dbError(ctx, err)
+	}
+	if err := exportRows(ctx, tx, dump, DumpThread, `SELECT id, forum, author, created, message, COALESCE(slug, '') AS slug, title
+		FROM threads WHERE forum_id = $1 AND deleted_at IS NULL ORDER BY id`, id); err != nil {
+		return err
+	}
+	if err := exportRows(ctx, tx, dump, DumpPost, `SELECT posts.id, posts.thread, posts.author, posts.created, posts.message,
+			COALESCE(posts.parent, 0) AS parent, posts.is_edited, posts.is_deleted
+		FROM posts JOIN threads ON threads.id = posts.thread
+		WHERE threads.forum_id = $1 AND threads.deleted_at IS NULL ORDER BY posts.thread, posts.path`, id); err != nil {
+		return err
+	}
+	return exportRows(ctx, tx, dump, DumpVote, `SELECT votes.thread, votes.author AS nickname, votes.voice
+		FROM votes JOIN threads ON threads.id = votes.thread
+		WHERE threads.forum_id = $1 AND threads.deleted_at IS NULL ORDER BY votes.thread, lower(votes.author)`, id)
+}
+
+// exportRows writes every row of query as a record of the given type.
+func exportRows(ctx context.Context, tx *tracedTx, dump *dumpWriter, kind, query string, args ...interface{}) *Error {
+	rows, err := tx.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record := dumpRecord{Type: kind}
+		if err := rows.StructScan(&record); err != nil {
+			return dbError(ctx, err)
+		}
+		if err := dump.write(&record); err != nil {
+			return dbError(ctx, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(ctx, err)
+	}
+	return nil
+}
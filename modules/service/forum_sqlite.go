@@ -0,0 +1,76 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/couatl/forum-db-api/restapi/operations"
+	"github.com/go-openapi/runtime/middleware"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ForumSQLite reuses ForumPgSQL queries on top of the schema from db/sqlite,
+// where posts.path is a dot separated list of zero-padded ids instead of INT[].
+type ForumSQLite struct {
+	ForumPgSQL
+}
+
+func NewForumSQLite(dataSourceName string) ForumHandler {
+	if !strings.Contains(dataSourceName, "_foreign_keys") {
+		if strings.Contains(dataSourceName, "?") {
+			dataSourceName += "&_foreign_keys=1"
+		} else {
+			dataSourceName += "?_foreign_keys=1"
+		}
+	}
+	generic := NewForumGeneric("sqlite3", dataSourceName)
+	// SQLite allows a single writer, and every connection to :memory: opens its own database.
+	generic.db.SetMaxOpenConns(1)
+	dbManager := ForumSQLite{ForumPgSQL: ForumPgSQL{ForumGeneric: generic}}
+	dbManager.webhooks = startWebhooks(dbManager.ForumPgSQL, generic.logger)
+	return dbManager
+}
+
+// Clear ... SQLite has no TRUNCATE
+func (dbManager ForumSQLite) Clear(params operations.ClearParams, principal *models.Principal) middleware.Responder {
+	if err := authorizeClear(principal); err != nil {
+		return err
+	}
+
+	ctx, cancel := dbManager.operationContext(params.HTTPRequest, "clear")
+	defer cancel()
+
+	tx, err := dbManager.begin(ctx)
+	if err != nil {
+		return dbError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"webhook_deliveries", "webhooks", "reports", "bans", "forum_roles", "idempotency_keys", "post_revisions", "thread_revisions", "forum_users", "votes", "posts", "threads", "forums", "sqlite_sequence"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table); err != nil {
+			return dbError(ctx, err)
+		}
+	}
+	// Accounts of administrators are kept with their tokens
+	admins := adminNicknames()
+	args := make([]interface{}, len(admins))
+	placeholders := make([]string, len(admins))
+	for i, admin := range admins {
+		args[i] = admin
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	keep := `lower(nickname) NOT IN (` + strings.Join(placeholders, ", ") + `)`
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id IN (SELECT id FROM users WHERE `+keep+`)`, args...); err != nil {
+		return dbError(ctx, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE `+keep, args...); err != nil {
+		return dbError(ctx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError(ctx, err)
+	}
+
+	return operations.NewClearOK()
+}
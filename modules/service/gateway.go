@@ -0,0 +1,162 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// GatewayHeartbeat is the interval of pings, a connection that misses two pongs in a row is closed.
+var GatewayHeartbeat = 30 * time.Second
+
+// GatewayMaxSubscriptions limits the number of topics of a single connection.
+var GatewayMaxSubscriptions = 50
+
+// gatewayWriteTimeout limits a single write, a client that doesn't read is disconnected.
+const gatewayWriteTimeout = 10 * time.Second
+
+// gatewayReadLimit is the size limit of a message from a client.
+const gatewayReadLimit = 4096
+
+// Gateway actions and replies.
+const (
+	actionSubscribe   = "subscribe"
+	actionUnsubscribe = "unsubscribe"
+	replySubscribed   = "subscribed"
+	replyError        = "error"
+)
+
+// gatewayRequest changes the topics of a connection, e.g. {"action": "subscribe", "topics": ["forum:pirates", "thread:42"]}.
+type gatewayRequest struct {
+	Action string   `json:"action"`
+	Topics []string `json:"topics"`
+}
+
+// gatewayReply answers a request with the resulting topics of the connection or with an error.
+type gatewayReply struct {
+	Type    string   `json:"type"`
+	Topics  []string `json:"topics,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+var gatewayUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// gateway serves events of hub over WebSocket. Initial topics may be given by topic query parameters.
+type gateway struct {
+	hub *eventHub
+}
+
+func (gw gateway) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	conn, err := gatewayUpgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	sub := gw.hub.subscribe()
+	defer gw.hub.unsubscribe(sub)
+
+	replies := make(chan gatewayReply, 1)
+	closing := make(chan struct{})
+	defer close(closing)
+	if topics := r.URL.Query()["topic"]; len(topics) > 0 {
+		replies <- gw.handle(sub, gatewayRequest{Action: actionSubscribe, Topics: topics})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gw.read(conn, sub, replies, closing)
+	}()
+	gw.write(conn, sub, replies, done)
+}
+
+// read handles requests of the client until the connection is broken or it misses heartbeats.
+func (gw gateway) read(conn *websocket.Conn, sub *subscription, replies chan<- gatewayReply, closing <-chan struct{}) {
+	conn.SetReadLimit(gatewayReadLimit)
+	conn.SetReadDeadline(time.Now().Add(2 * GatewayHeartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * GatewayHeartbeat))
+	})
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		request := gatewayRequest{}
+		reply := gatewayReply{}
+		if err := json.Unmarshal(message, &request); err != nil {
+			reply = gatewayReply{Type: replyError, Message: "Malformed request: " + err.Error()}
+		} else {
+			reply = gw.handle(sub, request)
+		}
+		select {
+		case replies <- reply:
+		case <-closing:
+			return
+		}
+	}
+}
+
+func (gw gateway) handle(sub *subscription, request gatewayRequest) gatewayReply {
+	topics := []string{}
+	for _, topic := range request.Topics {
+		parsed, err := parseTopic(topic)
+		if err != nil {
+			return gatewayReply{Type: replyError, Message: err.Message}
+		}
+		topics = append(topics, parsed)
+	}
+
+	switch request.Action {
+	case actionSubscribe:
+		if !gw.hub.listen(sub, GatewayMaxSubscriptions, topics...) {
+			return gatewayReply{Type: replyError, Message: fmt.Sprintf("At most %d topics per connection", GatewayMaxSubscriptions)}
+		}
+	case actionUnsubscribe:
+		gw.hub.ignore(sub, topics...)
+	default:
+		return gatewayReply{Type: replyError, Message: fmt.Sprintf("Unknown action %q", request.Action)}
+	}
+	return gatewayReply{Type: replySubscribed, Topics: gw.hub.topicsOf(sub)}
+}
+
+// write sends events, replies and pings. A client too slow to take events is disconnected
+// with 1013 (try again later) once the hub drops its subscription.
+func (gw gateway) write(conn *websocket.Conn, sub *subscription, replies <-chan gatewayReply, done <-chan struct{}) {
+	heartbeat := time.NewTicker(GatewayHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var message interface{}
+		select {
+		case <-done:
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Too slow to receive events"),
+					time.Now().Add(gatewayWriteTimeout))
+				return
+			}
+			message = event
+		case reply := <-replies:
+			message = reply
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(gatewayWriteTimeout)); err != nil {
+				return
+			}
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(gatewayWriteTimeout))
+		if err := conn.WriteJSON(message); err != nil {
+			return
+		}
+	}
+}
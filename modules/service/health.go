@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-openapi/runtime"
+	"github.com/rubenv/sql-migrate"
+)
+
+// Health check statuses.
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// ReadyTimeout limits the checks of a readiness probe.
+var ReadyTimeout = 2 * time.Second
+
+// migrationTable is where sql-migrate records applied migrations, the default one.
+const migrationTable = "gorp_migrations"
+
+// HealthCheck is the result of a single readiness check.
+type HealthCheck struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Health is the answer of /healthz and /readyz.
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+func healthCheck(err error, details interface{}) HealthCheck {
+	if err != nil {
+		return HealthCheck{Status: HealthFail, Error: err.Error(), Details: details}
+	}
+	return HealthCheck{Status: HealthOK, Details: details}
+}
+
+// Liveness answers while the process can serve HTTP at all, it doesn't look at the storage.
+func Liveness() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		writeHealth(rw, Health{Status: HealthOK})
+	})
+}
+
+// Readiness answers 200 when every check of handler passes within ReadyTimeout and 503 otherwise.
+func Readiness(handler ForumHandler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), ReadyTimeout)
+		defer cancel()
+
+		health := Health{Status: HealthOK, Checks: handler.Ready(ctx)}
+		for _, check := range health.Checks {
+			if check.Status != HealthOK {
+				health.Status = HealthFail
+			}
+		}
+		writeHealth(rw, health)
+	})
+}
+
+func writeHealth(rw http.ResponseWriter, health Health) {
+	status := http.StatusOK
+	if health.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+	rw.Header().Set(runtime.HeaderContentType, runtime.JSONMime)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(health)
+}
+
+// databaseDetails tell which database was pinged and how long it took, in seconds.
+type databaseDetails struct {
+	Dialect string  `json:"dialect"`
+	Latency float64 `json:"latency,omitempty"`
+}
+
+// poolDetails describe the connection pool of a backend.
+type poolDetails struct {
+	MaxOpen   int   `json:"max_open"`
+	Open      int   `json:"open"`
+	InUse     int   `json:"in_use"`
+	Idle      int   `json:"idle"`
+	WaitCount int64 `json:"wait_count"`
+}
+
+func newPoolDetails(stats sql.DBStats) poolDetails {
+	return poolDetails{
+		MaxOpen:   stats.MaxOpenConnections,
+		Open:      stats.OpenConnections,
+		InUse:     stats.InUse,
+		Idle:      stats.Idle,
+		WaitCount: stats.WaitCount,
+	}
+}
+
+// migrationDetails compare the migrations of the binary with the ones applied to the database.
+type migrationDetails struct {
+	Version int      `json:"version"`
+	Pending []string `json:"pending"`
+}
+
+// pendingMigrations lists the migrations of source that have no record in applied.
+func pendingMigrations(source migrate.MigrationSource, applied map[string]bool) ([]string, error) {
+	migrations, err := source.FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+	pending := []string{}
+	for _, migration := range migrations {
+		if !applied[migration.Id] {
+			pending = append(pending, migration.Id)
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"regexp"
+
+	"github.com/couatl/forum-db-api/models"
+)
+
+const (
+	diffEqual  = "equal"
+	diffInsert = "insert"
+	diffDelete = "delete"
+)
+
+// maxDiffCells limits the table of the longest common subsequence, changed parts of longer texts
+// are reported as replaced as a whole.
+const maxDiffCells = 1 << 22
+
+// diffTokens splits text into words and the whitespace between them, so joined tokens give the text back.
+var diffTokens = regexp.MustCompile(`\s+|\S+`)
+
+// postOriginal is the only revision of a post which was never edited.
+func postOriginal(post *models.Post) *models.Revision {
+	return &models.Revision{Number: 1, Message: post.Message, Editor: post.Author, Created: post.Created}
+}
+
+// threadOriginal is the only revision of a thread which was never edited.
+func threadOriginal(thread *models.Thread) *models.Revision {
+	return &models.Revision{Number: 1, Title: thread.Title, Message: thread.Message, Editor: thread.Author, Created: thread.Created}
+}
+
+// diffRevisions compares two revisions from history, title is compared only for threads.
+func diffRevisions(revisions models.Revisions, from, to int32, withTitle bool) (*models.RevisionDiff, *Error) {
+	var fromRevision, toRevision *models.Revision
+	for _, revision := range revisions {
+		if revision.Number == from {
+			fromRevision = revision
+		}
+		if revision.Number == to {
+			toRevision = revision
+		}
+	}
+	if fromRevision == nil {
+		return nil, NotFound("Can't find revision %d", from)
+	}
+	if toRevision == nil {
+		return nil, NotFound("Can't find revision %d", to)
+	}
+
+	diff := &models.RevisionDiff{From: from, To: to, Message: diffText(fromRevision.Message, toRevision.Message)}
+	if withTitle {
+		diff.Title = diffText(fromRevision.Title, toRevision.Title)
+	}
+	return diff, nil
+}
+
+// diffText finds word level changes between a and b with the longest common subsequence.
+// Common prefix and suffix are cut first: edits usually touch a small part of a post.
+// The rest is compared only up to maxDiffCells.
+func diffText(a, b string) models.DiffChunks {
+	x, y := diffTokens.FindAllString(a, -1), diffTokens.FindAllString(b, -1)
+
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+
+	chunks := models.DiffChunks{}
+	add := func(op string, token string) {
+		if last := len(chunks) - 1; last >= 0 && chunks[last].Op == op {
+			chunks[last].Text += token
+			return
+		}
+		chunks = append(chunks, &models.DiffChunk{Op: op, Text: token})
+	}
+
+	for _, token := range x[:prefix] {
+		add(diffEqual, token)
+	}
+
+	mx, my := x[prefix:len(x)-suffix], y[prefix:len(y)-suffix]
+	if (len(mx)+1)*(len(my)+1) > maxDiffCells {
+		for _, token := range mx {
+			add(diffDelete, token)
+		}
+		for _, token := range my {
+			add(diffInsert, token)
+		}
+		mx, my = nil, nil
+	}
+	// lcs[i][j] is the length of the longest common subsequence of mx[i:] and my[j:]
+	lcs := make([][]int, len(mx)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(my)+1)
+	}
+	for i := len(mx) - 1; i >= 0; i-- {
+		for j := len(my) - 1; j >= 0; j-- {
+			if mx[i] == my[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(mx) || j < len(my) {
+		switch {
+		case i < len(mx) && j < len(my) && mx[i] == my[j]:
+			add(diffEqual, mx[i])
+			i++
+			j++
+		case j == len(my) || i < len(mx) && lcs[i+1][j] >= lcs[i][j+1]:
+			add(diffDelete, mx[i])
+			i++
+		default:
+			add(diffInsert, my[j])
+			j++
+		}
+	}
+
+	for _, token := range x[len(x)-suffix:] {
+		add(diffEqual, token)
+	}
+	return chunks
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffText(t *testing.T) {
+	text := func(a, b string) string {
+		result := ""
+		for _, chunk := range diffText(a, b) {
+			result += "[" + chunk.Op + ":" + chunk.Text + "]"
+		}
+		return result
+	}
+	if diff, expected := text("We should be afraid", "We should not be afraid"), "[equal:We should ][insert:not ][equal:be afraid]"; diff != expected {
+		t.Errorf("expected %s, got %s", expected, diff)
+	}
+
+	// Long texts are replaced as a whole instead of filling a table of every pair of words
+	a := "Kraken " + strings.Repeat("a ", 5000) + "end"
+	b := "Kraken " + strings.Repeat("b ", 5000) + "end"
+	chunks := diffText(a, b)
+	if len(chunks) != 4 || chunks[1].Op != diffDelete || chunks[2].Op != diffInsert ||
+		chunks[1].Text != strings.TrimSpace(strings.Repeat("a ", 5000)) || chunks[2].Text != strings.TrimSpace(strings.Repeat("b ", 5000)) {
+		t.Errorf("expected the middle to be replaced, got %d chunks", len(chunks))
+	}
+}
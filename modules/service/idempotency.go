@@ -0,0 +1,78 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/go-openapi/runtime"
+)
+
+// IdempotencyTTL is how long the response of a request with Idempotency-Key is kept for its retries.
+var IdempotencyTTL = 24 * time.Hour
+
+// IdempotentReplayedHeader marks a response stored for an earlier request with the same Idempotency-Key.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// idempotency identifies a request made with Idempotency-Key. Keys are scoped to the principal, anonymous
+// clients share the scope; the fingerprint tells a retry from another request reusing the key.
+type idempotency struct {
+	Owner       string
+	Key         string
+	Operation   string
+	Fingerprint string
+}
+
+// newIdempotency returns nil for requests without a key, request is whatever the operation depends on.
+func newIdempotency(key *string, operation string, principal *models.Principal, request ...interface{}) (*idempotency, *Error) {
+	if key == nil || *key == "" {
+		return nil, nil
+	}
+	body, err := json.Marshal(append([]interface{}{operation}, request...))
+	if err != nil {
+		return nil, Internal(err)
+	}
+	sum := sha256.Sum256(body)
+	result := &idempotency{Key: *key, Operation: operation, Fingerprint: hex.EncodeToString(sum[:])}
+	if principal != nil {
+		result.Owner = principal.Nickname
+	}
+	return result, nil
+}
+
+// check returns Conflict unless the stored request was the same as this one.
+func (key *idempotency) check(operation, fingerprint string) *Error {
+	if operation != key.Operation || fingerprint != key.Fingerprint {
+		return Conflict("Idempotency-Key %s was used for another request", key.Key)
+	}
+	return nil
+}
+
+// conflict is returned when another request with the key committed first.
+func (key *idempotency) conflict() *Error {
+	return Conflict("Request with Idempotency-Key %s is already processed, retry it to get the response", key.Key)
+}
+
+// storedResponse is the response of a request given again to its retries.
+type storedResponse struct {
+	Status int
+	Body   []byte
+}
+
+func newStoredResponse(status int, payload interface{}) (*storedResponse, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &storedResponse{Status: status, Body: body}, nil
+}
+
+func (response *storedResponse) WriteResponse(rw http.ResponseWriter, producer runtime.Producer) {
+	rw.Header().Set(runtime.HeaderContentType, runtime.JSONMime)
+	rw.Header().Set(IdempotentReplayedHeader, "true")
+	rw.WriteHeader(response.Status)
+	rw.Write(response.Body)
+}
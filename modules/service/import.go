@@ -0,0 +1,207 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/couatl/forum-db-api/restapi/operations"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/go-openapi/strfmt"
+)
+
+// Types of dump records.
+const (
+	DumpUser   = "user"
+	DumpForum  = "forum"
+	DumpThread = "thread"
+	DumpPost   = "post"
+	DumpVote   = "vote"
+	// DumpEnd is the last record, it counts the others so that a truncated dump is told from a whole one.
+	DumpEnd = "end"
+)
+
+// PlaceholderEmailDomain gets emails of new users without them when an import asks for placeholders,
+// .invalid never resolves.
+const PlaceholderEmailDomain = "imported.invalid"
+
+// maxDumpLine limits a line of a dump, it has to fit the longest post.
+const maxDumpLine = 16 << 20
+
+// dumpRecord is a line of an NDJSON dump: the fields of the API model of its type besides
+// the type itself, a vote also names its thread. Exports scan records from the database.
+type dumpRecord struct {
+	Type string `json:"type" db:"-"`
+
+	ID       int64            `json:"id,omitempty" db:"id"`
+	Nickname string           `json:"nickname,omitempty" db:"nickname"`
+	Fullname string           `json:"fullname,omitempty" db:"fullname"`
+	Email    string           `json:"email,omitempty" db:"email"`
+	About    string           `json:"about,omitempty" db:"about"`
+	Slug     string           `json:"slug,omitempty" db:"slug"`
+	Title    string           `json:"title,omitempty" db:"title"`
+	User     string           `json:"user,omitempty" db:"user"`
+	Forum    string           `json:"forum,omitempty" db:"forum"`
+	Thread   int32            `json:"thread,omitempty" db:"thread"`
+	Author   string           `json:"author,omitempty" db:"author"`
+	Message  string           `json:"message,omitempty" db:"message"`
+	Parent   int64            `json:"parent,omitempty" db:"parent"`
+	Created  *strfmt.DateTime `json:"created,omitempty" db:"created"`
+	Edited   bool             `json:"isEdited,omitempty" db:"is_edited"`
+	Deleted  bool             `json:"isDeleted,omitempty" db:"is_deleted"`
+	Voice    int32            `json:"voice,omitempty" db:"voice"`
+
+	Counts *models.ImportResult `json:"counts,omitempty" db:"-"`
+}
+
+// validate checks what the database can't: required fields and limits of columns.
+// References between records are checked once the whole dump is staged.
+func (record *dumpRecord) validate() string {
+	switch record.Type {
+	case DumpUser:
+		// Existing users are matched by nickname, only new ones need an email
+		switch {
+		case record.Nickname == "" || record.Fullname == "":
+			return "user needs nickname and fullname"
+		case len([]rune(record.Fullname)) > 64:
+			return "fullname of user " + record.Nickname + " is longer than 64 characters"
+		}
+	case DumpForum:
+		switch {
+		case record.Slug == "" || record.Title == "" || record.User == "":
+			return "forum needs slug, title and user"
+		case len([]rune(record.Title)) > 255:
+			return "title of forum " + record.Slug + " is longer than 255 characters"
+		}
+	case DumpThread:
+		switch {
+		case record.ID <= 0 || record.Forum == "" || record.Author == "" || record.Title == "":
+			return "thread needs id, forum, author and title"
+		case len([]rune(record.Title)) > 255:
+			return "title of thread " + strconv.FormatInt(record.ID, 10) + " is longer than 255 characters"
+		}
+	case DumpPost:
+		// Deleted posts lose their authors
+		if record.ID <= 0 || record.Thread <= 0 || record.Author == "" && !record.Deleted || record.Parent < 0 {
+			return "post needs id, thread and author"
+		}
+	case DumpVote:
+		switch {
+		case record.Thread <= 0 || record.Nickname == "":
+			return "vote needs thread and nickname"
+		case record.Voice != 1 && record.Voice != -1:
+			return "voice of a vote is either 1 or -1"
+		}
+	case DumpEnd:
+		if record.Counts == nil {
+			return "end needs counts"
+		}
+	default:
+		return "unknown type " + strconv.Quote(record.Type)
+	}
+	return ""
+}
+
+// created is the timestamp of a thread or a post, records without one are created now.
+func (record *dumpRecord) created(now time.Time) time.Time {
+	if record.Created == nil {
+		return now
+	}
+	return time.Time(*record.Created)
+}
+
+// readDump decodes dump line by line and passes every record to add. Problems of the dump are
+// returned as *Error, errors of add as they are.
+func readDump(dump io.Reader, add func(record *dumpRecord) error) (*models.ImportResult, error) {
+	result := &models.ImportResult{}
+	counts := map[string]*int64{
+		DumpUser:   &result.Users,
+		DumpForum:  &result.Forums,
+		DumpThread: &result.Threads,
+		DumpPost:   &result.Posts,
+		DumpVote:   &result.Votes,
+	}
+
+	scanner := bufio.NewScanner(dump)
+	scanner.Buffer(make([]byte, 64*1024), maxDumpLine)
+	line := 0
+	var end *models.ImportResult
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if end != nil {
+			return nil, Validation("Line %d follows the end record", line)
+		}
+		record := dumpRecord{}
+		if err := json.Unmarshal(text, &record); err != nil {
+			return nil, Validation("Line %d is not a record: %v", line, err)
+		}
+		if message := record.validate(); message != "" {
+			return nil, Validation("Line %d: %s", line, message)
+		}
+		if record.Type == DumpEnd {
+			end = record.Counts
+			continue
+		}
+		if err := add(&record); err != nil {
+			return nil, err
+		}
+		*counts[record.Type]++
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, Validation("Line %d is longer than %d bytes", line+1, maxDumpLine)
+		}
+		return nil, Validation("Can't read the dump: %v", err)
+	}
+	switch {
+	case end == nil:
+		return nil, Validation("Dump has no end record, it may be truncated")
+	case *end != *result:
+		return nil, Validation("Dump has %d users, %d forums, %d threads, %d posts and %d votes, its end record counts %d, %d, %d, %d and %d",
+			result.Users, result.Forums, result.Threads, result.Posts, result.Votes, end.Users, end.Forums, end.Threads, end.Posts, end.Votes)
+	}
+	return result, nil
+}
+
+// importError reports problems of the dump as they are and anything else as a database error.
+func importError(ctx context.Context, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return dbError(ctx, err)
+}
+
+// ImportHandler serves importDump for administrators, the operation timeout applies to the whole import.
+func ImportHandler(handler ForumHandler) operations.ImportDumpHandlerFunc {
+	return func(params operations.ImportDumpParams, principal *models.Principal) middleware.Responder {
+		if err := authorizeImport(principal); err != nil {
+			return err
+		}
+		defer params.Dump.Close()
+
+		ctx, cancel := importContext(params.HTTPRequest.Context())
+		defer cancel()
+
+		result, err := handler.Import(ctx, params.Dump, params.PlaceholderEmails != nil && *params.PlaceholderEmails)
+		if err != nil {
+			return err
+		}
+		return operations.NewImportDumpOK().WithPayload(result)
+	}
+}
+
+func importContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := DefaultTimeouts.For("importDump"); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
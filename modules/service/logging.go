@@ -0,0 +1,99 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-openapi/runtime"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLogger is used by backends created with NewForum and by responders outside of LogRequests.
+var DefaultLogger logrus.FieldLogger = &logrus.Logger{
+	Out:       logrus.StandardLogger().Out,
+	Formatter: &logrus.JSONFormatter{},
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.InfoLevel,
+}
+
+// NewLogger makes a logger of level writing format: json lines or text.
+func NewLogger(level, format string) (*logrus.Logger, error) {
+	logger := logrus.New()
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetLevel(parsed)
+	switch format {
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	case "text":
+		logger.Formatter = &logrus.TextFormatter{}
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected json or text", format)
+	}
+	return logger, nil
+}
+
+// requestLog tags log lines with the request they are written for.
+type requestLog struct {
+	logger logrus.FieldLogger
+	info   *requestInfo
+}
+
+func (log *requestLog) entry() *logrus.Entry {
+	return log.logger.WithFields(logrus.Fields{
+		"request_id": log.info.id,
+		"operation":  log.info.operation,
+		"latency":    time.Since(log.info.started).Seconds(),
+	})
+}
+
+// requestLogger is the logger of the request rw answers, DefaultLogger when rw didn't come from LogRequests.
+func requestLogger(rw http.ResponseWriter) logrus.FieldLogger {
+	if recorder, ok := rw.(*statusRecorder); ok && recorder.log != nil {
+		return recorder.log.entry()
+	}
+	return DefaultLogger
+}
+
+// LogRequests writes a line per request with its id, operation, status and latency. The id is taken
+// from X-Request-ID and echoed in the response. Panics are logged and answered with 500.
+func LogRequests(logger logrus.FieldLogger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		info, r := trackRequest(r)
+		rw.Header().Set(RequestIDHeader, info.id)
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK, log: &requestLog{logger: logger, info: info}}
+
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				recorder.log.entry().WithFields(logrus.Fields{
+					"panic": fmt.Sprint(p),
+					"stack": string(debug.Stack()),
+				}).Error("Recovered from panic")
+				if !recorder.wroteHeader {
+					recorder.Header().Set(runtime.HeaderContentType, runtime.JSONMime)
+					Internal(nil).WriteResponse(recorder, runtime.JSONProducer())
+				}
+			}
+
+			entry := recorder.log.entry().WithFields(logrus.Fields{
+				"method": r.Method,
+				"path":   r.URL.Path,
+				"status": recorder.status,
+			})
+			if recorder.status >= http.StatusInternalServerError {
+				entry.Warn("Request failed")
+			} else {
+				entry.Info("Request")
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
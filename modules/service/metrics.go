@@ -0,0 +1,146 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rubenv/sql-migrate"
+)
+
+// Metrics collects Prometheus metrics of the server: requests by swagger operationId and the state of the storage.
+type Metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+func NewMetrics(handler ForumHandler) *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "forum_http_requests_total",
+			Help: "Requests by swagger operationId and response status.",
+		}, []string{"operation", "code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "forum_http_request_errors_total",
+			Help: "Requests answered with a 5xx status by swagger operationId.",
+		}, []string{"operation"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "forum_http_request_duration_seconds",
+			Help:    "Time to answer a request by swagger operationId, streams are observed when they end.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"operation"}),
+	}
+	metrics.registry.MustRegister(
+		metrics.requests, metrics.errors, metrics.latency, handler.Collector(),
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return metrics
+}
+
+// ServeHTTP exposes the metrics in the Prometheus text format.
+func (metrics *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(rw, r)
+}
+
+// Instrument counts and times requests to next, it is meant to be the outermost middleware.
+func (metrics *Metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		info, r := trackRequest(r)
+		recorder := newStatusRecorder(rw)
+
+		next.ServeHTTP(recorder, r)
+
+		metrics.latency.WithLabelValues(info.operation).Observe(time.Since(info.started).Seconds())
+		metrics.requests.WithLabelValues(info.operation, strconv.Itoa(recorder.status)).Inc()
+		if recorder.status >= http.StatusInternalServerError {
+			metrics.errors.WithLabelValues(info.operation).Inc()
+		}
+	})
+}
+
+// Descriptions of the storage metrics.
+var (
+	dbMaxOpenDesc = prometheus.NewDesc("forum_db_max_open_connections",
+		"Maximum number of open connections to the database.", nil, nil)
+	dbOpenDesc = prometheus.NewDesc("forum_db_open_connections",
+		"Established connections to the database, both in use and idle.", nil, nil)
+	dbInUseDesc = prometheus.NewDesc("forum_db_in_use_connections",
+		"Connections currently in use.", nil, nil)
+	dbIdleDesc = prometheus.NewDesc("forum_db_idle_connections",
+		"Idle connections.", nil, nil)
+	dbWaitCountDesc = prometheus.NewDesc("forum_db_wait_count_total",
+		"Connections waited for.", nil, nil)
+	dbWaitDurationDesc = prometheus.NewDesc("forum_db_wait_duration_seconds_total",
+		"Time blocked waiting for a connection.", nil, nil)
+	dbMaxIdleClosedDesc = prometheus.NewDesc("forum_db_max_idle_closed_total",
+		"Connections closed due to the limit of idle connections.", nil, nil)
+	dbMaxLifetimeClosedDesc = prometheus.NewDesc("forum_db_max_lifetime_closed_total",
+		"Connections closed due to their maximum lifetime.", nil, nil)
+	dbMigrationDesc = prometheus.NewDesc("forum_db_migration_version",
+		"Number of the latest applied migration from db/<dialect>.", nil, nil)
+)
+
+// dbCollector reports the connection pool of db and its schema version, it reports nothing without db.
+type dbCollector struct {
+	db        *sqlx.DB
+	migration int
+}
+
+func (collector dbCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{dbMaxOpenDesc, dbOpenDesc, dbInUseDesc, dbIdleDesc, dbWaitCountDesc,
+		dbWaitDurationDesc, dbMaxIdleClosedDesc, dbMaxLifetimeClosedDesc, dbMigrationDesc} {
+		descs <- desc
+	}
+}
+
+func (collector dbCollector) Collect(metrics chan<- prometheus.Metric) {
+	if collector.db == nil {
+		return
+	}
+	stats := collector.db.Stats()
+	gauge := func(desc *prometheus.Desc, value float64) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+	counter := func(desc *prometheus.Desc, value float64) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value)
+	}
+	gauge(dbMaxOpenDesc, float64(stats.MaxOpenConnections))
+	gauge(dbOpenDesc, float64(stats.OpenConnections))
+	gauge(dbInUseDesc, float64(stats.InUse))
+	gauge(dbIdleDesc, float64(stats.Idle))
+	counter(dbWaitCountDesc, float64(stats.WaitCount))
+	counter(dbWaitDurationDesc, stats.WaitDuration.Seconds())
+	counter(dbMaxIdleClosedDesc, float64(stats.MaxIdleClosed))
+	counter(dbMaxLifetimeClosedDesc, float64(stats.MaxLifetimeClosed))
+	gauge(dbMigrationDesc, float64(collector.migration))
+}
+
+// migrationVersion is the number of the latest applied migration, migrations are named NNNN-name.sql.
+func migrationVersion(db *sqlx.DB, dialect string) (int, error) {
+	records, err := migrate.GetMigrationRecords(db.DB, dialect)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for _, record := range records {
+		if number := migrationNumber(record.Id); number > version {
+			version = number
+		}
+	}
+	return version, nil
+}
+
+func migrationNumber(id string) int {
+	number, err := strconv.Atoi(strings.SplitN(id, "-", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return number
+}
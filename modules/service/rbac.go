@@ -0,0 +1,139 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/couatl/forum-db-api/models"
+)
+
+// Roles of a user in a forum. Only moderator is stored in forum_roles, owner comes from forums.author,
+// admin from Admins and banned from active bans.
+const (
+	RoleAdmin     = "admin"
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+	RoleBanned    = "banned"
+)
+
+// Admins are nicknames of site administrators, they have every permission in every forum.
+// Their accounts are created by BootstrapAdmins before the server starts and survive Clear,
+// so nobody else can register the nickname.
+var Admins []string
+
+// adminNicknames lists Admins in lower case, never nil so that pq.Array gives an empty array.
+func adminNicknames() []string {
+	nicknames := make([]string, 0, len(Admins))
+	for _, admin := range Admins {
+		nicknames = append(nicknames, strings.ToLower(admin))
+	}
+	return nicknames
+}
+
+// adminEmail is the placeholder email of an account made by BootstrapAdmins, .invalid never resolves.
+func adminEmail(nickname string) string {
+	return strings.ToLower(nickname) + "@admins.invalid"
+}
+
+type permission int
+
+const (
+	// permWrite allows to create threads and posts, to vote and to edit own posts and threads.
+	permWrite permission = iota
+	// permModerate allows to edit and delete any post, to lock, pin and delete threads and to ban members.
+	permModerate
+	// permAppoint allows to appoint, dismiss and ban moderators.
+	permAppoint
+	// permBanGlobal allows to ban users site-wide.
+	permBanGlobal
+	// permClear allows to wipe the whole database.
+	permClear
+	// permWebhooks allows to register and remove webhooks of a forum and to see their deliveries.
+	permWebhooks
+	// permImport allows to load dumps of other boards.
+	permImport
+	// permExport allows to download a dump of a forum.
+	permExport
+)
+
+var rolePermissions = map[string][]permission{
+	RoleAdmin:     {permWrite, permModerate, permAppoint, permBanGlobal, permClear, permWebhooks, permImport, permExport},
+	RoleOwner:     {permWrite, permModerate, permAppoint, permWebhooks, permExport},
+	RoleModerator: {permWrite, permModerate},
+	RoleMember:    {permWrite},
+	RoleBanned:    {},
+}
+
+func can(role string, perm permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func isAdmin(principal *models.Principal) bool {
+	if principal == nil {
+		return false
+	}
+	for _, admin := range Admins {
+		if strings.EqualFold(admin, principal.Nickname) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRole gives the role of principal in a forum owned by owner, stored is the role from forum_roles.
+// A ban outweighs the stored role.
+func resolveRole(principal *models.Principal, owner string, stored string, banned bool) string {
+	switch {
+	case isAdmin(principal):
+		return RoleAdmin
+	case isPrincipal(principal, owner):
+		return RoleOwner
+	case banned:
+		return RoleBanned
+	case stored != "":
+		return stored
+	default:
+		return RoleMember
+	}
+}
+
+// canEdit tells whether a user with role may change a post or a thread written by author.
+func canEdit(role string, principal *models.Principal, author string) bool {
+	if isPrincipal(principal, author) {
+		return can(role, permWrite)
+	}
+	return can(role, permModerate)
+}
+
+// canAssign tells whether a user with role may change the role of a user from current to next.
+func canAssign(role string, current string, next string) bool {
+	switch {
+	case current == RoleAdmin || current == RoleOwner:
+		return false
+	case current == RoleModerator || next == RoleModerator:
+		return can(role, permAppoint)
+	default:
+		return can(role, permModerate)
+	}
+}
+
+// authorizeClear returns Forbidden unless principal is an administrator.
+func authorizeClear(principal *models.Principal) *Error {
+	if !can(resolveRole(principal, "", "", false), permClear) {
+		return Forbidden("Only administrators can clear the database")
+	}
+	return nil
+}
+
+// authorizeImport returns Forbidden unless principal is an administrator.
+func authorizeImport(principal *models.Principal) *Error {
+	if !can(resolveRole(principal, "", "", false), permImport) {
+		return Forbidden("Only administrators can import dumps")
+	}
+	return nil
+}
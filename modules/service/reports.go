@@ -0,0 +1,46 @@
+package service
+
+import (
+	"github.com/couatl/forum-db-api/models"
+)
+
+// Report statuses.
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// Actions a moderator takes when resolving a report.
+const (
+	ActionNone       = "none"
+	ActionDeletePost = "delete_post"
+	ActionLockThread = "lock_thread"
+)
+
+// resolutionAction is the action of resolution, none if it is omitted.
+func resolutionAction(resolution *models.ReportResolution) string {
+	if resolution == nil || resolution.Action == "" {
+		return ActionNone
+	}
+	return resolution.Action
+}
+
+// checkReportAction returns Conflict when report is already closed
+// and Validation when action can't be applied to it. Dismissed reports have no action.
+func checkReportAction(report *models.Report, action string) *Error {
+	if report.Status != ReportOpen {
+		return Conflict("Report %d is already %s", report.ID, report.Status)
+	}
+	switch action {
+	case "", ActionNone, ActionLockThread:
+		return nil
+	case ActionDeletePost:
+		if report.Post == 0 {
+			return Validation("Report %d is about thread %d, only posts can be deleted", report.ID, report.Thread)
+		}
+		return nil
+	default:
+		return Validation("Unknown action %s", action)
+	}
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-openapi/runtime/middleware"
+)
+
+// RequestIDHeader is accepted from clients and proxies and echoed in every response.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestID limits the length of an ID given by a client.
+const maxRequestID = 128
+
+// unknownOperation labels requests that didn't reach an operation, e.g. unmatched routes and swagger.json.
+const unknownOperation = "none"
+
+type requestKey struct{}
+
+// requestInfo is shared by the middlewares of a request, the operation is filled in by SetOperation once it is routed.
+type requestInfo struct {
+	id        string
+	operation string
+	started   time.Time
+}
+
+// trackRequest returns the info of r, the first middleware to ask for it creates it.
+func trackRequest(r *http.Request) (*requestInfo, *http.Request) {
+	if info, ok := r.Context().Value(requestKey{}).(*requestInfo); ok {
+		return info, r
+	}
+	info := &requestInfo{id: requestID(r.Header.Get(RequestIDHeader)), operation: unknownOperation, started: time.Now()}
+	return info, r.WithContext(context.WithValue(r.Context(), requestKey{}, info))
+}
+
+// requestID keeps an ID given by the client when it is short and printable, otherwise a random one is made up.
+func requestID(given string) string {
+	valid := given != "" && len(given) <= maxRequestID
+	for i := 0; valid && i < len(given); i++ {
+		valid = given[i] > ' ' && given[i] < 0x7f
+	}
+	if valid {
+		return given
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// SetOperation names the operation r is served by, for requests passed through Metrics and LogRequests.
+func SetOperation(r *http.Request, operation string) {
+	if info, ok := r.Context().Value(requestKey{}).(*requestInfo); ok {
+		info.operation = operation
+	}
+}
+
+// LabelOperation names requests by the operationId of their swagger route, it goes inside the swagger router.
+func LabelOperation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if route := middleware.MatchedRouteFrom(r); route != nil && route.Operation != nil {
+			SetOperation(r, route.Operation.ID)
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// statusRecorder remembers the response status, streams and the WebSocket gateway still get
+// the Flusher and Hijacker of the server.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	// log is set by LogRequests, so responders can log with the fields of the request
+	log *requestLog
+}
+
+// newStatusRecorder wraps rw, keeping the log of the request when rw is a statusRecorder itself.
+func newStatusRecorder(rw http.ResponseWriter) *statusRecorder {
+	recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+	if inner, ok := rw.(*statusRecorder); ok {
+		recorder.log = inner.log
+	}
+	return recorder
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.status, recorder.wroteHeader = status, true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	recorder.wroteHeader = true
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *statusRecorder) Flush() {
+	recorder.wroteHeader = true
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	recorder.status, recorder.wroteHeader = http.StatusSwitchingProtocols, true
+	return hijacker.Hijack()
+}
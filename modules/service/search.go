@@ -0,0 +1,55 @@
+package service
+
+import (
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+)
+
+const (
+	searchResultPost   = "post"
+	searchResultThread = "thread"
+)
+
+func searchResultCreated(result *models.SearchResult) time.Time {
+	if result.Post != nil && result.Post.Created != nil {
+		return time.Time(*result.Post.Created)
+	}
+	if result.Thread != nil && result.Thread.Created != nil {
+		return time.Time(*result.Thread.Created)
+	}
+	return time.Time{}
+}
+
+func searchResultID(result *models.SearchResult) int64 {
+	if result.Post != nil {
+		return result.Post.ID
+	}
+	if result.Thread != nil {
+		return int64(result.Thread.ID)
+	}
+	return 0
+}
+
+// mergeSearchResults merges found posts and threads, both already sorted by creation date.
+// limit < 0 means no limit.
+func mergeSearchResults(posts, threads models.SearchResults, desc bool, limit int) models.SearchResults {
+	results := models.SearchResults{}
+	for (len(posts) > 0 || len(threads) > 0) && (limit < 0 || len(results) < limit) {
+		takePost := len(threads) == 0
+		if len(posts) > 0 && len(threads) > 0 {
+			post, thread := searchResultCreated(posts[0]), searchResultCreated(threads[0])
+			if desc {
+				takePost = !post.Before(thread)
+			} else {
+				takePost = !post.After(thread)
+			}
+		}
+		if takePost {
+			results, posts = append(results, posts[0]), posts[1:]
+		} else {
+			results, threads = append(results, threads[0]), threads[1:]
+		}
+	}
+	return results
+}
@@ -0,0 +1,3099 @@
+// Package servicetest contains behavioral tests shared by every service.ForumHandler implementation.
+package servicetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/couatl/forum-db-api/modules/service"
+	"github.com/couatl/forum-db-api/restapi/operations"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/swag"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// admin is the nickname of the site administrator during tests.
+const admin = "admin"
+
+// Factory returns a handler to run a single test case against.
+// The handler may be shared between cases: every case starts with Clear.
+type Factory func() service.ForumHandler
+
+type testCase struct {
+	name string
+	run  func(t *testing.T, handler service.ForumHandler)
+}
+
+var testCases = []testCase{
+	{"Clear", testClear},
+	{"Status", testStatus},
+	{"Timeouts", testTimeouts},
+	{"UserCreate", testUserCreate},
+	{"UserGetOne", testUserGetOne},
+	{"UserUpdate", testUserUpdate},
+	{"Auth", testAuth},
+	{"Admins", testAdmins},
+	{"ForumCreate", testForumCreate},
+	{"ForumGetOne", testForumGetOne},
+	{"ForumGetThreads", testForumGetThreads},
+	{"ForumGetUsers", testForumGetUsers},
+	{"ForumRoles", testForumRoles},
+	{"Bans", testBans},
+	{"Reports", testReports},
+	{"ThreadCreate", testThreadCreate},
+	{"ThreadGetOne", testThreadGetOne},
+	{"ThreadUpdate", testThreadUpdate},
+	{"ThreadVote", testThreadVote},
+	{"ThreadLock", testThreadLock},
+	{"ThreadPin", testThreadPin},
+	{"ThreadDelete", testThreadDelete},
+	{"PostsCreate", testPostsCreate},
+	{"PostGetOne", testPostGetOne},
+	{"PostUpdate", testPostUpdate},
+	{"PostDelete", testPostDelete},
+	{"PostHistory", testPostHistory},
+	{"ThreadHistory", testThreadHistory},
+	{"ThreadGetPosts", testThreadGetPosts},
+	{"Idempotency", testIdempotency},
+	{"Import", testImport},
+	{"Export", testExport},
+	{"Search", testSearch},
+	{"Cursors", testCursors},
+	{"ThreadStream", testThreadStream},
+	{"Gateway", testGateway},
+	{"Webhooks", testWebhooks},
+	{"Feeds", testFeeds},
+	{"Metrics", testMetrics},
+	{"Logging", testLogging},
+	{"Tracing", testTracing},
+	{"Health", testHealth},
+}
+
+// Run checks that handler follows the contract described in swagger.yml.
+func Run(t *testing.T, factory Factory) {
+	service.Admins = []string{admin}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			handler := factory()
+			expect(t, handler.Clear(withRequest(operations.NewClearParams()).(operations.ClearParams), principal(admin)), http.StatusOK, nil)
+			tc.run(t, handler)
+		})
+	}
+}
+
+// expect writes responder the same way the API does and decodes its JSON body into payload.
+func expect(t *testing.T, responder middleware.Responder, status int, payload interface{}) {
+	t.Helper()
+	respond(t, responder, status, payload)
+}
+
+// expectPage is expect for listings, it returns the cursor of the next page.
+func expectPage(t *testing.T, responder middleware.Responder, payload interface{}) string {
+	t.Helper()
+	return respond(t, responder, http.StatusOK, payload).Header().Get("X-Next-Cursor")
+}
+
+func respond(t *testing.T, responder middleware.Responder, status int, payload interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	responder.WriteResponse(recorder, runtime.JSONProducer())
+
+	if recorder.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, recorder.Code, recorder.Body.String())
+	}
+	if payload == nil {
+		return recorder
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), payload); err != nil {
+		t.Fatalf("can't decode response %q: %v", recorder.Body.String(), err)
+	}
+	return recorder
+}
+
+// withRequest fills HTTPRequest of generated params, since handlers may rely on it.
+func withRequest(params interface{}) interface{} {
+	value := reflect.New(reflect.TypeOf(params)).Elem()
+	value.Set(reflect.ValueOf(params))
+	value.FieldByName("HTTPRequest").Set(reflect.ValueOf(httptest.NewRequest(http.MethodGet, "/api", nil)))
+	return value.Interface()
+}
+
+// principal is the user the request is made on behalf of, as resolved by Authenticate.
+func principal(nickname string) *models.Principal {
+	return &models.Principal{Nickname: nickname}
+}
+
+func dateTime(value string) *strfmt.DateTime {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	result := strfmt.DateTime(parsed)
+	return &result
+}
+
+func createUser(t *testing.T, handler service.ForumHandler, nickname string) models.User {
+	t.Helper()
+
+	params := withRequest(operations.NewUserCreateParams()).(operations.UserCreateParams)
+	params.Nickname = nickname
+	params.Profile = &models.User{
+		Fullname: "Captain " + nickname,
+		About:    "About " + nickname,
+		Email:    strfmt.Email(nickname + "@blackpearl.sea"),
+	}
+
+	user := models.User{}
+	expect(t, handler.UserCreate(params), http.StatusCreated, &user)
+	return user
+}
+
+func createForum(t *testing.T, handler service.ForumHandler, slug, owner string) models.Forum {
+	t.Helper()
+
+	params := withRequest(operations.NewForumCreateParams()).(operations.ForumCreateParams)
+	params.Forum = &models.Forum{Slug: slug, Title: "Forum " + slug, User: owner}
+
+	forum := models.Forum{}
+	expect(t, handler.ForumCreate(params), http.StatusCreated, &forum)
+	return forum
+}
+
+func createThread(t *testing.T, handler service.ForumHandler, forum string, thread models.Thread) models.Thread {
+	t.Helper()
+
+	params := withRequest(operations.NewThreadCreateParams()).(operations.ThreadCreateParams)
+	params.Slug = forum
+	params.Thread = &thread
+
+	result := models.Thread{}
+	expect(t, handler.ThreadCreate(params, principal(thread.Author)), http.StatusCreated, &result)
+	return result
+}
+
+// postsCreate sends the batch on behalf of the author of its first post.
+func postsCreate(handler service.ForumHandler, slugOrID string, posts ...*models.Post) middleware.Responder {
+	params := withRequest(operations.NewPostsCreateParams()).(operations.PostsCreateParams)
+	params.SlugOrID = slugOrID
+	params.Posts = models.Posts(posts)
+	author := "j.sparrow"
+	if len(posts) > 0 {
+		author = posts[0].Author
+	}
+	return handler.PostsCreate(params, principal(author))
+}
+
+func createPost(t *testing.T, handler service.ForumHandler, thread int32, author string, parent int64) models.Post {
+	t.Helper()
+
+	posts := models.Posts{}
+	expect(t, postsCreate(handler, swag.FormatInt32(thread),
+		&models.Post{Author: author, Message: "Message from " + author, Parent: parent}), http.StatusCreated, &posts)
+	if len(posts) != 1 {
+		t.Fatalf("expected 1 post, got %d", len(posts))
+	}
+	return *posts[0]
+}
+
+func testClear(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+
+	params := withRequest(operations.NewClearParams()).(operations.ClearParams)
+	expect(t, handler.Clear(params, principal("j.sparrow")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.Clear(params, principal(admin)), http.StatusOK, nil)
+
+	status := models.Status{}
+	expect(t, handler.Status(withRequest(operations.NewStatusParams()).(operations.StatusParams)), http.StatusOK, &status)
+	if status != (models.Status{}) {
+		t.Errorf("expected empty database after clear, got %+v", status)
+	}
+}
+
+func testStatus(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "w.turner", Title: "Kraken", Message: "Run!"})
+	createPost(t, handler, thread.ID, "j.sparrow", 0)
+	createPost(t, handler, thread.ID, "w.turner", 0)
+
+	status := models.Status{}
+	expect(t, handler.Status(withRequest(operations.NewStatusParams()).(operations.StatusParams)), http.StatusOK, &status)
+	if expected := (models.Status{User: 2, Forum: 1, Thread: 1, Post: 2}); status != expected {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+}
+
+func testTimeouts(t *testing.T, handler service.ForumHandler) {
+	// In-memory storage has no queries to stop
+	if len(handler.Ready(context.Background())) == 0 {
+		return
+	}
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cases := []struct {
+		name   string
+		ctx    context.Context
+		status int
+	}{
+		{"operation timeout", expired, http.StatusGatewayTimeout},
+		{"client went away", cancelled, http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		get := withRequest(operations.NewUserGetOneParams()).(operations.UserGetOneParams)
+		get.HTTPRequest = get.HTTPRequest.WithContext(tc.ctx)
+		get.Nickname = "j.sparrow"
+		expect(t, handler.UserGetOne(get), tc.status, &models.Error{})
+
+		create := withRequest(operations.NewThreadCreateParams()).(operations.ThreadCreateParams)
+		create.HTTPRequest = create.HTTPRequest.WithContext(tc.ctx)
+		create.Slug = "pirates"
+		create.Thread = &models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!"}
+		expect(t, handler.ThreadCreate(create, principal("j.sparrow")), tc.status, &models.Error{})
+	}
+
+	// Nothing is written and connections are back in the pool
+	params := withRequest(operations.NewForumGetThreadsParams()).(operations.ForumGetThreadsParams)
+	params.Slug = "pirates"
+	threads := models.Threads{}
+	expect(t, handler.ForumGetThreads(params), http.StatusOK, &threads)
+	if len(threads) != 0 {
+		t.Errorf("expected threads to be rolled back, got %+v", threads)
+	}
+}
+
+func testUserCreate(t *testing.T, handler service.ForumHandler) {
+	sparrow := createUser(t, handler, "j.sparrow")
+	if sparrow.Nickname != "j.sparrow" || sparrow.Email != "j.sparrow@blackpearl.sea" {
+		t.Errorf("unexpected user %+v", sparrow)
+	}
+	createUser(t, handler, "w.turner")
+
+	cases := []struct {
+		nickname  string
+		email     string
+		conflicts int
+	}{
+		{"J.Sparrow", "new@blackpearl.sea", 1},
+		{"someone", "W.TURNER@blackpearl.sea", 1},
+		{"j.sparrow", "w.turner@blackpearl.sea", 2},
+	}
+	for _, c := range cases {
+		params := withRequest(operations.NewUserCreateParams()).(operations.UserCreateParams)
+		params.Nickname = c.nickname
+		params.Profile = &models.User{Fullname: "Someone", Email: strfmt.Email(c.email)}
+
+		users := models.Users{}
+		expect(t, handler.UserCreate(params), http.StatusConflict, &users)
+		if len(users) != c.conflicts {
+			t.Errorf("%s/%s: expected %d conflicting users, got %d", c.nickname, c.email, c.conflicts, len(users))
+		}
+	}
+}
+
+func testUserGetOne(t *testing.T, handler service.ForumHandler) {
+	created := createUser(t, handler, "j.sparrow")
+
+	params := withRequest(operations.NewUserGetOneParams()).(operations.UserGetOneParams)
+	params.Nickname = "J.SPARROW"
+	user := models.User{}
+	expect(t, handler.UserGetOne(params), http.StatusOK, &user)
+	if user != created {
+		t.Errorf("expected %+v, got %+v", created, user)
+	}
+
+	params.Nickname = "d.jones"
+	expect(t, handler.UserGetOne(params), http.StatusNotFound, &models.Error{})
+}
+
+func testUserUpdate(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+
+	cases := []struct {
+		name     string
+		nickname string
+		as       string
+		profile  models.UserUpdate
+		status   int
+		expected models.User
+	}{
+		{"fullname only", "J.Sparrow", "j.sparrow", models.UserUpdate{Fullname: "Jack"}, http.StatusOK,
+			models.User{Nickname: "j.sparrow", Fullname: "Jack", About: "About j.sparrow", Email: "j.sparrow@blackpearl.sea"}},
+		{"own email", "j.sparrow", "J.SPARROW", models.UserUpdate{Email: "j.sparrow@blackpearl.sea", About: "Captain"}, http.StatusOK,
+			models.User{Nickname: "j.sparrow", Fullname: "Jack", About: "Captain", Email: "j.sparrow@blackpearl.sea"}},
+		{"foreign email", "j.sparrow", "j.sparrow", models.UserUpdate{Email: "W.Turner@blackpearl.sea"}, http.StatusConflict, models.User{}},
+		{"new email", "w.turner", "w.turner", models.UserUpdate{Email: "will@flyingdutchman.sea"}, http.StatusOK,
+			models.User{Nickname: "w.turner", Fullname: "Captain w.turner", About: "About w.turner", Email: "will@flyingdutchman.sea"}},
+		{"released email", "j.sparrow", "j.sparrow", models.UserUpdate{Email: "w.turner@blackpearl.sea"}, http.StatusOK,
+			models.User{Nickname: "j.sparrow", Fullname: "Jack", About: "Captain", Email: "w.turner@blackpearl.sea"}},
+		{"quotes are kept", "w.turner", "w.turner", models.UserUpdate{Fullname: "Will O'Turner", About: "', about = 'pwned"}, http.StatusOK,
+			models.User{Nickname: "w.turner", Fullname: "Will O'Turner", About: "', about = 'pwned", Email: "will@flyingdutchman.sea"}},
+		{"unknown user", "d.jones", "d.jones", models.UserUpdate{Fullname: "Davy"}, http.StatusNotFound, models.User{}},
+		{"foreign profile", "w.turner", "j.sparrow", models.UserUpdate{Fullname: "Bootstrap"}, http.StatusForbidden, models.User{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			profile := c.profile
+			params := withRequest(operations.NewUserUpdateParams()).(operations.UserUpdateParams)
+			params.Nickname = c.nickname
+			params.Profile = &profile
+
+			if c.status != http.StatusOK {
+				expect(t, handler.UserUpdate(params, principal(c.as)), c.status, &models.Error{})
+				return
+			}
+			user := models.User{}
+			expect(t, handler.UserUpdate(params, principal(c.as)), c.status, &user)
+			if user != c.expected {
+				t.Errorf("expected %+v, got %+v", c.expected, user)
+			}
+		})
+	}
+}
+
+func testAuth(t *testing.T, handler service.ForumHandler) {
+	create := withRequest(operations.NewUserCreateParams()).(operations.UserCreateParams)
+	create.Nickname = "j.sparrow"
+	create.Profile = &models.User{Fullname: "Jack Sparrow", Email: "j.sparrow@blackpearl.sea", Password: "black-pearl"}
+	user := models.User{}
+	expect(t, handler.UserCreate(create), http.StatusCreated, &user)
+	if user.Password != "" {
+		t.Errorf("password must not be returned, got %+v", user)
+	}
+	createUser(t, handler, "w.turner")
+
+	login := withRequest(operations.NewUserLoginParams()).(operations.UserLoginParams)
+	for _, c := range []struct{ nickname, password string }{
+		{"j.sparrow", "white-pearl"},
+		{"w.turner", ""},
+		{"d.jones", "black-pearl"},
+	} {
+		login.Nickname = c.nickname
+		login.Credentials = &models.Credentials{Password: strfmt.Password(c.password)}
+		expect(t, handler.UserLogin(login), http.StatusUnauthorized, &models.Error{})
+	}
+
+	login.Nickname = "J.SPARROW"
+	login.Credentials = &models.Credentials{Password: "black-pearl"}
+	session := models.Token{}
+	expect(t, handler.UserLogin(login), http.StatusOK, &session)
+	if session.Token == "" || session.Nickname != "j.sparrow" || session.Expires == nil || !time.Time(*session.Expires).After(time.Now()) {
+		t.Fatalf("unexpected session %+v", session)
+	}
+
+	authenticated, err := handler.Authenticate(session.Token)
+	if err != nil || authenticated.Nickname != "j.sparrow" {
+		t.Errorf("expected j.sparrow, got %+v, %v", authenticated, err)
+	}
+	for _, token := range []string{"", "bogus"} {
+		if _, err := handler.Authenticate(token); err == nil {
+			t.Errorf("token %q must be rejected", token)
+		}
+	}
+
+	tokenCreate := withRequest(operations.NewUserTokenCreateParams()).(operations.UserTokenCreateParams)
+	tokenCreate.Nickname = "w.turner"
+	expect(t, handler.UserTokenCreate(tokenCreate, principal("j.sparrow")), http.StatusForbidden, &models.Error{})
+	tokenCreate.Nickname = "d.jones"
+	expect(t, handler.UserTokenCreate(tokenCreate, principal("d.jones")), http.StatusNotFound, &models.Error{})
+	tokenCreate.Nickname = "j.sparrow"
+	apiToken := models.Token{}
+	expect(t, handler.UserTokenCreate(tokenCreate, principal("j.sparrow")), http.StatusCreated, &apiToken)
+	if apiToken.Token == "" || apiToken.Token == session.Token || apiToken.Expires != nil {
+		t.Errorf("unexpected API token %+v", apiToken)
+	}
+
+	logout := withRequest(operations.NewUserLogoutParams()).(operations.UserLogoutParams)
+	logout.Nickname = "j.sparrow"
+	logout.HTTPRequest.Header.Set("Authorization", "Bearer "+session.Token)
+	expect(t, handler.UserLogout(logout, principal("w.turner")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.UserLogout(logout, principal("j.sparrow")), http.StatusOK, nil)
+	if _, err := handler.Authenticate(session.Token); err == nil {
+		t.Errorf("session token must be revoked by logout")
+	}
+	if _, err := handler.Authenticate(apiToken.Token); err != nil {
+		t.Errorf("logout must keep other tokens, got %v", err)
+	}
+}
+
+func testAdmins(t *testing.T, handler service.ForumHandler) {
+	// Accounts of the administrators of this case are dropped by the Clear of the next one
+	service.Admins = []string{"Root", "gibbs"}
+	defer func() { service.Admins = []string{admin} }()
+
+	login := func(nickname, password string, status int) string {
+		t.Helper()
+		params := withRequest(operations.NewUserLoginParams()).(operations.UserLoginParams)
+		params.Nickname = nickname
+		params.Credentials = &models.Credentials{Password: strfmt.Password(password)}
+		token := models.Token{}
+		if status != http.StatusOK {
+			expect(t, handler.UserLogin(params), status, &models.Error{})
+			return ""
+		}
+		expect(t, handler.UserLogin(params), status, &token)
+		return token.Token
+	}
+
+	// The nickname was taken before it was given to an administrator
+	create := withRequest(operations.NewUserCreateParams()).(operations.UserCreateParams)
+	create.Nickname = "root"
+	create.Profile = &models.User{Fullname: "Squatter", Email: "root@tortuga.sea", Password: "mine"}
+	expect(t, handler.UserCreate(create), http.StatusCreated, &models.User{})
+	squatted := login("root", "mine", http.StatusOK)
+
+	if err := handler.BootstrapAdmins(context.Background(), "sesame"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Authenticate(squatted); err == nil {
+		t.Errorf("tokens issued before the bootstrap must be revoked")
+	}
+	login("root", "mine", http.StatusUnauthorized)
+	session := login("ROOT", "sesame", http.StatusOK)
+	login("gibbs", "sesame", http.StatusOK)
+
+	// The same password keeps the sessions
+	if err := handler.BootstrapAdmins(context.Background(), "sesame"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Authenticate(session); err != nil {
+		t.Errorf("bootstrap with the same password must keep tokens, got %v", err)
+	}
+
+	createUser(t, handler, "j.sparrow")
+	expect(t, handler.Clear(withRequest(operations.NewClearParams()).(operations.ClearParams), principal("root")), http.StatusOK, nil)
+
+	status := models.Status{}
+	expect(t, handler.Status(withRequest(operations.NewStatusParams()).(operations.StatusParams)), http.StatusOK, &status)
+	if expected := (models.Status{User: 2}); status != expected {
+		t.Errorf("expected only administrators after clear, got %+v", status)
+	}
+	if authenticated, err := handler.Authenticate(session); err != nil || authenticated.Nickname != "root" {
+		t.Errorf("expected the session of root to survive clear, got %+v, %v", authenticated, err)
+	}
+	create.Nickname = "Gibbs"
+	create.Profile = &models.User{Fullname: "Impostor", Email: "gibbs@tortuga.sea", Password: "mine"}
+	expect(t, handler.UserCreate(create), http.StatusConflict, &models.Users{})
+}
+
+func testForumCreate(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+
+	forum := createForum(t, handler, "pirates", "J.SPARROW")
+	if expected := (models.Forum{Slug: "pirates", Title: "Forum pirates", User: "j.sparrow"}); forum != expected {
+		t.Errorf("expected %+v, got %+v", expected, forum)
+	}
+
+	params := withRequest(operations.NewForumCreateParams()).(operations.ForumCreateParams)
+	params.Forum = &models.Forum{Slug: "PIRATES", Title: "Another", User: "j.sparrow"}
+	conflict := models.Forum{}
+	expect(t, handler.ForumCreate(params), http.StatusConflict, &conflict)
+	if conflict != forum {
+		t.Errorf("expected conflict with %+v, got %+v", forum, conflict)
+	}
+
+	params.Forum = &models.Forum{Slug: "dutchman", Title: "Flying Dutchman", User: "d.jones"}
+	expect(t, handler.ForumCreate(params), http.StatusNotFound, &models.Error{})
+}
+
+func testForumGetOne(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!"})
+	createPost(t, handler, thread.ID, "j.sparrow", 0)
+
+	params := withRequest(operations.NewForumGetOneParams()).(operations.ForumGetOneParams)
+	params.Slug = "Pirates"
+	forum := models.Forum{}
+	expect(t, handler.ForumGetOne(params), http.StatusOK, &forum)
+	if expected := (models.Forum{Slug: "pirates", Title: "Forum pirates", User: "j.sparrow", Threads: 1, Posts: 1}); forum != expected {
+		t.Errorf("expected %+v, got %+v", expected, forum)
+	}
+
+	params.Slug = "dutchman"
+	expect(t, handler.ForumGetOne(params), http.StatusNotFound, &models.Error{})
+}
+
+func testForumGetThreads(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	createForum(t, handler, "dutchman", "j.sparrow")
+
+	ids := map[string]int32{}
+	for _, item := range []struct{ title, created string }{
+		{"second", "2017-01-02T00:00:00Z"},
+		{"first", "2017-01-01T00:00:00Z"},
+		{"third", "2017-01-03T00:00:00Z"},
+	} {
+		thread := createThread(t, handler, "pirates", models.Thread{
+			Author: "j.sparrow", Title: item.title, Message: item.title, Created: dateTime(item.created)})
+		ids[item.title] = thread.ID
+	}
+	createThread(t, handler, "dutchman", models.Thread{Author: "j.sparrow", Title: "other", Message: "other"})
+
+	cases := []struct {
+		name     string
+		since    *strfmt.DateTime
+		limit    int32
+		desc     bool
+		expected []string
+	}{
+		{"all", nil, 100, false, []string{"first", "second", "third"}},
+		{"limit", nil, 2, false, []string{"first", "second"}},
+		{"desc", nil, 2, true, []string{"third", "second"}},
+		{"since includes", dateTime("2017-01-02T00:00:00Z"), 100, false, []string{"second", "third"}},
+		{"since desc", dateTime("2017-01-02T00:00:00Z"), 100, true, []string{"second", "first"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := withRequest(operations.NewForumGetThreadsParams()).(operations.ForumGetThreadsParams)
+			params.Slug = "PIRATES"
+			params.Since = c.since
+			params.Limit = swag.Int32(c.limit)
+			params.Desc = swag.Bool(c.desc)
+
+			threads := models.Threads{}
+			expect(t, handler.ForumGetThreads(params), http.StatusOK, &threads)
+			if len(threads) != len(c.expected) {
+				t.Fatalf("expected %d threads, got %d", len(c.expected), len(threads))
+			}
+			for idx, title := range c.expected {
+				if threads[idx].ID != ids[title] || threads[idx].Forum != "pirates" {
+					t.Errorf("expected %q at %d, got %+v", title, idx, threads[idx])
+				}
+			}
+		})
+	}
+
+	params := withRequest(operations.NewForumGetThreadsParams()).(operations.ForumGetThreadsParams)
+	params.Slug = "unknown"
+	expect(t, handler.ForumGetThreads(params), http.StatusNotFound, &models.Error{})
+}
+
+func testForumGetUsers(t *testing.T, handler service.ForumHandler) {
+	for _, nickname := range []string{"owner", "b.user", "A.user", "c.user", "d.user"} {
+		createUser(t, handler, nickname)
+	}
+	createForum(t, handler, "pirates", "owner")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "c.user", Title: "Kraken", Message: "Run!"})
+	createPost(t, handler, thread.ID, "A.user", 0)
+	createPost(t, handler, thread.ID, "b.user", 0)
+	createPost(t, handler, thread.ID, "a.user", 0)
+
+	cases := []struct {
+		name     string
+		since    *string
+		limit    int32
+		desc     bool
+		expected []string
+	}{
+		{"all", nil, 100, false, []string{"A.user", "b.user", "c.user"}},
+		{"desc limit", nil, 2, true, []string{"c.user", "b.user"}},
+		{"since excludes", swag.String("a.user"), 100, false, []string{"b.user", "c.user"}},
+		{"since desc", swag.String("C.USER"), 100, true, []string{"b.user", "A.user"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := withRequest(operations.NewForumGetUsersParams()).(operations.ForumGetUsersParams)
+			params.Slug = "pirates"
+			params.Since = c.since
+			params.Limit = swag.Int32(c.limit)
+			params.Desc = swag.Bool(c.desc)
+
+			users := models.Users{}
+			expect(t, handler.ForumGetUsers(params), http.StatusOK, &users)
+			nicknames := []string{}
+			for _, user := range users {
+				nicknames = append(nicknames, user.Nickname)
+			}
+			if !reflect.DeepEqual(nicknames, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, nicknames)
+			}
+		})
+	}
+
+	// Banned users are listed unless excluded
+	ban := withRequest(operations.NewForumBanSetParams()).(operations.ForumBanSetParams)
+	ban.Slug = "pirates"
+	ban.Nickname = "b.user"
+	ban.Ban = &models.Ban{Reason: "Spam"}
+	expect(t, handler.ForumBanSet(ban, principal("owner")), http.StatusOK, &models.Ban{})
+	userBan := withRequest(operations.NewUserBanParams()).(operations.UserBanParams)
+	userBan.Nickname = "c.user"
+	userBan.Ban = &models.Ban{Reason: "Spam"}
+	expect(t, handler.UserBan(userBan, principal(admin)), http.StatusOK, &models.Ban{})
+
+	params := withRequest(operations.NewForumGetUsersParams()).(operations.ForumGetUsersParams)
+	params.Slug = "pirates"
+	params.ExcludeBanned = swag.Bool(true)
+	users := models.Users{}
+	expect(t, handler.ForumGetUsers(params), http.StatusOK, &users)
+	if len(users) != 1 || users[0].Nickname != "A.user" {
+		t.Errorf("expected only A.user, got %+v", users)
+	}
+}
+
+func testForumRoles(t *testing.T, handler service.ForumHandler) {
+	for _, nickname := range []string{"j.sparrow", "w.turner", "e.swann", "d.jones"} {
+		createUser(t, handler, nickname)
+	}
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "d.jones", Title: "Kraken", Message: "Release!", Slug: "kraken"})
+	post := createPost(t, handler, thread.ID, "d.jones", 0)
+
+	setRole := func(nickname, role string, as string, status int) {
+		t.Helper()
+		params := withRequest(operations.NewForumRoleSetParams()).(operations.ForumRoleSetParams)
+		params.Slug = "pirates"
+		params.Nickname = nickname
+		params.Role = &models.ForumRole{Role: role}
+		if status != http.StatusOK {
+			expect(t, handler.ForumRoleSet(params, principal(as)), status, &models.Error{})
+			return
+		}
+		result := models.ForumRole{}
+		expect(t, handler.ForumRoleSet(params, principal(as)), status, &result)
+		if !strings.EqualFold(result.Nickname, nickname) || result.Role != role {
+			t.Errorf("expected %s to be %s, got %+v", nickname, role, result)
+		}
+	}
+
+	// Only the owner and administrators appoint moderators
+	setRole("e.swann", service.RoleModerator, "w.turner", http.StatusForbidden)
+	setRole("W.Turner", service.RoleModerator, "j.sparrow", http.StatusOK)
+	setRole("e.swann", service.RoleModerator, "w.turner", http.StatusForbidden)
+	setRole("j.sparrow", service.RoleModerator, "w.turner", http.StatusForbidden)
+	setRole("j.sparrow", service.RoleModerator, admin, http.StatusForbidden)
+
+	// Moderators manage content of other users
+	update := withRequest(operations.NewPostUpdateParams()).(operations.PostUpdateParams)
+	update.ID = post.ID
+	update.Post = &models.PostUpdate{Message: "Moderated"}
+	expect(t, handler.PostUpdate(update, principal("e.swann")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.PostUpdate(update, principal("w.turner")), http.StatusOK, &models.Post{})
+
+	lock := withRequest(operations.NewThreadLockParams()).(operations.ThreadLockParams)
+	lock.SlugOrID = "kraken"
+	expect(t, handler.ThreadLock(lock, principal("e.swann")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.ThreadLock(lock, principal("w.turner")), http.StatusOK, &models.Thread{})
+	unlock := withRequest(operations.NewThreadUnlockParams()).(operations.ThreadUnlockParams)
+	unlock.SlugOrID = "kraken"
+	expect(t, handler.ThreadUnlock(unlock, principal("w.turner")), http.StatusOK, &models.Thread{})
+
+	threadUpdate := withRequest(operations.NewThreadUpdateParams()).(operations.ThreadUpdateParams)
+	threadUpdate.SlugOrID = "kraken"
+	threadUpdate.Thread = &models.ThreadUpdate{Pinned: swag.Bool(true)}
+	expect(t, handler.ThreadUpdate(threadUpdate, principal("d.jones")), http.StatusForbidden, &models.Error{})
+
+	remove := withRequest(operations.NewPostDeleteParams()).(operations.PostDeleteParams)
+	remove.ID = post.ID
+	deleted := models.Post{}
+	expect(t, handler.PostDelete(remove, principal("w.turner")), http.StatusOK, &deleted)
+	if !deleted.IsDeleted {
+		t.Errorf("expected deleted post, got %+v", deleted)
+	}
+
+	// Administrators manage every forum
+	setRole("w.turner", service.RoleMember, admin, http.StatusOK)
+	setRole("e.swann", service.RoleMember, "w.turner", http.StatusForbidden)
+	setRole("d.jones", service.RoleModerator, "unknown", http.StatusForbidden)
+	setRole("d.jones", service.RoleModerator, admin, http.StatusOK)
+
+	params := withRequest(operations.NewForumGetRolesParams()).(operations.ForumGetRolesParams)
+	params.Slug = "pirates"
+	roles := models.ForumRoles{}
+	expect(t, handler.ForumGetRoles(params), http.StatusOK, &roles)
+	if len(roles) != 1 || roles[0].Nickname != "d.jones" || roles[0].Role != service.RoleModerator {
+		t.Errorf("expected only moderator d.jones, got %+v", roles)
+	}
+
+	setRole("b.barbossa", service.RoleModerator, "j.sparrow", http.StatusNotFound)
+	params.Slug = "dutchman"
+	expect(t, handler.ForumGetRoles(params), http.StatusNotFound, &models.Error{})
+}
+
+func testBans(t *testing.T, handler service.ForumHandler) {
+	for _, nickname := range []string{"j.sparrow", "w.turner", "e.swann", "d.jones"} {
+		createUser(t, handler, nickname)
+	}
+	createForum(t, handler, "pirates", "j.sparrow")
+	createForum(t, handler, "dutchman", "d.jones")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "d.jones", Title: "Kraken", Message: "Release!", Slug: "kraken"})
+
+	role := withRequest(operations.NewForumRoleSetParams()).(operations.ForumRoleSetParams)
+	role.Slug = "pirates"
+	role.Nickname = "w.turner"
+	role.Role = &models.ForumRole{Role: service.RoleModerator}
+	expect(t, handler.ForumRoleSet(role, principal("j.sparrow")), http.StatusOK, &models.ForumRole{})
+
+	banSet := func(nickname string, ban models.Ban, as string, status int) models.Ban {
+		t.Helper()
+		params := withRequest(operations.NewForumBanSetParams()).(operations.ForumBanSetParams)
+		params.Slug = "pirates"
+		params.Nickname = nickname
+		params.Ban = &ban
+		if status != http.StatusOK {
+			expect(t, handler.ForumBanSet(params, principal(as)), status, &models.Error{})
+			return models.Ban{}
+		}
+		result := models.Ban{}
+		expect(t, handler.ForumBanSet(params, principal(as)), status, &result)
+		return result
+	}
+	getBans := func() models.Bans {
+		t.Helper()
+		params := withRequest(operations.NewForumGetBansParams()).(operations.ForumGetBansParams)
+		params.Slug = "pirates"
+		bans := models.Bans{}
+		expect(t, handler.ForumGetBans(params), http.StatusOK, &bans)
+		return bans
+	}
+	vote := withRequest(operations.NewThreadVoteParams()).(operations.ThreadVoteParams)
+	vote.SlugOrID = "kraken"
+	vote.Vote = &models.Vote{Voice: 1}
+
+	// Moderators ban members, only the owner and administrators ban moderators
+	banSet("d.jones", models.Ban{Reason: "Kraken"}, "e.swann", http.StatusForbidden)
+	banSet("j.sparrow", models.Ban{}, "w.turner", http.StatusForbidden)
+	banSet("j.sparrow", models.Ban{}, admin, http.StatusForbidden)
+	ban := banSet("D.Jones", models.Ban{Reason: "Kraken"}, "w.turner", http.StatusOK)
+	if ban.Nickname != "d.jones" || ban.Forum != "pirates" || ban.Moderator != "w.turner" || ban.Reason != "Kraken" ||
+		ban.Created == nil || ban.Expires != nil {
+		t.Errorf("unexpected ban %+v", ban)
+	}
+
+	// Banned users can only read the forum
+	banned := models.Error{}
+	expect(t, postsCreate(handler, "kraken", &models.Post{Author: "d.jones", Message: "Release!"}), http.StatusForbidden, &banned)
+	if !strings.Contains(banned.Message, "pirates") || !strings.Contains(banned.Message, "Kraken") {
+		t.Errorf("expected the forum and the reason in %q", banned.Message)
+	}
+	expect(t, handler.ThreadVote(vote, principal("d.jones")), http.StatusForbidden, &models.Error{})
+	create := withRequest(operations.NewThreadCreateParams()).(operations.ThreadCreateParams)
+	create.Slug = "pirates"
+	create.Thread = &models.Thread{Title: "Dutchman", Message: "Sail!"}
+	expect(t, handler.ThreadCreate(create, principal("d.jones")), http.StatusForbidden, &models.Error{})
+	threadUpdate := withRequest(operations.NewThreadUpdateParams()).(operations.ThreadUpdateParams)
+	threadUpdate.SlugOrID = swag.FormatInt32(thread.ID)
+	threadUpdate.Thread = &models.ThreadUpdate{Message: "Released"}
+	expect(t, handler.ThreadUpdate(threadUpdate, principal("d.jones")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.ThreadVote(vote, principal("e.swann")), http.StatusOK, &models.Thread{})
+	create.Slug = "dutchman"
+	expect(t, handler.ThreadCreate(create, principal("d.jones")), http.StatusCreated, &models.Thread{})
+
+	if bans := getBans(); len(bans) != 1 || bans[0].Nickname != "d.jones" || bans[0].Reason != "Kraken" {
+		t.Errorf("expected ban of d.jones, got %+v", bans)
+	}
+
+	// A new ban replaces the active one
+	banSet("d.jones", models.Ban{Reason: "Again", Expires: dateTime(time.Now().Add(time.Hour).Format(time.RFC3339))}, "w.turner", http.StatusOK)
+	if bans := getBans(); len(bans) != 1 || bans[0].Reason != "Again" || bans[0].Expires == nil {
+		t.Errorf("expected the second ban of d.jones, got %+v", bans)
+	}
+
+	remove := withRequest(operations.NewForumBanDeleteParams()).(operations.ForumBanDeleteParams)
+	remove.Slug = "pirates"
+	remove.Nickname = "d.jones"
+	expect(t, handler.ForumBanDelete(remove, principal("e.swann")), http.StatusForbidden, &models.Error{})
+	lifted := models.Ban{}
+	expect(t, handler.ForumBanDelete(remove, principal("w.turner")), http.StatusOK, &lifted)
+	if lifted.Reason != "Again" || lifted.Expires == nil || time.Time(*lifted.Expires).After(time.Now()) {
+		t.Errorf("expected lifted ban, got %+v", lifted)
+	}
+	expect(t, handler.ForumBanDelete(remove, principal("w.turner")), http.StatusNotFound, &models.Error{})
+	if bans := getBans(); len(bans) != 0 {
+		t.Errorf("expected no bans, got %+v", bans)
+	}
+	createPost(t, handler, thread.ID, "d.jones", 0)
+
+	// Expired bans are kept but not enforced
+	banSet("d.jones", models.Ban{Expires: dateTime("2017-01-01T00:00:00Z")}, "w.turner", http.StatusOK)
+	if bans := getBans(); len(bans) != 0 {
+		t.Errorf("expected no active bans, got %+v", bans)
+	}
+	createPost(t, handler, thread.ID, "d.jones", 0)
+
+	// A ban outweighs the moderator role
+	banSet("w.turner", models.Ban{}, "j.sparrow", http.StatusOK)
+	lock := withRequest(operations.NewThreadLockParams()).(operations.ThreadLockParams)
+	lock.SlugOrID = "kraken"
+	expect(t, handler.ThreadLock(lock, principal("w.turner")), http.StatusForbidden, &models.Error{})
+
+	// Site-wide bans are set by administrators and apply to every forum
+	userBan := withRequest(operations.NewUserBanParams()).(operations.UserBanParams)
+	userBan.Nickname = "e.swann"
+	userBan.Ban = &models.Ban{Reason: "Spam"}
+	expect(t, handler.UserBan(userBan, principal("j.sparrow")), http.StatusForbidden, &models.Error{})
+	global := models.Ban{}
+	expect(t, handler.UserBan(userBan, principal(admin)), http.StatusOK, &global)
+	if global.Nickname != "e.swann" || global.Forum != "" || global.Moderator != admin {
+		t.Errorf("unexpected site-wide ban %+v", global)
+	}
+	expect(t, handler.ThreadVote(vote, principal("e.swann")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.ThreadCreate(create, principal("e.swann")), http.StatusForbidden, &models.Error{})
+	for _, ban := range getBans() {
+		if ban.Nickname == "e.swann" {
+			t.Errorf("expected site-wide ban not to be listed in forum, got %+v", ban)
+		}
+	}
+	userBan.Nickname = admin
+	expect(t, handler.UserBan(userBan, principal(admin)), http.StatusForbidden, &models.Error{})
+	userBan.Nickname = "b.barbossa"
+	expect(t, handler.UserBan(userBan, principal(admin)), http.StatusNotFound, &models.Error{})
+
+	unban := withRequest(operations.NewUserUnbanParams()).(operations.UserUnbanParams)
+	unban.Nickname = "e.swann"
+	expect(t, handler.UserUnban(unban, principal("j.sparrow")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.UserUnban(unban, principal(admin)), http.StatusOK, &models.Ban{})
+	expect(t, handler.UserUnban(unban, principal(admin)), http.StatusNotFound, &models.Error{})
+	expect(t, handler.ThreadVote(vote, principal("e.swann")), http.StatusOK, &models.Thread{})
+
+	banSet("b.barbossa", models.Ban{}, "j.sparrow", http.StatusNotFound)
+	params := withRequest(operations.NewForumGetBansParams()).(operations.ForumGetBansParams)
+	params.Slug = "unknown"
+	expect(t, handler.ForumGetBans(params), http.StatusNotFound, &models.Error{})
+}
+
+func testReports(t *testing.T, handler service.ForumHandler) {
+	for _, nickname := range []string{"j.sparrow", "w.turner", "e.swann", "d.jones"} {
+		createUser(t, handler, nickname)
+	}
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "d.jones", Title: "Kraken", Message: "Release!", Slug: "kraken"})
+	post := createPost(t, handler, thread.ID, "d.jones", 0)
+
+	role := withRequest(operations.NewForumRoleSetParams()).(operations.ForumRoleSetParams)
+	role.Slug = "pirates"
+	role.Nickname = "w.turner"
+	role.Role = &models.ForumRole{Role: service.RoleModerator}
+	expect(t, handler.ForumRoleSet(role, principal("j.sparrow")), http.StatusOK, &models.ForumRole{})
+
+	postReport := func(id int64, as string, status int) models.Report {
+		t.Helper()
+		params := withRequest(operations.NewPostReportParams()).(operations.PostReportParams)
+		params.ID = id
+		params.Report = &models.Report{Reason: "Spam"}
+		if status != http.StatusCreated {
+			expect(t, handler.PostReport(params, principal(as)), status, &models.Error{})
+			return models.Report{}
+		}
+		result := models.Report{}
+		expect(t, handler.PostReport(params, principal(as)), status, &result)
+		return result
+	}
+	threadReport := func(slugOrID string, as string, status int) models.Report {
+		t.Helper()
+		params := withRequest(operations.NewThreadReportParams()).(operations.ThreadReportParams)
+		params.SlugOrID = slugOrID
+		params.Report = &models.Report{Reason: "Offtopic"}
+		if status != http.StatusCreated {
+			expect(t, handler.ThreadReport(params, principal(as)), status, &models.Error{})
+			return models.Report{}
+		}
+		result := models.Report{}
+		expect(t, handler.ThreadReport(params, principal(as)), status, &result)
+		return result
+	}
+	getReports := func(status string, since *int64, limit int32) models.Reports {
+		t.Helper()
+		params := withRequest(operations.NewForumGetReportsParams()).(operations.ForumGetReportsParams)
+		params.Slug = "pirates"
+		params.Status = swag.String(status)
+		params.Since = since
+		params.Limit = swag.Int32(limit)
+		reports := models.Reports{}
+		expect(t, handler.ForumGetReports(params, principal("w.turner")), http.StatusOK, &reports)
+		return reports
+	}
+	resolve := func(id int64, action string, as string, status int) models.Report {
+		t.Helper()
+		params := withRequest(operations.NewReportResolveParams()).(operations.ReportResolveParams)
+		params.ID = id
+		params.Resolution = &models.ReportResolution{Action: action}
+		if status != http.StatusOK {
+			expect(t, handler.ReportResolve(params, principal(as)), status, &models.Error{})
+			return models.Report{}
+		}
+		result := models.Report{}
+		expect(t, handler.ReportResolve(params, principal(as)), status, &result)
+		return result
+	}
+
+	// Anyone who may write to the forum reports posts and threads once
+	report := postReport(post.ID, "e.swann", http.StatusCreated)
+	if report.ID == 0 || report.Forum != "pirates" || report.Thread != thread.ID || report.Post != post.ID ||
+		report.Reporter != "e.swann" || report.Reason != "Spam" || report.Status != service.ReportOpen || report.Created == nil {
+		t.Errorf("unexpected report %+v", report)
+	}
+	postReport(post.ID, "e.swann", http.StatusConflict)
+	postReport(post.ID+100, "e.swann", http.StatusNotFound)
+	threadReport("unknown", "e.swann", http.StatusNotFound)
+	onThread := threadReport("KRAKEN", "w.turner", http.StatusCreated)
+	if onThread.Thread != thread.ID || onThread.Post != 0 || onThread.Reason != "Offtopic" {
+		t.Errorf("unexpected thread report %+v", onThread)
+	}
+
+	ban := withRequest(operations.NewForumBanSetParams()).(operations.ForumBanSetParams)
+	ban.Slug = "pirates"
+	ban.Nickname = "d.jones"
+	ban.Ban = &models.Ban{Reason: "Kraken"}
+	expect(t, handler.ForumBanSet(ban, principal("j.sparrow")), http.StatusOK, &models.Ban{})
+	threadReport("kraken", "d.jones", http.StatusForbidden)
+
+	// The queue is open to moderators only, oldest reports first
+	queue := withRequest(operations.NewForumGetReportsParams()).(operations.ForumGetReportsParams)
+	queue.Slug = "pirates"
+	expect(t, handler.ForumGetReports(queue, principal("e.swann")), http.StatusForbidden, &models.Error{})
+	queue.Slug = "unknown"
+	expect(t, handler.ForumGetReports(queue, principal("w.turner")), http.StatusNotFound, &models.Error{})
+	if reports := getReports(service.ReportOpen, nil, 100); len(reports) != 2 || reports[0].ID != report.ID || reports[1].ID != onThread.ID {
+		t.Errorf("expected reports %d and %d, got %+v", report.ID, onThread.ID, reports)
+	}
+	if reports := getReports(service.ReportOpen, nil, 1); len(reports) != 1 || reports[0].ID != report.ID {
+		t.Errorf("expected report %d, got %+v", report.ID, reports)
+	}
+	if reports := getReports(service.ReportOpen, swag.Int64(report.ID), 100); len(reports) != 1 || reports[0].ID != onThread.ID {
+		t.Errorf("expected report %d, got %+v", onThread.ID, reports)
+	}
+
+	// Resolving may delete the post or lock the thread
+	resolve(report.ID, service.ActionDeletePost, "e.swann", http.StatusForbidden)
+	resolve(onThread.ID, service.ActionDeletePost, "w.turner", http.StatusBadRequest)
+	resolved := resolve(report.ID, service.ActionDeletePost, "w.turner", http.StatusOK)
+	if resolved.Status != service.ReportResolved || resolved.Action != service.ActionDeletePost ||
+		resolved.Moderator != "w.turner" || resolved.Closed == nil {
+		t.Errorf("unexpected resolved report %+v", resolved)
+	}
+	resolve(report.ID, service.ActionNone, "w.turner", http.StatusConflict)
+	resolve(report.ID+100, service.ActionNone, "w.turner", http.StatusNotFound)
+
+	getPost := withRequest(operations.NewPostGetOneParams()).(operations.PostGetOneParams)
+	getPost.ID = post.ID
+	full := models.PostFull{}
+	expect(t, handler.PostGetOne(getPost), http.StatusOK, &full)
+	if full.Post == nil || !full.Post.IsDeleted {
+		t.Errorf("expected deleted post, got %+v", full.Post)
+	}
+
+	resolve(onThread.ID, service.ActionLockThread, "j.sparrow", http.StatusOK)
+	getThread := withRequest(operations.NewThreadGetOneParams()).(operations.ThreadGetOneParams)
+	getThread.SlugOrID = "kraken"
+	locked := models.Thread{}
+	expect(t, handler.ThreadGetOne(getThread), http.StatusOK, &locked)
+	if !locked.Locked {
+		t.Errorf("expected locked thread, got %+v", locked)
+	}
+
+	// Dismissing only closes the report, after that it may be filed again
+	again := postReport(post.ID, "e.swann", http.StatusCreated)
+	dismiss := withRequest(operations.NewReportDismissParams()).(operations.ReportDismissParams)
+	dismiss.ID = again.ID
+	expect(t, handler.ReportDismiss(dismiss, principal("e.swann")), http.StatusForbidden, &models.Error{})
+	dismissed := models.Report{}
+	expect(t, handler.ReportDismiss(dismiss, principal("w.turner")), http.StatusOK, &dismissed)
+	if dismissed.Status != service.ReportDismissed || dismissed.Action != "" || dismissed.Moderator != "w.turner" {
+		t.Errorf("unexpected dismissed report %+v", dismissed)
+	}
+	expect(t, handler.ReportDismiss(dismiss, principal("w.turner")), http.StatusConflict, &models.Error{})
+
+	if reports := getReports(service.ReportOpen, nil, 100); len(reports) != 0 {
+		t.Errorf("expected empty queue, got %+v", reports)
+	}
+	if reports := getReports(service.ReportResolved, nil, 100); len(reports) != 2 {
+		t.Errorf("expected 2 resolved reports, got %+v", reports)
+	}
+	if reports := getReports(service.ReportDismissed, nil, 100); len(reports) != 1 || reports[0].ID != again.ID {
+		t.Errorf("expected dismissed report %d, got %+v", again.ID, reports)
+	}
+}
+
+func testThreadCreate(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+
+	thread := createThread(t, handler, "PIRATES", models.Thread{
+		Author: "J.Sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken", Created: dateTime("2017-01-01T00:00:00Z")})
+	if thread.ID == 0 || thread.Forum != "pirates" || thread.Author != "j.sparrow" || thread.Slug != "kraken" {
+		t.Errorf("unexpected thread %+v", thread)
+	}
+	if !time.Time(*thread.Created).Equal(time.Time(*dateTime("2017-01-01T00:00:00Z"))) {
+		t.Errorf("expected created to be kept, got %v", thread.Created)
+	}
+
+	params := withRequest(operations.NewThreadCreateParams()).(operations.ThreadCreateParams)
+	params.Slug = "pirates"
+	params.Thread = &models.Thread{Author: "j.sparrow", Title: "Another", Message: "Another", Slug: "KRAKEN"}
+	conflict := models.Thread{}
+	expect(t, handler.ThreadCreate(params, principal("j.sparrow")), http.StatusConflict, &conflict)
+	if conflict.ID != thread.ID || conflict.Title != "Kraken" {
+		t.Errorf("expected conflict with %+v, got %+v", thread, conflict)
+	}
+
+	params.Thread = &models.Thread{Title: "Dutchman", Message: "Dutchman"}
+	expect(t, handler.ThreadCreate(params, principal("d.jones")), http.StatusNotFound, &models.Error{})
+
+	// The author comes from the principal, not from the body
+	params.Thread = &models.Thread{Author: "d.jones", Title: "Dutchman", Message: "Dutchman"}
+	created := models.Thread{}
+	expect(t, handler.ThreadCreate(params, principal("j.sparrow")), http.StatusCreated, &created)
+	if created.Author != "j.sparrow" {
+		t.Errorf("expected thread by j.sparrow, got %+v", created)
+	}
+
+	params.Slug = "dutchman"
+	expect(t, handler.ThreadCreate(params, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+}
+
+func testThreadGetOne(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	created := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+
+	for _, slugOrID := range []string{"Kraken", swag.FormatInt32(created.ID)} {
+		params := withRequest(operations.NewThreadGetOneParams()).(operations.ThreadGetOneParams)
+		params.SlugOrID = slugOrID
+		thread := models.Thread{}
+		expect(t, handler.ThreadGetOne(params), http.StatusOK, &thread)
+		if thread.ID != created.ID {
+			t.Errorf("%s: expected thread %d, got %d", slugOrID, created.ID, thread.ID)
+		}
+	}
+
+	params := withRequest(operations.NewThreadGetOneParams()).(operations.ThreadGetOneParams)
+	params.SlugOrID = "unknown"
+	expect(t, handler.ThreadGetOne(params), http.StatusNotFound, &models.Error{})
+}
+
+func testThreadUpdate(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	created := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+
+	params := withRequest(operations.NewThreadUpdateParams()).(operations.ThreadUpdateParams)
+	params.SlugOrID = "kraken"
+	params.Thread = &models.ThreadUpdate{Message: "Hide!"}
+	thread := models.Thread{}
+	expect(t, handler.ThreadUpdate(params, principal("j.sparrow")), http.StatusOK, &thread)
+	if thread.ID != created.ID || thread.Title != "Kraken" || thread.Message != "Hide!" {
+		t.Errorf("unexpected thread %+v", thread)
+	}
+
+	// Text is never a part of the query
+	params.Thread = &models.ThreadUpdate{Title: "Davy Jones' locker", Message: "x', title = 'Mutiny"}
+	expect(t, handler.ThreadUpdate(params, principal("j.sparrow")), http.StatusOK, &thread)
+	if thread.Title != "Davy Jones' locker" || thread.Message != "x', title = 'Mutiny" {
+		t.Errorf("expected the title and message as they were sent, got %+v", thread)
+	}
+
+	params.Thread = &models.ThreadUpdate{Message: "Surrender!"}
+	expect(t, handler.ThreadUpdate(params, principal("w.turner")), http.StatusForbidden, &models.Error{})
+
+	params.SlugOrID = "unknown"
+	expect(t, handler.ThreadUpdate(params, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+}
+
+func testThreadVote(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+	createForum(t, handler, "pirates", "j.sparrow")
+	created := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+
+	cases := []struct {
+		slugOrID string
+		nickname string
+		voice    int32
+		votes    int32
+	}{
+		{"kraken", "j.sparrow", 1, 1},
+		{swag.FormatInt32(created.ID), "w.turner", -1, 0},
+		{"kraken", "j.sparrow", -1, -2},
+		{"kraken", "j.sparrow", -1, -2},
+		{"KRAKEN", "w.turner", 1, 0},
+	}
+	for idx, c := range cases {
+		params := withRequest(operations.NewThreadVoteParams()).(operations.ThreadVoteParams)
+		params.SlugOrID = c.slugOrID
+		params.Vote = &models.Vote{Voice: c.voice}
+		thread := models.Thread{}
+		expect(t, handler.ThreadVote(params, principal(c.nickname)), http.StatusOK, &thread)
+		if thread.ID != created.ID || thread.Votes != c.votes {
+			t.Errorf("vote %d: expected %d votes, got %+v", idx, c.votes, thread)
+		}
+	}
+
+	params := withRequest(operations.NewThreadVoteParams()).(operations.ThreadVoteParams)
+	params.SlugOrID = "unknown"
+	params.Vote = &models.Vote{Voice: 1}
+	expect(t, handler.ThreadVote(params, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+
+	params.SlugOrID = "kraken"
+	expect(t, handler.ThreadVote(params, principal("d.jones")), http.StatusNotFound, &models.Error{})
+}
+
+func testThreadLock(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+
+	lock := withRequest(operations.NewThreadLockParams()).(operations.ThreadLockParams)
+	lock.SlugOrID = "kraken"
+	thread := models.Thread{}
+	expect(t, handler.ThreadLock(lock, principal("w.turner")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.ThreadLock(lock, principal("j.sparrow")), http.StatusOK, &thread)
+	if !thread.Locked {
+		t.Errorf("expected locked thread, got %+v", thread)
+	}
+
+	expect(t, postsCreate(handler, "kraken", &models.Post{Author: "j.sparrow", Message: "Too late"}), http.StatusConflict, &models.Error{})
+	vote := withRequest(operations.NewThreadVoteParams()).(operations.ThreadVoteParams)
+	vote.SlugOrID = "kraken"
+	vote.Vote = &models.Vote{Voice: 1}
+	expect(t, handler.ThreadVote(vote, principal("j.sparrow")), http.StatusConflict, &models.Error{})
+
+	unlock := withRequest(operations.NewThreadUnlockParams()).(operations.ThreadUnlockParams)
+	unlock.SlugOrID = "kraken"
+	expect(t, handler.ThreadUnlock(unlock, principal("j.sparrow")), http.StatusOK, &thread)
+	if thread.Locked {
+		t.Errorf("expected unlocked thread, got %+v", thread)
+	}
+	expect(t, postsCreate(handler, "kraken", &models.Post{Author: "j.sparrow", Message: "Just in time"}), http.StatusCreated, &models.Posts{})
+	expect(t, handler.ThreadVote(vote, principal("j.sparrow")), http.StatusOK, &thread)
+
+	update := withRequest(operations.NewThreadUpdateParams()).(operations.ThreadUpdateParams)
+	update.SlugOrID = "kraken"
+	update.Thread = &models.ThreadUpdate{Locked: swag.Bool(true)}
+	expect(t, handler.ThreadUpdate(update, principal("j.sparrow")), http.StatusOK, &thread)
+	if !thread.Locked || thread.Message != "Run!" {
+		t.Errorf("expected locked thread with the same message, got %+v", thread)
+	}
+
+	lock.SlugOrID = "unknown"
+	expect(t, handler.ThreadLock(lock, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+}
+
+func testThreadPin(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	first := createThread(t, handler, "pirates", models.Thread{
+		Author: "j.sparrow", Title: "first", Message: "first", Created: dateTime("2017-01-01T00:00:00Z")})
+	second := createThread(t, handler, "pirates", models.Thread{
+		Author: "j.sparrow", Title: "second", Message: "second", Created: dateTime("2017-01-02T00:00:00Z")})
+	third := createThread(t, handler, "pirates", models.Thread{
+		Author: "j.sparrow", Title: "third", Message: "third", Created: dateTime("2017-01-03T00:00:00Z")})
+
+	pin := withRequest(operations.NewThreadPinParams()).(operations.ThreadPinParams)
+	pin.SlugOrID = swag.FormatInt32(second.ID)
+	thread := models.Thread{}
+	expect(t, handler.ThreadPin(pin, principal("j.sparrow")), http.StatusOK, &thread)
+	if !thread.Pinned {
+		t.Errorf("expected pinned thread, got %+v", thread)
+	}
+
+	for _, c := range []struct {
+		desc     bool
+		expected []int32
+	}{
+		{false, []int32{second.ID, first.ID, third.ID}},
+		{true, []int32{second.ID, third.ID, first.ID}},
+	} {
+		params := withRequest(operations.NewForumGetThreadsParams()).(operations.ForumGetThreadsParams)
+		params.Slug = "pirates"
+		params.Limit = swag.Int32(100)
+		params.Desc = swag.Bool(c.desc)
+		threads := models.Threads{}
+		expect(t, handler.ForumGetThreads(params), http.StatusOK, &threads)
+		if len(threads) != len(c.expected) {
+			t.Fatalf("desc %v: expected %d threads, got %d", c.desc, len(c.expected), len(threads))
+		}
+		for idx, id := range c.expected {
+			if threads[idx].ID != id {
+				t.Errorf("desc %v: expected thread %d at %d, got %+v", c.desc, id, idx, threads[idx])
+			}
+		}
+	}
+
+	unpin := withRequest(operations.NewThreadUnpinParams()).(operations.ThreadUnpinParams)
+	unpin.SlugOrID = swag.FormatInt32(second.ID)
+	expect(t, handler.ThreadUnpin(unpin, principal("j.sparrow")), http.StatusOK, &thread)
+	if thread.Pinned {
+		t.Errorf("expected unpinned thread, got %+v", thread)
+	}
+}
+
+func testThreadDelete(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	kraken := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+	dutchman := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Dutchman", Message: "Sail!"})
+	post := createPost(t, handler, kraken.ID, "j.sparrow", 0)
+	tombstone := createPost(t, handler, kraken.ID, "j.sparrow", 0)
+	createPost(t, handler, dutchman.ID, "j.sparrow", 0)
+	remove := withRequest(operations.NewPostDeleteParams()).(operations.PostDeleteParams)
+	remove.ID = tombstone.ID
+	expect(t, handler.PostDelete(remove, principal("j.sparrow")), http.StatusOK, &models.Post{})
+
+	params := withRequest(operations.NewThreadDeleteParams()).(operations.ThreadDeleteParams)
+	params.SlugOrID = "kraken"
+	thread := models.Thread{}
+	expect(t, handler.ThreadDelete(params, principal("w.turner")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.ThreadDelete(params, principal("j.sparrow")), http.StatusOK, &thread)
+	if thread.ID != kraken.ID {
+		t.Errorf("expected deleted thread %d, got %+v", kraken.ID, thread)
+	}
+	expect(t, handler.ThreadDelete(params, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+
+	getOne := withRequest(operations.NewThreadGetOneParams()).(operations.ThreadGetOneParams)
+	for _, slugOrID := range []string{"kraken", swag.FormatInt32(kraken.ID)} {
+		getOne.SlugOrID = slugOrID
+		expect(t, handler.ThreadGetOne(getOne), http.StatusNotFound, &models.Error{})
+	}
+	expect(t, postsCreate(handler, "kraken", &models.Post{Author: "j.sparrow", Message: "Anyone?"}), http.StatusNotFound, &models.Error{})
+
+	// Posts are gone with the thread
+	postParams := withRequest(operations.NewPostGetOneParams()).(operations.PostGetOneParams)
+	postParams.ID = post.ID
+	postParams.Related = []string{"thread"}
+	expect(t, handler.PostGetOne(postParams), http.StatusNotFound, &models.Error{})
+	remove.ID = post.ID
+	expect(t, handler.PostDelete(remove, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+
+	threadsParams := withRequest(operations.NewForumGetThreadsParams()).(operations.ForumGetThreadsParams)
+	threadsParams.Slug = "pirates"
+	threadsParams.Limit = swag.Int32(100)
+	threads := models.Threads{}
+	expect(t, handler.ForumGetThreads(threadsParams), http.StatusOK, &threads)
+	if len(threads) != 1 || threads[0].Title != "Dutchman" {
+		t.Errorf("deleted thread must disappear from the forum, got %+v", threads)
+	}
+
+	forumParams := withRequest(operations.NewForumGetOneParams()).(operations.ForumGetOneParams)
+	forumParams.Slug = "pirates"
+	forum := models.Forum{}
+	expect(t, handler.ForumGetOne(forumParams), http.StatusOK, &forum)
+	if forum.Threads != 1 || forum.Posts != 1 {
+		t.Errorf("expected 1 thread with 1 post in forum after deletion, got %+v", forum)
+	}
+
+	// The slug of a deleted thread can be taken again
+	createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Again", Slug: "kraken"})
+}
+
+func testPostsCreate(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+	other := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Dutchman", Message: "Sail!"})
+	root := createPost(t, handler, thread.ID, "j.sparrow", 0)
+	foreign := createPost(t, handler, other.ID, "j.sparrow", 0)
+
+	posts := models.Posts{}
+	expect(t, postsCreate(handler, "kraken",
+		&models.Post{Author: "W.Turner", Message: "first", Parent: root.ID},
+		&models.Post{Author: "j.sparrow", Message: "second"}), http.StatusCreated, &posts)
+	if len(posts) != 2 {
+		t.Fatalf("expected 2 posts, got %d", len(posts))
+	}
+	if posts[0].Author != "w.turner" || posts[0].Message != "first" || posts[0].Parent != root.ID ||
+		posts[0].Thread != thread.ID || posts[0].Forum != "pirates" || posts[0].IsEdited {
+		t.Errorf("unexpected post %+v", posts[0])
+	}
+	if posts[1].Author != "w.turner" {
+		t.Errorf("every post of the batch is written by the principal, got %+v", posts[1])
+	}
+	if posts[1].Message != "second" || posts[1].ID <= posts[0].ID {
+		t.Errorf("posts must be returned in the order they were passed, got %+v", posts[1])
+	}
+	if !time.Time(*posts[0].Created).Equal(time.Time(*posts[1].Created)) {
+		t.Errorf("posts of the same batch must share created, got %v and %v", posts[0].Created, posts[1].Created)
+	}
+
+	empty := models.Posts{}
+	expect(t, postsCreate(handler, "kraken"), http.StatusCreated, &empty)
+	if len(empty) != 0 {
+		t.Errorf("expected no posts, got %d", len(empty))
+	}
+
+	expect(t, postsCreate(handler, "kraken", &models.Post{Author: "j.sparrow", Message: "reply", Parent: foreign.ID}),
+		http.StatusConflict, &models.Error{})
+	expect(t, postsCreate(handler, "kraken", &models.Post{Author: "j.sparrow", Message: "reply", Parent: foreign.ID + 1000}),
+		http.StatusConflict, &models.Error{})
+	expect(t, postsCreate(handler, "kraken", &models.Post{Author: "d.jones", Message: "reply"}),
+		http.StatusNotFound, &models.Error{})
+	expect(t, postsCreate(handler, "unknown", &models.Post{Author: "j.sparrow", Message: "reply"}),
+		http.StatusNotFound, &models.Error{})
+
+	params := withRequest(operations.NewForumGetOneParams()).(operations.ForumGetOneParams)
+	params.Slug = "pirates"
+	forum := models.Forum{}
+	expect(t, handler.ForumGetOne(params), http.StatusOK, &forum)
+	if forum.Posts != 4 {
+		t.Errorf("failed batches must not be counted, expected 4 posts, got %d", forum.Posts)
+	}
+}
+
+func testPostGetOne(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!"})
+	created := createPost(t, handler, thread.ID, "j.sparrow", 0)
+
+	cases := []struct {
+		related                  []string
+		author, forum, hasThread bool
+	}{
+		{nil, false, false, false},
+		{[]string{"user"}, true, false, false},
+		{[]string{"user", "forum", "thread"}, true, true, true},
+	}
+	for _, c := range cases {
+		params := withRequest(operations.NewPostGetOneParams()).(operations.PostGetOneParams)
+		params.ID = created.ID
+		params.Related = c.related
+
+		post := models.PostFull{}
+		expect(t, handler.PostGetOne(params), http.StatusOK, &post)
+		if post.Post == nil || post.Post.ID != created.ID {
+			t.Fatalf("%v: unexpected post %+v", c.related, post.Post)
+		}
+		if (post.Author != nil) != c.author || (post.Forum != nil) != c.forum || (post.Thread != nil) != c.hasThread {
+			t.Errorf("%v: unexpected related objects %+v", c.related, post)
+		}
+		if c.author && post.Author.Nickname != "j.sparrow" {
+			t.Errorf("unexpected author %+v", post.Author)
+		}
+		if c.forum && post.Forum.Slug != "pirates" {
+			t.Errorf("unexpected forum %+v", post.Forum)
+		}
+		if c.hasThread && post.Thread.ID != thread.ID {
+			t.Errorf("unexpected thread %+v", post.Thread)
+		}
+	}
+
+	params := withRequest(operations.NewPostGetOneParams()).(operations.PostGetOneParams)
+	params.ID = created.ID + 1000
+	expect(t, handler.PostGetOne(params), http.StatusNotFound, &models.Error{})
+}
+
+func testPostUpdate(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!"})
+	created := createPost(t, handler, thread.ID, "j.sparrow", 0)
+
+	cases := []struct {
+		message  string
+		expected string
+		edited   bool
+	}{
+		{"", created.Message, false},
+		{created.Message, created.Message, false},
+		{"Hide!", "Hide!", true},
+	}
+	for _, c := range cases {
+		params := withRequest(operations.NewPostUpdateParams()).(operations.PostUpdateParams)
+		params.ID = created.ID
+		params.Post = &models.PostUpdate{Message: c.message}
+
+		post := models.Post{}
+		expect(t, handler.PostUpdate(params, principal("j.sparrow")), http.StatusOK, &post)
+		if post.Message != c.expected || post.IsEdited != c.edited {
+			t.Errorf("%q: unexpected post %+v", c.message, post)
+		}
+	}
+
+	params := withRequest(operations.NewPostUpdateParams()).(operations.PostUpdateParams)
+	params.ID = created.ID
+	params.Post = &models.PostUpdate{Message: "Surrender!"}
+	expect(t, handler.PostUpdate(params, principal("w.turner")), http.StatusForbidden, &models.Error{})
+
+	params.ID = created.ID + 1000
+	expect(t, handler.PostUpdate(params, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+}
+
+func testPostDelete(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!"})
+	root := createPost(t, handler, thread.ID, "j.sparrow", 0)
+	reply := createPost(t, handler, thread.ID, "j.sparrow", root.ID)
+
+	params := withRequest(operations.NewPostDeleteParams()).(operations.PostDeleteParams)
+	params.ID = root.ID
+	expect(t, handler.PostDelete(params, principal("w.turner")), http.StatusForbidden, &models.Error{})
+	for attempt := 0; attempt < 2; attempt++ {
+		post := models.Post{}
+		expect(t, handler.PostDelete(params, principal("j.sparrow")), http.StatusOK, &post)
+		if !post.IsDeleted || post.ID != root.ID || post.Author != "" || post.Message == root.Message {
+			t.Errorf("attempt %d: expected tombstone, got %+v", attempt, post)
+		}
+	}
+
+	forumParams := withRequest(operations.NewForumGetOneParams()).(operations.ForumGetOneParams)
+	forumParams.Slug = "pirates"
+	forum := models.Forum{}
+	expect(t, handler.ForumGetOne(forumParams), http.StatusOK, &forum)
+	if forum.Posts != 1 {
+		t.Errorf("expected 1 post in forum after deletion, got %d", forum.Posts)
+	}
+
+	postsParams := withRequest(operations.NewThreadGetPostsParams()).(operations.ThreadGetPostsParams)
+	postsParams.SlugOrID = swag.FormatInt32(thread.ID)
+	postsParams.Sort = swag.String("tree")
+	posts := models.Posts{}
+	expect(t, handler.ThreadGetPosts(postsParams), http.StatusOK, &posts)
+	if len(posts) != 2 || posts[0].ID != root.ID || !posts[0].IsDeleted || posts[1].ID != reply.ID {
+		t.Errorf("deleted post must keep its place in the tree, got %+v", posts)
+	}
+
+	updateParams := withRequest(operations.NewPostUpdateParams()).(operations.PostUpdateParams)
+	updateParams.ID = root.ID
+	updateParams.Post = &models.PostUpdate{Message: "Back again"}
+	expect(t, handler.PostUpdate(updateParams, principal("j.sparrow")), http.StatusConflict, &models.Error{})
+
+	params.ID = reply.ID + 1000
+	expect(t, handler.PostDelete(params, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+}
+
+func testPostHistory(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!"})
+	created := createPost(t, handler, thread.ID, "j.sparrow", 0)
+
+	history := withRequest(operations.NewPostHistoryParams()).(operations.PostHistoryParams)
+	history.ID = created.ID
+	revisions := models.Revisions{}
+	expect(t, handler.PostHistory(history), http.StatusOK, &revisions)
+	if len(revisions) != 1 || revisions[0].Number != 1 || revisions[0].Message != created.Message || revisions[0].Editor != "j.sparrow" {
+		t.Errorf("expected the original version only, got %+v", revisions)
+	}
+
+	update := withRequest(operations.NewPostUpdateParams()).(operations.PostUpdateParams)
+	update.ID = created.ID
+	update.Post = &models.PostUpdate{Message: "We should be afraid of the Kraken"}
+	expect(t, handler.PostUpdate(update, principal("j.sparrow")), http.StatusOK, &models.Post{})
+	update.Post = &models.PostUpdate{Message: "We should not be afraid of the Kraken"}
+	expect(t, handler.PostUpdate(update, principal("J.SPARROW")), http.StatusOK, &models.Post{})
+	update.Post = &models.PostUpdate{Message: "Hide!"}
+	expect(t, handler.PostUpdate(update, principal("w.turner")), http.StatusForbidden, &models.Error{})
+
+	revisions = models.Revisions{}
+	expect(t, handler.PostHistory(history), http.StatusOK, &revisions)
+	expected := []models.Revision{
+		{Number: 1, Message: created.Message, Editor: "j.sparrow"},
+		{Number: 2, Message: "We should be afraid of the Kraken", Editor: "j.sparrow"},
+		{Number: 3, Message: "We should not be afraid of the Kraken", Editor: "j.sparrow"},
+	}
+	if len(revisions) != len(expected) {
+		t.Fatalf("expected %d revisions, got %+v", len(expected), revisions)
+	}
+	for idx, revision := range revisions {
+		if revision.Number != expected[idx].Number || revision.Message != expected[idx].Message ||
+			revision.Editor != expected[idx].Editor || revision.Created == nil {
+			t.Errorf("expected %+v at %d, got %+v", expected[idx], idx, revision)
+		}
+	}
+
+	diffParams := withRequest(operations.NewPostHistoryDiffParams()).(operations.PostHistoryDiffParams)
+	diffParams.ID = created.ID
+	diffParams.From = 2
+	diffParams.To = 3
+	diff := models.RevisionDiff{}
+	expect(t, handler.PostHistoryDiff(diffParams), http.StatusOK, &diff)
+	text := ""
+	for _, chunk := range diff.Message {
+		text += "[" + chunk.Op + ":" + chunk.Text + "]"
+	}
+	if expected := "[equal:We should ][insert:not ][equal:be afraid of the Kraken]"; text != expected {
+		t.Errorf("expected diff %s, got %s", expected, text)
+	}
+
+	diffParams.To = 4
+	expect(t, handler.PostHistoryDiff(diffParams), http.StatusNotFound, &models.Error{})
+
+	// Versions of a deleted post are kept for moderators, others see the tombstone
+	remove := withRequest(operations.NewPostDeleteParams()).(operations.PostDeleteParams)
+	remove.ID = created.ID
+	expect(t, handler.PostDelete(remove, principal("j.sparrow")), http.StatusOK, &models.Post{})
+	tokens := map[string]string{}
+	for _, nickname := range []string{"j.sparrow", "w.turner"} {
+		tokenCreate := withRequest(operations.NewUserTokenCreateParams()).(operations.UserTokenCreateParams)
+		tokenCreate.Nickname = nickname
+		token := models.Token{}
+		expect(t, handler.UserTokenCreate(tokenCreate, principal(nickname)), http.StatusCreated, &token)
+		tokens[nickname] = "Bearer " + token.Token
+	}
+	for _, authorization := range []string{"", "Bearer bogus", tokens["w.turner"]} {
+		history.HTTPRequest.Header.Set("Authorization", authorization)
+		revisions = models.Revisions{}
+		expect(t, handler.PostHistory(history), http.StatusOK, &revisions)
+		if len(revisions) != 1 || revisions[0].Message != "[deleted]" || revisions[0].Editor != "" {
+			t.Errorf("expected the tombstone only for %q, got %+v", authorization, revisions)
+		}
+		diffParams.HTTPRequest.Header.Set("Authorization", authorization)
+		diffParams.To = 3
+		expect(t, handler.PostHistoryDiff(diffParams), http.StatusNotFound, &models.Error{})
+	}
+	history.HTTPRequest.Header.Set("Authorization", tokens["j.sparrow"])
+	revisions = models.Revisions{}
+	expect(t, handler.PostHistory(history), http.StatusOK, &revisions)
+	if len(revisions) != len(expected) || revisions[2].Message != expected[2].Message {
+		t.Errorf("expected every version for the moderator, got %+v", revisions)
+	}
+	diffParams.HTTPRequest.Header.Set("Authorization", tokens["j.sparrow"])
+	expect(t, handler.PostHistoryDiff(diffParams), http.StatusOK, &models.RevisionDiff{})
+
+	// The original of a post deleted without edits is kept as well
+	unedited := createPost(t, handler, thread.ID, "w.turner", 0)
+	remove.ID = unedited.ID
+	expect(t, handler.PostDelete(remove, principal("w.turner")), http.StatusOK, &models.Post{})
+	history.ID = unedited.ID
+	revisions = models.Revisions{}
+	expect(t, handler.PostHistory(history), http.StatusOK, &revisions)
+	if len(revisions) != 1 || revisions[0].Message != unedited.Message || revisions[0].Editor != "w.turner" {
+		t.Errorf("expected the original for the moderator, got %+v", revisions)
+	}
+
+	history.ID = created.ID + 1000
+	expect(t, handler.PostHistory(history), http.StatusNotFound, &models.Error{})
+}
+
+func testThreadHistory(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+
+	update := withRequest(operations.NewThreadUpdateParams()).(operations.ThreadUpdateParams)
+	update.SlugOrID = "kraken"
+	update.Thread = &models.ThreadUpdate{Pinned: swag.Bool(true)}
+	expect(t, handler.ThreadUpdate(update, principal("j.sparrow")), http.StatusOK, &models.Thread{})
+	update.Thread = &models.ThreadUpdate{Title: "Kraken attack"}
+	expect(t, handler.ThreadUpdate(update, principal("j.sparrow")), http.StatusOK, &models.Thread{})
+
+	history := withRequest(operations.NewThreadHistoryParams()).(operations.ThreadHistoryParams)
+	history.SlugOrID = "kraken"
+	revisions := models.Revisions{}
+	expect(t, handler.ThreadHistory(history), http.StatusOK, &revisions)
+	if len(revisions) != 2 || revisions[0].Title != "Kraken" || revisions[1].Title != "Kraken attack" || revisions[1].Message != "Run!" {
+		t.Errorf("expected the original and the renamed versions, got %+v", revisions)
+	}
+
+	diffParams := withRequest(operations.NewThreadHistoryDiffParams()).(operations.ThreadHistoryDiffParams)
+	diffParams.SlugOrID = "kraken"
+	diffParams.From = 1
+	diffParams.To = 2
+	diff := models.RevisionDiff{}
+	expect(t, handler.ThreadHistoryDiff(diffParams), http.StatusOK, &diff)
+	if len(diff.Title) != 2 || diff.Title[1].Op != "insert" || diff.Title[1].Text != " attack" ||
+		len(diff.Message) != 1 || diff.Message[0].Op != "equal" {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+
+	history.SlugOrID = "unknown"
+	expect(t, handler.ThreadHistory(history), http.StatusNotFound, &models.Error{})
+
+	// History is gone with the thread
+	remove := withRequest(operations.NewThreadDeleteParams()).(operations.ThreadDeleteParams)
+	remove.SlugOrID = "kraken"
+	deleted := models.Thread{}
+	expect(t, handler.ThreadDelete(remove, principal("j.sparrow")), http.StatusOK, &deleted)
+	history.SlugOrID = swag.FormatInt32(deleted.ID)
+	expect(t, handler.ThreadHistory(history), http.StatusNotFound, &models.Error{})
+	diffParams.SlugOrID = swag.FormatInt32(deleted.ID)
+	expect(t, handler.ThreadHistoryDiff(diffParams), http.StatusNotFound, &models.Error{})
+}
+
+func testThreadGetPosts(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+
+	// r1        r2      r3
+	// ├─ c1     └─ c2
+	// │  └─ c3
+	// └─ c4
+	ids := map[string]int64{}
+	for _, item := range []struct{ name, parent string }{
+		{"r1", ""}, {"r2", ""}, {"r3", ""}, {"c1", "r1"}, {"c2", "r2"}, {"c3", "c1"}, {"c4", "r1"},
+	} {
+		ids[item.name] = createPost(t, handler, thread.ID, "j.sparrow", ids[item.parent]).ID
+	}
+
+	cases := []struct {
+		sort     string
+		since    string
+		limit    int32
+		desc     bool
+		expected []string
+	}{
+		{"flat", "", 100, false, []string{"r1", "r2", "r3", "c1", "c2", "c3", "c4"}},
+		{"flat", "", 3, true, []string{"c4", "c3", "c2"}},
+		{"flat", "r3", 100, false, []string{"c1", "c2", "c3", "c4"}},
+		{"flat", "c1", 2, true, []string{"r3", "r2"}},
+		{"tree", "", 100, false, []string{"r1", "c1", "c3", "c4", "r2", "c2", "r3"}},
+		{"tree", "", 100, true, []string{"r3", "c2", "r2", "c4", "c3", "c1", "r1"}},
+		{"tree", "c1", 3, false, []string{"c3", "c4", "r2"}},
+		{"tree", "c4", 2, true, []string{"c3", "c1"}},
+		{"parent_tree", "", 2, false, []string{"r1", "c1", "c3", "c4", "r2", "c2"}},
+		{"parent_tree", "", 1, true, []string{"r3"}},
+		{"parent_tree", "", 2, true, []string{"r3", "c2", "r2"}},
+		{"parent_tree", "r1", 1, false, []string{"r2", "c2"}},
+		{"parent_tree", "c2", 100, true, []string{"c4", "c3", "c1", "r1"}},
+	}
+	for _, c := range cases {
+		name := c.sort + "/since=" + c.since + "/limit=" + swag.FormatInt32(c.limit) + "/desc=" + swag.FormatBool(c.desc)
+		t.Run(name, func(t *testing.T) {
+			params := withRequest(operations.NewThreadGetPostsParams()).(operations.ThreadGetPostsParams)
+			params.SlugOrID = "kraken"
+			params.Sort = swag.String(c.sort)
+			params.Limit = swag.Int32(c.limit)
+			params.Desc = swag.Bool(c.desc)
+			if c.since != "" {
+				params.Since = swag.Int64(ids[c.since])
+			}
+
+			posts := models.Posts{}
+			expect(t, handler.ThreadGetPosts(params), http.StatusOK, &posts)
+			actual := []int64{}
+			for _, post := range posts {
+				actual = append(actual, post.ID)
+			}
+			expected := []int64{}
+			for _, name := range c.expected {
+				expected = append(expected, ids[name])
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected %v (%v), got %v", expected, c.expected, actual)
+			}
+		})
+	}
+
+	params := withRequest(operations.NewThreadGetPostsParams()).(operations.ThreadGetPostsParams)
+	params.SlugOrID = "unknown"
+	expect(t, handler.ThreadGetPosts(params), http.StatusNotFound, &models.Error{})
+}
+
+func testIdempotency(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+	createForum(t, handler, "pirates", "j.sparrow")
+	createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+
+	postsCreate := func(key, author, message string) middleware.Responder {
+		params := withRequest(operations.NewPostsCreateParams()).(operations.PostsCreateParams)
+		params.IdempotencyKey, params.SlugOrID = swag.String(key), "kraken"
+		params.Posts = models.Posts{{Message: message}}
+		return handler.PostsCreate(params, principal(author))
+	}
+	forumPosts := func() int64 {
+		forum := models.Forum{}
+		expect(t, handler.ForumGetOne(withRequest(operations.ForumGetOneParams{Slug: "pirates"}).(operations.ForumGetOneParams)), http.StatusOK, &forum)
+		return forum.Posts
+	}
+
+	first, retried := models.Posts{}, models.Posts{}
+	if replayed := respond(t, postsCreate("a1", "j.sparrow", "Run!"), http.StatusCreated, &first).Header().Get("Idempotent-Replayed"); replayed != "" {
+		t.Errorf("expected the first request to be performed, got Idempotent-Replayed %q", replayed)
+	}
+	if replayed := respond(t, postsCreate("a1", "j.sparrow", "Run!"), http.StatusCreated, &retried).Header().Get("Idempotent-Replayed"); replayed != "true" {
+		t.Errorf("expected the retry to be replayed, got Idempotent-Replayed %q", replayed)
+	}
+	if len(first) != 1 || len(retried) != 1 || first[0].ID != retried[0].ID || retried[0].Message != "Run!" {
+		t.Errorf("expected the retry to return the post created first, got %+v and %+v", first, retried)
+	}
+	if posts := forumPosts(); posts != 1 {
+		t.Errorf("expected a single post in the forum after the retry, got %d", posts)
+	}
+
+	// The key belongs to the request it was first used for and to its principal
+	expect(t, postsCreate("a1", "j.sparrow", "Swim!"), http.StatusConflict, &models.Error{})
+	other := models.Posts{}
+	expect(t, postsCreate("a1", "w.turner", "Run!"), http.StatusCreated, &other)
+	if len(other) != 1 || other[0].ID == first[0].ID || other[0].Author != "w.turner" {
+		t.Errorf("expected keys of another principal to be independent, got %+v", other)
+	}
+
+	threadCreate := func(key string) models.Thread {
+		params := withRequest(operations.NewThreadCreateParams()).(operations.ThreadCreateParams)
+		params.IdempotencyKey, params.Slug = swag.String(key), "pirates"
+		params.Thread = &models.Thread{Title: "Dutchman", Message: "Sail!"}
+		thread := models.Thread{}
+		expect(t, handler.ThreadCreate(params, principal("j.sparrow")), http.StatusCreated, &thread)
+		return thread
+	}
+	if thread, retried := threadCreate("b1"), threadCreate("b1"); thread.ID != retried.ID || !time.Time(*thread.Created).Equal(time.Time(*retried.Created)) {
+		t.Errorf("expected the retry to return the thread created first, got %+v and %+v", thread, retried)
+	}
+	forum := models.Forum{}
+	expect(t, handler.ForumGetOne(withRequest(operations.ForumGetOneParams{Slug: "pirates"}).(operations.ForumGetOneParams)), http.StatusOK, &forum)
+	if forum.Threads != 2 {
+		t.Errorf("expected 2 threads after the retry, got %d", forum.Threads)
+	}
+
+	// Anonymous operations replay as well: a retried registration is not a conflict
+	userCreate := withRequest(operations.NewUserCreateParams()).(operations.UserCreateParams)
+	userCreate.IdempotencyKey, userCreate.Nickname = swag.String("c1"), "e.swann"
+	userCreate.Profile = &models.User{Fullname: "Elizabeth Swann", Email: "e.swann@blackpearl.sea", Password: "port-royal"}
+	expect(t, handler.UserCreate(userCreate), http.StatusCreated, &models.User{})
+	expect(t, handler.UserCreate(userCreate), http.StatusCreated, &models.User{})
+
+	// Secrets are not stored with responses, a retried webhook comes without it
+	webhookCreate := withRequest(operations.NewForumWebhookCreateParams()).(operations.ForumWebhookCreateParams)
+	webhookCreate.IdempotencyKey, webhookCreate.Slug = swag.String("e1"), "pirates"
+	webhookCreate.Webhook = &models.Webhook{URL: "https://hooks.example.com/pirates"}
+	webhook, retriedWebhook := models.Webhook{}, models.Webhook{}
+	expect(t, handler.ForumWebhookCreate(webhookCreate, principal("j.sparrow")), http.StatusCreated, &webhook)
+	expect(t, handler.ForumWebhookCreate(webhookCreate, principal("j.sparrow")), http.StatusCreated, &retriedWebhook)
+	if webhook.Secret == "" || retriedWebhook.Secret != "" || retriedWebhook.ID != webhook.ID {
+		t.Errorf("expected the retry to return webhook %d without the secret, got %+v", webhook.ID, retriedWebhook)
+	}
+
+	// Expired keys are forgotten
+	defer func(ttl time.Duration) { service.IdempotencyTTL = ttl }(service.IdempotencyTTL)
+	service.IdempotencyTTL = -time.Second
+	expect(t, postsCreate("d1", "j.sparrow", "Yo ho!"), http.StatusCreated, &models.Posts{})
+	expect(t, postsCreate("d1", "j.sparrow", "Yo ho!"), http.StatusCreated, &models.Posts{})
+	if posts := forumPosts(); posts != 4 {
+		t.Errorf("expected an expired key to be performed again, got %d posts", posts)
+	}
+}
+
+// dumpEnd is the end record counting the records of a dump.
+func dumpEnd(lines ...string) string {
+	counts := models.ImportResult{}
+	for _, line := range lines {
+		record := struct {
+			Type string `json:"type"`
+		}{}
+		json.Unmarshal([]byte(line), &record)
+		switch record.Type {
+		case service.DumpUser:
+			counts.Users++
+		case service.DumpForum:
+			counts.Forums++
+		case service.DumpThread:
+			counts.Threads++
+		case service.DumpPost:
+			counts.Posts++
+		case service.DumpVote:
+			counts.Votes++
+		}
+	}
+	end, _ := json.Marshal(map[string]interface{}{"type": service.DumpEnd, "counts": counts})
+	return string(end)
+}
+
+func testImport(t *testing.T, handler service.ForumHandler) {
+	importLines := func(nickname string, lines ...string) middleware.Responder {
+		params := withRequest(operations.NewImportDumpParams()).(operations.ImportDumpParams)
+		params.Dump = ioutil.NopCloser(strings.NewReader(strings.Join(lines, "\n")))
+		return service.ImportHandler(handler)(params, principal(nickname))
+	}
+	// importDump ends the dump with the right end record
+	importDump := func(nickname string, lines ...string) middleware.Responder {
+		return importLines(nickname, append(lines, dumpEnd(lines...))...)
+	}
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+
+	// In-memory storage keeps ids dense and can't import at all
+	recorder := httptest.NewRecorder()
+	importDump(admin).WriteResponse(recorder, runtime.JSONProducer())
+	if recorder.Code == http.StatusNotImplemented {
+		return
+	}
+	expect(t, importDump("j.sparrow", `{"type":"user","nickname":"w.turner","fullname":"Will Turner","email":"will@dutchman.sea"}`),
+		http.StatusForbidden, &models.Error{})
+
+	// r100        r300
+	// └─ c200
+	//    └─ c150
+	dump := []string{
+		`{"type":"user","nickname":"w.turner","fullname":"Will Turner","email":"will@dutchman.sea","about":"Blacksmith"}`,
+		`{"type":"user","nickname":"e.swann","fullname":"Elizabeth Swann","email":"elizabeth@port-royal.sea"}`,
+		`{"type":"forum","slug":"navy","title":"Royal Navy","user":"E.Swann"}`,
+		``,
+		`{"type":"thread","id":40,"forum":"NAVY","author":"w.turner","title":"Dutchman","message":"Sail","slug":"dutchman","created":"2017-01-02T03:04:05.000Z"}`,
+		`{"type":"thread","id":41,"forum":"pirates","author":"j.sparrow","title":"Pearl","message":"Sail"}`,
+		`{"type":"post","id":150,"thread":40,"author":"j.sparrow","message":"Aye","parent":200,"created":"2017-01-02T03:04:08.000Z"}`,
+		`{"type":"post","id":100,"thread":40,"author":"w.turner","message":"Hoist","created":"2017-01-02T03:04:06.000Z"}`,
+		`{"type":"post","id":200,"thread":40,"author":"e.swann","message":"Why?","parent":100,"isEdited":true,"created":"2017-01-02T03:04:07.000Z"}`,
+		`{"type":"post","id":300,"thread":40,"author":"w.turner","message":"Gone","isDeleted":true}`,
+		`{"type":"vote","thread":40,"nickname":"j.sparrow","voice":1}`,
+		`{"type":"vote","thread":40,"nickname":"e.swann","voice":1}`,
+		`{"type":"vote","thread":41,"nickname":"w.turner","voice":-1}`,
+	}
+	result := models.ImportResult{}
+	expect(t, importDump(admin, dump...), http.StatusOK, &result)
+	if expected := (models.ImportResult{Users: 2, Forums: 1, Threads: 2, Posts: 4, Votes: 3}); result != expected {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	forumParams := withRequest(operations.NewForumGetOneParams()).(operations.ForumGetOneParams)
+	forumParams.Slug = "navy"
+	forum := models.Forum{}
+	expect(t, handler.ForumGetOne(forumParams), http.StatusOK, &forum)
+	if expected := (models.Forum{Slug: "navy", Title: "Royal Navy", User: "e.swann", Threads: 1, Posts: 3}); forum != expected {
+		t.Errorf("expected %+v, got %+v", expected, forum)
+	}
+
+	threadParams := withRequest(operations.NewThreadGetOneParams()).(operations.ThreadGetOneParams)
+	threadParams.SlugOrID = "dutchman"
+	thread := models.Thread{}
+	expect(t, handler.ThreadGetOne(threadParams), http.StatusOK, &thread)
+	if thread.ID != 40 || thread.Forum != "navy" || thread.Votes != 2 || !time.Time(*thread.Created).Equal(time.Time(*dateTime("2017-01-02T03:04:05Z"))) {
+		t.Errorf("expected thread 40 of navy created at 2017-01-02T03:04:05Z with 2 votes, got %+v", thread)
+	}
+	threadParams.SlugOrID = "41"
+	expect(t, handler.ThreadGetOne(threadParams), http.StatusOK, &thread)
+	if thread.Votes != -1 {
+		t.Errorf("expected a vote against thread 41, got %+v", thread)
+	}
+
+	postsParams := withRequest(operations.NewThreadGetPostsParams()).(operations.ThreadGetPostsParams)
+	postsParams.SlugOrID = "40"
+	postsParams.Sort = swag.String("tree")
+	posts := models.Posts{}
+	expect(t, handler.ThreadGetPosts(postsParams), http.StatusOK, &posts)
+	actual := []int64{}
+	for _, post := range posts {
+		actual = append(actual, post.ID)
+	}
+	if expected := []int64{100, 200, 150, 300}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected posts %v in tree order, got %v", expected, actual)
+	}
+	if len(posts) == 4 && (!posts[1].IsEdited || posts[1].Parent != 100 || posts[1].Forum != "navy") {
+		t.Errorf("expected an edited reply to post 100 in navy, got %+v", posts[1])
+	}
+
+	usersParams := withRequest(operations.NewForumGetUsersParams()).(operations.ForumGetUsersParams)
+	usersParams.Slug = "navy"
+	users := models.Users{}
+	expect(t, handler.ForumGetUsers(usersParams), http.StatusOK, &users)
+	nicknames := []string{}
+	for _, user := range users {
+		nicknames = append(nicknames, user.Nickname)
+	}
+	if expected := []string{"e.swann", "j.sparrow", "w.turner"}; !reflect.DeepEqual(nicknames, expected) {
+		t.Errorf("expected users %v, got %v", expected, nicknames)
+	}
+
+	// New posts and threads get ids after the imported ones
+	if post := createPost(t, handler, 40, "w.turner", 150); post.ID <= 300 {
+		t.Errorf("expected a new post after the imported ones, got %d", post.ID)
+	}
+	if created := createThread(t, handler, "navy", models.Thread{Author: "w.turner", Title: "Kraken", Message: "Run!"}); created.ID <= 41 {
+		t.Errorf("expected a new thread after the imported ones, got %d", created.ID)
+	}
+
+	// A broken dump is rejected as a whole
+	expect(t, importDump(admin,
+		`{"type":"user","nickname":"h.barbossa","fullname":"Hector Barbossa","email":"hector@pearl.sea"}`,
+		`{"type":"thread","id":50,"forum":"unknown","author":"h.barbossa","title":"Mutiny","message":"Arr"}`,
+	), http.StatusBadRequest, &models.Error{})
+	expect(t, importDump(admin,
+		`{"type":"user","nickname":"h.barbossa","fullname":"Hector Barbossa","email":"hector@pearl.sea"}`,
+		`{"type":"post","id":500,"thread":41,"author":"h.barbossa","message":"Arr","parent":501}`,
+		`{"type":"post","id":501,"thread":41,"author":"h.barbossa","message":"Arr","parent":500}`,
+	), http.StatusBadRequest, &models.Error{})
+	expect(t, importDump(admin, `{"type":"user","nickname":"h.barbossa"`), http.StatusBadRequest, &models.Error{})
+	expect(t, importDump(admin, `{"type":"ship","name":"Black Pearl"}`), http.StatusBadRequest, &models.Error{})
+	userParams := withRequest(operations.NewUserGetOneParams()).(operations.UserGetOneParams)
+	userParams.Nickname = "h.barbossa"
+	expect(t, handler.UserGetOne(userParams), http.StatusNotFound, &models.Error{})
+
+	expect(t, importDump(admin, `{"type":"post","id":100,"thread":41,"author":"w.turner","message":"Again"}`),
+		http.StatusConflict, &models.Error{})
+	expect(t, importDump(admin, `{"type":"user","nickname":"W.Turner","fullname":"Will Turner","email":"other@dutchman.sea"}`),
+		http.StatusConflict, &models.Error{})
+	expect(t, importDump(admin, `{"type":"forum","slug":"Pirates","title":"Pirates again","user":"j.sparrow"}`),
+		http.StatusConflict, &models.Error{})
+	expect(t, importDump(admin,
+		`{"type":"forum","slug":"tortuga","title":"Tortuga","user":"j.sparrow"}`,
+		`{"type":"forum","slug":"TORTUGA","title":"Tortuga again","user":"j.sparrow"}`,
+	), http.StatusConflict, &models.Error{})
+
+	// Existing users are matched by nickname, new ones need an email
+	barbossa := `{"type":"user","nickname":"h.barbossa","fullname":"Hector Barbossa"}`
+	expect(t, importDump(admin, barbossa), http.StatusBadRequest, &models.Error{})
+	expect(t, importDump(admin,
+		`{"type":"user","nickname":"W.TURNER","fullname":"Will Turner"}`,
+		`{"type":"user","nickname":"e.swann","fullname":"Elizabeth Swann","email":"Elizabeth@Port-Royal.sea"}`,
+		`{"type":"thread","id":60,"forum":"navy","author":"w.turner","title":"Chest","message":"Heart"}`,
+	), http.StatusOK, &result)
+	if expected := (models.ImportResult{Users: 2, Threads: 1}); result != expected {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	// A dump without its end record or with other counts is truncated
+	thread61 := `{"type":"thread","id":61,"forum":"navy","author":"w.turner","title":"Chest","message":"Heart"}`
+	expect(t, importLines(admin, thread61), http.StatusBadRequest, &models.Error{})
+	expect(t, importLines(admin, thread61, `{"type":"end","counts":{"threads":2}}`), http.StatusBadRequest, &models.Error{})
+	expect(t, importLines(admin, thread61, dumpEnd(thread61), thread61), http.StatusBadRequest, &models.Error{})
+	expect(t, importLines(admin, thread61, `{"type":"end"}`), http.StatusBadRequest, &models.Error{})
+	threadParams.SlugOrID = "61"
+	expect(t, handler.ThreadGetOne(threadParams), http.StatusNotFound, &models.Error{})
+}
+
+func testExport(t *testing.T, handler service.ForumHandler) {
+	for _, nickname := range []string{"j.sparrow", "w.turner", "e.swann", "h.barbossa", "d.jones"} {
+		createUser(t, handler, nickname)
+	}
+	createForum(t, handler, "pirates", "j.sparrow")
+	createForum(t, handler, "dutchman", "d.jones")
+	kraken := createThread(t, handler, "pirates", models.Thread{Author: "w.turner", Title: "Kraken", Message: "Run!", Slug: "kraken"})
+	pearl := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Pearl", Message: "Sail!", Slug: "pearl"})
+	createThread(t, handler, "dutchman", models.Thread{Author: "d.jones", Title: "Chest", Message: "Heart"})
+
+	// r1        r2
+	// └─ c1
+	//    └─ c2
+	r1 := createPost(t, handler, kraken.ID, "j.sparrow", 0)
+	r2 := createPost(t, handler, kraken.ID, "w.turner", 0)
+	c1 := createPost(t, handler, kraken.ID, "e.swann", r1.ID)
+	c2 := createPost(t, handler, kraken.ID, "j.sparrow", c1.ID)
+	remove := withRequest(operations.NewPostDeleteParams()).(operations.PostDeleteParams)
+	remove.ID = c1.ID
+	expect(t, handler.PostDelete(remove, principal("e.swann")), http.StatusOK, &models.Post{})
+	vote := withRequest(operations.NewThreadVoteParams()).(operations.ThreadVoteParams)
+	vote.SlugOrID = "kraken"
+	vote.Vote = &models.Vote{Voice: -1}
+	expect(t, handler.ThreadVote(vote, principal("h.barbossa")), http.StatusOK, &models.Thread{})
+	// Deleted threads are left out with their posts
+	createPost(t, handler, pearl.ID, "j.sparrow", 0)
+	deleteThread := withRequest(operations.NewThreadDeleteParams()).(operations.ThreadDeleteParams)
+	deleteThread.SlugOrID = "pearl"
+	expect(t, handler.ThreadDelete(deleteThread, principal("j.sparrow")), http.StatusOK, &models.Thread{})
+
+	export := func(nickname, slug, format string, status int) *httptest.ResponseRecorder {
+		t.Helper()
+		params := withRequest(operations.NewForumExportParams()).(operations.ForumExportParams)
+		params.Slug = slug
+		params.Format = swag.String(format)
+		return respond(t, handler.ForumExport(params, principal(nickname)), status, nil)
+	}
+	type record struct {
+		Type     string `json:"type"`
+		ID       int64  `json:"id"`
+		Nickname string `json:"nickname"`
+		Email    string `json:"email"`
+		Slug     string `json:"slug"`
+		Thread   int32  `json:"thread"`
+		Author   string `json:"author"`
+		Parent   int64  `json:"parent"`
+		Voice    int32  `json:"voice"`
+
+		Counts *models.ImportResult `json:"counts"`
+	}
+	decode := func(body []byte) []record {
+		t.Helper()
+		records := []record{}
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			item := record{}
+			if err := json.Unmarshal([]byte(line), &item); err != nil {
+				t.Fatalf("expected a JSON record per line, got %q: %v", line, err)
+			}
+			records = append(records, item)
+		}
+		return records
+	}
+
+	recorder := export("J.Sparrow", "Pirates", "ndjson", http.StatusOK)
+	if disposition := recorder.Header().Get("Content-Disposition"); !strings.Contains(disposition, `filename="pirates.ndjson"`) {
+		t.Errorf("expected an attachment pirates.ndjson, got %q", disposition)
+	}
+	records := decode(recorder.Body.Bytes())
+	actual := []string{}
+	for _, item := range records {
+		switch item.Type {
+		case "user":
+			actual = append(actual, "user "+item.Nickname)
+			if item.Email != "" {
+				t.Errorf("expected emails to be left out for the owner, got %+v", item)
+			}
+		case "forum":
+			actual = append(actual, "forum "+item.Slug)
+		case "thread":
+			actual = append(actual, "thread "+item.Slug)
+		case "post":
+			actual = append(actual, "post "+swag.FormatInt64(item.ID)+" "+item.Author)
+		case "vote":
+			actual = append(actual, "vote "+item.Nickname+" "+swag.FormatInt32(item.Voice))
+		}
+	}
+	expected := []string{
+		"user e.swann", "user h.barbossa", "user j.sparrow", "user w.turner",
+		"forum pirates",
+		"thread kraken",
+		"post " + swag.FormatInt64(r1.ID) + " j.sparrow", "post " + swag.FormatInt64(c1.ID) + " ",
+		"post " + swag.FormatInt64(c2.ID) + " j.sparrow", "post " + swag.FormatInt64(r2.ID) + " w.turner",
+		"vote h.barbossa -1",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected records %v, got %v", expected, actual)
+	}
+	end := records[len(records)-1]
+	if counts := (models.ImportResult{Users: 4, Forums: 1, Threads: 1, Posts: 4, Votes: 1}); end.Type != "end" || end.Counts == nil || *end.Counts != counts {
+		t.Errorf("expected the end record to count %+v, got %+v", counts, end)
+	}
+	ownerDump := recorder.Body.String()
+
+	// Administrators get emails, the JSON archive has the same records
+	recorder = export(admin, "pirates", "json", http.StatusOK)
+	archive := []record{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &archive); err != nil || len(archive) != len(records) {
+		t.Fatalf("expected a JSON array of %d records, got %s", len(records), recorder.Body.String())
+	}
+	if archive[0].Email != "e.swann@blackpearl.sea" {
+		t.Errorf("expected the email of e.swann, got %+v", archive[0])
+	}
+
+	export("w.turner", "pirates", "ndjson", http.StatusForbidden)
+	export("j.sparrow", "unknown", "ndjson", http.StatusNotFound)
+	empty := bytes.Buffer{}
+	if err := handler.Export(context.Background(), "unknown", service.DumpNDJSON, &empty); err == nil || err.StatusCode() != http.StatusNotFound || empty.Len() != 0 {
+		t.Errorf("expected nothing but 404 for an unknown forum, got %v and %q", err, empty.String())
+	}
+
+	// The export moves the forum to an empty database
+	dump := bytes.Buffer{}
+	if err := handler.Export(context.Background(), "pirates", service.DumpNDJSON, &dump); err != nil {
+		t.Fatalf("expected an export, got %v", err)
+	}
+	expect(t, handler.Clear(withRequest(operations.NewClearParams()).(operations.ClearParams), principal(admin)), http.StatusOK, nil)
+	params := withRequest(operations.NewImportDumpParams()).(operations.ImportDumpParams)
+	params.Dump = ioutil.NopCloser(&dump)
+	recorder = httptest.NewRecorder()
+	service.ImportHandler(handler)(params, principal(admin)).WriteResponse(recorder, runtime.JSONProducer())
+	if recorder.Code == http.StatusNotImplemented {
+		return
+	}
+	result := models.ImportResult{}
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &result) != nil {
+		t.Fatalf("expected the export to be imported, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if expected := (models.ImportResult{Users: 4, Forums: 1, Threads: 1, Posts: 4, Votes: 1}); result != expected {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+	forumParams := withRequest(operations.NewForumGetOneParams()).(operations.ForumGetOneParams)
+	forumParams.Slug = "pirates"
+	forum := models.Forum{}
+	expect(t, handler.ForumGetOne(forumParams), http.StatusOK, &forum)
+	if expected := (models.Forum{Slug: "pirates", Title: "Forum pirates", User: "j.sparrow", Threads: 1, Posts: 3}); forum != expected {
+		t.Errorf("expected %+v, got %+v", expected, forum)
+	}
+	if again := decode(export(admin, "pirates", "ndjson", http.StatusOK).Body.Bytes()); !reflect.DeepEqual(again, archive) {
+		t.Errorf("expected the imported forum to export the same records %+v, got %+v", archive, again)
+	}
+
+	// The export of the owner has no emails, it moves the forum to a database with its users
+	// or to an empty one with placeholder emails
+	importOwner := func(dump string, placeholderEmails bool, status int) {
+		t.Helper()
+		params.Dump = ioutil.NopCloser(strings.NewReader(dump))
+		params.PlaceholderEmails = swag.Bool(placeholderEmails)
+		expect(t, service.ImportHandler(handler)(params, principal(admin)), status, nil)
+	}
+	expect(t, handler.Clear(withRequest(operations.NewClearParams()).(operations.ClearParams), principal(admin)), http.StatusOK, nil)
+	importOwner(ownerDump, false, http.StatusBadRequest)
+	importOwner(ownerDump, true, http.StatusOK)
+	expect(t, handler.ForumGetOne(forumParams), http.StatusOK, &forum)
+	if expected := (models.Forum{Slug: "pirates", Title: "Forum pirates", User: "j.sparrow", Threads: 1, Posts: 3}); forum != expected {
+		t.Errorf("expected %+v, got %+v", expected, forum)
+	}
+	userParams := withRequest(operations.NewUserGetOneParams()).(operations.UserGetOneParams)
+	userParams.Nickname = "w.turner"
+	user := models.User{}
+	expect(t, handler.UserGetOne(userParams), http.StatusOK, &user)
+	if user.Email != "w.turner@"+service.PlaceholderEmailDomain {
+		t.Errorf("expected a placeholder email, got %+v", user)
+	}
+
+	expect(t, handler.Clear(withRequest(operations.NewClearParams()).(operations.ClearParams), principal(admin)), http.StatusOK, nil)
+	for _, nickname := range []string{"j.sparrow", "w.turner", "e.swann", "h.barbossa"} {
+		createUser(t, handler, nickname)
+	}
+	// A cut off export is refused
+	importOwner(ownerDump[:strings.LastIndex(strings.TrimSpace(ownerDump), "\n")], false, http.StatusBadRequest)
+	importOwner(ownerDump, false, http.StatusOK)
+	expect(t, handler.ForumGetOne(forumParams), http.StatusOK, &forum)
+	if expected := (models.Forum{Slug: "pirates", Title: "Forum pirates", User: "j.sparrow", Threads: 1, Posts: 3}); forum != expected {
+		t.Errorf("expected %+v, got %+v", expected, forum)
+	}
+}
+
+func testSearch(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	createForum(t, handler, "dutchman", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!"})
+	other := createThread(t, handler, "dutchman", models.Thread{Author: "j.sparrow", Title: "Chest", Message: "Find the chest"})
+	expect(t, postsCreate(handler, swag.FormatInt32(thread.ID),
+		&models.Post{Author: "j.sparrow", Message: "We should be afraid of the kraken"},
+		&models.Post{Author: "j.sparrow", Message: "Nothing to be afraid of"}), http.StatusCreated, &models.Posts{})
+	expect(t, postsCreate(handler, swag.FormatInt32(other.ID),
+		&models.Post{Author: "j.sparrow", Message: "Kraken took the chest"}), http.StatusCreated, &models.Posts{})
+
+	cases := []struct {
+		forum    string
+		q        string
+		limit    int32
+		expected int
+	}{
+		{"pirates", "kraken", 100, 2},
+		{"PIRATES", "kraken", 1, 1},
+		{"dutchman", "chest", 100, 2},
+		{"pirates", "chest", 100, 0},
+		{"", "kraken", 100, 3},
+		{"", "davy", 100, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.forum+"/"+c.q, func(t *testing.T) {
+			results := models.SearchResults{}
+			if c.forum != "" {
+				params := withRequest(operations.NewForumSearchParams()).(operations.ForumSearchParams)
+				params.Slug = c.forum
+				params.Q = c.q
+				params.Limit = swag.Int32(c.limit)
+				expect(t, handler.ForumSearch(params), http.StatusOK, &results)
+			} else {
+				params := withRequest(operations.NewSearchParams()).(operations.SearchParams)
+				params.Q = c.q
+				params.Limit = swag.Int32(c.limit)
+				expect(t, handler.Search(params), http.StatusOK, &results)
+			}
+
+			if len(results) != c.expected {
+				t.Fatalf("expected %d results, got %d", c.expected, len(results))
+			}
+			for _, result := range results {
+				if (result.Type == "post") != (result.Post != nil) || (result.Type == "thread") != (result.Thread != nil) {
+					t.Errorf("unexpected result %+v", result)
+				}
+			}
+		})
+	}
+
+	params := withRequest(operations.NewForumSearchParams()).(operations.ForumSearchParams)
+	params.Slug = "unknown"
+	params.Q = "kraken"
+	expect(t, handler.ForumSearch(params), http.StatusNotFound, &models.Error{})
+}
+
+// collectPages follows cursors from the first page to the last one and joins the pages.
+func collectPages(t *testing.T, page func(cursor *string) ([]string, string)) []string {
+	t.Helper()
+
+	all := []string{}
+	var next *string
+	for pages := 0; pages < 100; pages++ {
+		items, cursor := page(next)
+		all = append(all, items...)
+		if cursor == "" {
+			return all
+		}
+		next = &cursor
+	}
+	t.Fatalf("too many pages, got %v", all)
+	return nil
+}
+
+func testCursors(t *testing.T, handler service.ForumHandler) {
+	for _, nickname := range []string{"j.sparrow", "w.turner", "e.swann", "d.jones", "h.barbossa"} {
+		createUser(t, handler, nickname)
+	}
+	createForum(t, handler, "pirates", "j.sparrow")
+
+	// Threads created at the same moment used to be skipped or repeated by since
+	threads := []models.Thread{}
+	for _, title := range []string{"Kraken", "Chest", "Compass", "Pearl", "Dutchman"} {
+		threads = append(threads, createThread(t, handler, "pirates",
+			models.Thread{Author: "j.sparrow", Title: title, Message: "Kraken", Created: dateTime("2017-01-01T00:00:00Z")}))
+	}
+	pin := withRequest(operations.NewThreadPinParams()).(operations.ThreadPinParams)
+	pin.SlugOrID = swag.FormatInt32(threads[2].ID)
+	expect(t, handler.ThreadPin(pin, principal("j.sparrow")), http.StatusOK, &models.Thread{})
+
+	root := createPost(t, handler, threads[0].ID, "w.turner", 0)
+	for _, author := range []string{"e.swann", "d.jones"} {
+		createPost(t, handler, threads[0].ID, author, root.ID)
+	}
+	expect(t, postsCreate(handler, swag.FormatInt32(threads[0].ID),
+		&models.Post{Author: "h.barbossa", Message: "Kraken!"},
+		&models.Post{Author: "e.swann", Message: "Kraken?"},
+		&models.Post{Author: "d.jones", Message: "Kraken."}), http.StatusCreated, &models.Posts{})
+
+	getThreads := func(desc bool, limit int32, cursor *string) ([]string, string) {
+		params := withRequest(operations.NewForumGetThreadsParams()).(operations.ForumGetThreadsParams)
+		params.Slug = "pirates"
+		params.Desc = swag.Bool(desc)
+		params.Limit = swag.Int32(limit)
+		params.Cursor = cursor
+		result := models.Threads{}
+		next := expectPage(t, handler.ForumGetThreads(params), &result)
+		ids := []string{}
+		for _, thread := range result {
+			ids = append(ids, swag.FormatInt32(thread.ID))
+		}
+		return ids, next
+	}
+	getUsers := func(desc bool, limit int32, cursor *string) ([]string, string) {
+		params := withRequest(operations.NewForumGetUsersParams()).(operations.ForumGetUsersParams)
+		params.Slug = "pirates"
+		params.Desc = swag.Bool(desc)
+		params.Limit = swag.Int32(limit)
+		params.Cursor = cursor
+		result := models.Users{}
+		next := expectPage(t, handler.ForumGetUsers(params), &result)
+		nicknames := []string{}
+		for _, user := range result {
+			nicknames = append(nicknames, user.Nickname)
+		}
+		return nicknames, next
+	}
+	getPosts := func(sort string, desc bool, limit int32, cursor *string) ([]string, string) {
+		params := withRequest(operations.NewThreadGetPostsParams()).(operations.ThreadGetPostsParams)
+		params.SlugOrID = swag.FormatInt32(threads[0].ID)
+		params.Sort = swag.String(sort)
+		params.Desc = swag.Bool(desc)
+		params.Limit = swag.Int32(limit)
+		params.Cursor = cursor
+		result := models.Posts{}
+		next := expectPage(t, handler.ThreadGetPosts(params), &result)
+		ids := []string{}
+		for _, post := range result {
+			ids = append(ids, swag.FormatInt64(post.ID))
+		}
+		return ids, next
+	}
+	search := func(desc bool, limit int32, cursor *string) ([]string, string) {
+		params := withRequest(operations.NewSearchParams()).(operations.SearchParams)
+		params.Q = "kraken"
+		params.Desc = swag.Bool(desc)
+		params.Limit = swag.Int32(limit)
+		params.Cursor = cursor
+		result := models.SearchResults{}
+		next := expectPage(t, handler.Search(params), &result)
+		ids := []string{}
+		for _, item := range result {
+			if item.Post != nil {
+				ids = append(ids, "post "+swag.FormatInt64(item.Post.ID))
+			} else if item.Thread != nil {
+				ids = append(ids, "thread "+swag.FormatInt32(item.Thread.ID))
+			}
+		}
+		return ids, next
+	}
+
+	listings := map[string]func(limit int32, cursor *string) ([]string, string){}
+	for _, desc := range []bool{false, true} {
+		desc := desc
+		suffix := "/asc"
+		if desc {
+			suffix = "/desc"
+		}
+		listings["threads"+suffix] = func(limit int32, cursor *string) ([]string, string) { return getThreads(desc, limit, cursor) }
+		listings["users"+suffix] = func(limit int32, cursor *string) ([]string, string) { return getUsers(desc, limit, cursor) }
+		listings["search"+suffix] = func(limit int32, cursor *string) ([]string, string) { return search(desc, limit, cursor) }
+		for _, sort := range []string{"flat", "tree", "parent_tree"} {
+			sort := sort
+			listings["posts/"+sort+suffix] = func(limit int32, cursor *string) ([]string, string) {
+				return getPosts(sort, desc, limit, cursor)
+			}
+		}
+	}
+	for name, listing := range listings {
+		listing := listing
+		t.Run(name, func(t *testing.T) {
+			all, next := listing(100, nil)
+			if next != "" {
+				t.Errorf("expected no cursor after the last page, got %q", next)
+			}
+			paged := collectPages(t, func(cursor *string) ([]string, string) { return listing(2, cursor) })
+			if !reflect.DeepEqual(paged, all) {
+				t.Errorf("expected pages to make up %v, got %v", all, paged)
+			}
+		})
+	}
+
+	if ids, _ := getThreads(false, 100, nil); len(ids) != 5 || ids[0] != swag.FormatInt32(threads[2].ID) ||
+		ids[1] != swag.FormatInt32(threads[0].ID) || ids[4] != swag.FormatInt32(threads[4].ID) {
+		t.Errorf("expected the pinned thread and then threads by id, got %v", ids)
+	}
+
+	// A cursor is valid only for the listing it was issued for
+	_, next := getThreads(false, 2, nil)
+	params := withRequest(operations.NewForumGetThreadsParams()).(operations.ForumGetThreadsParams)
+	params.Slug = "pirates"
+	params.Desc = swag.Bool(true)
+	params.Cursor = &next
+	expect(t, handler.ForumGetThreads(params), http.StatusBadRequest, &models.Error{})
+	params.Desc = swag.Bool(false)
+	tampered := "x" + next
+	params.Cursor = &tampered
+	expect(t, handler.ForumGetThreads(params), http.StatusBadRequest, &models.Error{})
+	users := withRequest(operations.NewForumGetUsersParams()).(operations.ForumGetUsersParams)
+	users.Slug = "pirates"
+	users.Cursor = &next
+	expect(t, handler.ForumGetUsers(users), http.StatusBadRequest, &models.Error{})
+}
+
+// streamRecorder is a ResponseWriter that can be read while a stream is being written to it.
+type streamRecorder struct {
+	mu     sync.Mutex
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (recorder *streamRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *streamRecorder) WriteHeader(status int) {}
+
+func (recorder *streamRecorder) Write(data []byte) (int, error) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return recorder.body.Write(data)
+}
+
+func (recorder *streamRecorder) Flush() {}
+
+// events decodes the data of every complete event written so far.
+func (recorder *streamRecorder) events(t *testing.T) []models.ThreadEvent {
+	t.Helper()
+
+	recorder.mu.Lock()
+	body := recorder.body.String()
+	recorder.mu.Unlock()
+
+	events := []models.ThreadEvent{}
+	blocks := strings.Split(body, "\n\n")
+	for _, block := range blocks[:len(blocks)-1] {
+		for _, line := range strings.Split(block, "\n") {
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			event := models.ThreadEvent{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("can't decode event %q: %v", line, err)
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// waitEvents waits until count events are written, streams of PostgreSQL get them asynchronously.
+func (recorder *streamRecorder) waitEvents(t *testing.T, count int) []models.ThreadEvent {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		events := recorder.events(t)
+		if len(events) >= count || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testThreadStream(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Release the Kraken", Slug: "kraken"})
+	other := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Chest", Message: "Dead man's chest"})
+
+	missing := withRequest(operations.NewThreadStreamParams()).(operations.ThreadStreamParams)
+	missing.SlugOrID = "flying-dutchman"
+	expect(t, handler.ThreadStream(missing), http.StatusNotFound, &models.Error{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	params := operations.NewThreadStreamParams()
+	params.HTTPRequest = httptest.NewRequest(http.MethodGet, "/api", nil).WithContext(ctx)
+	params.SlugOrID = "kraken"
+	responder := handler.ThreadStream(params)
+
+	recorder := &streamRecorder{header: http.Header{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		responder.WriteResponse(recorder, runtime.JSONProducer())
+	}()
+
+	createPost(t, handler, other.ID, "w.turner", 0)
+	post := createPost(t, handler, thread.ID, "w.turner", 0)
+	vote := withRequest(operations.NewThreadVoteParams()).(operations.ThreadVoteParams)
+	vote.SlugOrID = "kraken"
+	vote.Vote = &models.Vote{Voice: 1}
+	expect(t, handler.ThreadVote(vote, principal("w.turner")), http.StatusOK, &models.Thread{})
+
+	events := recorder.waitEvents(t, 2)
+	if len(events) != 2 {
+		t.Fatalf("expected a post and a vote, got %+v", events)
+	}
+	if events[0].Type != "post" || events[0].Thread != thread.ID || events[0].Post == nil || events[0].Post.ID != post.ID {
+		t.Errorf("expected post %d, got %+v", post.ID, events[0])
+	}
+	if events[1].Type != "vote" || events[1].Thread != thread.ID || events[1].Votes != 1 {
+		t.Errorf("expected thread rating 1, got %+v", events[1])
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream is not closed after the client went away")
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %q", contentType)
+	}
+	if events := recorder.events(t); len(events) != 2 {
+		t.Errorf("expected no events of other threads, got %+v", events)
+	}
+}
+
+// gatewayMessage is either an event or a reply of the gateway.
+type gatewayMessage struct {
+	models.ForumEvent
+	Topics  []string `json:"topics"`
+	Message string   `json:"message"`
+}
+
+func testGateway(t *testing.T, handler service.ForumHandler) {
+	for _, nickname := range []string{"j.sparrow", "w.turner", "e.swann"} {
+		createUser(t, handler, nickname)
+	}
+	createForum(t, handler, "pirates", "j.sparrow")
+	createForum(t, handler, "navy", "e.swann")
+
+	defer func(limit int) { service.GatewayMaxSubscriptions = limit }(service.GatewayMaxSubscriptions)
+	service.GatewayMaxSubscriptions = 3
+
+	server := httptest.NewServer(handler.Gateway())
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?topic=forum:Pirates", nil)
+	if err != nil {
+		t.Fatalf("can't connect: %v", err)
+	}
+	defer conn.Close()
+
+	receive := func(expected string) gatewayMessage {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		message := gatewayMessage{}
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("expected %s, got %v", expected, err)
+		}
+		if message.Type != expected {
+			t.Fatalf("expected %s, got %+v", expected, message)
+		}
+		return message
+	}
+	send := func(action string, topics ...string) {
+		t.Helper()
+		if err := conn.WriteJSON(map[string]interface{}{"action": action, "topics": topics}); err != nil {
+			t.Fatalf("can't send %s: %v", action, err)
+		}
+	}
+
+	if message := receive("subscribed"); !reflect.DeepEqual(message.Topics, []string{"forum:pirates"}) {
+		t.Errorf("expected topics from the query, got %v", message.Topics)
+	}
+	send("subscribe", "user:W.Turner")
+	if message := receive("subscribed"); !reflect.DeepEqual(message.Topics, []string{"forum:pirates", "user:w.turner"}) {
+		t.Errorf("expected forum and user topics, got %v", message.Topics)
+	}
+	send("subscribe", "ship:pearl")
+	receive("error")
+	send("subscribe", "thread:1", "thread:2")
+	if message := receive("error"); !strings.Contains(message.Message, "3") {
+		t.Errorf("expected the subscription limit in %q", message.Message)
+	}
+	send("jump")
+	receive("error")
+
+	// Every event is delivered once, even when it matches several topics
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Release the Kraken"})
+	if message := receive("thread"); message.Thread == nil || message.Thread.ID != thread.ID || message.User != "j.sparrow" {
+		t.Errorf("expected thread %d, got %+v", thread.ID, message)
+	}
+	post := createPost(t, handler, thread.ID, "w.turner", 0)
+	if message := receive("post"); message.Post == nil || message.Post.ID != post.ID || message.Forum != "pirates" {
+		t.Errorf("expected post %d, got %+v", post.ID, message)
+	}
+
+	navy := createThread(t, handler, "navy", models.Thread{Author: "e.swann", Title: "Pirates", Message: "Hang them"})
+	navyPost := createPost(t, handler, navy.ID, "w.turner", 0)
+	if message := receive("post"); message.Post == nil || message.Post.ID != navyPost.ID || message.Forum != "navy" {
+		t.Errorf("expected post %d of the user in another forum, got %+v", navyPost.ID, message)
+	}
+
+	update := withRequest(operations.NewPostUpdateParams()).(operations.PostUpdateParams)
+	update.ID = post.ID
+	update.Post = &models.PostUpdate{Message: "Release the Kraken!"}
+	expect(t, handler.PostUpdate(update, principal("w.turner")), http.StatusOK, &models.Post{})
+	if message := receive("post_edit"); message.Post == nil || message.Post.Message != "Release the Kraken!" {
+		t.Errorf("expected the edited post, got %+v", message)
+	}
+
+	vote := withRequest(operations.NewThreadVoteParams()).(operations.ThreadVoteParams)
+	vote.SlugOrID = swag.FormatInt32(thread.ID)
+	vote.Vote = &models.Vote{Voice: 1}
+	expect(t, handler.ThreadVote(vote, principal("e.swann")), http.StatusOK, &models.Thread{})
+	if message := receive("vote"); message.Thread == nil || message.Thread.Votes != 1 || message.User != "e.swann" {
+		t.Errorf("expected thread rating 1, got %+v", message)
+	}
+
+	send("unsubscribe", "forum:pirates")
+	if message := receive("subscribed"); !reflect.DeepEqual(message.Topics, []string{"user:w.turner"}) {
+		t.Errorf("expected the user topic only, got %v", message.Topics)
+	}
+	createPost(t, handler, thread.ID, "j.sparrow", 0)
+	last := createPost(t, handler, thread.ID, "w.turner", 0)
+	if message := receive("post"); message.Post == nil || message.Post.ID != last.ID {
+		t.Errorf("expected post %d after unsubscribing from the forum, got %+v", last.ID, message)
+	}
+}
+
+// webhookReceiver is a local stand-in for a webhook endpoint, it answers 500 to the first failures requests.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func (receiver *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	receiver.requests = append(receiver.requests, receivedWebhook{header: r.Header, body: body})
+	if receiver.failures > 0 {
+		receiver.failures--
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (receiver *webhookReceiver) received() []receivedWebhook {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return append([]receivedWebhook{}, receiver.requests...)
+}
+
+func testWebhooks(t *testing.T, handler service.ForumHandler) {
+	defer func(backoff, poll time.Duration, attempts int) {
+		service.WebhookBackoff, service.WebhookPollInterval, service.WebhookMaxAttempts = backoff, poll, attempts
+		service.WebhookAllowLoopback = false
+	}(service.WebhookBackoff, service.WebhookPollInterval, service.WebhookMaxAttempts)
+	service.WebhookBackoff, service.WebhookPollInterval, service.WebhookMaxAttempts = 10*time.Millisecond, 10*time.Millisecond, 3
+	service.WebhookAllowLoopback = true
+
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+	createForum(t, handler, "pirates", "j.sparrow")
+
+	receiver := &webhookReceiver{failures: 1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	create := func(slug, url, nickname string) middleware.Responder {
+		params := withRequest(operations.NewForumWebhookCreateParams()).(operations.ForumWebhookCreateParams)
+		params.Slug = slug
+		params.Webhook = &models.Webhook{URL: url}
+		return handler.ForumWebhookCreate(params, principal(nickname))
+	}
+	expect(t, create("pirates", server.URL, "w.turner"), http.StatusForbidden, &models.Error{})
+	expect(t, create("navy", server.URL, "j.sparrow"), http.StatusNotFound, &models.Error{})
+	expect(t, create("pirates", "ftp://example.com/events", "j.sparrow"), http.StatusBadRequest, &models.Error{})
+	expect(t, create("pirates", "http://169.254.169.254/latest/meta-data", "j.sparrow"), http.StatusBadRequest, &models.Error{})
+	webhook := models.Webhook{}
+	expect(t, create("pirates", server.URL, "j.sparrow"), http.StatusCreated, &webhook)
+	if webhook.Secret == "" || webhook.Forum != "pirates" || webhook.Creator != "j.sparrow" {
+		t.Errorf("expected a webhook of pirates with a secret, got %+v", webhook)
+	}
+
+	list := withRequest(operations.NewForumGetWebhooksParams()).(operations.ForumGetWebhooksParams)
+	list.Slug = "pirates"
+	expect(t, handler.ForumGetWebhooks(list, principal("w.turner")), http.StatusForbidden, &models.Error{})
+	webhooks := models.Webhooks{}
+	expect(t, handler.ForumGetWebhooks(list, principal("j.sparrow")), http.StatusOK, &webhooks)
+	if len(webhooks) != 1 || webhooks[0].ID != webhook.ID || webhooks[0].URL != server.URL || webhooks[0].Secret != "" {
+		t.Errorf("expected the webhook without its secret, got %+v", webhooks)
+	}
+
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Release the Kraken"})
+	post := createPost(t, handler, thread.ID, "w.turner", 0)
+	update := withRequest(operations.NewPostUpdateParams()).(operations.PostUpdateParams)
+	update.ID = post.ID
+	update.Post = &models.PostUpdate{Message: "Release the Kraken!"}
+	expect(t, handler.PostUpdate(update, principal("w.turner")), http.StatusOK, &models.Post{})
+	vote := withRequest(operations.NewThreadVoteParams()).(operations.ThreadVoteParams)
+	vote.SlugOrID = swag.FormatInt32(thread.ID)
+	vote.Vote = &models.Vote{Voice: 1}
+	expect(t, handler.ThreadVote(vote, principal("w.turner")), http.StatusOK, &models.Thread{})
+
+	// waitDeliveries waits until count deliveries of the webhook are no longer pending
+	waitDeliveries := func(id int64, count int) models.WebhookDeliveries {
+		t.Helper()
+		params := withRequest(operations.NewWebhookDeliveriesParams()).(operations.WebhookDeliveriesParams)
+		params.ID = id
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			deliveries := models.WebhookDeliveries{}
+			expect(t, handler.WebhookDeliveries(params, principal("j.sparrow")), http.StatusOK, &deliveries)
+			done := 0
+			for _, delivery := range deliveries {
+				if delivery.Status != "pending" {
+					done++
+				}
+			}
+			if done >= count || time.Now().After(deadline) {
+				return deliveries
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	deliveries := waitDeliveries(webhook.ID, 4)
+	types := []string{}
+	for _, delivery := range deliveries {
+		if delivery.Status != "delivered" || delivery.ResponseStatus != http.StatusNoContent || delivery.Event == nil {
+			t.Errorf("expected a delivered event, got %+v", delivery)
+			continue
+		}
+		types = append(types, delivery.Event.Type)
+	}
+	if !reflect.DeepEqual(types, []string{"thread", "post", "post_edit", "vote"}) {
+		t.Errorf("expected every event to be delivered in order, got %v", types)
+	}
+	if len(deliveries) > 0 && deliveries[0].Attempts != 2 {
+		t.Errorf("expected the first delivery to be retried once, got %+v", deliveries[0])
+	}
+
+	requests := receiver.received()
+	if len(requests) != 5 {
+		t.Errorf("expected 4 events and a retry, got %d requests", len(requests))
+	}
+	for _, request := range requests {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(request.body)
+		if signature := "sha256=" + hex.EncodeToString(mac.Sum(nil)); request.header.Get("X-Forum-Signature") != signature {
+			t.Errorf("expected signature %s, got %q", signature, request.header.Get("X-Forum-Signature"))
+		}
+		event := models.ForumEvent{}
+		if err := json.Unmarshal(request.body, &event); err != nil || event.Forum != "pirates" || request.header.Get("X-Forum-Event") != event.Type {
+			t.Errorf("expected an event of pirates, got %s: %v", request.body, err)
+		}
+	}
+
+	// A delivery is failed when attempts are exhausted
+	failing := httptest.NewServer(&webhookReceiver{failures: 100})
+	defer failing.Close()
+	broken := models.Webhook{}
+	expect(t, create("pirates", failing.URL, "j.sparrow"), http.StatusCreated, &broken)
+	createPost(t, handler, thread.ID, "j.sparrow", 0)
+	deliveries = waitDeliveries(broken.ID, 1)
+	if len(deliveries) != 1 || deliveries[0].Status != "failed" || deliveries[0].Attempts != 3 ||
+		deliveries[0].ResponseStatus != http.StatusInternalServerError || deliveries[0].Error == "" {
+		t.Errorf("expected a failed delivery after 3 attempts, got %+v", deliveries)
+	}
+
+	remove := withRequest(operations.NewWebhookDeleteParams()).(operations.WebhookDeleteParams)
+	remove.ID = broken.ID
+	expect(t, handler.WebhookDelete(remove, principal("w.turner")), http.StatusForbidden, &models.Error{})
+	expect(t, handler.WebhookDelete(remove, principal("j.sparrow")), http.StatusOK, &models.Webhook{})
+	expect(t, handler.WebhookDelete(remove, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+	params := withRequest(operations.NewWebhookDeliveriesParams()).(operations.WebhookDeliveriesParams)
+	params.ID = broken.ID
+	expect(t, handler.WebhookDeliveries(params, principal("j.sparrow")), http.StatusNotFound, &models.Error{})
+}
+
+// atomFeed is the part of an Atom feed the tests check.
+type atomFeed struct {
+	ID      string `xml:"id"`
+	Title   string `xml:"title"`
+	Updated string `xml:"updated"`
+	Entries []struct {
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+		Author  string `xml:"author>name"`
+		Content string `xml:"content"`
+	} `xml:"entry"`
+}
+
+// feedRequest is a request for a feed made to a server at forum.test, with extra headers.
+func feedRequest(path string, header ...string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "http://forum.test/api"+path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		request.Header.Set(header[i], header[i+1])
+	}
+	return request
+}
+
+func testFeeds(t *testing.T, handler service.ForumHandler) {
+	createUser(t, handler, "j.sparrow")
+	createUser(t, handler, "w.turner")
+	createForum(t, handler, "pirates", "j.sparrow")
+	kraken := createThread(t, handler, "pirates",
+		models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Release the Kraken", Created: dateTime("2017-01-01T00:00:00Z")})
+	createThread(t, handler, "pirates",
+		models.Thread{Author: "w.turner", Title: "Dutchman", Message: "Ship of the damned", Created: dateTime("2017-01-02T00:00:00Z")})
+
+	forumAtom := func(header ...string) middleware.Responder {
+		params := operations.NewForumGetThreadsAtomParams()
+		params.HTTPRequest = feedRequest("/forum/pirates/threads.atom", header...)
+		params.Slug = "pirates"
+		return handler.ForumGetThreadsAtom(params)
+	}
+	recorder := respond(t, forumAtom(), http.StatusOK, nil)
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/atom+xml") {
+		t.Errorf("expected an Atom feed, got %s", contentType)
+	}
+	feed := atomFeed{}
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("can't decode feed %q: %v", recorder.Body.String(), err)
+	}
+	if feed.Title != "Forum pirates" || feed.Updated != "2017-01-02T00:00:00Z" || len(feed.Entries) != 2 {
+		t.Fatalf("expected a feed of 2 threads updated with the latest one, got %+v", feed)
+	}
+	entry := feed.Entries[1]
+	if entry.Title != "Kraken" || entry.Author != "j.sparrow" || entry.Content != "Release the Kraken" ||
+		entry.Updated != "2017-01-01T00:00:00Z" || entry.ID != "http://forum.test/api/thread/"+swag.FormatInt32(kraken.ID)+"/details" {
+		t.Errorf("expected the oldest thread last, got %+v", entry)
+	}
+
+	// Conditional requests
+	etag, modified := recorder.Header().Get("ETag"), recorder.Header().Get("Last-Modified")
+	if etag == "" || modified != "Mon, 02 Jan 2017 00:00:00 GMT" {
+		t.Errorf("expected ETag and Last-Modified of the latest thread, got %q and %q", etag, modified)
+	}
+	respond(t, forumAtom("If-None-Match", etag), http.StatusNotModified, nil)
+	respond(t, forumAtom("If-Modified-Since", modified), http.StatusNotModified, nil)
+	respond(t, forumAtom("If-Modified-Since", "Sun, 01 Jan 2017 00:00:00 GMT"), http.StatusOK, nil)
+	respond(t, forumAtom("If-None-Match", `"stale"`, "If-Modified-Since", modified), http.StatusOK, nil)
+
+	rss := operations.NewForumGetThreadsRssParams()
+	rss.HTTPRequest = feedRequest("/forum/pirates/threads.rss")
+	rss.Slug = "pirates"
+	recorder = respond(t, handler.ForumGetThreadsRss(rss), http.StatusOK, nil)
+	channel := struct {
+		Title string   `xml:"channel>title"`
+		Items []string `xml:"channel>item>title"`
+	}{}
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &channel); err != nil {
+		t.Fatalf("can't decode feed %q: %v", recorder.Body.String(), err)
+	}
+	if !reflect.DeepEqual(channel.Items, []string{"Dutchman", "Kraken"}) {
+		t.Errorf("expected both threads in RSS, got %+v", channel)
+	}
+
+	missing := operations.NewForumGetThreadsAtomParams()
+	missing.HTTPRequest = feedRequest("/forum/navy/threads.atom")
+	missing.Slug = "navy"
+	expect(t, handler.ForumGetThreadsAtom(missing), http.StatusNotFound, &models.Error{})
+
+	// Posts of a thread, the deleted one is left out
+	first := createPost(t, handler, kraken.ID, "w.turner", 0)
+	createPost(t, handler, kraken.ID, "j.sparrow", first.ID)
+	remove := withRequest(operations.NewPostDeleteParams()).(operations.PostDeleteParams)
+	remove.ID = first.ID
+	expect(t, handler.PostDelete(remove, principal("w.turner")), http.StatusOK, &models.Post{})
+
+	threadAtom := func(header ...string) middleware.Responder {
+		params := operations.NewThreadGetPostsAtomParams()
+		params.HTTPRequest = feedRequest("/thread/"+swag.FormatInt32(kraken.ID)+"/posts.atom", header...)
+		params.SlugOrID = swag.FormatInt32(kraken.ID)
+		return handler.ThreadGetPostsAtom(params)
+	}
+	recorder = respond(t, threadAtom(), http.StatusOK, nil)
+	feed = atomFeed{}
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("can't decode feed %q: %v", recorder.Body.String(), err)
+	}
+	if feed.Title != "Kraken" || len(feed.Entries) != 1 || feed.Entries[0].Author != "j.sparrow" || feed.Entries[0].Content != "Message from j.sparrow" {
+		t.Fatalf("expected a feed of the remaining post, got %+v", feed)
+	}
+
+	// A new post changes the feed
+	etag = recorder.Header().Get("ETag")
+	respond(t, threadAtom("If-None-Match", etag), http.StatusNotModified, nil)
+	createPost(t, handler, kraken.ID, "w.turner", 0)
+	recorder = respond(t, threadAtom("If-None-Match", etag), http.StatusOK, nil)
+	if recorder.Header().Get("ETag") == etag {
+		t.Errorf("expected the ETag to change with a new post")
+	}
+}
+
+func testMetrics(t *testing.T, handler service.ForumHandler) {
+	metrics := service.NewMetrics(handler)
+	server := metrics.Instrument(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/forum/create":
+			service.SetOperation(r, "forumCreate")
+			rw.WriteHeader(http.StatusCreated)
+		case "/api/thread/42/posts":
+			service.SetOperation(r, "threadGetPosts")
+			rw.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	for _, path := range []string{"/api/forum/create", "/api/forum/create", "/api/thread/42/posts", "/api/missing"} {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected metrics, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`forum_http_requests_total{code="201",operation="forumCreate"} 2`,
+		`forum_http_requests_total{code="500",operation="threadGetPosts"} 1`,
+		`forum_http_requests_total{code="404",operation="none"} 1`,
+		`forum_http_request_errors_total{operation="threadGetPosts"} 1`,
+		`forum_http_request_duration_seconds_count{operation="forumCreate"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `forum_http_request_errors_total{operation="forumCreate"}`) {
+		t.Errorf("expected no errors of forumCreate:\n%s", body)
+	}
+	// Backends with a database also report its pool and schema
+	if strings.Contains(body, "forum_db_open_connections") &&
+		(!strings.Contains(body, "\nforum_db_migration_version ") || strings.Contains(body, "\nforum_db_migration_version 0\n")) {
+		t.Errorf("expected the applied migration in metrics:\n%s", body)
+	}
+}
+
+func testLogging(t *testing.T, handler service.ForumHandler) {
+	output := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.Out, logger.Formatter = output, &logrus.JSONFormatter{}
+
+	server := service.LogRequests(logger, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/thread/kraken/posts":
+			service.SetOperation(r, "threadGetPosts")
+			params := operations.NewThreadGetPostsParams()
+			params.HTTPRequest, params.SlugOrID = r, "kraken"
+			handler.ThreadGetPosts(params).WriteResponse(rw, runtime.JSONProducer())
+		case "/api/broken":
+			service.SetOperation(r, "broken")
+			service.Internal(errors.New("connection reset")).WriteResponse(rw, runtime.JSONProducer())
+		default:
+			panic("Release the Kraken")
+		}
+	}))
+	serve := func(path, requestID string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if requestID != "" {
+			request.Header.Set("X-Request-ID", requestID)
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+	lines := func() []map[string]interface{} {
+		result := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+			fields := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Fatalf("expected a JSON line, got %q: %v", line, err)
+			}
+			result = append(result, fields)
+		}
+		output.Reset()
+		return result
+	}
+
+	// The id of the client is echoed and tags every line
+	recorder := serve("/api/thread/kraken/posts", "kraken-42")
+	if recorder.Code != http.StatusNotFound || recorder.Header().Get("X-Request-ID") != "kraken-42" {
+		t.Errorf("expected 404 with the given request id, got %d and %q", recorder.Code, recorder.Header().Get("X-Request-ID"))
+	}
+	logged := lines()
+	if len(logged) != 1 || logged[0]["request_id"] != "kraken-42" || logged[0]["operation"] != "threadGetPosts" ||
+		logged[0]["status"] != float64(http.StatusNotFound) || logged[0]["latency"] == nil || logged[0]["msg"] != "Request" {
+		t.Errorf("expected a line of the request, got %v", logged)
+	}
+
+	// Errors with a cause are logged with the fields of the request, malformed ids are replaced
+	recorder = serve("/api/broken", "not an id")
+	requestID := recorder.Header().Get("X-Request-ID")
+	if recorder.Code != http.StatusInternalServerError || len(requestID) != 32 {
+		t.Errorf("expected 500 with a generated request id, got %d and %q", recorder.Code, requestID)
+	}
+	logged = lines()
+	if len(logged) != 2 || logged[0]["error"] != "connection reset" || logged[0]["request_id"] != requestID ||
+		logged[0]["operation"] != "broken" || logged[0]["level"] != "error" || logged[1]["status"] != float64(http.StatusInternalServerError) {
+		t.Errorf("expected the error and the request, got %v", logged)
+	}
+
+	// Panics are recovered
+	recorder = serve("/api/kraken", "")
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), "message") {
+		t.Errorf("expected 500 with an error, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	logged = lines()
+	if len(logged) != 2 || logged[0]["panic"] != "Release the Kraken" || logged[0]["stack"] == nil ||
+		logged[0]["request_id"] != recorder.Header().Get("X-Request-ID") || logged[1]["status"] != float64(http.StatusInternalServerError) {
+		t.Errorf("expected the panic and the request, got %v", logged)
+	}
+}
+
+func testTracing(t *testing.T, handler service.ForumHandler) {
+	spans := tracetest.NewSpanRecorder()
+	defer func(provider trace.TracerProvider, propagator propagation.TextMapPropagator) {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	}(otel.GetTracerProvider(), otel.GetTextMapPropagator())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	createUser(t, handler, "j.sparrow")
+	createForum(t, handler, "pirates", "j.sparrow")
+	thread := createThread(t, handler, "pirates", models.Thread{Author: "j.sparrow", Title: "Kraken", Message: "Run!"})
+	post := createPost(t, handler, thread.ID, "j.sparrow", 0)
+
+	server := service.TraceOperations(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		params := operations.NewPostGetOneParams()
+		params.HTTPRequest, params.ID = r, post.ID
+		params.Related = []string{"user", "forum", "thread"}
+		handler.PostGetOne(params).WriteResponse(rw, runtime.JSONProducer())
+	}))
+	request := httptest.NewRequest(http.MethodGet, "/api/post/"+swag.FormatInt64(post.ID)+"/details", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	// The operation continues the trace of the client
+	var operation sdktrace.ReadOnlySpan
+	for _, span := range spans.Ended() {
+		if span.SpanKind() == trace.SpanKindServer {
+			operation = span
+		}
+	}
+	if operation == nil {
+		t.Fatalf("expected a span of the operation, got %v", spans.Ended())
+	}
+	if operation.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		operation.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the span to continue the trace of the client, got %v with parent %v", operation.SpanContext(), operation.Parent())
+	}
+
+	// Statements of backends with a database are its children, with their rows
+	statements := 0
+	for _, span := range spans.Ended() {
+		if span.SpanKind() != trace.SpanKindClient {
+			continue
+		}
+		statements++
+		attributes := map[string]string{}
+		for _, attribute := range span.Attributes() {
+			attributes[string(attribute.Key)] = attribute.Value.Emit()
+		}
+		if span.Parent().SpanID() != operation.SpanContext().SpanID() || attributes["db.statement"] == "" || attributes["db.rows"] != "1" {
+			t.Errorf("expected a statement of the operation returning a row, got %s %v", span.Name(), attributes)
+		}
+	}
+	if statements > 0 && statements < 4 {
+		t.Errorf("expected statements of the post, its author, forum and thread, got %d", statements)
+	}
+}
+
+func testHealth(t *testing.T, handler service.ForumHandler) {
+	probe := func(server http.Handler, ctx context.Context, status int) service.Health {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx))
+		health := service.Health{}
+		if recorder.Code != status || json.Unmarshal(recorder.Body.Bytes(), &health) != nil {
+			t.Fatalf("expected %d with a JSON body, got %d: %s", status, recorder.Code, recorder.Body.String())
+		}
+		return health
+	}
+
+	if health := probe(service.Liveness(), context.Background(), http.StatusOK); health.Status != service.HealthOK {
+		t.Errorf("expected a live process, got %+v", health)
+	}
+
+	health := probe(service.Readiness(handler), context.Background(), http.StatusOK)
+	if health.Status != service.HealthOK {
+		t.Errorf("expected a ready backend, got %+v", health)
+	}
+	for name, check := range health.Checks {
+		if check.Status != service.HealthOK || check.Error != "" {
+			t.Errorf("expected check %s to pass, got %+v", name, check)
+		}
+	}
+	// Backends with a database check it, its schema and the pool
+	if len(health.Checks) == 0 {
+		return
+	}
+	for _, name := range []string{"database", "migrations", "pool"} {
+		if _, ok := health.Checks[name]; !ok {
+			t.Errorf("expected check %s, got %+v", name, health.Checks)
+		}
+	}
+	migrations, _ := health.Checks["migrations"].Details.(map[string]interface{})
+	if pending, ok := migrations["pending"].([]interface{}); !ok || len(pending) != 0 || migrations["version"] == float64(0) {
+		t.Errorf("expected every migration to be applied, got %+v", health.Checks["migrations"])
+	}
+
+	// A database that doesn't answer in time makes the backend unready
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	health = probe(service.Readiness(handler), ctx, http.StatusServiceUnavailable)
+	if health.Status != service.HealthFail || health.Checks["database"].Status != service.HealthFail {
+		t.Errorf("expected an unreachable database, got %+v", health)
+	}
+}
@@ -0,0 +1,287 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of spans made by the service.
+const tracerName = "github.com/couatl/forum-db-api/modules/service"
+
+// maxStatement limits the length of db.statement.
+const maxStatement = 2048
+
+// Attributes of statement spans besides semantic conventions.
+const (
+	attrRows      = attribute.Key("db.rows")
+	attrRequestID = attribute.Key("http.request_id")
+)
+
+// TracingOptions tell where spans are exported, tracing is off when neither Endpoint nor File is set.
+type TracingOptions struct {
+	// Endpoint is host:port of an OTLP/HTTP collector
+	Endpoint string
+	Insecure bool
+	// File receives spans as JSON
+	File        string
+	ServiceName string
+	SampleRatio float64
+}
+
+// SetupTracing installs the global tracer provider, shutdown flushes the spans left.
+func SetupTracing(options TracingOptions) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if options.Endpoint == "" && options.File == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	providerOptions := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(options.ServiceName))),
+	}
+	var file *os.File
+	if options.File != "" {
+		if file, err = os.OpenFile(options.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		providerOptions = append(providerOptions, sdktrace.WithBatcher(exporter))
+	}
+	if options.Endpoint != "" {
+		clientOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(options.Endpoint)}
+		if options.Insecure {
+			clientOptions = append(clientOptions, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), clientOptions...)
+		if err != nil {
+			if file != nil {
+				file.Close()
+			}
+			return nil, err
+		}
+		providerOptions = append(providerOptions, sdktrace.WithBatcher(exporter))
+	}
+
+	provider := sdktrace.NewTracerProvider(providerOptions...)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// tracer is taken from the global provider every time, so a provider installed later is used.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// TraceOperations makes a server span of every swagger operation, it goes inside the swagger router.
+// The span continues a trace given by the traceparent header.
+func TraceOperations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		name, route := unknownOperation, ""
+		if matched := middleware.MatchedRouteFrom(r); matched != nil && matched.Operation != nil {
+			name, route = matched.Operation.ID, matched.PathPattern
+		}
+		attributes := []attribute.KeyValue{semconv.HTTPMethodKey.String(r.Method), semconv.HTTPRouteKey.String(route)}
+		if info, ok := r.Context().Value(requestKey{}).(*requestInfo); ok {
+			attributes = append(attributes, attrRequestID.String(info.id))
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attributes...))
+		defer span.End()
+
+		recorder := newStatusRecorder(rw)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+var (
+	sqlStrings    = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumbers    = regexp.MustCompile(`([^$\w.])\d+(?:\.\d+)?\b`)
+	sqlWhitespace = regexp.MustCompile(`\s+`)
+)
+
+// sanitizeSQL hides literals, queries built with ids in their text look the same for every request.
+func sanitizeSQL(query string) string {
+	query = sqlStrings.ReplaceAllString(query, "?")
+	query = sqlNumbers.ReplaceAllString(query, "${1}?")
+	query = strings.TrimSpace(sqlWhitespace.ReplaceAllString(query, " "))
+	if len(query) > maxStatement {
+		query = query[:maxStatement]
+	}
+	return query
+}
+
+// startStatement makes a span of a statement, only within a traced operation: background
+// work such as the webhook worker would otherwise make a trace of every poll.
+func startStatement(ctx context.Context, dialect, query string) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return ctx, nil
+	}
+	statement := sanitizeSQL(query)
+	operation := strings.ToUpper(strings.SplitN(statement, " ", 2)[0])
+	system := "postgresql"
+	if dialect != "postgres" {
+		system = "sqlite"
+	}
+	return tracer().Start(ctx, operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemKey.String(system),
+		semconv.DBOperationKey.String(operation),
+		semconv.DBStatementKey.String(statement),
+	))
+}
+
+// endStatement records the rows a statement returned or changed, negative rows are unknown.
+// sql.ErrNoRows is an answer rather than a failure.
+func endStatement(span trace.Span, rows int64, err error) {
+	if span == nil {
+		return
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		rows, err = 0, nil
+	case err != nil:
+		rows = -1
+	}
+	if rows >= 0 {
+		span.SetAttributes(attrRows.Int64(rows))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func selectedRows(dest interface{}) int64 {
+	value := reflect.ValueOf(dest)
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() == reflect.Slice {
+		return int64(value.Len())
+	}
+	return -1
+}
+
+func affectedRows(result sql.Result) int64 {
+	if result == nil {
+		return -1
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return rows
+}
+
+// tracedTx is a transaction that makes a span of every statement within a traced operation.
+type tracedTx struct {
+	*sqlx.Tx
+	dialect string
+}
+
+func (tx *tracedTx) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, span := startStatement(ctx, tx.dialect, query)
+	err := tx.Tx.GetContext(ctx, dest, query, args...)
+	endStatement(span, 1, err)
+	return err
+}
+
+func (tx *tracedTx) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, span := startStatement(ctx, tx.dialect, query)
+	err := tx.Tx.SelectContext(ctx, dest, query, args...)
+	endStatement(span, selectedRows(dest), err)
+	return err
+}
+
+func (tx *tracedTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startStatement(ctx, tx.dialect, query)
+	result, err := tx.Tx.ExecContext(ctx, query, args...)
+	endStatement(span, affectedRows(result), err)
+	return result, err
+}
+
+// QueryRowxContext runs the query before returning, the span doesn't include scanning the row.
+func (tx *tracedTx) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	ctx, span := startStatement(ctx, tx.dialect, query)
+	row := tx.Tx.QueryRowxContext(ctx, query, args...)
+	endStatement(span, -1, row.Err())
+	return row
+}
+
+// QueryxContext is for results read as a stream, the span ends before the rows are read.
+func (tx *tracedTx) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	ctx, span := startStatement(ctx, tx.dialect, query)
+	rows, err := tx.Tx.QueryxContext(ctx, query, args...)
+	endStatement(span, -1, err)
+	return rows, err
+}
+
+func (tx *tracedTx) PreparexContext(ctx context.Context, query string) (*tracedStmt, error) {
+	stmt, err := tx.Tx.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: stmt, dialect: tx.dialect, query: query}, nil
+}
+
+// tracedStmt is a prepared statement of tracedTx, every execution makes a span.
+type tracedStmt struct {
+	*sqlx.Stmt
+	dialect string
+	query   string
+}
+
+func (stmt *tracedStmt) GetContext(ctx context.Context, dest interface{}, args ...interface{}) error {
+	ctx, span := startStatement(ctx, stmt.dialect, stmt.query)
+	err := stmt.Stmt.GetContext(ctx, dest, args...)
+	endStatement(span, 1, err)
+	return err
+}
+
+func (stmt *tracedStmt) SelectContext(ctx context.Context, dest interface{}, args ...interface{}) error {
+	ctx, span := startStatement(ctx, stmt.dialect, stmt.query)
+	err := stmt.Stmt.SelectContext(ctx, dest, args...)
+	endStatement(span, selectedRows(dest), err)
+	return err
+}
+
+func (stmt *tracedStmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	ctx, span := startStatement(ctx, stmt.dialect, stmt.query)
+	result, err := stmt.Stmt.ExecContext(ctx, args...)
+	endStatement(span, affectedRows(result), err)
+	return result, err
+}
@@ -0,0 +1,266 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/couatl/forum-db-api/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookTimeout limits a single delivery attempt.
+var WebhookTimeout = 10 * time.Second
+
+// WebhookMaxAttempts is the number of attempts after which a delivery is failed.
+var WebhookMaxAttempts = 8
+
+// WebhookBackoff is the delay after the first failed attempt, it doubles with every next one up to WebhookMaxBackoff.
+var WebhookBackoff = 10 * time.Second
+
+// WebhookMaxBackoff limits the delay between attempts.
+var WebhookMaxBackoff = time.Hour
+
+// WebhookPollInterval is how often the outbox is checked for retries and for deliveries written by other instances.
+var WebhookPollInterval = time.Second
+
+// WebhookAllowLoopback lets webhooks reach this host, e.g. a receiver in tests. Private and link-local
+// networks are never allowed.
+var WebhookAllowLoopback = false
+
+// webhookSlots is the number of deliveries a worker attempts at the same time, an endpoint
+// that doesn't answer holds only the slots of its own deliveries.
+const webhookSlots = 10
+
+// privateNetworks are not routed from the Internet, link-local and loopback ones are checked by net.IP.
+var privateNetworks = func() []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// webhookAddressAllowed tells whether a webhook may be delivered to ip.
+func webhookAddressAllowed(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return WebhookAllowLoopback
+	}
+	if ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookURL returns Validation unless value is an absolute http or https URL.
+// Hosts are resolved at delivery, only addresses written in the URL are checked here.
+func checkWebhookURL(value string) *Error {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Host == "" || parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return Validation("Webhook URL %q is not an absolute http or https URL", value)
+	}
+	if ip := net.ParseIP(parsed.Hostname()); ip != nil && !webhookAddressAllowed(ip) {
+		return Validation("Webhook URL %q points to a local or private network", value)
+	}
+	return nil
+}
+
+// webhookControl refuses connections to local and private addresses, it runs after the host is
+// resolved, so a DNS name can't lead a delivery there.
+func webhookControl(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+		return fmt.Errorf("webhook address %s is in a local or private network", host)
+	}
+	return nil
+}
+
+// newWebhookClient makes the client of deliveries: no proxies, no redirects and only public addresses.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: WebhookTimeout, Control: webhookControl}
+	return &http.Client{
+		Timeout:   WebhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, MaxIdleConnsPerHost: 2, IdleConnTimeout: time.Minute},
+		// A redirect is an unexpected response status, it could lead to a private address
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// webhookSignature is the value of X-Forum-Signature for payload.
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookLease is how long a leased delivery is hidden from other workers: a worker that dies
+// in the middle of an attempt doesn't lose the delivery. Deliveries are leased only for free slots
+// and attempted right away, so the lease covers a single attempt.
+func webhookLease() time.Duration {
+	return 2 * WebhookTimeout
+}
+
+// webhookRetry gives the time of the next attempt after attempts failed ones, false when there are no attempts left.
+func webhookRetry(attempts int32, now time.Time) (time.Time, bool) {
+	if int(attempts) >= WebhookMaxAttempts {
+		return time.Time{}, false
+	}
+	delay := WebhookBackoff
+	for i := int32(1); i < attempts && delay < WebhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > WebhookMaxBackoff {
+		delay = WebhookMaxBackoff
+	}
+	return now.Add(delay), true
+}
+
+// webhookJob is a leased delivery, Attempts already counts the current attempt.
+type webhookJob struct {
+	ID       int64
+	URL      string
+	Secret   string
+	Payload  []byte
+	Attempts int32
+}
+
+// webhookResult is the outcome of an attempt.
+type webhookResult struct {
+	Status      string
+	Response    int32
+	Error       string
+	NextAttempt time.Time
+	Delivered   *time.Time
+}
+
+// outbox is the durable queue of webhook deliveries of a backend.
+type outbox interface {
+	// leaseDeliveries takes up to limit deliveries due at now and hides them from other workers.
+	leaseDeliveries(now time.Time, limit int) ([]webhookJob, error)
+	// completeDelivery records the result of an attempt.
+	completeDelivery(job webhookJob, result webhookResult) error
+}
+
+// webhookWorker delivers the outbox in the background, it is woken up when new deliveries are committed.
+type webhookWorker struct {
+	wake chan struct{}
+	log  logrus.FieldLogger
+}
+
+func startWebhooks(box outbox, logger logrus.FieldLogger) *webhookWorker {
+	worker := &webhookWorker{wake: make(chan struct{}, 1), log: logger.WithField("component", "webhooks")}
+	go worker.run(box)
+	return worker
+}
+
+// notify wakes the worker up without waiting for it.
+func (worker *webhookWorker) notify() {
+	if worker == nil {
+		return
+	}
+	select {
+	case worker.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (worker *webhookWorker) run(box outbox) {
+	client := newWebhookClient()
+	done := make(chan struct{}, webhookSlots)
+	busy := 0
+	for {
+		free := webhookSlots - busy
+		if free > 0 {
+			jobs, err := box.leaseDeliveries(time.Now(), free)
+			if err != nil {
+				worker.log.WithError(err).Error("Can't lease deliveries")
+			}
+			for _, job := range jobs {
+				busy++
+				go func(job webhookJob) {
+					defer func() { done <- struct{}{} }()
+					if err := box.completeDelivery(job, deliverWebhook(client, job)); err != nil {
+						worker.log.WithError(err).WithField("delivery", job.ID).Error("Can't record the delivery")
+					}
+				}(job)
+			}
+			// Every free slot is taken, more deliveries may be due
+			if len(jobs) == free {
+				continue
+			}
+		}
+		select {
+		case <-done:
+			busy--
+		case <-worker.wake:
+		case <-time.After(WebhookPollInterval):
+		}
+	}
+}
+
+// deliverWebhook makes a single attempt, any 2xx response means the event is delivered.
+func deliverWebhook(client *http.Client, job webhookJob) webhookResult {
+	event := models.ForumEvent{}
+	json.Unmarshal(job.Payload, &event)
+
+	result := webhookResult{}
+	request, err := http.NewRequest(http.MethodPost, job.URL, bytes.NewReader(job.Payload))
+	if err == nil {
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-Forum-Event", event.Type)
+		request.Header.Set("X-Forum-Delivery", strconv.FormatInt(job.ID, 10))
+		request.Header.Set("X-Forum-Signature", webhookSignature(job.Secret, job.Payload))
+
+		var response *http.Response
+		if response, err = client.Do(request); err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+			result.Response = int32(response.StatusCode)
+			if response.StatusCode < 200 || response.StatusCode > 299 {
+				err = fmt.Errorf("unexpected response status %s", response.Status)
+			}
+		}
+	}
+
+	now := time.Now()
+	if err == nil {
+		result.Status, result.NextAttempt, result.Delivered = DeliveryDelivered, now, &now
+		return result
+	}
+	result.Error = err.Error()
+	if next, ok := webhookRetry(job.Attempts, now); ok {
+		result.Status, result.NextAttempt = DeliveryPending, next
+	} else {
+		result.Status, result.NextAttempt = DeliveryFailed, now
+	}
+	return result
+}
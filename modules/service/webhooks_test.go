@@ -0,0 +1,131 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	cases := []struct {
+		address  string
+		loopback bool
+		allowed  bool
+	}{
+		{"93.184.216.34", false, true},
+		{"2606:2800:220:1:248:1893:25c8:1946", false, true},
+		{"127.0.0.1", false, false},
+		{"127.0.0.1", true, true},
+		{"::1", false, false},
+		{"::1", true, true},
+		{"169.254.169.254", true, false},
+		{"fe80::1", true, false},
+		{"10.1.2.3", true, false},
+		{"172.20.0.1", true, false},
+		{"192.168.1.1", true, false},
+		{"100.64.0.1", true, false},
+		{"fd00::1", true, false},
+		{"::ffff:10.0.0.1", true, false},
+		{"0.0.0.0", true, false},
+		{"224.0.0.1", true, false},
+	}
+	defer func() { WebhookAllowLoopback = false }()
+	for _, tc := range cases {
+		WebhookAllowLoopback = tc.loopback
+		if allowed := webhookAddressAllowed(net.ParseIP(tc.address)); allowed != tc.allowed {
+			t.Errorf("%s with loopback %v: expected %v, got %v", tc.address, tc.loopback, tc.allowed, allowed)
+		}
+	}
+
+	WebhookAllowLoopback = false
+	if err := checkWebhookURL("http://[::1]:8080/events"); err == nil {
+		t.Errorf("expected loopback URL to be rejected")
+	}
+	if err := checkWebhookURL("https://hooks.example.com/events"); err != nil {
+		t.Errorf("expected names to be checked at delivery, got %v", err)
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	defer func() { WebhookAllowLoopback = false }()
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	receiver := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer receiver.Close()
+
+	// The receiver is on loopback, it isn't dialed without the option
+	job := webhookJob{ID: 1, URL: receiver.URL, Payload: []byte(`{"type":"post"}`), Attempts: 1}
+	if result := deliverWebhook(newWebhookClient(), job); result.Status != DeliveryPending || result.Response != 0 {
+		t.Errorf("expected the dial to be refused, got %+v", result)
+	}
+
+	WebhookAllowLoopback = true
+	result := deliverWebhook(newWebhookClient(), job)
+	if result.Status != DeliveryPending || result.Response != http.StatusTemporaryRedirect || redirected {
+		t.Errorf("expected the redirect to fail the attempt, got %+v", result)
+	}
+}
+
+// fakeOutbox hands its jobs out once and passes the results on.
+type fakeOutbox struct {
+	mu      sync.Mutex
+	jobs    []webhookJob
+	results chan int64
+}
+
+func (box *fakeOutbox) leaseDeliveries(now time.Time, limit int) ([]webhookJob, error) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	if limit > len(box.jobs) {
+		limit = len(box.jobs)
+	}
+	jobs := box.jobs[:limit]
+	box.jobs = box.jobs[limit:]
+	return jobs, nil
+}
+
+func (box *fakeOutbox) completeDelivery(job webhookJob, result webhookResult) error {
+	if result.Status == DeliveryDelivered {
+		box.results <- job.ID
+	}
+	return nil
+}
+
+func TestWebhookDeadEndpoint(t *testing.T) {
+	WebhookAllowLoopback = true
+	defer func() { WebhookAllowLoopback = false }()
+
+	release := make(chan struct{})
+	dead := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer dead.Close()
+	defer close(release)
+	live := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer live.Close()
+
+	// Deliveries to an endpoint that never answers are leased first
+	box := &fakeOutbox{results: make(chan int64, 1)}
+	for id := int64(1); id < webhookSlots; id++ {
+		box.jobs = append(box.jobs, webhookJob{ID: id, URL: dead.URL, Attempts: 1})
+	}
+	box.jobs = append(box.jobs, webhookJob{ID: webhookSlots, URL: live.URL, Attempts: 1})
+	startWebhooks(box, logrus.New())
+
+	select {
+	case id := <-box.results:
+		if id != webhookSlots {
+			t.Errorf("expected delivery %d, got %d", webhookSlots, id)
+		}
+	case <-time.After(WebhookTimeout / 2):
+		t.Errorf("delivery to a live endpoint waits for the dead one")
+	}
+}
@@ -1,32 +1,183 @@
 package restapi
 
 import (
+	"context"
 	"crypto/tls"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
-	"github.com/dre1080/recover"
 	errors "github.com/go-openapi/errors"
 	runtime "github.com/go-openapi/runtime"
+	"github.com/sirupsen/logrus"
 	graceful "github.com/tylerb/graceful"
 
+	"github.com/couatl/forum-db-api/models"
 	"github.com/couatl/forum-db-api/modules/service"
 	"github.com/couatl/forum-db-api/restapi/operations"
 	"github.com/go-openapi/swag"
 )
 
-//go:generate swagger generate server --target .. --name forum --spec ../swagger.yml
+//go:generate swagger generate server --target .. --name forum --spec ../swagger.yml --principal models.Principal --exclude-main
 //go:generate go-bindata -pkg assets_db -o ../modules/assets/assets_db/assets_db.go -prefix ../modules/assets/ ../modules/assets/...
 
 type DatabaseFlags struct {
-	Database string `long:"database" description:"database connection parameters"`
+	Database          string                   `long:"database" description:"database connection parameters"`
+	QueryTimeout      time.Duration            `long:"query-timeout" default:"10s" description:"default time limit of a database operation"`
+	OperationTimeouts map[string]time.Duration `long:"operation-timeout" description:"time limit of a single operation by its operationId, e.g. threadGetPosts:30s"`
 }
 
 var dbFlags DatabaseFlags
 
+type AuthFlags struct {
+	SessionTTL time.Duration `long:"session-ttl" default:"24h" description:"lifetime of a token issued by userLogin"`
+	Admins     []string      `long:"admin" description:"nickname of a site administrator, may be repeated"`
+	// The password comes from the environment so that it stays out of the process list
+	AdminPassword string `long:"admin-password" env:"FORUM_ADMIN_PASSWORD" description:"password the accounts of administrators are created or reset with"`
+}
+
+var authFlags AuthFlags
+
+type PaginationFlags struct {
+	CursorSecret string `long:"cursor-secret" description:"key signing pagination cursors, random on every start when empty"`
+}
+
+var paginationFlags PaginationFlags
+
+type IdempotencyFlags struct {
+	TTL time.Duration `long:"idempotency-ttl" default:"24h" description:"how long responses to requests with Idempotency-Key are kept for their retries"`
+}
+
+var idempotencyFlags IdempotencyFlags
+
+type GatewayFlags struct {
+	Heartbeat        time.Duration `long:"ws-heartbeat" default:"30s" description:"interval of WebSocket pings, a connection missing two pongs is closed"`
+	MaxSubscriptions int           `long:"ws-max-subscriptions" default:"50" description:"maximum number of topics of a WebSocket connection"`
+}
+
+var gatewayFlags GatewayFlags
+
+type LoggingFlags struct {
+	Level  string `long:"log-level" default:"info" choice:"debug" choice:"info" choice:"warning" choice:"error" description:"minimum level of log lines"`
+	Format string `long:"log-format" default:"json" choice:"json" choice:"text" description:"format of log lines"`
+}
+
+var loggingFlags LoggingFlags
+
+type TracingFlags struct {
+	OTLPEndpoint string  `long:"otlp-endpoint" description:"host:port of an OTLP/HTTP collector spans are exported to"`
+	OTLPInsecure bool    `long:"otlp-insecure" description:"export spans to the OTLP collector over plain HTTP"`
+	TraceFile    string  `long:"trace-file" description:"file spans are appended to as JSON"`
+	ServiceName  string  `long:"trace-service-name" default:"forum" description:"service.name of exported spans"`
+	SampleRatio  float64 `long:"trace-sample-ratio" default:"1" description:"share of traces started by this server to sample"`
+}
+
+var tracingFlags TracingFlags
+
+// ImportCommand is `forum-server import`, it loads a dump with the database and logging options
+// of the server instead of starting it.
+type ImportCommand struct {
+	PlaceholderEmails bool `long:"placeholder-emails" description:"give new users without emails placeholder ones at imported.invalid"`
+	Args              struct {
+		File string `positional-arg-name:"FILE" description:"NDJSON dump, standard input when omitted or -"`
+	} `positional-args:"yes"`
+}
+
+// Execute loads the dump in a single transaction, the import has no time limit.
+func (command *ImportCommand) Execute(args []string) error {
+	var err error
+	if logger, err = service.NewLogger(loggingFlags.Level, loggingFlags.Format); err != nil {
+		return err
+	}
+	service.DefaultLogger = logger
+	service.DefaultTimeouts = service.Timeouts{}
+
+	var dump io.Reader = os.Stdin
+	if command.Args.File != "" && command.Args.File != "-" {
+		file, err := os.Open(command.Args.File)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dump = file
+	}
+
+	started := time.Now()
+	result, importErr := service.NewForum(dbFlags.Database).Import(context.Background(), dump, command.PlaceholderEmails)
+	if importErr != nil {
+		return importErr
+	}
+	logger.WithFields(logrus.Fields{
+		"users":    result.Users,
+		"forums":   result.Forums,
+		"threads":  result.Threads,
+		"posts":    result.Posts,
+		"votes":    result.Votes,
+		"duration": time.Since(started).Seconds(),
+	}).Info("Dump is imported")
+	return nil
+}
+
+// ExportCommand is `forum-server export`, it writes a forum with the database and logging options
+// of the server instead of starting it.
+type ExportCommand struct {
+	Format string `long:"format" default:"ndjson" choice:"ndjson" choice:"json" description:"a record per line or a JSON array of records"`
+	Args   struct {
+		Slug string `positional-arg-name:"SLUG" required:"yes" description:"forum to export"`
+		File string `positional-arg-name:"FILE" description:"file to write, standard output when omitted or -"`
+	} `positional-args:"yes"`
+}
+
+// Execute writes the forum from a single snapshot, the export has no time limit.
+func (command *ExportCommand) Execute(args []string) error {
+	var err error
+	if logger, err = service.NewLogger(loggingFlags.Level, loggingFlags.Format); err != nil {
+		return err
+	}
+	service.DefaultLogger = logger
+	service.DefaultTimeouts = service.Timeouts{}
+
+	var dump io.Writer = os.Stdout
+	if command.Args.File != "" && command.Args.File != "-" {
+		file, err := os.Create(command.Args.File)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dump = file
+	}
+
+	started := time.Now()
+	if exportErr := service.NewForum(dbFlags.Database).Export(context.Background(), command.Args.Slug, command.Format, dump); exportErr != nil {
+		return exportErr
+	}
+	logger.WithFields(logrus.Fields{
+		"forum":    command.Args.Slug,
+		"duration": time.Since(started).Seconds(),
+	}).Info("Forum is exported")
+	return nil
+}
+
+// metrics of the server, exposed at /metrics
+var metrics *service.Metrics
+
+// readiness of the storage, exposed at /readyz
+var readiness http.Handler
+
+// logger writes a line per request, see service.LogRequests
+var logger *logrus.Logger
+
 func configureFlags(api *operations.ForumAPI) {
 	api.CommandLineOptionsGroups = []swag.CommandLineOptionsGroup{
 		{"database", "database connection parameters", &dbFlags},
+		{"auth", "authentication parameters", &authFlags},
+		{"pagination", "pagination parameters", &paginationFlags},
+		{"idempotency", "idempotency parameters", &idempotencyFlags},
+		{"gateway", "WebSocket gateway parameters", &gatewayFlags},
+		{"logging", "logging parameters", &loggingFlags},
+		{"tracing", "OpenTelemetry tracing parameters", &tracingFlags},
 	}
 }
 
@@ -39,33 +190,123 @@ func configureAPI(api *operations.ForumAPI) http.Handler {
 
 	api.JSONProducer = runtime.JSONProducer()
 
+	// Feeds render themselves, the producer only writes their errors
+	api.XMLProducer = runtime.XMLProducer()
+
+	var err error
+	if logger, err = service.NewLogger(loggingFlags.Level, loggingFlags.Format); err != nil {
+		log.Fatal(err)
+	}
+	service.DefaultLogger = logger
+
+	shutdownTracing, err := service.SetupTracing(service.TracingOptions{
+		Endpoint:    tracingFlags.OTLPEndpoint,
+		Insecure:    tracingFlags.OTLPInsecure,
+		File:        tracingFlags.TraceFile,
+		ServiceName: tracingFlags.ServiceName,
+		SampleRatio: tracingFlags.SampleRatio,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	service.DefaultTimeouts = service.Timeouts{
+		Default:    dbFlags.QueryTimeout,
+		Operations: dbFlags.OperationTimeouts,
+	}
+	service.SessionTTL = authFlags.SessionTTL
+	service.Admins = authFlags.Admins
+	service.CursorSecret = []byte(paginationFlags.CursorSecret)
+	service.IdempotencyTTL = idempotencyFlags.TTL
+	service.GatewayHeartbeat = gatewayFlags.Heartbeat
+	service.GatewayMaxSubscriptions = gatewayFlags.MaxSubscriptions
 	var handler service.ForumHandler = service.NewForum(dbFlags.Database)
+	if len(service.Admins) != 0 {
+		if authFlags.AdminPassword == "" {
+			log.Fatal("--admin requires --admin-password or FORUM_ADMIN_PASSWORD")
+		}
+		if err := handler.BootstrapAdmins(context.Background(), authFlags.AdminPassword); err != nil {
+			log.Fatal(err)
+		}
+	}
+	metrics = service.NewMetrics(handler)
+	readiness = service.Readiness(handler)
+
+	api.TokenAuth = func(token string) (*models.Principal, error) {
+		return handler.Authenticate(service.BearerToken(token))
+	}
 
 	api.ClearHandler = operations.ClearHandlerFunc(handler.Clear)
+	api.ImportDumpHandler = service.ImportHandler(handler)
 	api.StatusHandler = operations.StatusHandlerFunc(handler.Status)
 
+	api.ForumBanDeleteHandler = operations.ForumBanDeleteHandlerFunc(handler.ForumBanDelete)
+	api.ForumBanSetHandler = operations.ForumBanSetHandlerFunc(handler.ForumBanSet)
 	api.ForumCreateHandler = operations.ForumCreateHandlerFunc(handler.ForumCreate)
+	api.ForumExportHandler = operations.ForumExportHandlerFunc(handler.ForumExport)
+	api.ForumGetBansHandler = operations.ForumGetBansHandlerFunc(handler.ForumGetBans)
 	api.ForumGetOneHandler = operations.ForumGetOneHandlerFunc(handler.ForumGetOne)
+	api.ForumGetReportsHandler = operations.ForumGetReportsHandlerFunc(handler.ForumGetReports)
 	api.ForumGetThreadsHandler = operations.ForumGetThreadsHandlerFunc(handler.ForumGetThreads)
+	api.ForumGetThreadsAtomHandler = operations.ForumGetThreadsAtomHandlerFunc(handler.ForumGetThreadsAtom)
+	api.ForumGetThreadsRssHandler = operations.ForumGetThreadsRssHandlerFunc(handler.ForumGetThreadsRss)
+	api.ForumGetRolesHandler = operations.ForumGetRolesHandlerFunc(handler.ForumGetRoles)
 	api.ForumGetUsersHandler = operations.ForumGetUsersHandlerFunc(handler.ForumGetUsers)
+	api.ForumRoleSetHandler = operations.ForumRoleSetHandlerFunc(handler.ForumRoleSet)
+	api.ForumSearchHandler = operations.ForumSearchHandlerFunc(handler.ForumSearch)
+	api.ForumGetWebhooksHandler = operations.ForumGetWebhooksHandlerFunc(handler.ForumGetWebhooks)
+	api.ForumWebhookCreateHandler = operations.ForumWebhookCreateHandlerFunc(handler.ForumWebhookCreate)
 
+	api.PostDeleteHandler = operations.PostDeleteHandlerFunc(handler.PostDelete)
 	api.PostGetOneHandler = operations.PostGetOneHandlerFunc(handler.PostGetOne)
+	api.PostHistoryHandler = operations.PostHistoryHandlerFunc(handler.PostHistory)
+	api.PostHistoryDiffHandler = operations.PostHistoryDiffHandlerFunc(handler.PostHistoryDiff)
+	api.PostReportHandler = operations.PostReportHandlerFunc(handler.PostReport)
 	api.PostUpdateHandler = operations.PostUpdateHandlerFunc(handler.PostUpdate)
 	api.PostsCreateHandler = operations.PostsCreateHandlerFunc(handler.PostsCreate)
 
 	api.ThreadCreateHandler = operations.ThreadCreateHandlerFunc(handler.ThreadCreate)
+	api.ThreadDeleteHandler = operations.ThreadDeleteHandlerFunc(handler.ThreadDelete)
 	api.ThreadGetOneHandler = operations.ThreadGetOneHandlerFunc(handler.ThreadGetOne)
 	api.ThreadGetPostsHandler = operations.ThreadGetPostsHandlerFunc(handler.ThreadGetPosts)
+	api.ThreadGetPostsAtomHandler = operations.ThreadGetPostsAtomHandlerFunc(handler.ThreadGetPostsAtom)
+	api.ThreadHistoryHandler = operations.ThreadHistoryHandlerFunc(handler.ThreadHistory)
+	api.ThreadHistoryDiffHandler = operations.ThreadHistoryDiffHandlerFunc(handler.ThreadHistoryDiff)
+	api.ThreadLockHandler = operations.ThreadLockHandlerFunc(handler.ThreadLock)
+	api.ThreadPinHandler = operations.ThreadPinHandlerFunc(handler.ThreadPin)
+	api.ThreadReportHandler = operations.ThreadReportHandlerFunc(handler.ThreadReport)
+	api.ThreadStreamHandler = operations.ThreadStreamHandlerFunc(handler.ThreadStream)
+	api.ThreadUnlockHandler = operations.ThreadUnlockHandlerFunc(handler.ThreadUnlock)
+	api.ThreadUnpinHandler = operations.ThreadUnpinHandlerFunc(handler.ThreadUnpin)
 	api.ThreadUpdateHandler = operations.ThreadUpdateHandlerFunc(handler.ThreadUpdate)
 	api.ThreadVoteHandler = operations.ThreadVoteHandlerFunc(handler.ThreadVote)
 
+	api.UserBanHandler = operations.UserBanHandlerFunc(handler.UserBan)
 	api.UserCreateHandler = operations.UserCreateHandlerFunc(handler.UserCreate)
 	api.UserGetOneHandler = operations.UserGetOneHandlerFunc(handler.UserGetOne)
+	api.UserLoginHandler = operations.UserLoginHandlerFunc(handler.UserLogin)
+	api.UserLogoutHandler = operations.UserLogoutHandlerFunc(handler.UserLogout)
+	api.UserTokenCreateHandler = operations.UserTokenCreateHandlerFunc(handler.UserTokenCreate)
+	api.UserUnbanHandler = operations.UserUnbanHandlerFunc(handler.UserUnban)
 	api.UserUpdateHandler = operations.UserUpdateHandlerFunc(handler.UserUpdate)
 
-	api.ServerShutdown = func() {}
+	api.ReportDismissHandler = operations.ReportDismissHandlerFunc(handler.ReportDismiss)
+	api.ReportResolveHandler = operations.ReportResolveHandlerFunc(handler.ReportResolve)
+
+	api.SearchHandler = operations.SearchHandlerFunc(handler.Search)
+
+	api.WebhookDeleteHandler = operations.WebhookDeleteHandlerFunc(handler.WebhookDelete)
+	api.WebhookDeliveriesHandler = operations.WebhookDeliveriesHandlerFunc(handler.WebhookDeliveries)
+
+	api.ServerShutdown = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.WithError(err).Error("Can't export the spans left")
+		}
+	}
 
-	return setupGlobalMiddleware(api.Serve(setupMiddlewares))
+	return setupGlobalMiddleware(gatewayMiddleware(handler.Gateway(), api.Serve(setupMiddlewares)))
 }
 
 // The TLS configuration before HTTPS server starts.
@@ -73,17 +314,55 @@ func configureTLS(tlsConfig *tls.Config) {
 }
 
 func configureServer(s *graceful.Server, scheme, addr string) {
+	// Streams lift --write-timeout from their connections, see service.ConnContext
+	s.ConnContext = service.ConnContext
 }
 
 func setupMiddlewares(handler http.Handler) http.Handler {
-	return handler
+	return service.LabelOperation(service.TraceOperations(handler))
 }
 
 func setupGlobalMiddleware(handler http.Handler) http.Handler {
-	recovery := recover.New(&recover.Options{
-		Log: log.Print,
+	return healthMiddleware(metricsMiddleware(metrics.Instrument(service.LogRequests(logger, uiMiddleware(handler)))))
+}
+
+// healthMiddleware serves the probes of an orchestrator at /healthz and /readyz, outside of
+// the swagger API, metrics and the request log.
+func healthMiddleware(handler http.Handler) http.Handler {
+	liveness := service.Liveness()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			liveness.ServeHTTP(w, r)
+		case "/readyz":
+			readiness.ServeHTTP(w, r)
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// metricsMiddleware serves Prometheus metrics at /metrics, outside of the swagger API.
+func metricsMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			metrics.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// gatewayMiddleware serves WebSocket connections at /api/ws, outside of the swagger API.
+func gatewayMiddleware(gateway http.Handler, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/ws" {
+			service.SetOperation(r, "gateway")
+			gateway.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
 	})
-	return recovery(uiMiddleware(handler))
 }
 
 func uiMiddleware(handler http.Handler) http.Handler {